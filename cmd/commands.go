@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/stephenhenderson/ebooklib/lib/config"
+	"github.com/stephenhenderson/ebooklib/lib/ebooks"
+	. "github.com/stephenhenderson/ebooklib/lib/logging"
+)
+
+// A library which can be maintained by the commands, implemented by both
+// the file and bolt libraries
+type maintainableLibrary interface {
+	ebooks.Library
+	RebuildThumbnails() error
+	Close() error
+}
+
+// A maintenance command which is run against the library instead of
+// starting the webservice, e.g. "ebooklib -config config.json rebuild-thumbnails"
+type command struct {
+	description string
+	run         func(library maintainableLibrary, args []string) error
+}
+
+var commands = map[string]command{
+	"rebuild-thumbnails": {
+		"Regenerates the cover thumbnails of every book",
+		rebuildThumbnails,
+	},
+	"backfill-covers": {
+		"Sets the cover of every book without one to the cover embedded in\n\tits epub, pdf or mobi files",
+		backfillCovers,
+	},
+	"migrate-to-bolt": {
+		"Converts a library using the file backend to the bolt backend, set\n\tLibraryBackend to \"bolt\" in the config afterwards",
+		migrateToBolt,
+	},
+	"collect-garbage": {
+		"Deletes the stored contents of files which no book refers to, only\n\tneeded by libraries using the file backend",
+		collectGarbage,
+	},
+	"fsck": {
+		"Lists inconsistencies between the index and the files on disk, run\n\t\"fsck -repair\" to repair them, only supported by the file backend",
+		checkLibrary,
+	},
+}
+
+// A maintenance command which is run against the library's folder without
+// opening the library first
+type folderCommand struct {
+	description string
+	run         func(appConfig *config.AppConfig, args []string) error
+}
+
+var folderCommands = map[string]folderCommand{
+	"rebuild-index": {
+		"Recreates the index of a library using the file backend from the\n\tmetadata file in each book's folder, even if the index cannot be read",
+		rebuildIndex,
+	},
+}
+
+// runFolderCommand runs the folder command named by the first argument, if
+// there is one, passing it the remaining arguments and exiting if it
+// fails, and returns whether it was found
+func runFolderCommand(appConfig *config.AppConfig, args []string) bool {
+	cmd, found := folderCommands[args[0]]
+	if !found {
+		return false
+	}
+	if err := cmd.run(appConfig, args[1:]); err != nil {
+		Logger.Fatalf("Command %s failed: %v", args[0], err)
+	}
+	return true
+}
+
+// runCommand runs the command named by the first argument, passing it the
+// remaining arguments, and exits if it fails
+func runCommand(library maintainableLibrary, args []string) {
+	cmd, found := commands[args[0]]
+	if !found {
+		fmt.Fprintf(os.Stderr, "Unknown command %s\n", args[0])
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if err := cmd.run(library, args[1:]); err != nil {
+		Logger.Fatalf("Command %s failed: %v", args[0], err)
+	}
+	if err := library.Close(); err != nil {
+		Logger.Fatalf("Error closing library: %v", err)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s -config <file> [command]\n", os.Args[0])
+	flag.PrintDefaults()
+
+	descriptions := make(map[string]string)
+	for name, cmd := range commands {
+		descriptions[name] = cmd.description
+	}
+	for name, cmd := range folderCommands {
+		descriptions[name] = cmd.description
+	}
+	names := make([]string, 0, len(descriptions))
+	for name := range descriptions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(os.Stderr, "Commands (the webservice is started if none is given):")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n\t%s\n", name, descriptions[name])
+	}
+}
+
+func rebuildThumbnails(library maintainableLibrary, args []string) error {
+	return library.RebuildThumbnails()
+}
+
+func backfillCovers(library maintainableLibrary, args []string) error {
+	backfilled, failed := ebooks.DefaultMetadataExtractors.BackfillCovers(library)
+	Logger.Printf("Set the cover of %d books", backfilled)
+	if failed > 0 {
+		return fmt.Errorf("%d covers could not be saved", failed)
+	}
+	return nil
+}
+
+func migrateToBolt(library maintainableLibrary, args []string) error {
+	fileLibrary, isFileLibrary := library.(*ebooks.FileLibrary)
+	if !isFileLibrary {
+		return errors.New("library does not use the file backend")
+	}
+	boltLibrary, err := ebooks.MigrateFileLibraryToBolt(fileLibrary)
+	if err != nil {
+		return err
+	}
+	return boltLibrary.Close()
+}
+
+func collectGarbage(library maintainableLibrary, args []string) error {
+	fileLibrary, isFileLibrary := library.(*ebooks.FileLibrary)
+	if !isFileLibrary {
+		return errors.New("library does not use the file backend")
+	}
+	removed, err := fileLibrary.CollectGarbage()
+	Logger.Printf("Deleted %d unreferenced blobs", removed)
+	return err
+}
+
+// rebuildIndex is run on the library's folder without opening the
+// library, which would fail if the index cannot be read
+func rebuildIndex(appConfig *config.AppConfig, args []string) error {
+	if appConfig.LibraryBackend == config.BoltBackend {
+		return errors.New("library does not use the file backend")
+	}
+	rebuilt, skipped, err := ebooks.RebuildFileLibraryIndex(appConfig.LibraryPath)
+	if err != nil {
+		return err
+	}
+	for _, path := range skipped {
+		fmt.Printf("Skipped %s, its metadata file cannot be read or its contents are missing\n", path)
+	}
+	Logger.Printf("Rebuilt the index with %d books, skipped %d folders and files", rebuilt, len(skipped))
+	return nil
+}
+
+func checkLibrary(library maintainableLibrary, args []string) error {
+	flags := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	repair := flags.Bool("repair", false, "Repair the problems found, moving files not in the index to lost+found")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	checkable, isCheckable := library.(ebooks.CheckableLibrary)
+	if !isCheckable {
+		return ebooks.CheckNotSupported
+	}
+	report, err := checkable.Check(*repair)
+	if err != nil {
+		return err
+	}
+	for _, problem := range report.Problems {
+		fmt.Printf("%s: %s\n\t%s\n", problem.Kind, problem.Path, problem.Description)
+		if problem.Repaired {
+			fmt.Printf("\tRepaired: %s\n", problem.Fix)
+		} else if problem.Fix != "" {
+			fmt.Printf("\tRepair: %s\n", problem.Fix)
+		}
+	}
+	Logger.Printf("Found %d problems, %d unrepaired", len(report.Problems), report.Unrepaired())
+	if unrepaired := report.Unrepaired(); unrepaired > 0 {
+		return fmt.Errorf("%d problems were not repaired", unrepaired)
+	}
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"flag"
 	"os"
 	"fmt"
+	"path/filepath"
 
 	"github.com/stephenhenderson/ebooklib/lib/config"
 	"github.com/stephenhenderson/ebooklib/lib/ebooks"
@@ -14,8 +15,17 @@ import (
 
 func main() {
 	appConfig := tryToLoadAppConfig()
-	library := tryToInitializeLibrary(appConfig.LibraryPath)
-	webservice := tryToInitializeWebService(library, appConfig.TemplatePath)
+	if flag.NArg() > 0 && runFolderCommand(appConfig, flag.Args()) {
+		return
+	}
+	library := tryToInitializeLibrary(appConfig)
+	if flag.NArg() > 0 {
+		runCommand(library, flag.Args())
+		return
+	}
+
+	fullText := tryToOpenFullTextIndex(appConfig.LibraryPath)
+	webservice := tryToInitializeWebService(library, fullText, appConfig.TemplatePath)
 	webservice.StartService(appConfig.NetworkAddr)
 }
 
@@ -35,6 +45,7 @@ func parseFlags() (*config.AppConfig, error) {
 		"",
 		"Path to config file containing")
 
+	flag.Usage = usage
 	flag.Parse()
 	if *configPath == "" {
 		return nil, errors.New("Missing config path")
@@ -43,16 +54,30 @@ func parseFlags() (*config.AppConfig, error) {
 	return config.LoadConfigFromFile(*configPath)
 }
 
-func tryToInitializeLibrary(libraryPath string) *ebooks.FileLibrary {
-	library, err := ebooks.NewFileLibrary(libraryPath)
+func tryToInitializeLibrary(appConfig *config.AppConfig) maintainableLibrary {
+	var library maintainableLibrary
+	var err error
+	if appConfig.LibraryBackend == config.BoltBackend {
+		library, err = ebooks.NewBoltLibrary(appConfig.LibraryPath)
+	} else {
+		library, err = ebooks.NewFileLibrary(appConfig.LibraryPath)
+	}
 	if err != nil {
 		Logger.Fatalf("Encountered fatal error %v", err)
 	}
 	return library
 }
 
-func tryToInitializeWebService(library *ebooks.FileLibrary, templatePath string) *webservice.EbookWebService {
-	webservice, err := webservice.NewEbookWebService(library, templatePath)
+func tryToOpenFullTextIndex(libraryPath string) *ebooks.FullTextIndex {
+	fullText, err := ebooks.OpenFullTextIndex(filepath.Join(libraryPath, ebooks.FullTextDirName))
+	if err != nil {
+		Logger.Fatalf("Error opening full-text index %v", err)
+	}
+	return fullText
+}
+
+func tryToInitializeWebService(library ebooks.Library, fullText *ebooks.FullTextIndex, templatePath string) *webservice.EbookWebService {
+	webservice, err := webservice.NewEbookWebService(library, fullText, templatePath)
 	if err != nil {
 		Logger.Fatalf("Error loading html templates from %s\nerr:\n%v",
 			templatePath, err)
@@ -6,10 +6,22 @@ import (
 	"encoding/json"
 )
 
+const (
+	// Stores the library index in a json file, the default
+	FileBackend = "file"
+
+	// Stores the library index in a bolt database
+	BoltBackend = "bolt"
+)
+
 type AppConfig struct {
 	// LibraryPath is the directory where the library is persisted
 	LibraryPath string
 
+	// LibraryBackend is how the library index is stored, either "file" or
+	// "bolt", defaults to "file"
+	LibraryBackend string
+
 	// TemplatePath is the directory containing the html templates and
 	// static assets
 	TemplatePath string
@@ -50,5 +62,12 @@ func validateConfig(config *AppConfig) error {
 	if config.NetworkAddr == "" {
 		return fmt.Errorf("Missing network address")
 	}
+	switch config.LibraryBackend {
+	case "":
+		config.LibraryBackend = FileBackend
+	case FileBackend, BoltBackend:
+	default:
+		return fmt.Errorf("Unknown library backend %s", config.LibraryBackend)
+	}
 	return nil
 }
\ No newline at end of file
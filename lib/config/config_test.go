@@ -35,6 +35,25 @@ func TestReturnsErrorIfConfigIsEmpty(t *testing.T) {
 	}
 }
 
+func TestLibraryBackendDefaultsToFile(t *testing.T) {
+	configFile := tempConfigFile(t, []byte(`{"LibraryPath": "/tmp/lib", "TemplatePath": "/tmp/templates", "NetworkAddr": ":8080"}`))
+	config, err := LoadConfigFromFile(configFile)
+	if err != nil {
+		t.Fatalf("Error loading config: %v", err)
+	}
+	if config.LibraryBackend != FileBackend {
+		t.Fatalf("Expected library backend %s but was %s", FileBackend, config.LibraryBackend)
+	}
+}
+
+func TestReturnsErrorIfLibraryBackendIsUnknown(t *testing.T) {
+	configFile := tempConfigFile(t, []byte(`{"LibraryPath": "/tmp/lib", "TemplatePath": "/tmp/templates", "NetworkAddr": ":8080", "LibraryBackend": "tape"}`))
+	_, err := LoadConfigFromFile(configFile)
+	if err == nil {
+		t.Fatal("Expected error when library backend is unknown")
+	}
+}
+
 func tempConfigFile(t *testing.T, data []byte) string {
 	tempDir := testutils.CreateTempDir(t)
 	configPath := filepath.Join(tempDir, "config.json")
@@ -0,0 +1,160 @@
+package ebooks
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Folder under the base directory of a file library holding the contents
+// of every book's files
+const BlobsDirName = "blobs"
+
+// Folder in the blob store holding uploads while they are streamed to
+// disk, before their checksum is known
+const blobTempDirName = "tmp"
+
+// A content-addressed store of file contents. Each unique content is stored
+// once as a blob named by its SHA-256, in a folder named by the first two
+// hex digits so that no one folder grows too large.
+type blobStore struct {
+	dir string
+}
+
+// relativePathToBlob returns the path of the blob with the given checksum
+// relative to the base directory of the library
+func relativePathToBlob(checksum string) string {
+	return filepath.Join(BlobsDirName, checksum[:2], checksum)
+}
+
+func (store *blobStore) pathTo(checksum string) string {
+	return filepath.Join(store.dir, checksum[:2], checksum)
+}
+
+func (store *blobStore) exists(checksum string) bool {
+	_, err := os.Stat(store.pathTo(checksum))
+	return err == nil
+}
+
+// createTemp creates a file in the store's temp folder to stream the
+// contents of a new blob to, it is added to the store with adopt once its
+// checksum is known
+func (store *blobStore) createTemp() (*os.File, error) {
+	dir := filepath.Join(store.dir, blobTempDirName)
+	if err := mkDirs(dir); err != nil {
+		return nil, err
+	}
+	return ioutil.TempFile(dir, "upload")
+}
+
+// removeTempFiles deletes any files left in the temp folder by uploads
+// which were interrupted
+func (store *blobStore) removeTempFiles() error {
+	return os.RemoveAll(filepath.Join(store.dir, blobTempDirName))
+}
+
+// adopt moves the file at the given path into the store as the blob with
+// the given checksum, if the blob is already stored the file is removed.
+// The rename is synced to disk so a change committed after it never refers
+// to a blob lost in a crash, the file's contents must already be synced.
+func (store *blobStore) adopt(path, checksum string) error {
+	if store.exists(checksum) {
+		return os.Remove(path)
+	}
+	blobPath := store.pathTo(checksum)
+	if err := mkDirs(filepath.Dir(blobPath)); err != nil {
+		return err
+	}
+	if err := os.Rename(path, blobPath); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(blobPath))
+}
+
+// copyIn adds the contents of the file at the given path to the store as
+// the blob with the given checksum, leaving the file where it is. The copy
+// is made in the temp folder first so a partly copied blob is never left
+// under its checksum.
+func (store *blobStore) copyIn(path, checksum string) error {
+	if store.exists(checksum) {
+		return nil
+	}
+	tempFile, err := store.createTemp()
+	if err != nil {
+		return err
+	}
+	tempFile.Close()
+	if err = linkOrCopyFile(path, tempFile.Name()); err != nil {
+		os.Remove(tempFile.Name())
+		return err
+	}
+	return store.adopt(tempFile.Name(), checksum)
+}
+
+// remove deletes the blob with the given checksum, if it is stored
+func (store *blobStore) remove(checksum string) error {
+	err := os.Remove(store.pathTo(checksum))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// files returns the path of every blob in the store relative to its
+// folder, the temp folder is left out as uploads may be in progress
+func (store *blobStore) files() ([]string, error) {
+	folders, err := ioutil.ReadDir(store.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	paths := []string{}
+	for _, folder := range folders {
+		if folder.Name() == blobTempDirName {
+			continue
+		}
+		files, err := ioutil.ReadDir(filepath.Join(store.dir, folder.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			paths = append(paths, filepath.Join(folder.Name(), file.Name()))
+		}
+	}
+	return paths, nil
+}
+
+// removeFile deletes a file in the store by its path as returned by files
+func (store *blobStore) removeFile(path string) error {
+	return os.Remove(filepath.Join(store.dir, path))
+}
+
+// linkOrCopyFile makes the file at dest have the same contents as the file
+// at src, as a hard link if the file system supports it
+func linkOrCopyFile(src, dest string) error {
+	os.Remove(dest)
+	if err := os.Link(src, dest); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0700)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
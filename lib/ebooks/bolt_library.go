@@ -0,0 +1,899 @@
+package ebooks
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	. "github.com/stephenhenderson/ebooklib/lib/logging"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	BoltDBFileName = "library.db"
+
+	// How long to wait for another process to release the database
+	boltOpenTimeout = time.Second
+
+	// Added to the names of the index files of a file library once it has
+	// been migrated to bolt
+	migratedIndexSuffix = ".migrated"
+
+	// Folder under the base directory where uploaded files are written
+	// before they are moved into their book's folder
+	boltUploadsDirName = "uploads"
+)
+
+var (
+	// Buckets holding the records of books in the library and the trash,
+	// keyed by book id. The sequence of the books bucket is the largest
+	// id ever used so ids are never reused.
+	booksBucket = []byte("books")
+	trashBucket = []byte("trash")
+)
+
+var _ Library = &BoltLibrary{}
+
+// NewBoltLibrary opens a bolt library in the given directory, creating a
+// new empty library if no database is found. A directory holding a file
+// library must be converted with MigrateFileLibraryToBolt first.
+func NewBoltLibrary(baseDir string) (*BoltLibrary, error) {
+	Logger.Printf("Opening bolt library in %s\n", baseDir)
+	_, err := os.Stat(filepath.Join(baseDir, BoltDBFileName))
+	if os.IsNotExist(err) {
+		if _, err = os.Stat(filepath.Join(baseDir, IndexFileName)); err == nil {
+			return nil, fmt.Errorf("found a file library in %s which has not been migrated to bolt", baseDir)
+		}
+	}
+	return openBoltLibrary(baseDir)
+}
+
+// checkNotMigratedToBolt returns an error if the directory holds a bolt
+// library, which must not be opened as a file library
+func checkNotMigratedToBolt(baseDir string) error {
+	if _, err := os.Stat(filepath.Join(baseDir, BoltDBFileName)); err == nil {
+		return fmt.Errorf("found a bolt library in %s, set LibraryBackend to \"bolt\" to open it", baseDir)
+	}
+	return nil
+}
+
+// A library where ebook details are stored in a bolt database and the
+// files of each book on the local file system, laid out the same as a
+// FileLibrary. Each change is written in its own transaction so unlike a
+// FileLibrary the cost of a change does not grow with the library. All
+// methods are safe to call from multiple goroutines.
+type BoltLibrary struct {
+
+	// Guards the book folders, the database serialises its own
+	// transactions but not the file changes made alongside them
+	mutex sync.RWMutex
+
+	db *bolt.DB
+
+	// Base directory where the library contents are stored
+	BaseDir string
+}
+
+// The record of a book stored in the database
+type boltRecord struct {
+	*BookDetails
+
+	// File name of the cover in the book's folder, empty if the book has
+	// no cover
+	Image string `json:",omitempty"`
+
+	// The files in the book's files folder by name
+	Files map[string]*BookFile `json:"BookFiles"`
+
+	// Names of the files in records written before files had timestamps,
+	// replaced by Files when the library is opened
+	LegacyFiles []string `json:"Files,omitempty"`
+
+	Created time.Time
+	Updated time.Time
+}
+
+func openBoltLibrary(baseDir string) (*BoltLibrary, error) {
+	if err := mkDirs(baseDir, filepath.Join(baseDir, TrashDirName)); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(filepath.Join(baseDir, BoltDBFileName), 0600, &bolt.Options{Timeout: boltOpenTimeout})
+	if err != nil {
+		return nil, err
+	}
+
+	lib := &BoltLibrary{db: db, BaseDir: baseDir}
+	// left by uploads which were interrupted, the database is locked so
+	// no other process can be uploading
+	if err = os.RemoveAll(lib.folderForUploads()); err != nil {
+		db.Close()
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{booksBucket, trashBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		lib.recoverInterruptedMoves(tx)
+		return lib.upgradeRecords(tx)
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return lib, nil
+}
+
+// MigrateFileLibraryToBolt converts the file library into a bolt library
+// in the same directory. Both lay out the book folders the same way so
+// only the index is converted. The files of each book are linked into its
+// folder and, once the books are in the database, the index files are
+// renamed with the suffix ".migrated" and the blob store is removed. The
+// file library must only be closed afterwards, which no longer writes its
+// index.
+func MigrateFileLibraryToBolt(source *FileLibrary) (*BoltLibrary, error) {
+	dbFile := filepath.Join(source.BaseDir, BoltDBFileName)
+	if _, err := os.Stat(dbFile); err == nil {
+		return nil, fmt.Errorf("cannot migrate library in %s, %s already exists", source.BaseDir, BoltDBFileName)
+	}
+
+	source.mutex.Lock()
+	defer source.mutex.Unlock()
+
+	// a bolt library keeps each book's files in its folder rather than in
+	// the blob store
+	if err := linkFilesIntoBookFolders(source.BaseDir, source.index, relativeFolderForBook); err != nil {
+		return nil, err
+	}
+	if err := linkFilesIntoBookFolders(source.BaseDir, source.trash, relativeTrashFolderForBook); err != nil {
+		return nil, err
+	}
+
+	lib, err := openBoltLibrary(source.BaseDir)
+	if err != nil {
+		return nil, err
+	}
+	err = lib.db.Update(func(tx *bolt.Tx) error {
+		if err := putBooksAsRecords(tx.Bucket(booksBucket), source.index); err != nil {
+			return err
+		}
+		if err := putBooksAsRecords(tx.Bucket(trashBucket), source.trash); err != nil {
+			return err
+		}
+		return tx.Bucket(booksBucket).SetSequence(uint64(source.maxID))
+	})
+	if err != nil {
+		// leave the directory as a file library so the migration can be retried
+		lib.Close()
+		os.Remove(dbFile)
+		return nil, err
+	}
+	Logger.Printf("Migrated %d books and %d in the trash to %s\n", len(source.index), len(source.trash), dbFile)
+
+	// The file library's index refers to the blob store, it is written in
+	// full and retired so nothing opens the directory as a file library or
+	// writes the index again. NewFileLibrary refuses the directory anyway
+	// now that the database exists, so failures are only logged.
+	if err = source.saveIndexToDisk(); err != nil {
+		Logger.Printf("Error writing the index before retiring it: %v", err)
+	}
+	source.migrated = true
+	for _, indexFile := range []string{source.fileForIndex(), source.fileForTrashIndex()} {
+		if err = os.Rename(indexFile, indexFile+migratedIndexSuffix); err != nil && !os.IsNotExist(err) {
+			Logger.Printf("Error retiring %s after migrating: %v", indexFile, err)
+		}
+	}
+
+	// CollectGarbage only works on a file library, so the blobs would
+	// otherwise never be deleted. The migration has succeeded whether or
+	// not they are, the blobs folder can be deleted by hand if it is left.
+	if err = os.RemoveAll(source.blobs().dir); err != nil {
+		Logger.Printf("Error removing %s after migrating: %v", source.blobs().dir, err)
+	}
+	return lib, nil
+}
+
+// linkFilesIntoBookFolders links the file of each book stored by a file
+// library into the files folder under the book's folder, given relative
+// to the base directory
+func linkFilesIntoBookFolders(baseDir string, books map[int]*Ebook, bookFolder func(int) string) error {
+	for id, book := range books {
+		filesFolder := filepath.Join(baseDir, bookFolder(id), "files")
+		if err := mkDirs(filesFolder); err != nil {
+			return err
+		}
+		for fileName, file := range book.Files {
+			src := filepath.Join(baseDir, file.Path)
+			dest := filepath.Join(filesFolder, fileName)
+			if src == dest {
+				continue
+			}
+			if err := linkOrCopyFile(src, dest); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func putBooksAsRecords(bucket *bolt.Bucket, books map[int]*Ebook) error {
+	for id, book := range books {
+		record := &boltRecord{BookDetails: book.BookDetails, Files: make(map[string]*BookFile),
+			Created: book.Created, Updated: book.Updated}
+		if book.Image != "" {
+			record.Image = filepath.Base(book.Image)
+		}
+		for fileName, file := range book.Files {
+			record.addFile(fileName, file.withPath(""))
+		}
+		if err := putRecord(bucket, id, record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (lib *BoltLibrary) Add(bookDetails *BookDetails, image []byte, files map[string]io.Reader) (*Ebook, error) {
+	imageName := ""
+	if image != nil {
+		ext, err := imageFileExtension(image)
+		if err != nil {
+			return nil, err
+		}
+		imageName = coverFileName + ext
+	}
+	thumbnails := generateThumbnails(image)
+
+	fileDetails := make(map[string]*BookFile)
+	tempFiles := make(map[string]string)
+	defer removeFiles(tempFiles)
+	for fileName, content := range files {
+		Logger.Printf("Adding files for book=%v, file=%v", bookDetails, fileName)
+		file, tempFile, err := lib.stageBookFile(fileName, content)
+		if err != nil {
+			return nil, err
+		}
+		fileDetails[fileName], tempFiles[fileName] = file, tempFile
+	}
+
+	lib.mutex.Lock()
+	defer lib.mutex.Unlock()
+
+	var book *Ebook
+	err := lib.db.Update(func(tx *bolt.Tx) error {
+		books := tx.Bucket(booksBucket)
+		seq, err := books.NextSequence()
+		if err != nil {
+			return err
+		}
+		id := int(seq)
+
+		// Any existing folder for a new id was left by an add which never
+		// committed, its contents must not be picked up by the new book
+		bookFolder := filepath.Join(lib.BaseDir, relativeFolderForBook(id))
+		if err = os.RemoveAll(bookFolder); err != nil {
+			return err
+		}
+		if err = mkDirs(bookFolder, filepath.Join(bookFolder, "files")); err != nil {
+			return err
+		}
+
+		now := time.Now().UTC()
+		record := &boltRecord{BookDetails: bookDetails, Image: imageName, Files: make(map[string]*BookFile),
+			Created: now, Updated: now}
+		if image != nil {
+			if err = writeFileAtomically(filepath.Join(bookFolder, imageName), image, 0700); err != nil {
+				return err
+			}
+		}
+		for fileName, file := range fileDetails {
+			if err = os.Rename(tempFiles[fileName], filepath.Join(bookFolder, "files", fileName)); err != nil {
+				return err
+			}
+			file.Added = now
+			record.addFile(fileName, file)
+		}
+
+		if err = putRecord(books, id, record); err != nil {
+			return err
+		}
+		book = record.toEbook(id, relativeFolderForBook(id))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	lib.writeThumbnails(book.ID, thumbnails)
+	return book, nil
+}
+
+// UpdateBook replaces the details of the book with the given id, the
+// book's files are left unchanged
+func (lib *BoltLibrary) UpdateBook(id int, bookDetails *BookDetails) (*Ebook, error) {
+	lib.mutex.Lock()
+	defer lib.mutex.Unlock()
+
+	return lib.updateRecord(id, func(record *boltRecord) error {
+		record.BookDetails = bookDetails
+		return nil
+	})
+}
+
+// SetBookImage stores the image as the cover of the book with the given
+// id, replacing any existing cover. Only jpeg, png and gif images are
+// supported.
+func (lib *BoltLibrary) SetBookImage(id int, image []byte) (*Ebook, error) {
+	ext, err := imageFileExtension(image)
+	if err != nil {
+		return nil, err
+	}
+	imageName := coverFileName + ext
+	thumbnails := generateThumbnails(image)
+
+	lib.mutex.Lock()
+	defer lib.mutex.Unlock()
+
+	oldImageName := ""
+	book, err := lib.updateRecord(id, func(record *boltRecord) error {
+		oldImageName = record.Image
+		record.Image = imageName
+		return writeFileAtomically(filepath.Join(lib.folderForBook(id), imageName), image, 0700)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// a cover of a different type is written alongside the old one
+	if oldImageName != "" && oldImageName != imageName {
+		os.Remove(filepath.Join(lib.folderForBook(id), oldImageName))
+	}
+	lib.writeThumbnails(id, thumbnails)
+	return book, nil
+}
+
+// RemoveBookImage deletes the cover of the book with the given id
+func (lib *BoltLibrary) RemoveBookImage(id int) error {
+	lib.mutex.Lock()
+	defer lib.mutex.Unlock()
+
+	oldImageName := ""
+	_, err := lib.updateRecord(id, func(record *boltRecord) error {
+		oldImageName = record.Image
+		record.Image = ""
+		return nil
+	})
+	if err != nil || oldImageName == "" {
+		return err
+	}
+	if err = os.RemoveAll(filepath.Join(lib.folderForBook(id), thumbnailsDirName)); err != nil {
+		return err
+	}
+	return os.Remove(filepath.Join(lib.folderForBook(id), oldImageName))
+}
+
+// OpenBookImage opens the cover of the book with the given id
+func (lib *BoltLibrary) OpenBookImage(id int) (FileContent, error) {
+	lib.mutex.RLock()
+	defer lib.mutex.RUnlock()
+
+	record, err := lib.viewRecord(booksBucket, id)
+	if err != nil {
+		return nil, err
+	}
+	if record.Image == "" {
+		return nil, BookHasNoImage
+	}
+	return os.Open(filepath.Join(lib.folderForBook(id), record.Image))
+}
+
+// OpenThumbnail opens the thumbnail of the given size for the book's
+// cover. If the thumbnail has not been generated the cover itself is
+// opened instead.
+func (lib *BoltLibrary) OpenThumbnail(id int, sizeName string) (FileContent, error) {
+	if _, err := thumbnailSizeByName(sizeName); err != nil {
+		return nil, err
+	}
+
+	lib.mutex.RLock()
+	defer lib.mutex.RUnlock()
+
+	record, err := lib.viewRecord(booksBucket, id)
+	if err != nil {
+		return nil, err
+	}
+	if record.Image == "" {
+		return nil, BookHasNoImage
+	}
+
+	bookFolder := lib.folderForBook(id)
+	thumbnail, err := os.Open(filepath.Join(bookFolder, thumbnailsDirName, sizeName+".jpg"))
+	if err != nil {
+		return os.Open(filepath.Join(bookFolder, record.Image))
+	}
+	return thumbnail, nil
+}
+
+// RebuildThumbnails regenerates the thumbnails of every book in the
+// library with a cover, e.g. after the thumbnail sizes have changed
+func (lib *BoltLibrary) RebuildThumbnails() error {
+	for _, book := range lib.GetAll() {
+		if book.Image == "" {
+			continue
+		}
+
+		cover, err := ioutil.ReadFile(filepath.Join(lib.BaseDir, book.Image))
+		if err != nil {
+			return err
+		}
+		Logger.Printf("Rebuilding thumbnails for book=%d", book.ID)
+		thumbnails := generateThumbnails(cover)
+
+		lib.mutex.Lock()
+		// skip books whose cover changed or which were deleted meanwhile
+		current, err := lib.viewRecord(booksBucket, book.ID)
+		if err == nil && filepath.Base(book.Image) == current.Image {
+			lib.writeThumbnails(book.ID, thumbnails)
+		}
+		lib.mutex.Unlock()
+	}
+	return nil
+}
+
+// writeThumbnails replaces the book's cached thumbnails, errors are only
+// logged as the thumbnails can always be rebuilt from the cover. Callers
+// must hold the write lock.
+func (lib *BoltLibrary) writeThumbnails(bookID int, thumbnails map[string][]byte) {
+	err := writeThumbnailFiles(filepath.Join(lib.folderForBook(bookID), thumbnailsDirName), thumbnails)
+	if err != nil {
+		Logger.Printf("Error writing thumbnails for book=%d: %v", bookID, err)
+	}
+}
+
+// AddFileToBook stores a file against the book with the given id,
+// replacing any existing file with the same name
+func (lib *BoltLibrary) AddFileToBook(bookID int, name string, content io.Reader) error {
+	file, tempFile, err := lib.stageBookFile(name, content)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile)
+
+	lib.mutex.Lock()
+	defer lib.mutex.Unlock()
+
+	_, err = lib.updateRecord(bookID, func(record *boltRecord) error {
+		if err := os.Rename(tempFile, lib.fullPathToBookFile(name, bookID)); err != nil {
+			return err
+		}
+		file.Added = record.Updated
+		record.addFile(name, file)
+		return nil
+	})
+	return err
+}
+
+// stageBookFile streams the contents of a file to a temp file in the
+// uploads folder and returns its record along with the temp file, as for a
+// FileLibrary, so neither the lock nor a transaction is held while a large
+// file is uploaded. Callers move the temp file into the book's folder in
+// the transaction adding the file to the book's record.
+func (lib *BoltLibrary) stageBookFile(name string, content io.Reader) (*BookFile, string, error) {
+	if err := mkDirs(lib.folderForUploads()); err != nil {
+		return nil, "", err
+	}
+	tempFile, err := ioutil.TempFile(lib.folderForUploads(), "upload")
+	if err != nil {
+		return nil, "", err
+	}
+	file, err := copyBookFile(tempFile, name, content, time.Time{})
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tempFile.Name())
+		return nil, "", err
+	}
+	return file, tempFile.Name(), nil
+}
+
+func (lib *BoltLibrary) DeleteFileFromBook(bookID int, fileName string) error {
+	lib.mutex.Lock()
+	defer lib.mutex.Unlock()
+
+	_, err := lib.updateRecord(bookID, func(record *boltRecord) error {
+		if !record.removeFile(fileName) {
+			return FileNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return os.Remove(lib.fullPathToBookFile(fileName, bookID))
+}
+
+// SetFileRole changes what a file of the book with the given id is to
+// the book
+func (lib *BoltLibrary) SetFileRole(bookID int, fileName string, role FileRole) error {
+	if !role.IsValid() {
+		return InvalidFileRole
+	}
+
+	lib.mutex.Lock()
+	defer lib.mutex.Unlock()
+
+	_, err := lib.updateRecord(bookID, func(record *boltRecord) error {
+		file, found := record.Files[fileName]
+		if !found {
+			return FileNotFound
+		}
+		file.Role = role
+		return nil
+	})
+	return err
+}
+
+// OpenBookFile opens a file of the book with the given id
+func (lib *BoltLibrary) OpenBookFile(bookID int, fileName string) (FileContent, error) {
+	lib.mutex.RLock()
+	defer lib.mutex.RUnlock()
+
+	record, err := lib.viewRecord(booksBucket, bookID)
+	if err != nil {
+		return nil, err
+	}
+	if !record.hasFile(fileName) {
+		return nil, FileNotFound
+	}
+	return os.Open(lib.fullPathToBookFile(fileName, bookID))
+}
+
+// DeleteBook moves the book with the given id and all its files to the
+// trash, from where it can be restored or purged
+func (lib *BoltLibrary) DeleteBook(id int) error {
+	lib.mutex.Lock()
+	defer lib.mutex.Unlock()
+
+	_, err := lib.moveBook(id, booksBucket, trashBucket, relativeFolderForBook, relativeTrashFolderForBook)
+	return err
+}
+
+// RestoreBook moves the book with the given id out of the trash and back
+// into the library
+func (lib *BoltLibrary) RestoreBook(id int) (*Ebook, error) {
+	lib.mutex.Lock()
+	defer lib.mutex.Unlock()
+
+	return lib.moveBook(id, trashBucket, booksBucket, relativeTrashFolderForBook, relativeFolderForBook)
+}
+
+// PurgeBook permanently deletes the book with the given id from the trash
+func (lib *BoltLibrary) PurgeBook(id int) error {
+	lib.mutex.Lock()
+	defer lib.mutex.Unlock()
+
+	err := lib.db.Update(func(tx *bolt.Tx) error {
+		trash := tx.Bucket(trashBucket)
+		if trash.Get(itob(id)) == nil {
+			return BookNotFound
+		}
+		return trash.Delete(itob(id))
+	})
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(filepath.Join(lib.BaseDir, relativeTrashFolderForBook(id)))
+}
+
+// GetTrash returns all deleted books which can be restored
+func (lib *BoltLibrary) GetTrash() []*Ebook {
+	return lib.allBooksIn(trashBucket, relativeTrashFolderForBook)
+}
+
+// GetBookByID returns the book with the given id
+func (lib *BoltLibrary) GetBookByID(id int) (*Ebook, error) {
+	lib.mutex.RLock()
+	defer lib.mutex.RUnlock()
+
+	record, err := lib.viewRecord(booksBucket, id)
+	if err != nil {
+		return nil, err
+	}
+	return record.toEbook(id, relativeFolderForBook(id)), nil
+}
+
+// GetAll returns all books currently in the library ordered by id
+func (lib *BoltLibrary) GetAll() []*Ebook {
+	return lib.allBooksIn(booksBucket, relativeFolderForBook)
+}
+
+// Close releases the database, the library must not be used afterwards
+func (lib *BoltLibrary) Close() error {
+	return lib.db.Close()
+}
+
+// allBooksIn returns every book in the bucket, records which cannot be
+// read are logged and left out
+func (lib *BoltLibrary) allBooksIn(bucketName []byte, bookFolder func(int) string) []*Ebook {
+	lib.mutex.RLock()
+	defer lib.mutex.RUnlock()
+
+	books := []*Ebook{}
+	err := lib.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketName).ForEach(func(key, data []byte) error {
+			id := btoi(key)
+			record := &boltRecord{}
+			if err := json.Unmarshal(data, record); err != nil {
+				Logger.Printf("Skipping unreadable record for book=%d: %v", id, err)
+				return nil
+			}
+			books = append(books, record.toEbook(id, bookFolder(id)))
+			return nil
+		})
+	})
+	if err != nil {
+		Logger.Printf("Error reading books from %s: %v", bucketName, err)
+	}
+	return books
+}
+
+// viewRecord reads the record of the book with the given id from the
+// bucket, callers must hold the read lock
+func (lib *BoltLibrary) viewRecord(bucketName []byte, id int) (*boltRecord, error) {
+	var record *boltRecord
+	err := lib.db.View(func(tx *bolt.Tx) error {
+		var err error
+		record, err = getRecord(tx.Bucket(bucketName), id)
+		return err
+	})
+	return record, err
+}
+
+// updateRecord marks the record of the book with the given id as updated
+// now, applies the change to it and stores it in a single transaction,
+// nothing is stored if the change returns an error. Callers must hold the
+// write lock.
+func (lib *BoltLibrary) updateRecord(id int, change func(record *boltRecord) error) (*Ebook, error) {
+	var book *Ebook
+	err := lib.db.Update(func(tx *bolt.Tx) error {
+		books := tx.Bucket(booksBucket)
+		record, err := getRecord(books, id)
+		if err != nil {
+			return err
+		}
+		record.Updated = time.Now().UTC()
+		if err = change(record); err != nil {
+			return err
+		}
+		if err = putRecord(books, id, record); err != nil {
+			return err
+		}
+		book = record.toEbook(id, relativeFolderForBook(id))
+		return nil
+	})
+	return book, err
+}
+
+// moveBook moves the record and folder of the book with the given id
+// between the library and the trash. The folder is moved back if the
+// transaction fails, a crash in between is fixed up on the next open by
+// recoverInterruptedMoves. Callers must hold the write lock.
+func (lib *BoltLibrary) moveBook(id int, from, to []byte, fromFolder, toFolder func(int) string) (*Ebook, error) {
+	src := filepath.Join(lib.BaseDir, fromFolder(id))
+	dest := filepath.Join(lib.BaseDir, toFolder(id))
+
+	var book *Ebook
+	moved := false
+	err := lib.db.Update(func(tx *bolt.Tx) error {
+		record, err := getRecord(tx.Bucket(from), id)
+		if err != nil {
+			return err
+		}
+		if err = tx.Bucket(from).Delete(itob(id)); err != nil {
+			return err
+		}
+		if err = putRecord(tx.Bucket(to), id, record); err != nil {
+			return err
+		}
+
+		if err = os.RemoveAll(dest); err != nil {
+			return err
+		}
+		if err = os.Rename(src, dest); err != nil {
+			return err
+		}
+		moved = true
+		book = record.toEbook(id, toFolder(id))
+		return nil
+	})
+	if err != nil && moved {
+		os.Rename(dest, src)
+	}
+	return book, err
+}
+
+// recoverInterruptedMoves moves back the folders of books which were
+// moved to or from the trash by a transaction which never committed
+func (lib *BoltLibrary) recoverInterruptedMoves(tx *bolt.Tx) {
+	moveBack := func(bucketName []byte, bookFolder, otherFolder func(int) string) {
+		tx.Bucket(bucketName).ForEach(func(key, _ []byte) error {
+			id := btoi(key)
+			folder := filepath.Join(lib.BaseDir, bookFolder(id))
+			if _, err := os.Stat(folder); !os.IsNotExist(err) {
+				return nil
+			}
+			other := filepath.Join(lib.BaseDir, otherFolder(id))
+			if _, err := os.Stat(other); err != nil {
+				return nil
+			}
+			Logger.Printf("Moving %s back to %s after an interrupted change", other, folder)
+			if err := os.Rename(other, folder); err != nil {
+				Logger.Printf("Error moving %s back: %v", other, err)
+			}
+			return nil
+		})
+	}
+	moveBack(booksBucket, relativeFolderForBook, relativeTrashFolderForBook)
+	moveBack(trashBucket, relativeTrashFolderForBook, relativeFolderForBook)
+}
+
+// upgradeRecords converts records written by older versions of the
+// library. Timestamps missing from records are taken from the modification
+// times of the book's folder, files and cover, and the size, type, role and
+// checksum missing from files are read from the files themselves.
+func (lib *BoltLibrary) upgradeRecords(tx *bolt.Tx) error {
+	upgrade := func(bucketName []byte, bookFolder func(int) string) error {
+		bucket := tx.Bucket(bucketName)
+		upgraded := make(map[int]*boltRecord)
+		err := bucket.ForEach(func(key, data []byte) error {
+			record := &boltRecord{}
+			if err := json.Unmarshal(data, record); err != nil {
+				return nil
+			}
+			folder := filepath.Join(lib.BaseDir, bookFolder(btoi(key)))
+			changed := false
+			if record.Files == nil {
+				lib.backfillTimestamps(record, folder)
+				changed = true
+			}
+			for fileName, file := range record.Files {
+				path := filepath.Join(folder, "files", fileName)
+				if file.MimeType == "" {
+					record.addFile(fileName, bookFileFromDisk(path, file.Added))
+					changed = true
+				} else if file.Checksum == "" {
+					if file.Checksum, _ = checksumOfFile(path); file.Checksum != "" {
+						changed = true
+					}
+				}
+			}
+			if changed {
+				upgraded[btoi(key)] = record
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for id, record := range upgraded {
+			if err = putRecord(bucket, id, record); err != nil {
+				return err
+			}
+		}
+		if len(upgraded) > 0 {
+			Logger.Printf("Upgraded the records of %d books in %s", len(upgraded), bucketName)
+		}
+		return nil
+	}
+	if err := upgrade(booksBucket, relativeFolderForBook); err != nil {
+		return err
+	}
+	return upgrade(trashBucket, relativeTrashFolderForBook)
+}
+
+// backfillTimestamps converts a record written before books and files had
+// timestamps, taking them from the modification times of the book's folder,
+// files and cover
+func (lib *BoltLibrary) backfillTimestamps(record *boltRecord, folder string) {
+	others := []string{folder}
+	if record.Image != "" {
+		others = append(others, filepath.Join(folder, record.Image))
+	}
+	times := modTimesOfBook(folder, record.LegacyFiles, others...)
+
+	record.Created, record.Updated = times.created, times.updated
+	record.Files = make(map[string]*BookFile, len(record.LegacyFiles))
+	for _, fileName := range record.LegacyFiles {
+		record.addFile(fileName, &BookFile{Added: times.added[fileName]})
+	}
+	record.LegacyFiles = nil
+}
+
+func (lib *BoltLibrary) folderForBook(id int) string {
+	return filepath.Join(lib.BaseDir, relativeFolderForBook(id))
+}
+
+func (lib *BoltLibrary) folderForUploads() string {
+	return filepath.Join(lib.BaseDir, boltUploadsDirName)
+}
+
+func (lib *BoltLibrary) fullPathToBookFile(fileName string, bookID int) string {
+	return filepath.Join(lib.folderForBook(bookID), "files", fileName)
+}
+
+// toEbook returns the book for the record, bookFolder is the folder
+// holding the book relative to the base directory
+func (record *boltRecord) toEbook(id int, bookFolder string) *Ebook {
+	files := make(map[string]*BookFile, len(record.Files))
+	for fileName, file := range record.Files {
+		files[fileName] = file.withPath(filepath.Join(bookFolder, "files", fileName))
+	}
+	image := ""
+	if record.Image != "" {
+		image = filepath.Join(bookFolder, record.Image)
+	}
+	return &Ebook{id, files, image, record.Created, record.Updated, record.BookDetails}
+}
+
+func (record *boltRecord) hasFile(fileName string) bool {
+	_, found := record.Files[fileName]
+	return found
+}
+
+// addFile records the file under the given name, replacing any existing
+// file with the same name
+func (record *boltRecord) addFile(fileName string, file *BookFile) {
+	if record.Files == nil {
+		record.Files = make(map[string]*BookFile)
+	}
+	record.Files[fileName] = file
+}
+
+// removeFile removes the file name from the record, returning false if
+// the record has no such file
+func (record *boltRecord) removeFile(fileName string) bool {
+	if !record.hasFile(fileName) {
+		return false
+	}
+	delete(record.Files, fileName)
+	return true
+}
+
+func getRecord(bucket *bolt.Bucket, id int) (*boltRecord, error) {
+	data := bucket.Get(itob(id))
+	if data == nil {
+		return nil, BookNotFound
+	}
+	record := &boltRecord{}
+	if err := json.Unmarshal(data, record); err != nil {
+		return nil, fmt.Errorf("unreadable record for book with id=%d: %v", id, err)
+	}
+	return record, nil
+}
+
+func putRecord(bucket *bolt.Bucket, id int, record *boltRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(itob(id), data)
+}
+
+// itob returns the database key for a book id, big endian so that keys
+// sort in id order
+func itob(id int) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(id))
+	return key
+}
+
+func btoi(key []byte) int {
+	return int(binary.BigEndian.Uint64(key))
+}
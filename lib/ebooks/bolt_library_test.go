@@ -0,0 +1,269 @@
+package ebooks
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stephenhenderson/ebooklib/lib/testutils"
+	"github.com/stephenhenderson/ebooklib/lib/testutils/assert"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestBoltLibraryBooksArePersistedWhenReopened(t *testing.T) {
+	library := newBoltLibraryInTempFolder(t)
+	book, _ := library.Add(aBook("Book1", "mr writer", 2016, nil), aPngImage(t), fileReaders(map[string][]byte{"file1.json": aJsonFile()}))
+	deleted, _ := library.Add(aBook("Book2", "mrs writer", 2015, nil), noImage, emptyFileMap())
+	assert.NoError(t, library.DeleteBook(deleted.ID))
+	assert.NoError(t, library.Close())
+
+	reopened, err := NewBoltLibrary(library.BaseDir)
+	assert.NoError(t, err)
+	defer reopened.Close()
+
+	reopenedBook, err := reopened.GetBookByID(book.ID)
+	assert.NoError(t, err)
+	if !reopenedBook.Equals(book.BookDetails) || reopenedBook.Image != book.Image {
+		t.Fatalf("Expected book %v after reopening but found %v", book, reopenedBook)
+	}
+	assertBookFiles(reopened, book.ID, map[string][]byte{"file1.json": aJsonFile()}, t)
+	if trash := reopened.GetTrash(); len(trash) != 1 || trash[0].ID != deleted.ID {
+		t.Fatalf("Expected deleted book in the trash after reopening but found %v", trash)
+	}
+
+	newBook, _ := reopened.Add(aBook("Book3", "mr writer", 2016, nil), noImage, emptyFileMap())
+	if newBook.ID != 3 {
+		t.Fatalf("Expected next id to be 3 after reopening but was %d", newBook.ID)
+	}
+}
+
+func TestNewBoltLibraryRefusesToOpenAFileLibraryWhichHasNotBeenMigrated(t *testing.T) {
+	fileLibrary := newLibraryInTempFolder(t)
+	fileLibrary.Add(aBook("Book1", "mr writer", 2016, nil), noImage, emptyFileMap())
+	assert.NoError(t, fileLibrary.Close())
+
+	if _, err := NewBoltLibrary(fileLibrary.BaseDir); err == nil {
+		t.Fatal("Expected error opening a file library as a bolt library")
+	}
+}
+
+func TestMigrateFileLibraryToBoltKeepsBooksFilesCoversAndTrash(t *testing.T) {
+	fileLibrary := newLibraryInTempFolder(t)
+	bookFiles := map[string][]byte{"file1.json": aJsonFile()}
+	book, _ := fileLibrary.Add(aBook("Book1", "mr writer", 2016, []string{"tag1"}), aPngImage(t), fileReaders(bookFiles))
+	deleted, _ := fileLibrary.Add(aBook("Book2", "mrs writer", 2015, nil), noImage, emptyFileMap())
+	assert.NoError(t, fileLibrary.DeleteBook(deleted.ID))
+
+	library, err := MigrateFileLibraryToBolt(fileLibrary)
+	assert.NoError(t, err)
+	assert.NoError(t, fileLibrary.Close())
+	assert.NoError(t, library.Close())
+	if _, err = os.Stat(filepath.Join(fileLibrary.BaseDir, BlobsDirName)); !os.IsNotExist(err) {
+		t.Fatalf("Expected the blob store to be removed once migrated but got %v", err)
+	}
+
+	library, err = NewBoltLibrary(fileLibrary.BaseDir)
+	assert.NoError(t, err)
+	defer library.Close()
+
+	assertSameBooks(fileLibrary, library, t)
+	assertBookFiles(library, book.ID, bookFiles, t)
+	assertContent(library.OpenBookImage(book.ID))(aPngImage(t), t)
+	if trash := library.GetTrash(); len(trash) != 1 || trash[0].ID != deleted.ID {
+		t.Fatalf("Expected deleted book in the trash after migrating but found %v", trash)
+	}
+
+	restored, err := library.RestoreBook(deleted.ID)
+	assert.NoError(t, err)
+	if !restored.Equals(deleted.BookDetails) {
+		t.Fatalf("Expected to restore %v but restored %v", deleted.BookDetails, restored.BookDetails)
+	}
+
+	newBook, _ := library.Add(aBook("Book3", "mr writer", 2016, nil), noImage, emptyFileMap())
+	if newBook.ID != 3 {
+		t.Fatalf("Expected next id after migrating to be 3 but was %d", newBook.ID)
+	}
+}
+
+func TestAMigratedLibraryCannotBeReopenedAsAFileLibrary(t *testing.T) {
+	fileLibrary := newLibraryInTempFolder(t)
+	fileLibrary.Add(aBook("Book1", "mr writer", 2016, nil), noImage, fileReaders(map[string][]byte{"file1.json": aJsonFile()}))
+	library, err := MigrateFileLibraryToBolt(fileLibrary)
+	assert.NoError(t, err)
+	assert.NoError(t, fileLibrary.Close())
+	assert.NoError(t, library.Close())
+
+	if _, err = os.Stat(fileLibrary.fileForIndex()); !os.IsNotExist(err) {
+		t.Fatalf("Expected the index to be retired rather than written on closing but got %v", err)
+	}
+	if _, err = os.Stat(fileLibrary.fileForIndex() + migratedIndexSuffix); err != nil {
+		t.Fatalf("Expected the retired index to be kept but got %v", err)
+	}
+	if _, err = NewFileLibrary(fileLibrary.BaseDir); err == nil {
+		t.Fatal("Expected a migrated library to be refused as a file library")
+	}
+	if _, _, err = RebuildFileLibraryIndex(fileLibrary.BaseDir); err == nil {
+		t.Fatal("Expected rebuilding the index of a migrated library to be refused")
+	}
+}
+
+func TestMigrateFileLibraryToBoltFailsIfAlreadyMigrated(t *testing.T) {
+	fileLibrary := newLibraryInTempFolder(t)
+	library, err := MigrateFileLibraryToBolt(fileLibrary)
+	assert.NoError(t, err)
+	assert.NoError(t, library.Close())
+
+	if _, err = MigrateFileLibraryToBolt(fileLibrary); err == nil {
+		t.Fatal("Expected error migrating a library which has already been migrated")
+	}
+}
+
+func TestBoltLibraryMovesBackTheFolderOfADeleteWhichNeverCommitted(t *testing.T) {
+	library := newBoltLibraryInTempFolder(t)
+	bookFiles := map[string][]byte{"file1.json": aJsonFile()}
+	book, _ := library.Add(aBook("Book1", "mr writer", 2016, nil), noImage, fileReaders(bookFiles))
+	assert.NoError(t, library.Close())
+
+	// the process died after moving the folder to the trash but before the
+	// transaction committed
+	assert.NoError(t, os.Rename(
+		filepath.Join(library.BaseDir, relativeFolderForBook(book.ID)),
+		filepath.Join(library.BaseDir, relativeTrashFolderForBook(book.ID))))
+
+	reopened, err := NewBoltLibrary(library.BaseDir)
+	assert.NoError(t, err)
+	defer reopened.Close()
+	assertBookFiles(reopened, book.ID, bookFiles, t)
+}
+
+func TestBoltLibraryFailedUploadsLeaveNoTempFiles(t *testing.T) {
+	library := newBoltLibraryInTempFolder(t)
+	defer library.Close()
+	book, _ := library.Add(aBook("Book1", "mr writer", 2016, nil), noImage, fileReaders(map[string][]byte{"file.txt": []byte("original")}))
+
+	if err := library.AddFileToBook(book.ID, "file.txt", anUploadWhichFails()); err != errUploadFailed {
+		t.Fatalf("Expected the upload's error but got %v", err)
+	}
+	if err := library.AddFileToBook(123, "file.txt", bytes.NewReader(aJsonFile())); err != BookNotFound {
+		t.Fatalf("Expected BookNotFound adding a file to a missing book but got %v", err)
+	}
+	for _, folder := range []string{library.folderForUploads(), filepath.Join(library.folderForBook(book.ID), "files")} {
+		if files, _ := ioutil.ReadDir(folder); len(files) > 1 {
+			t.Fatalf("Expected no temp files in %s but found %d files", folder, len(files))
+		}
+	}
+	assertFileContents(library.fullPathToBookFile("file.txt", book.ID), []byte("original"), t)
+}
+
+func TestBoltLibraryRemovesUploadsInterruptedByACrashWhenOpened(t *testing.T) {
+	library := newBoltLibraryInTempFolder(t)
+	assert.NoError(t, mkDirs(library.folderForUploads()))
+	writeTestFile(filepath.Join(library.folderForUploads(), "upload123"), "the start of the file")
+	assert.NoError(t, library.Close())
+
+	reopened, err := NewBoltLibrary(library.BaseDir)
+	assert.NoError(t, err)
+	defer reopened.Close()
+	if _, err = os.Stat(reopened.folderForUploads()); !os.IsNotExist(err) {
+		t.Fatalf("Expected the interrupted upload to be removed but got %v", err)
+	}
+}
+
+func TestBoltLibraryBackfillsTimestampsOfRecordsWrittenWithoutThem(t *testing.T) {
+	library := newBoltLibraryInTempFolder(t)
+	writeBookFolder(library.BaseDir, "1", "a.pdf")
+	modTime := time.Date(2016, 5, 1, 0, 0, 0, 0, time.UTC)
+	setModTime(filepath.Join(library.BaseDir, "1", "files", "a.pdf"), modTime)
+	setModTime(filepath.Join(library.BaseDir, "1"), modTime)
+	err := library.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(booksBucket).Put(itob(1), []byte(`{"Title": "Book1", "Files": ["a.pdf"]}`))
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, library.Close())
+
+	// reopened twice as records are only backfilled once
+	for i := 0; i < 2; i++ {
+		reopened, err := NewBoltLibrary(library.BaseDir)
+		assert.NoError(t, err)
+		book, err := reopened.GetBookByID(1)
+		assert.NoError(t, err)
+		if !book.Created.Equal(modTime) || !book.Updated.Equal(modTime) || len(book.Files) != 1 || !book.Files["a.pdf"].Added.Equal(modTime) {
+			t.Fatalf("Expected timestamps to be backfilled from the modification times but found %v", book)
+		}
+		assertBookFiles(reopened, 1, map[string][]byte{"a.pdf": []byte("a.pdf")}, t)
+		assert.NoError(t, reopened.Close())
+	}
+}
+
+func TestBoltLibraryBackfillsTheDetailsOfFilesRecordedWithoutThem(t *testing.T) {
+	library := newBoltLibraryInTempFolder(t)
+	writeBookFolder(library.BaseDir, "1", "a.pdf")
+	record := `{"Title": "Book1", "BookFiles": {"a.pdf": {"Added": "2016-05-01T00:00:00Z"}}}`
+	err := library.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(booksBucket).Put(itob(1), []byte(record))
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, library.Close())
+
+	reopened, err := NewBoltLibrary(library.BaseDir)
+	assert.NoError(t, err)
+	defer reopened.Close()
+	book, err := reopened.GetBookByID(1)
+	assert.NoError(t, err)
+	file := book.Files["a.pdf"]
+	if file.Size != 5 || file.MimeType != PdfMimeType || file.Role != RoleEbook ||
+		!file.Added.Equal(time.Date(2016, 5, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("Expected the details of a.pdf to be read from disk but found %+v", file)
+	}
+}
+
+func TestBoltLibraryBackfillsTheChecksumsOfFilesRecordedWithoutThem(t *testing.T) {
+	library := newBoltLibraryInTempFolder(t)
+	writeBookFolder(library.BaseDir, "1", "a.pdf")
+	record := `{"Title": "Book1", "BookFiles": {"a.pdf": {"Size": 5, "MimeType": "application/pdf", "Role": "errata"}}}`
+	err := library.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(booksBucket).Put(itob(1), []byte(record))
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, library.Close())
+
+	reopened, err := NewBoltLibrary(library.BaseDir)
+	assert.NoError(t, err)
+	defer reopened.Close()
+	book, err := reopened.GetBookByID(1)
+	assert.NoError(t, err)
+	if file := book.Files["a.pdf"]; file.Checksum != aPdfChecksum || file.Role != RoleErrata {
+		t.Fatalf("Expected the checksum of a.pdf to be read from disk but found %+v", file)
+	}
+}
+
+func TestBoltLibraryRecordsAreKeyedInIdOrder(t *testing.T) {
+	library := newBoltLibraryInTempFolder(t)
+	defer library.Close()
+	for i := 0; i < 300; i++ {
+		library.Add(aBook("Book", "mr writer", 2016, nil), noImage, emptyFileMap())
+	}
+
+	err := library.db.View(func(tx *bolt.Tx) error {
+		expectedID := 1
+		return tx.Bucket(booksBucket).ForEach(func(key, _ []byte) error {
+			if btoi(key) != expectedID {
+				t.Fatalf("Expected book with id %d but found %d", expectedID, btoi(key))
+			}
+			expectedID++
+			return nil
+		})
+	})
+	assert.NoError(t, err)
+}
+
+func newBoltLibraryInTempFolder(t *testing.T) *BoltLibrary {
+	library, err := NewBoltLibrary(testutils.CreateTempDir(t))
+	if err != nil {
+		t.Fatalf("Error creating library %v", err)
+	}
+	return library
+}
@@ -0,0 +1,211 @@
+package ebooks
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var InvalidFileRole = errors.New("Invalid file role, must be one of ebook, code, errata or other")
+
+// What a file is to the book it is stored against
+type FileRole string
+
+const (
+	// The book itself, e.g. an epub or pdf
+	RoleEbook FileRole = "ebook"
+
+	// Code samples accompanying the book
+	RoleCode FileRole = "code"
+
+	// Corrections to the book
+	RoleErrata FileRole = "errata"
+
+	RoleOther FileRole = "other"
+)
+
+// All file roles in the order they are offered to users
+var FileRoles = []FileRole{RoleEbook, RoleCode, RoleErrata, RoleOther}
+
+// IsValid returns true if the role is one of the FileRoles
+func (role FileRole) IsValid() bool {
+	for _, valid := range FileRoles {
+		if role == valid {
+			return true
+		}
+	}
+	return false
+}
+
+// Number of bytes at the start of a file needed to sniff its MIME type
+const mimeSniffLength = 512
+
+// MIME types of files which are most likely the book itself
+var ebookMimeTypes = map[string]bool{
+	EpubMimeType: true,
+	PdfMimeType:  true,
+	MobiMimeType: true,
+}
+
+// File extensions of archives, which are most likely code samples
+var codeArchiveExtensions = map[string]bool{
+	".zip": true,
+	".tar": true,
+	".gz":  true,
+	".tgz": true,
+	".bz2": true,
+	".7z":  true,
+}
+
+// A file stored against a book
+type BookFile struct {
+	// Where the library stores the file, only meaningful to the library
+	Path string `json:"-"`
+
+	// When the file was uploaded
+	Added time.Time
+
+	// Size of the file in bytes
+	Size int64
+
+	// MIME type of the file, sniffed from its contents when it was added
+	MimeType string
+
+	// What the file is to the book, guessed from its name and type when
+	// it is added and changed with SetFileRole
+	Role FileRole
+
+	// Hex encoded SHA-256 of the file's contents
+	Checksum string
+}
+
+// newBookFile returns the record of a file with the given name and
+// contents added at the given time
+func newBookFile(name string, data []byte, added time.Time) *BookFile {
+	details := newBookFileWriter()
+	details.Write(data)
+	return details.bookFile(name, added)
+}
+
+// bookFileFromDisk returns the record of the file at the given path added
+// at the given time, for files recorded before their details were. A file
+// which cannot be read is recorded as empty without a checksum.
+func bookFileFromDisk(path string, added time.Time) *BookFile {
+	details := newBookFileWriter()
+	content, err := os.Open(path)
+	if err == nil {
+		_, err = io.Copy(details, content)
+		content.Close()
+	}
+	file := details.bookFile(filepath.Base(path), added)
+	if err != nil {
+		file.Size, file.Checksum = 0, ""
+	}
+	return file
+}
+
+// copyBookFile streams the contents of a file with the given name to dest
+// and returns its record as added at the given time, the details are
+// computed as it is copied so the file is never held in memory
+func copyBookFile(dest io.Writer, name string, content io.Reader, added time.Time) (*BookFile, error) {
+	details := newBookFileWriter()
+	if _, err := io.Copy(io.MultiWriter(dest, details), content); err != nil {
+		return nil, err
+	}
+	return details.bookFile(name, added), nil
+}
+
+// A writer which computes the details of a file from its contents as they
+// are written: the size, the checksum and enough of the start of the file
+// to sniff its MIME type
+type bookFileWriter struct {
+	hash hash.Hash
+	size int64
+	head []byte
+}
+
+func newBookFileWriter() *bookFileWriter {
+	return &bookFileWriter{hash: sha256.New(), head: make([]byte, 0, mimeSniffLength)}
+}
+
+func (details *bookFileWriter) Write(data []byte) (int, error) {
+	if missing := mimeSniffLength - len(details.head); missing > 0 {
+		if missing > len(data) {
+			missing = len(data)
+		}
+		details.head = append(details.head, data[:missing]...)
+	}
+	details.hash.Write(data)
+	details.size += int64(len(data))
+	return len(data), nil
+}
+
+// bookFile returns the record of a file with the given name and the
+// contents written so far, added at the given time
+func (details *bookFileWriter) bookFile(name string, added time.Time) *BookFile {
+	mimeType := fileMimeType(name, details.head)
+	return &BookFile{Added: added, Size: details.size, MimeType: mimeType, Role: guessFileRole(name, mimeType),
+		Checksum: hex.EncodeToString(details.hash.Sum(nil))}
+}
+
+// checksumOfFile returns the hex encoded SHA-256 of the contents of the
+// file at the given path
+func checksumOfFile(path string) (string, error) {
+	content, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer content.Close()
+
+	hash := sha256.New()
+	if _, err = io.Copy(hash, content); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// withPath returns a copy of the file stored at the given path
+func (file *BookFile) withPath(path string) *BookFile {
+	fileCopy := *file
+	fileCopy.Path = path
+	return &fileCopy
+}
+
+// fileMimeType returns the MIME type of a file sniffed from its contents,
+// falling back to the type of its extension when the contents are not
+// recognised
+func fileMimeType(name string, data []byte) string {
+	mimeType := sniffMimeType(data)
+	if mimeType != "" && mimeType != "application/octet-stream" && mimeType != "text/plain" {
+		return mimeType
+	}
+	if byExtension, _, err := mime.ParseMediaType(mime.TypeByExtension(filepath.Ext(name))); err == nil {
+		return byExtension
+	}
+	if mimeType == "" {
+		return "application/octet-stream"
+	}
+	return mimeType
+}
+
+// guessFileRole guesses what a file is to its book from its name and MIME
+// type: errata by name, ebooks by type and code samples by archive type
+func guessFileRole(name, mimeType string) FileRole {
+	lowerName := strings.ToLower(name)
+	switch {
+	case strings.Contains(lowerName, "errata"):
+		return RoleErrata
+	case ebookMimeTypes[mimeType]:
+		return RoleEbook
+	case mimeType == "application/zip" || codeArchiveExtensions[filepath.Ext(lowerName)]:
+		return RoleCode
+	}
+	return RoleOther
+}
@@ -0,0 +1,79 @@
+package ebooks
+
+import (
+	"bytes"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/stephenhenderson/ebooklib/lib/testutils"
+	"github.com/stephenhenderson/ebooklib/lib/testutils/assert"
+)
+
+func TestFileRolesAreGuessedFromTheNameAndType(t *testing.T) {
+	expectedRoles := map[string]FileRole{
+		"book.epub":       RoleEbook,
+		"book.pdf":        RoleEbook,
+		"Book-Errata.pdf": RoleErrata,
+		"code.zip":        RoleCode,
+		"examples.tgz":    RoleCode,
+		"notes.txt":       RoleOther,
+	}
+	mimeTypes := map[string]string{"book.epub": EpubMimeType, "book.pdf": PdfMimeType, "Book-Errata.pdf": PdfMimeType}
+	for fileName, expected := range expectedRoles {
+		if role := guessFileRole(fileName, mimeTypes[fileName]); role != expected {
+			t.Fatalf("Expected %s to be guessed as %s but was %s", fileName, expected, role)
+		}
+	}
+}
+
+func TestMimeTypesFallBackToTheFileExtensionWhenTheContentsAreNotRecognised(t *testing.T) {
+	if mimeType := fileMimeType("book.pdf", []byte("%PDF-1.4")); mimeType != PdfMimeType {
+		t.Fatalf("Expected the sniffed type %s but was %s", PdfMimeType, mimeType)
+	}
+	if mimeType := fileMimeType("book.pdf", []byte("not really a pdf")); mimeType != PdfMimeType {
+		t.Fatalf("Expected the type of the extension %s but was %s", PdfMimeType, mimeType)
+	}
+	if mimeType := fileMimeType("data.unknown", []byte{0, 1, 2}); mimeType != "application/octet-stream" {
+		t.Fatalf("Expected an unrecognised file to be application/octet-stream but was %s", mimeType)
+	}
+}
+
+func TestOnlyTheKnownFileRolesAreValid(t *testing.T) {
+	for _, role := range FileRoles {
+		if !role.IsValid() {
+			t.Fatalf("Expected %s to be valid", role)
+		}
+	}
+	for _, role := range []FileRole{"", "Ebook", "poster"} {
+		if role.IsValid() {
+			t.Fatalf("Expected '%s' to be invalid", role)
+		}
+	}
+}
+
+func TestAFileWhichCannotBeReadIsRecordedAsEmpty(t *testing.T) {
+	added := time.Date(2016, 5, 1, 0, 0, 0, 0, time.UTC)
+	file := bookFileFromDisk(filepath.Join(testutils.CreateTempDir(t), "missing.pdf"), added)
+	if file.Size != 0 || file.MimeType != PdfMimeType || file.Role != RoleEbook || !file.Added.Equal(added) {
+		t.Fatalf("Expected an empty pdf added at %v but found %+v", added, file)
+	}
+}
+
+func TestTheDetailsOfAStreamedFileMatchThoseOfItsContents(t *testing.T) {
+	added := time.Date(2016, 5, 1, 0, 0, 0, 0, time.UTC)
+	data := append([]byte("%PDF-1.4\n"), bytes.Repeat([]byte("a page of the book\n"), 100)...)
+	copied := &bytes.Buffer{}
+
+	// read a byte at a time so the start of the file arrives in pieces
+	file, err := copyBookFile(copied, "book.pdf", iotest.OneByteReader(bytes.NewReader(data)), added)
+	assert.NoError(t, err)
+	if expected := newBookFile("book.pdf", data, added); !reflect.DeepEqual(file, expected) {
+		t.Fatalf("Expected %+v but found %+v", expected, file)
+	}
+	if !bytes.Equal(copied.Bytes(), data) {
+		t.Fatalf("Expected the contents to be copied but found %d bytes", copied.Len())
+	}
+}
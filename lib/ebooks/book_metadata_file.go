@@ -0,0 +1,329 @@
+package ebooks
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	. "github.com/stephenhenderson/ebooklib/lib/logging"
+)
+
+// Name of the file in each book's folder holding a copy of the book's
+// entry in the index, from which the index can be rebuilt if it is lost
+const BookMetadataFileName = "book.json"
+
+// The version of the book metadata files written by this version of the
+// library, files from newer versions are not read
+const bookMetadataFileVersion = 1
+
+// The contents of a book metadata file. The id is left out as it is taken
+// from the name of the folder, so a folder copied into another library
+// under a new id becomes that book.
+type bookMetadataFile struct {
+	Version int         `json:"version"`
+	Book    *indexEntry `json:"book"`
+}
+
+// writeBookMetadataFile writes the metadata file of the book with the
+// given entry to the book's folder
+func writeBookMetadataFile(bookFolder string, entry *indexEntry) error {
+	data, err := json.MarshalIndent(&bookMetadataFile{bookMetadataFileVersion, entry}, "", " ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(filepath.Join(bookFolder, BookMetadataFileName), data, 0700)
+}
+
+// readBookMetadataFile reads the entry of a book from the metadata file in
+// its folder
+func readBookMetadataFile(bookFolder string) (*indexEntry, error) {
+	data, err := ioutil.ReadFile(filepath.Join(bookFolder, BookMetadataFileName))
+	if err != nil {
+		return nil, err
+	}
+	metadata := &bookMetadataFile{}
+	if err = json.Unmarshal(data, metadata); err != nil {
+		return nil, err
+	}
+	if metadata.Version > bookMetadataFileVersion {
+		return nil, fmt.Errorf("metadata file has version %d but only versions up to %d are supported",
+			metadata.Version, bookMetadataFileVersion)
+	}
+	if metadata.Book == nil || metadata.Book.BookDetails == nil {
+		return nil, fmt.Errorf("metadata file has no book")
+	}
+	return metadata.Book, nil
+}
+
+// saveBookMetadata writes the metadata file of the book with the given id
+// in the library or its trash, a book which no longer exists is skipped.
+// Callers must hold the write lock.
+func (lib *FileLibrary) saveBookMetadata(id int) error {
+	book, folder := lib.index[id], relativeFolderForBook(id)
+	if book == nil {
+		book, folder = lib.trash[id], relativeTrashFolderForBook(id)
+	}
+	if book == nil {
+		return nil
+	}
+	entry := &indexEntry{book.BookDetails, book.Image, book.Files, book.Created, book.Updated}
+	return writeBookMetadataFile(filepath.Join(lib.BaseDir, folder), entry)
+}
+
+// saveBookMetadataOrLog saves the metadata file of the book with the given
+// id, errors are only logged as the index holds the same details and the
+// file is written again the next time the book changes. Callers must hold
+// the write lock.
+func (lib *FileLibrary) saveBookMetadataOrLog(id int) {
+	if err := lib.saveBookMetadata(id); err != nil {
+		Logger.Printf("Error writing the metadata file of book=%d: %v", id, err)
+	}
+}
+
+// RebuildIndex replaces the index and trash index with the books read from
+// the metadata file in each book folder, e.g. after restoring some of the
+// folders from a backup or copying them in from another library, and
+// returns the number of books found. A book in the index whose folder has
+// no readable metadata file keeps its entry, other folders without one are
+// skipped. Files whose contents are missing, e.g. from a folder copied
+// without the library's blobs folder, are left out of their book. The
+// skipped folders and files are returned, relative to the base directory,
+// for Check to report. Changes in the journal which have not reached the
+// metadata files are applied to the rebuilt index.
+func (lib *FileLibrary) RebuildIndex() (int, []string, error) {
+	lib.mutex.Lock()
+	defer lib.mutex.Unlock()
+	return lib.rebuildIndex()
+}
+
+// RebuildFileLibraryIndex rebuilds the index of the file library in the
+// given directory as RebuildIndex does but without opening the library,
+// so that an index which can no longer be read can be replaced
+func RebuildFileLibraryIndex(baseDir string) (int, []string, error) {
+	if err := checkNotMigratedToBolt(baseDir); err != nil {
+		return 0, nil, err
+	}
+	lock, err := lockLibrary(filepath.Join(baseDir, LockFileName))
+	if err != nil {
+		return 0, nil, err
+	}
+	defer lock.Close()
+
+	lib := &FileLibrary{BaseDir: baseDir, index: make(map[int]*Ebook), trash: make(map[int]*Ebook), blobRefs: make(map[string]int)}
+	return lib.rebuildIndex()
+}
+
+// rebuildIndex rebuilds the index as described for RebuildIndex, writes it
+// and then truncates the journal, whether or not it has been opened yet.
+// Callers must hold the write lock.
+func (lib *FileLibrary) rebuildIndex() (int, []string, error) {
+	index, skipped, err := lib.readBooksFromFolders("", relativeFolderForBook, lib.index)
+	if err != nil {
+		return 0, nil, err
+	}
+	trash, skippedInTrash, err := lib.readBooksFromFolders(TrashDirName, relativeTrashFolderForBook, lib.trash)
+	if err != nil {
+		return 0, nil, err
+	}
+	skipped = append(skipped, skippedInTrash...)
+	for id := range trash {
+		if _, found := index[id]; found {
+			Logger.Printf("Book %d is in both the library and the trash, keeping the one in the library", id)
+			delete(trash, id)
+		}
+	}
+
+	lib.index, lib.trash = index, trash
+	lib.maxID = lib.largestBookFolderID()
+	lib.blobRefs = make(map[string]int)
+	for _, books := range []map[int]*Ebook{index, trash} {
+		for _, book := range books {
+			for _, file := range book.Files {
+				lib.retainFile(file)
+			}
+		}
+	}
+	if err = lib.replayJournalOverRebuiltIndex(); err != nil {
+		return 0, nil, err
+	}
+	skipped = lib.withoutIndexedFolders(skipped)
+
+	rebuilt := len(lib.index) + len(lib.trash)
+	if err = lib.saveIndexToDisk(); err != nil || lib.journal != nil {
+		return rebuilt, skipped, err
+	}
+	// the journal is not open yet so was not truncated with the index
+	journal, err := openJournal(lib.fileForJournal())
+	if err != nil {
+		return rebuilt, skipped, err
+	}
+	defer journal.close()
+	return rebuilt, skipped, journal.truncate()
+}
+
+// replayJournalOverRebuiltIndex applies the changes in the journal to the
+// books read from their metadata files, as a change whose metadata file
+// could not be written is only in the journal, and then writes the
+// metadata files of the books changed. Changes made before a book was
+// last updated according to its metadata file are already in it and are
+// skipped, so are changes which no longer apply. Callers must hold the
+// write lock.
+func (lib *FileLibrary) replayJournalOverRebuiltIndex() error {
+	journalFile := lib.fileForJournal()
+	entries, err := readJournal(journalFile)
+	if err != nil {
+		return err
+	}
+
+	changed := make(map[int]bool)
+	lib.replaying = true
+	for _, entry := range entries {
+		book, found := lib.index[entry.ID]
+		if !found {
+			book, found = lib.trash[entry.ID]
+		}
+		if found && !entry.Time.IsZero() && !entry.Time.After(book.Updated) {
+			continue
+		}
+		if entry.Time.IsZero() {
+			// written before entries were timestamped so always applied,
+			// the journal was last changed no earlier than the entry
+			if info, err := os.Stat(journalFile); err == nil {
+				entry.Time = info.ModTime().UTC()
+			}
+		}
+		if err := lib.applyJournalEntry(entry); err != nil {
+			Logger.Printf("Skipping change to book=%d from the journal: %v", entry.ID, err)
+			continue
+		}
+		changed[entry.ID] = true
+	}
+	lib.replaying = false
+
+	if len(changed) > 0 {
+		Logger.Printf("Applied changes to %d books from the journal missing from their metadata files", len(changed))
+	}
+	for id := range changed {
+		lib.saveBookMetadataOrLog(id)
+	}
+	return nil
+}
+
+// withoutIndexedFolders returns the skipped folders and files less the
+// folders of books which are in the index or trash after all, e.g. as the
+// journal added them. Callers must hold the write lock.
+func (lib *FileLibrary) withoutIndexedFolders(skipped []string) []string {
+	indexed := make(map[string]bool)
+	for id := range lib.index {
+		indexed[relativeFolderForBook(id)] = true
+	}
+	for id := range lib.trash {
+		indexed[relativeTrashFolderForBook(id)] = true
+	}
+	remaining := []string{}
+	for _, path := range skipped {
+		if !indexed[path] {
+			remaining = append(remaining, path)
+		}
+	}
+	return remaining
+}
+
+// readBooksFromFolders reads the book in every folder named by a book id
+// in the given folder, relative to the base directory, from its metadata
+// file. Books in current without a readable metadata file are kept as
+// they are, any other folder without one is skipped. The skipped folders
+// and the files left out of their books as their contents are missing are
+// returned.
+func (lib *FileLibrary) readBooksFromFolders(folder string, bookFolder func(int) string, current map[int]*Ebook) (map[int]*Ebook, []string, error) {
+	ids, err := bookFolderIDs(filepath.Join(lib.BaseDir, folder))
+	if err != nil {
+		return nil, nil, err
+	}
+	books := make(map[int]*Ebook)
+	skipped := []string{}
+	for _, id := range ids {
+		book, missing, err := lib.readBookFromFolder(id, bookFolder)
+		if err != nil {
+			if book, found := current[id]; found {
+				Logger.Printf("Keeping the indexed details of book %d, its metadata file cannot be read: %v", id, err)
+				books[id] = book
+			} else {
+				Logger.Printf("Skipping %s, its metadata file cannot be read: %v", bookFolder(id), err)
+				skipped = append(skipped, bookFolder(id))
+			}
+			continue
+		}
+		books[id] = book
+		skipped = append(skipped, missing...)
+	}
+	return books, skipped, nil
+}
+
+// readBookFromFolder reads the book with the given id from the metadata
+// file in its folder, given by bookFolder, with the paths of its cover and
+// files in that folder. Files whose contents are not in the library are
+// left out and returned as paths in the book's folder.
+func (lib *FileLibrary) readBookFromFolder(id int, bookFolder func(int) string) (*Ebook, []string, error) {
+	entry, err := readBookMetadataFile(filepath.Join(lib.BaseDir, bookFolder(id)))
+	if err != nil {
+		return nil, nil, err
+	}
+	book := &Ebook{id, make(map[string]*BookFile), "", entry.Created, entry.Updated, entry.BookDetails}
+	if entry.Image != "" {
+		book.Image = filepath.Join(bookFolder(id), filepath.Base(entry.Image))
+	}
+	missing := []string{}
+	for fileName, file := range entry.Files {
+		path := lib.relativePathOfFile(bookFolder(id), fileName, file)
+		if _, err := os.Stat(filepath.Join(lib.BaseDir, path)); err != nil {
+			Logger.Printf("Leaving %s out of book %d, its contents cannot be found at %s: %v", fileName, id, path, err)
+			missing = append(missing, filepath.Join(bookFolder(id), fileName))
+			continue
+		}
+		book.Files[fileName] = file.withPath(path)
+	}
+	return book, missing, nil
+}
+
+// largestBookFolderID returns the largest id of the book folders in the
+// base directory and the trash, whether or not they are in the index, so
+// that new books never take the id of a folder which is already there
+func (lib *FileLibrary) largestBookFolderID() int {
+	largest := 0
+	for _, folder := range []string{lib.BaseDir, lib.folderForTrash()} {
+		ids, _ := bookFolderIDs(folder)
+		for _, id := range ids {
+			if id > largest {
+				largest = id
+			}
+		}
+	}
+	return largest
+}
+
+// bookFolderIDs returns the ids of the folders in the given folder which
+// are named by a book id
+func bookFolderIDs(folder string) ([]int, error) {
+	entries, err := ioutil.ReadDir(folder)
+	if err != nil {
+		return nil, err
+	}
+	ids := []int{}
+	for _, entry := range entries {
+		if id, err := strconv.Atoi(entry.Name()); err == nil && entry.IsDir() {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// bookFolderExists returns true if the book folder at the given path
+// exists
+func bookFolderExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
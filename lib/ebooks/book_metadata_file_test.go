@@ -0,0 +1,289 @@
+package ebooks
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stephenhenderson/ebooklib/lib/testutils/assert"
+)
+
+func TestEachBookKeepsItsMetadataFileUpToDate(t *testing.T) {
+	library := newLibraryInTempFolder(t)
+	files := fileReaders(map[string][]byte{"book.pdf": []byte("%PDF"), "code.zip": []byte("code")})
+	book, err := library.Add(aBook("Go in Action", "mr writer", 2016, nil), aPngImage(t), files)
+	assert.NoError(t, err)
+	assertBookMetadataFile(library, book.ID, library.index[book.ID], t)
+
+	_, err = library.UpdateBook(book.ID, aBook("Go in Action, 2nd edition", "mr writer", 2017, []string{"golang"}))
+	assert.NoError(t, err)
+	assert.NoError(t, library.AddFileToBook(book.ID, "errata.txt", strings.NewReader("typos")))
+	assert.NoError(t, library.SetFileRole(book.ID, "code.zip", RoleOther))
+	assert.NoError(t, library.DeleteFileFromBook(book.ID, "book.pdf"))
+	assertBookMetadataFile(library, book.ID, library.index[book.ID], t)
+
+	assert.NoError(t, library.DeleteBook(book.ID))
+	assertBookMetadataFile(library, book.ID, library.trash[book.ID], t)
+}
+
+func TestChangesReplayedFromTheJournalReachTheMetadataFiles(t *testing.T) {
+	library := newLibraryInTempFolder(t)
+	book, err := library.Add(aBook("Book1", "mr writer", 2016, nil), noImage, emptyFileMap())
+	assert.NoError(t, err)
+	// as if the process was killed before the metadata file was written
+	appendToFile(library.fileForJournal(), `{"Op":"update","ID":1,"Book":{"Title":"Renamed"}}`+"\n", t)
+
+	reopened := reopenLibrary(library, t)
+	entry, err := readBookMetadataFile(reopened.folderForBook(book.ID))
+	assert.NoError(t, err)
+	if entry.Title != "Renamed" {
+		t.Fatalf("Expected the replayed change in the metadata file but the title was %s", entry.Title)
+	}
+}
+
+func TestTheIndexIsRebuiltFromTheBookFoldersWhenItIsLost(t *testing.T) {
+	library := newLibraryInTempFolder(t)
+	files := fileReaders(map[string][]byte{"book.pdf": []byte("%PDF"), "code.zip": []byte("code")})
+	book, err := library.Add(aBook("Go in Action", "mr writer", 2016, []string{"golang"}), aPngImage(t), files)
+	assert.NoError(t, err)
+	trashed, err := library.Add(aBook("Go Again", "mr writer", 2017, nil), aPngImage(t), fileReaders(map[string][]byte{"copy.pdf": []byte("%PDF")}))
+	assert.NoError(t, err)
+	assert.NoError(t, library.DeleteBook(trashed.ID))
+	assert.NoError(t, library.Close())
+	assert.NoError(t, os.Remove(library.fileForIndex()))
+	assert.NoError(t, os.Remove(library.fileForTrashIndex()))
+
+	reopened := reopenLibrary(library, t)
+	rebuilt, err := reopened.GetBookByID(book.ID)
+	assert.NoError(t, err)
+	if !rebuilt.Equals(book.BookDetails) || !rebuilt.Created.Equal(book.Created) || rebuilt.Image != book.Image {
+		t.Fatalf("Expected %+v to be rebuilt but found %+v", book, rebuilt)
+	}
+	for fileName, data := range map[string]string{"book.pdf": "%PDF", "code.zip": "code"} {
+		content, err := reopened.OpenBookFile(book.ID, fileName)
+		assert.NoError(t, err)
+		contents, _ := ioutil.ReadAll(content)
+		content.Close()
+		if string(contents) != data || rebuilt.Files[fileName].Checksum != book.Files[fileName].Checksum {
+			t.Fatalf("Expected %s to be rebuilt with its contents but found %+v", fileName, rebuilt.Files[fileName])
+		}
+	}
+	cover, err := reopened.OpenBookImage(book.ID)
+	assert.NoError(t, err)
+	cover.Close()
+
+	trash := reopened.GetTrash()
+	if len(trash) != 1 || trash[0].ID != trashed.ID || trash[0].Image != filepath.Join(relativeTrashFolderForBook(trashed.ID), "cover.png") {
+		t.Fatalf("Expected the trashed book to be rebuilt in the trash but found %v", trash)
+	}
+	added, err := reopened.Add(aBook("Go Further", "mr writer", 2018, nil), noImage, emptyFileMap())
+	assert.NoError(t, err)
+	if added.ID != trashed.ID+1 {
+		t.Fatalf("Expected the next book to get id %d but was %d", trashed.ID+1, added.ID)
+	}
+	assertNoProblems(reopened, t)
+}
+
+func TestRebuildIndexPicksUpBookFoldersCopiedFromAnotherLibrary(t *testing.T) {
+	other := newLibraryInTempFolder(t)
+	copied, err := other.Add(aBook("Go in Action", "mr writer", 2016, nil), aPngImage(t), fileReaders(map[string][]byte{"book.pdf": []byte("%PDF")}))
+	assert.NoError(t, err)
+	library := newLibraryInTempFolder(t)
+	_, err = library.Add(aBook("Go Again", "mr writer", 2017, nil), noImage, emptyFileMap())
+	assert.NoError(t, err)
+	copyFolder(other.folderForBook(copied.ID), library.folderForBook(7), t)
+	copyFolder(other.blobs().dir, library.blobs().dir, t)
+
+	rebuilt, skipped, err := library.RebuildIndex()
+	assert.NoError(t, err)
+	if rebuilt != 2 || len(skipped) != 0 {
+		t.Fatalf("Expected 2 books to be rebuilt but was %d", rebuilt)
+	}
+	for _, lib := range []*FileLibrary{library, reopenLibrary(library, t)} {
+		book, err := lib.GetBookByID(7)
+		assert.NoError(t, err)
+		if book.Title != "Go in Action" || book.Image != filepath.Join("7", "cover.png") {
+			t.Fatalf("Expected the copied book to take the id of its folder but found %+v", book)
+		}
+		content, err := lib.OpenBookFile(7, "book.pdf")
+		assert.NoError(t, err)
+		content.Close()
+	}
+	assertNoProblems(library, t)
+}
+
+func TestRebuildIndexLeavesOutFilesMissingFromTheBlobsFolder(t *testing.T) {
+	other := newLibraryInTempFolder(t)
+	copied, err := other.Add(aBook("Go in Action", "mr writer", 2016, nil), noImage, fileReaders(map[string][]byte{"book.pdf": []byte("%PDF")}))
+	assert.NoError(t, err)
+	library := newLibraryInTempFolder(t)
+	copyFolder(other.folderForBook(copied.ID), library.folderForBook(7), t)
+
+	rebuilt, skipped, err := library.RebuildIndex()
+	assert.NoError(t, err)
+	if rebuilt != 1 || len(skipped) != 1 || skipped[0] != filepath.Join("7", "book.pdf") {
+		t.Fatalf("Expected 1 book rebuilt and its missing file skipped but found %d and %v", rebuilt, skipped)
+	}
+	book, err := library.GetBookByID(7)
+	assert.NoError(t, err)
+	if len(book.Files) != 0 {
+		t.Fatalf("Expected the missing file to be left out of the book but found %v", book.Files)
+	}
+	assertNoProblems(library, t)
+}
+
+func TestRebuildIndexKeepsIndexedBooksWithoutAMetadataFile(t *testing.T) {
+	library := newLibraryInTempFolder(t)
+	book, err := library.Add(aBook("Go in Action", "mr writer", 2016, nil), noImage, fileReaders(map[string][]byte{"book.pdf": []byte("%PDF")}))
+	assert.NoError(t, err)
+	assert.NoError(t, os.Remove(filepath.Join(library.folderForBook(book.ID), BookMetadataFileName)))
+
+	_, skipped, err := library.RebuildIndex()
+	assert.NoError(t, err)
+	if len(skipped) != 0 {
+		t.Fatalf("Expected no folders to be skipped but found %v", skipped)
+	}
+	kept, err := library.GetBookByID(book.ID)
+	assert.NoError(t, err)
+	if kept.Title != book.Title || len(kept.Files) != 1 {
+		t.Fatalf("Expected the book to keep its entry but found %+v", kept)
+	}
+	assertBlobs(library, 1, t)
+}
+
+func TestFoldersWithoutAMetadataFileAreSkippedButTheirIdsAreNeverReused(t *testing.T) {
+	library := newLibraryInTempFolder(t)
+	writeBookFolder(library.BaseDir, "5", "a.pdf")
+
+	rebuilt, skipped, err := library.RebuildIndex()
+	assert.NoError(t, err)
+	if rebuilt != 0 || len(skipped) != 1 || skipped[0] != "5" {
+		t.Fatalf("Expected the folder without a metadata file to be skipped but %d books were rebuilt and %v skipped", rebuilt, skipped)
+	}
+	for _, lib := range []*FileLibrary{library, reopenLibrary(library, t)} {
+		book, err := lib.Add(aBook("Go in Action", "mr writer", 2016, nil), noImage, emptyFileMap())
+		assert.NoError(t, err)
+		if book.ID <= 5 {
+			t.Fatalf("Expected the new book to get an id after the folder's but was %d", book.ID)
+		}
+	}
+	assertFileContents(filepath.Join(library.BaseDir, "5", "files", "a.pdf"), []byte("a.pdf"), t)
+}
+
+func TestGarbageIsNotCollectedWhileBookFoldersAreMissingFromTheIndex(t *testing.T) {
+	library := newLibraryInTempFolder(t)
+	book, err := library.Add(aBook("Go in Action", "mr writer", 2016, nil), noImage, fileReaders(map[string][]byte{"book.pdf": []byte("%PDF")}))
+	assert.NoError(t, err)
+	assert.NoError(t, library.Close())
+	assert.NoError(t, os.Remove(library.fileForIndex()))
+	assert.NoError(t, os.Remove(filepath.Join(library.folderForBook(book.ID), BookMetadataFileName)))
+
+	// the folder is skipped when the index is rebuilt on opening
+	reopened := reopenLibrary(library, t)
+	if len(reopened.GetAll()) != 0 {
+		t.Fatalf("Expected the folder without a metadata file to be skipped but found %v", reopened.GetAll())
+	}
+	if _, err = reopened.CollectGarbage(); err == nil {
+		t.Fatal("Expected collecting garbage to fail while the book's folder is not in the index")
+	}
+	assertBlobs(reopened, 1, t)
+}
+
+func TestAnIndexWhichCannotBeReadIsRebuiltWithoutOpeningTheLibrary(t *testing.T) {
+	library := newLibraryInTempFolder(t)
+	book, err := library.Add(aBook("Go in Action", "mr writer", 2016, nil), noImage, fileReaders(map[string][]byte{"book.pdf": []byte("%PDF")}))
+	assert.NoError(t, err)
+	_, err = library.UpdateBook(book.ID, aBook("Go in Action, 2nd edition", "mr writer", 2017, nil))
+	assert.NoError(t, err)
+	writeBookFolder(library.BaseDir, "5")
+	assert.NoError(t, library.Close())
+	writeTestFile(library.fileForIndex(), "{corrupt")
+	if _, err = NewFileLibrary(library.BaseDir); err == nil {
+		t.Fatal("Expected a library with a corrupt index to fail to open")
+	}
+
+	rebuilt, skipped, err := RebuildFileLibraryIndex(library.BaseDir)
+	assert.NoError(t, err)
+	if rebuilt != 1 || len(skipped) != 1 || skipped[0] != "5" {
+		t.Fatalf("Expected 1 book rebuilt and folder 5 skipped but found %d and %v", rebuilt, skipped)
+	}
+	reopened, err := NewFileLibrary(library.BaseDir)
+	assert.NoError(t, err)
+	found, err := reopened.GetBookByID(book.ID)
+	assert.NoError(t, err)
+	if found.Title != "Go in Action, 2nd edition" || found.Files["book.pdf"] == nil {
+		t.Fatalf("Expected the book to be rebuilt from its metadata file but found %+v", found)
+	}
+}
+
+// assertBookMetadataFile checks the metadata file of the book with the
+// given id matches the book
+func assertBookMetadataFile(library *FileLibrary, id int, expected *Ebook, t *testing.T) {
+	folder := relativeFolderForBook(id)
+	if _, inTrash := library.trash[id]; inTrash {
+		folder = relativeTrashFolderForBook(id)
+	}
+	entry, err := readBookMetadataFile(filepath.Join(library.BaseDir, folder))
+	assert.NoError(t, err)
+	if !expected.Equals(entry.BookDetails) || entry.Image != expected.Image || !entry.Updated.Equal(expected.Updated) {
+		t.Fatalf("Expected the metadata file to hold %+v but found %+v", expected, entry)
+	}
+	if len(entry.Files) != len(expected.Files) {
+		t.Fatalf("Expected the metadata file to hold files %v but found %v", expected.Files, entry.Files)
+	}
+	for fileName, file := range expected.Files {
+		if found := entry.Files[fileName]; found == nil || found.Checksum != file.Checksum || found.Role != file.Role {
+			t.Fatalf("Expected the metadata file to hold %s as %+v but found %+v", fileName, file, found)
+		}
+	}
+}
+
+// copyFolder copies the files under src to the same paths under dest
+func copyFolder(src, dest string, t *testing.T) {
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relativePath, _ := filepath.Rel(src, path)
+		if info.IsDir() {
+			return mkDirs(filepath.Join(dest, relativePath))
+		}
+		return linkOrCopyFile(path, filepath.Join(dest, relativePath))
+	})
+	assert.NoError(t, err)
+}
+
+func TestRebuildingTheIndexAppliesJournalChangesMissingFromTheMetadataFiles(t *testing.T) {
+	library := newLibraryInTempFolder(t)
+	book, err := library.Add(aBook("Go in Action", "mr writer", 2016, nil), noImage, fileReaders(map[string][]byte{"book.pdf": []byte("%PDF")}))
+	assert.NoError(t, err)
+	metadataFile := filepath.Join(library.folderForBook(book.ID), BookMetadataFileName)
+	staleMetadata, err := ioutil.ReadFile(metadataFile)
+	assert.NoError(t, err)
+	_, err = library.UpdateBook(book.ID, aBook("Go in Action, 2nd edition", "mr writer", 2017, nil))
+	assert.NoError(t, err)
+	// as if writing the metadata file had failed and the process was then
+	// killed before the index was written
+	writeTestFile(metadataFile, string(staleMetadata))
+	library.lock.Close()
+
+	rebuilt, skipped, err := RebuildFileLibraryIndex(library.BaseDir)
+	assert.NoError(t, err)
+	if rebuilt != 1 || len(skipped) != 0 {
+		t.Fatalf("Expected 1 book rebuilt and nothing skipped but found %d and %v", rebuilt, skipped)
+	}
+	reopened, err := NewFileLibrary(library.BaseDir)
+	assert.NoError(t, err)
+	found, err := reopened.GetBookByID(book.ID)
+	assert.NoError(t, err)
+	if found.Title != "Go in Action, 2nd edition" || found.Files["book.pdf"] == nil {
+		t.Fatalf("Expected the update in the journal to be applied but found %+v", found)
+	}
+	entry, err := readBookMetadataFile(library.folderForBook(book.ID))
+	assert.NoError(t, err)
+	if entry.Title != "Go in Action, 2nd edition" {
+		t.Fatalf("Expected the metadata file to be brought up to date but found %+v", entry.BookDetails)
+	}
+}
@@ -0,0 +1,107 @@
+package ebooks
+
+import "sort"
+
+// A file of a book in the library
+type FileLocation struct {
+	BookID    int
+	BookTitle string
+	FileName  string
+}
+
+// Files with identical contents stored against one or more books
+type DuplicateFiles struct {
+	// Hex encoded SHA-256 shared by the files
+	Checksum string
+
+	// Size of each of the files in bytes
+	Size int64
+
+	// The files ordered by book id and then name
+	Files []*FileLocation
+}
+
+// FindDuplicateFiles returns the groups of files among the books with
+// identical contents, largest files first as they waste the most space.
+// Files without a checksum are never duplicates.
+func FindDuplicateFiles(books []*Ebook) []*DuplicateFiles {
+	byChecksum := groupFilesByChecksum(books)
+	duplicates := []*DuplicateFiles{}
+	for _, group := range byChecksum {
+		if len(group.Files) > 1 {
+			duplicates = append(duplicates, group)
+		}
+	}
+	sort.Sort(bySizeThenChecksum(duplicates))
+	return duplicates
+}
+
+// DuplicatesOfBook returns the other files among the books with the same
+// contents as each file of the book with the given id, by the name of the
+// book's file. Files without duplicates are left out.
+func DuplicatesOfBook(books []*Ebook, bookID int) map[string][]*FileLocation {
+	groups := groupFilesByChecksum(books)
+	duplicates := make(map[string][]*FileLocation)
+	for _, book := range books {
+		if book.ID != bookID {
+			continue
+		}
+		for fileName, file := range book.Files {
+			group, found := groups[file.Checksum]
+			if !found {
+				continue
+			}
+			for _, location := range group.Files {
+				if location.BookID != bookID || location.FileName != fileName {
+					duplicates[fileName] = append(duplicates[fileName], location)
+				}
+			}
+		}
+	}
+	return duplicates
+}
+
+// groupFilesByChecksum returns the files of the books with a checksum
+// grouped by it, each ordered by book id and then name
+func groupFilesByChecksum(books []*Ebook) map[string]*DuplicateFiles {
+	groups := make(map[string]*DuplicateFiles)
+	for _, book := range books {
+		for fileName, file := range book.Files {
+			if file.Checksum == "" {
+				continue
+			}
+			group, found := groups[file.Checksum]
+			if !found {
+				group = &DuplicateFiles{Checksum: file.Checksum, Size: file.Size}
+				groups[file.Checksum] = group
+			}
+			group.Files = append(group.Files, &FileLocation{book.ID, book.Title, fileName})
+		}
+	}
+	for _, group := range groups {
+		sort.Sort(byBookThenName(group.Files))
+	}
+	return groups
+}
+
+type bySizeThenChecksum []*DuplicateFiles
+
+func (groups bySizeThenChecksum) Len() int      { return len(groups) }
+func (groups bySizeThenChecksum) Swap(i, j int) { groups[i], groups[j] = groups[j], groups[i] }
+func (groups bySizeThenChecksum) Less(i, j int) bool {
+	if groups[i].Size != groups[j].Size {
+		return groups[i].Size > groups[j].Size
+	}
+	return groups[i].Checksum < groups[j].Checksum
+}
+
+type byBookThenName []*FileLocation
+
+func (files byBookThenName) Len() int      { return len(files) }
+func (files byBookThenName) Swap(i, j int) { files[i], files[j] = files[j], files[i] }
+func (files byBookThenName) Less(i, j int) bool {
+	if files[i].BookID != files[j].BookID {
+		return files[i].BookID < files[j].BookID
+	}
+	return files[i].FileName < files[j].FileName
+}
@@ -0,0 +1,47 @@
+package ebooks
+
+import "testing"
+
+func TestDuplicateFilesAreGroupedByChecksumLargestFirst(t *testing.T) {
+	books := []*Ebook{
+		aBookWithFiles(1, "Book1", map[string]*BookFile{"a.pdf": {Checksum: "aaa", Size: 10}, "a.zip": {Checksum: "zzz", Size: 99}}),
+		aBookWithFiles(2, "Book2", map[string]*BookFile{"copy.pdf": {Checksum: "aaa", Size: 10}, "b.pdf": {Checksum: "bbb", Size: 5}}),
+		aBookWithFiles(3, "Book3", map[string]*BookFile{"code.zip": {Checksum: "zzz", Size: 99}, "old.pdf": {}, "older.pdf": {}}),
+	}
+
+	duplicates := FindDuplicateFiles(books)
+	if len(duplicates) != 2 || duplicates[0].Checksum != "zzz" || duplicates[1].Checksum != "aaa" {
+		t.Fatalf("Expected the zip and then the pdf to be duplicated but found %v", duplicates)
+	}
+	assertFileLocations(duplicates[0].Files, []FileLocation{{1, "Book1", "a.zip"}, {3, "Book3", "code.zip"}}, t)
+	assertFileLocations(duplicates[1].Files, []FileLocation{{1, "Book1", "a.pdf"}, {2, "Book2", "copy.pdf"}}, t)
+}
+
+func TestDuplicatesOfABookAreTheOtherFilesWithTheSameContents(t *testing.T) {
+	books := []*Ebook{
+		aBookWithFiles(1, "Book1", map[string]*BookFile{"a.pdf": {Checksum: "aaa"}, "b.pdf": {Checksum: "bbb"}, "again.pdf": {Checksum: "aaa"}}),
+		aBookWithFiles(2, "Book2", map[string]*BookFile{"copy.pdf": {Checksum: "aaa"}}),
+	}
+
+	duplicates := DuplicatesOfBook(books, 1)
+	if len(duplicates) != 2 {
+		t.Fatalf("Expected duplicates of a.pdf and again.pdf only but found %v", duplicates)
+	}
+	assertFileLocations(duplicates["a.pdf"], []FileLocation{{1, "Book1", "again.pdf"}, {2, "Book2", "copy.pdf"}}, t)
+	assertFileLocations(duplicates["again.pdf"], []FileLocation{{1, "Book1", "a.pdf"}, {2, "Book2", "copy.pdf"}}, t)
+}
+
+func aBookWithFiles(id int, title string, files map[string]*BookFile) *Ebook {
+	return &Ebook{ID: id, Files: files, BookDetails: &BookDetails{Title: title}}
+}
+
+func assertFileLocations(actual []*FileLocation, expected []FileLocation, t *testing.T) {
+	if len(actual) != len(expected) {
+		t.Fatalf("Expected files %v but found %d files", expected, len(actual))
+	}
+	for i := range expected {
+		if *actual[i] != expected[i] {
+			t.Fatalf("Expected files %v but file %d was %v", expected, i, *actual[i])
+		}
+	}
+}
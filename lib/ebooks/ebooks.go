@@ -2,9 +2,39 @@ package ebooks
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
 	"github.com/stephenhenderson/ebooklib/lib/utils"
 )
 
+var UnsupportedImageType = errors.New("Unsupported image type, must be a jpeg, png or gif")
+
+var BookHasNoImage = errors.New("Book has no cover image")
+
+var FileNotFound = errors.New("File not found")
+
+// File extensions for the supported book cover image types
+var imageExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+}
+
+// imageFileExtension sniffs the type of the image and returns the file
+// extension to store it with
+func imageFileExtension(image []byte) (string, error) {
+	ext, found := imageExtensions[http.DetectContentType(image)]
+	if !found {
+		return "", UnsupportedImageType
+	}
+	return ext, nil
+}
+
 // Meta information about a book
 type BookDetails struct {
 	Title   string
@@ -41,18 +71,88 @@ type Ebook struct {
 	ID    int
 
 	// Files associated with this book (typically the ebook file(s) but
-	// could be supporting code, etc)
-	Files map[string]string
+	// could be supporting code, etc) by name
+	Files map[string]*BookFile
 
-	// Optional image of the book
+	// Where the library stores the cover image of the book, empty if the
+	// book has no cover
 	Image string
 
+	// When the book was added to the library
+	Created time.Time
+
+	// When the book's details, cover or files last changed
+	Updated time.Time
+
 	*BookDetails
 }
 
+// copy returns a copy of the book with its own Files map. The
+// BookDetails are shared and must be treated as read-only.
+func (book *Ebook) copy() *Ebook {
+	files := make(map[string]*BookFile, len(book.Files))
+	for name, file := range book.Files {
+		fileCopy := *file
+		files[name] = &fileCopy
+	}
+	return &Ebook{book.ID, files, book.Image, book.Created, book.Updated, book.BookDetails}
+}
+
+// Contents of a file stored in a library, e.g. a book file or cover
+type FileContent interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// A collection of ebooks. Books returned are copies, changes to them are
+// not reflected in the library. Implementations must be safe to call from
+// multiple goroutines.
 type Library interface {
-	// Add a new book to the library
-	Add(book *BookDetails, files map[string][]byte) (*Ebook, error)
+	// Add a new book to the library with an optional cover image. The
+	// contents of each file are read to the end but not closed.
+	Add(book *BookDetails, image []byte, files map[string]io.Reader) (*Ebook, error)
+
+	// Replaces the details of the book with the given id
+	UpdateBook(id int, book *BookDetails) (*Ebook, error)
+
+	// Moves the book with the given id to the trash
+	DeleteBook(id int) error
+
+	// Moves the book with the given id from the trash back to the library
+	RestoreBook(id int) (*Ebook, error)
+
+	// Permanently deletes the book with the given id from the trash
+	PurgeBook(id int) error
+
+	// Gets all books in the trash
+	GetTrash() []*Ebook
+
+	// Stores the image as the cover of the book with the given id
+	SetBookImage(id int, image []byte) (*Ebook, error)
+
+	// Removes the cover of the book with the given id
+	RemoveBookImage(id int) error
+
+	// Opens the cover of the book with the given id
+	OpenBookImage(id int) (FileContent, error)
+
+	// Opens a thumbnail of the cover of the book with the given id, the
+	// size is the name of one of the ThumbnailSizes
+	OpenThumbnail(id int, sizeName string) (FileContent, error)
+
+	// Stores a file against the book with the given id, replacing any
+	// existing file with the same name. The content is read to the end but
+	// not closed.
+	AddFileToBook(bookID int, name string, content io.Reader) error
+
+	// Deletes a file from the book with the given id
+	DeleteFileFromBook(bookID int, fileName string) error
+
+	// Changes what a file of the book with the given id is to the book
+	SetFileRole(bookID int, fileName string, role FileRole) error
+
+	// Opens a file of the book with the given id
+	OpenBookFile(bookID int, fileName string) (FileContent, error)
 
 	// Gets a single book with a given id if it exists
 	GetBookByID(id int) (*Ebook, error)
@@ -60,3 +160,24 @@ type Library interface {
 	// Gets all books in the library
 	GetAll() []*Ebook
 }
+
+// readBookFile reads the whole of a file of the book with the given id,
+// failing without reading it if it is larger than maxSize bytes
+func readBookFile(library Library, bookID int, fileName string, maxSize int64) ([]byte, error) {
+	content, err := library.OpenBookFile(bookID, fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+	size, err := content.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if size > maxSize {
+		return nil, fmt.Errorf("file is %d bytes, only files up to %d bytes are read", size, maxSize)
+	}
+	if _, err = content.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(content)
+}
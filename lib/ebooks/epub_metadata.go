@@ -0,0 +1,255 @@
+package ebooks
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"strings"
+)
+
+var InvalidEpub = errors.New("Invalid epub, no OPF package document found")
+
+// The container file which points to the OPF package document of an epub
+const epubContainerPath = "META-INF/container.xml"
+
+// Dublin Core metadata from the OPF package document of an epub
+type EpubMetadata struct {
+	Title      string
+	Creators   []string
+	Date       string
+	Subjects   []string
+	Language   string
+	Identifier string
+
+	// The cover image declared in the manifest, nil if the epub has none
+	CoverImage []byte
+}
+
+// Year returns the year the book was published from its date, 0 if the
+// epub has no date or it is not in a recognised format
+func (metadata *EpubMetadata) Year() int {
+	// dates are of the form YYYY[-MM[-DD]] optionally followed by a time
+	return yearFromDate(metadata.Date)
+}
+
+// BookDetails returns the title, authors, year and tags from the metadata,
+// any of which may be blank
+func (metadata *EpubMetadata) BookDetails() *BookDetails {
+	return &BookDetails{
+		Title:   metadata.Title,
+		Authors: metadata.Creators,
+		Year:    metadata.Year(),
+		Tags:    metadata.Subjects,
+	}
+}
+
+// The extractor for epubs, which only reads the entries of the zip it
+// needs so epubs of any size are read from their files
+type epubMetadataExtractor struct{}
+
+func (epubMetadataExtractor) ExtractMetadata(data []byte) (*ExtractedMetadata, error) {
+	return epubMetadataExtractor{}.ExtractMetadataFromFile(bytes.NewReader(data), int64(len(data)))
+}
+
+func (epubMetadataExtractor) ExtractMetadataFromFile(content io.ReaderAt, size int64) (*ExtractedMetadata, error) {
+	metadata, err := readEpubMetadata(content, size)
+	if err != nil {
+		return nil, err
+	}
+	return &ExtractedMetadata{BookDetails: metadata.BookDetails(), Cover: metadata.CoverImage}, nil
+}
+
+type epubContainer struct {
+	Rootfiles []struct {
+		FullPath  string `xml:"full-path,attr"`
+		MediaType string `xml:"media-type,attr"`
+	} `xml:"rootfiles>rootfile"`
+}
+
+type opfPackage struct {
+	UniqueIdentifier string      `xml:"unique-identifier,attr"`
+	Metadata         opfMetadata `xml:"metadata"`
+	Manifest         []opfItem   `xml:"manifest>item"`
+}
+
+// A file in the epub listed in the manifest
+type opfItem struct {
+	ID         string `xml:"id,attr"`
+	Href       string `xml:"href,attr"`
+	MediaType  string `xml:"media-type,attr"`
+	Properties string `xml:"properties,attr"`
+}
+
+type opfMetadata struct {
+	Titles      []opfElement `xml:"title"`
+	Creators    []opfElement `xml:"creator"`
+	Dates       []opfElement `xml:"date"`
+	Subjects    []opfElement `xml:"subject"`
+	Languages   []opfElement `xml:"language"`
+	Identifiers []opfElement `xml:"identifier"`
+	Metas       []opfMeta    `xml:"meta"`
+}
+
+// A Dublin Core element, epub 2 qualifies elements with attributes, epub 3
+// refines them with meta elements referring to their id
+type opfElement struct {
+	ID    string `xml:"id,attr"`
+	Role  string `xml:"role,attr"`
+	Event string `xml:"event,attr"`
+	Value string `xml:",chardata"`
+}
+
+type opfMeta struct {
+	Refines  string `xml:"refines,attr"`
+	Property string `xml:"property,attr"`
+	Name     string `xml:"name,attr"`
+	Content  string `xml:"content,attr"`
+	Value    string `xml:",chardata"`
+}
+
+// ReadEpubMetadata reads the Dublin Core metadata and cover image from the
+// OPF package document which the epub's container.xml points to
+func ReadEpubMetadata(epub []byte) (*EpubMetadata, error) {
+	return readEpubMetadata(bytes.NewReader(epub), int64(len(epub)))
+}
+
+func readEpubMetadata(epub io.ReaderAt, size int64) (*EpubMetadata, error) {
+	reader, err := zip.NewReader(epub, size)
+	if err != nil {
+		return nil, err
+	}
+
+	container := &epubContainer{}
+	if err = unmarshalZipFile(reader, epubContainerPath, container); err != nil {
+		return nil, err
+	}
+	opfPath := ""
+	for _, rootfile := range container.Rootfiles {
+		if rootfile.MediaType == "" || rootfile.MediaType == "application/oebps-package+xml" {
+			opfPath = rootfile.FullPath
+			break
+		}
+	}
+	if opfPath == "" {
+		return nil, InvalidEpub
+	}
+
+	opf := &opfPackage{}
+	if err = unmarshalZipFile(reader, opfPath, opf); err != nil {
+		return nil, err
+	}
+	metadata := opf.Metadata.toEpubMetadata(opf.UniqueIdentifier)
+
+	// a missing or unreadable cover is not an error, the book just has none
+	if coverPath := opf.coverPath(opfPath); coverPath != "" {
+		if cover, err := openZipFile(reader, coverPath); err == nil {
+			metadata.CoverImage, _ = ioutil.ReadAll(cover)
+			cover.Close()
+		}
+	}
+	return metadata, nil
+}
+
+// coverPath returns the path in the epub of the cover image, declared with
+// the cover-image property in epub 3 or a cover meta element in epub 2, ""
+// if there is none. Hrefs are relative to the package document.
+func (opf *opfPackage) coverPath(opfPath string) string {
+	coverID := ""
+	for _, meta := range opf.Metadata.Metas {
+		if meta.Name == "cover" {
+			coverID = strings.TrimSpace(meta.Content)
+		}
+	}
+
+	for _, item := range opf.Manifest {
+		isCoverImage := false
+		for _, property := range strings.Fields(item.Properties) {
+			isCoverImage = isCoverImage || property == "cover-image"
+		}
+		if !isCoverImage && (coverID == "" || item.ID != coverID) {
+			continue
+		}
+		// hrefs are urls so may be escaped, e.g. "my%20cover.jpg"
+		href := item.Href
+		if hrefURL, err := url.Parse(item.Href); err == nil {
+			href = hrefURL.Path
+		}
+		return path.Join(path.Dir(opfPath), href)
+	}
+	return ""
+}
+
+func (metadata *opfMetadata) toEpubMetadata(uniqueIdentifier string) *EpubMetadata {
+	roles := map[string]string{}
+	for _, meta := range metadata.Metas {
+		if meta.Property == "role" && strings.HasPrefix(meta.Refines, "#") {
+			roles[meta.Refines[1:]] = strings.TrimSpace(meta.Value)
+		}
+	}
+
+	epubMetadata := &EpubMetadata{Creators: []string{}, Subjects: []string{}}
+	if len(metadata.Titles) > 0 {
+		epubMetadata.Title = collapseSpace(strings.TrimSpace(metadata.Titles[0].Value))
+	}
+	for _, creator := range metadata.Creators {
+		role := creator.Role
+		if role == "" {
+			role = roles[creator.ID]
+		}
+		// creators without a role are assumed to be authors, others are
+		// editors, illustrators, etc.
+		name := collapseSpace(strings.TrimSpace(creator.Value))
+		if name != "" && (role == "" || role == "aut") {
+			epubMetadata.Creators = append(epubMetadata.Creators, name)
+		}
+	}
+	for _, date := range metadata.Dates {
+		if epubMetadata.Date == "" || date.Event == "publication" {
+			epubMetadata.Date = strings.TrimSpace(date.Value)
+		}
+	}
+	for _, subject := range metadata.Subjects {
+		if value := strings.TrimSpace(subject.Value); value != "" {
+			epubMetadata.Subjects = append(epubMetadata.Subjects, value)
+		}
+	}
+	if len(metadata.Languages) > 0 {
+		epubMetadata.Language = strings.TrimSpace(metadata.Languages[0].Value)
+	}
+	for _, identifier := range metadata.Identifiers {
+		if epubMetadata.Identifier == "" || identifier.ID == uniqueIdentifier {
+			epubMetadata.Identifier = strings.TrimSpace(identifier.Value)
+		}
+	}
+	return epubMetadata
+}
+
+// unmarshalZipFile decodes the xml file at the given path in the zip
+func unmarshalZipFile(reader *zip.Reader, name string, v interface{}) error {
+	content, err := openZipFile(reader, name)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	decoder := xml.NewDecoder(content)
+	decoder.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	return decoder.Decode(v)
+}
+
+// openZipFile opens the file at the given path in the zip, returning
+// InvalidEpub if there is no such file
+func openZipFile(reader *zip.Reader, name string) (io.ReadCloser, error) {
+	for _, file := range reader.File {
+		if path.Clean(file.Name) == path.Clean(name) {
+			return file.Open()
+		}
+	}
+	return nil, InvalidEpub
+}
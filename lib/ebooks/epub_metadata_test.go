@@ -0,0 +1,182 @@
+package ebooks
+
+import (
+	"testing"
+
+	"github.com/stephenhenderson/ebooklib/lib/utils"
+)
+
+const epubContainerXml = `<?xml version="1.0"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>`
+
+const epub2Opf = `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" unique-identifier="BookId" version="2.0">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:opf="http://www.idpf.org/2007/opf">
+    <dc:title>The Go
+      Programming Language</dc:title>
+    <dc:creator opf:role="aut" opf:file-as="Donovan, Alan">Alan Donovan</dc:creator>
+    <dc:creator opf:role="aut">Brian Kernighan</dc:creator>
+    <dc:creator opf:role="ill">An Illustrator</dc:creator>
+    <dc:date opf:event="modification">2016-01-02</dc:date>
+    <dc:date opf:event="publication">2015-10-26</dc:date>
+    <dc:subject>golang</dc:subject>
+    <dc:subject>programming</dc:subject>
+    <dc:language>en</dc:language>
+    <dc:identifier id="uuid">urn:uuid:1234</dc:identifier>
+    <dc:identifier id="BookId" opf:scheme="ISBN">9780134190440</dc:identifier>
+    <meta name="cover" content="cover-image"/>
+  </metadata>
+</package>`
+
+const epub3Opf = `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" unique-identifier="pub-id" version="3.0">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="pub-id">urn:isbn:9781491941294</dc:identifier>
+    <dc:title id="title">Concurrency in Go</dc:title>
+    <dc:creator id="creator1">Katherine Cox-Buday</dc:creator>
+    <meta refines="#creator1" property="role" scheme="marc:relators">aut</meta>
+    <dc:creator id="creator2">An Editor</dc:creator>
+    <meta refines="#creator2" property="role" scheme="marc:relators">edt</meta>
+    <dc:date>2017</dc:date>
+    <dc:language>en-GB</dc:language>
+    <meta property="dcterms:modified">2017-07-01T00:00:00Z</meta>
+  </metadata>
+</package>`
+
+func TestReadEpubMetadataFromAnEpub2PackageDocument(t *testing.T) {
+	epub := anEpub(map[string]string{
+		"META-INF/container.xml": epubContainerXml,
+		"OEBPS/content.opf":      epub2Opf,
+	}, t)
+
+	metadata, err := ReadEpubMetadata(epub)
+	if err != nil {
+		t.Fatalf("Error reading epub metadata: %v", err)
+	}
+	expected := &EpubMetadata{
+		Title:      "The Go Programming Language",
+		Creators:   []string{"Alan Donovan", "Brian Kernighan"},
+		Date:       "2015-10-26",
+		Subjects:   []string{"golang", "programming"},
+		Language:   "en",
+		Identifier: "9780134190440",
+	}
+	assertEpubMetadata(metadata, expected, t)
+	if metadata.Year() != 2015 {
+		t.Fatalf("Expected year 2015 but was %d", metadata.Year())
+	}
+}
+
+func TestReadEpubMetadataFromAnEpub3PackageDocument(t *testing.T) {
+	epub := anEpub(map[string]string{
+		"META-INF/container.xml": epubContainerXml,
+		"OEBPS/content.opf":      epub3Opf,
+	}, t)
+
+	metadata, err := ReadEpubMetadata(epub)
+	if err != nil {
+		t.Fatalf("Error reading epub metadata: %v", err)
+	}
+	expected := &EpubMetadata{
+		Title:      "Concurrency in Go",
+		Creators:   []string{"Katherine Cox-Buday"},
+		Date:       "2017",
+		Subjects:   []string{},
+		Language:   "en-GB",
+		Identifier: "urn:isbn:9781491941294",
+	}
+	assertEpubMetadata(metadata, expected, t)
+}
+
+func TestReadEpubMetadataReadsTheCoverImageFromTheManifest(t *testing.T) {
+	cover := string(aPngImage(t))
+	epub3 := anEpub(map[string]string{
+		"META-INF/container.xml": epubContainerXml,
+		"OEBPS/content.opf": `<package xmlns="http://www.idpf.org/2007/opf" version="3.0"><metadata/>
+			<manifest>
+			  <item id="ch1" href="chapter1.xhtml" media-type="application/xhtml+xml"/>
+			  <item id="img" href="images/cover.png" media-type="image/png" properties="svg cover-image"/>
+			</manifest></package>`,
+		"OEBPS/images/cover.png": cover,
+	}, t)
+	epub2 := anEpub(map[string]string{
+		"META-INF/container.xml": epubContainerXml,
+		"OEBPS/content.opf": `<package xmlns="http://www.idpf.org/2007/opf" version="2.0">
+			<metadata><meta name="cover" content="cover-id"/></metadata>
+			<manifest><item id="cover-id" href="../My%20Cover.png" media-type="image/png"/></manifest></package>`,
+		"My Cover.png": cover,
+	}, t)
+
+	for _, epub := range [][]byte{epub3, epub2} {
+		metadata, err := ReadEpubMetadata(epub)
+		if err != nil {
+			t.Fatalf("Error reading epub metadata: %v", err)
+		}
+		if string(metadata.CoverImage) != cover {
+			t.Fatal("Expected the cover image declared in the manifest")
+		}
+	}
+}
+
+func TestReadEpubMetadataIgnoresAMissingCover(t *testing.T) {
+	epub := anEpub(map[string]string{
+		"META-INF/container.xml": epubContainerXml,
+		"OEBPS/content.opf": `<package xmlns="http://www.idpf.org/2007/opf" version="3.0"><metadata/>
+			<manifest><item id="img" href="missing.png" properties="cover-image"/></manifest></package>`,
+	}, t)
+
+	metadata, err := ReadEpubMetadata(epub)
+	if err != nil {
+		t.Fatalf("Error reading epub metadata: %v", err)
+	}
+	if metadata.CoverImage != nil {
+		t.Fatal("Expected no cover image")
+	}
+}
+
+func TestReadEpubMetadataFailsWithoutAContainer(t *testing.T) {
+	epub := anEpub(map[string]string{"OEBPS/content.opf": epub2Opf}, t)
+	if _, err := ReadEpubMetadata(epub); err != InvalidEpub {
+		t.Fatalf("Expected error %v but was %v", InvalidEpub, err)
+	}
+	if _, err := ReadEpubMetadata([]byte("not a zip")); err == nil {
+		t.Fatal("Expected error reading metadata from a file which is not a zip")
+	}
+}
+
+func TestCompleteBookDetailsOnlyFillsInBlankFields(t *testing.T) {
+	epub := anEpub(map[string]string{
+		"META-INF/container.xml": epubContainerXml,
+		"OEBPS/content.opf":      epub2Opf,
+	}, t)
+	details := &BookDetails{Title: "My Title", Authors: []string{}, Tags: []string{"mine"}}
+
+	ExtractMetadata(fileSeekers(map[string][]byte{
+		"broken.epub": []byte("not a zip"),
+		"gopl.EPUB":   epub,
+		"notes.txt":   []byte("notes"),
+	})).CompleteBookDetails(details)
+
+	expected := &BookDetails{
+		Title:   "My Title",
+		Authors: []string{"Alan Donovan", "Brian Kernighan"},
+		Year:    2015,
+		Tags:    []string{"mine"},
+	}
+	if !details.Equals(expected) {
+		t.Fatalf("Expected book details %v but was %v", expected, details)
+	}
+}
+
+func assertEpubMetadata(metadata, expected *EpubMetadata, t *testing.T) {
+	if metadata.Title != expected.Title || metadata.Date != expected.Date ||
+		metadata.Language != expected.Language || metadata.Identifier != expected.Identifier ||
+		!utils.StringSliceEquals(metadata.Creators, expected.Creators) ||
+		!utils.StringSliceEquals(metadata.Subjects, expected.Subjects) {
+		t.Fatalf("Expected epub metadata %+v but was %+v", expected, metadata)
+	}
+}
@@ -1,230 +1,1175 @@
 package ebooks
 
 import (
-	"encoding/json"
 	"errors"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strconv"
+	"sync"
+	"time"
 
 	. "github.com/stephenhenderson/ebooklib/lib/logging"
 	"fmt"
-	"github.com/FiloSottile/gvt/fileutils"
 )
 
 var BookNotFound = errors.New("Book not found")
 
 const (
 	IndexFileName = "index.json"
+
+	// Name of a book's cover image in its folder, without the extension
+	coverFileName = "cover"
+
+	// Folder under the base directory holding deleted books until they
+	// are restored or purged, with its own index file
+	TrashDirName = "trash"
 )
 
 // NewFileLibrary opens a file library in the given directory. If existing
 // library files are found they are loaded otherwise a new empty library
 // is created. If the directory does not exist we attempt to create it.
+// The library is locked until it is closed so that no other process can
+// open it at the same time. A directory which has been migrated to bolt is
+// refused, its book files are no longer where the file library keeps them.
 func NewFileLibrary(baseDir string) (*FileLibrary, error) {
 	Logger.Printf("Opening library in %s\n", baseDir)
 	err := createDirIfNotExists(baseDir)
 	if err != nil {
 		return nil, err
 	}
+	if err = checkNotMigratedToBolt(baseDir); err != nil {
+		return nil, err
+	}
+	lock, err := lockLibrary(filepath.Join(baseDir, LockFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	lib, err := openFileLibrary(baseDir)
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+	lib.lock = lock
+	return lib, nil
+}
 
+func openFileLibrary(baseDir string) (*FileLibrary, error) {
 	index := make(map[int]*Ebook)
-	lib := &FileLibrary{BaseDir: baseDir, index: index}
+	trash := make(map[int]*Ebook)
+	lib := &FileLibrary{BaseDir: baseDir, index: index, trash: trash, blobRefs: make(map[string]int)}
+	err := mkDirs(lib.folderForTrash())
+	if err != nil {
+		return nil, err
+	}
+	removeStaleTempFiles(baseDir, IndexFileName)
+	removeStaleTempFiles(lib.folderForTrash(), IndexFileName)
+	if err = lib.blobs().removeTempFiles(); err != nil {
+		return nil, err
+	}
 
 	existingIndexFile := lib.fileForIndex()
-	if _, err := os.Stat(existingIndexFile); os.IsNotExist(err) {
+	if _, err := os.Stat(existingIndexFile); os.IsNotExist(err) && lib.largestBookFolderID() > 0 {
+		Logger.Println("No existing index found, rebuilding it from the book folders")
+		rebuilt, skipped, err := lib.rebuildIndex()
+		if err != nil {
+			return nil, err
+		}
+		Logger.Printf("Rebuilt index with %d books\n", rebuilt)
+		if len(skipped) > 0 {
+			Logger.Printf("Skipped %d book folders whose metadata file cannot be read or files which are missing: %v\n",
+				len(skipped), skipped)
+		}
+	} else if os.IsNotExist(err) {
 		Logger.Println("No existing index found, creating emptry library")
-		return lib, nil
+	} else {
+		// load existing library
+		Logger.Println("Found existing index file, loading...")
+		err = lib.loadIndexFromFile(existingIndexFile)
+		if err != nil {
+			return nil, err
+		}
+
+		existingTrashIndexFile := lib.fileForTrashIndex()
+		if _, err := os.Stat(existingTrashIndexFile); err == nil {
+			err = lib.loadTrashFromFile(existingTrashIndexFile)
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
 
-	// load existing library
-	Logger.Println("Found existing index file, loading...")
-	err = lib.loadIndexFromFile(existingIndexFile)
+	err = lib.openAndReplayJournal()
 	if err != nil {
 		return nil, err
 	}
+
+	// Folders of books missing from the index are kept until they are
+	// checked, new books must not take their ids
+	if largest := lib.largestBookFolderID(); largest > lib.maxID {
+		lib.maxID = largest
+	}
+
+	// Blobs may have been left unreferenced by an add which never
+	// committed or by changes replayed from the journal, they are only
+	// reported here and left for CollectGarbage
+	if unreferenced, err := lib.unreferencedBlobs(); err != nil {
+		return nil, err
+	} else if len(unreferenced) > 0 {
+		Logger.Printf("Found %d unreferenced blobs, run collect-garbage to remove them\n", len(unreferenced))
+	}
 	Logger.Printf("Loaded library with %v books\n", len(lib.index))
 	return lib, nil
 }
 
 
-// A library where ebook details are persisted to the local file system
+// The persisted form of a book in the index files. The details are
+// embedded so index files written before covers were supported still load.
+type indexEntry struct {
+	*BookDetails
+
+	// Path to the cover image relative to the base directory
+	Image string `json:",omitempty"`
+
+	// The book's files by name, the paths are not stored as they depend
+	// on whether the book is in the trash
+	Files map[string]*BookFile
+
+	Created time.Time
+	Updated time.Time
+}
+
+var _ Library = &FileLibrary{}
+
+// A library where ebook details are persisted to the local file system.
+// All methods are safe to call from multiple goroutines.
 type FileLibrary struct {
 
-	// Counter tracking the largest book id currently in the library
+	// Guards maxID, index, trash, blobRefs and the Files map of every book
+	// in them
+	mutex   sync.RWMutex
+
+	// Counter tracking the largest book id currently in the library or
+	// its trash
 	maxID   int
 
 	// All books currently in the library indexed by id
 	index   map[int]*Ebook
 
+	// Deleted books which can still be restored indexed by id
+	trash   map[int]*Ebook
+
+	// Log of changes made since the index file was last written
+	journal *journal
+
+	// Set while replaying the journal on startup, when a book's folder
+	// may already have been moved or purged by a later entry
+	replaying bool
+
+	// Number of files of books in the library or its trash referring to
+	// each blob by checksum, a blob is deleted when this drops to zero
+	blobRefs map[string]int
+
+	// The lock file held while the library is open
+	lock *os.File
+
+	// Set once the library has been migrated to bolt, its index files are
+	// retired and are no longer written
+	migrated bool
+
 	// Base directory where the library contents are stored
 	BaseDir string
 }
 
-func (lib *FileLibrary) Add(bookDetails *BookDetails, image []byte, files map[string][]byte) (*Ebook, error) {
+func (lib *FileLibrary) Add(bookDetails *BookDetails, image []byte, files map[string]io.Reader) (*Ebook, error) {
+	if image != nil {
+		if _, err := imageFileExtension(image); err != nil {
+			return nil, err
+		}
+	}
+	thumbnails := generateThumbnails(image)
+
+	fileDetails := make(map[string]*BookFile)
+	tempFiles := make(map[string]string)
+	defer removeFiles(tempFiles)
+	for fileName, content := range files {
+		Logger.Printf("Adding files for book=%v, file=%v", bookDetails, fileName)
+		file, tempFile, err := lib.stageBookFile(fileName, content)
+		if err != nil {
+			return nil, err
+		}
+		fileDetails[fileName], tempFiles[fileName] = file, tempFile
+	}
+
+	lib.mutex.Lock()
+	defer lib.mutex.Unlock()
+
 	var err error
 	lib.maxID += 1
-	ebook := &Ebook{lib.maxID, make(map[string]string), "", bookDetails}
+	ebook := &Ebook{ID: lib.maxID, BookDetails: bookDetails}
 	if err = lib.createNewBookFiles(ebook); err != nil {
 		return nil, err
 	}
 
-	for fileName, data := range(files) {
-		Logger.Printf("Adding files for book=%v, file=%v", bookDetails, fileName)
-		if err := lib.AddFileToBook(ebook, fileName, data); err != nil {
+	imagePath := ""
+	if image != nil {
+		if imagePath, err = lib.writeBookImage(ebook.ID, image); err != nil {
+			return nil, err
+		}
+	}
+
+	for fileName, file := range fileDetails {
+		if err = lib.blobs().adopt(tempFiles[fileName], file.Checksum); err != nil {
 			return nil, err
 		}
 	}
 
-	lib.index[ebook.ID] = ebook
-	err = lib.SaveIndexToDisk()
-	return ebook, err
+	entry := &journalEntry{Op: journalOpAdd, ID: ebook.ID, Book: bookDetails, Image: imagePath, FileDetails: fileDetails}
+	err = lib.commit(entry)
+	if err != nil {
+		return nil, err
+	}
+	lib.writeThumbnails(ebook.ID, thumbnails)
+	return lib.index[ebook.ID].copy(), nil
+}
+
+// SetBookImage stores the image as the cover of the book with the given
+// id, replacing any existing cover. Only jpeg, png and gif images are
+// supported.
+func (lib *FileLibrary) SetBookImage(id int, image []byte) (*Ebook, error) {
+	thumbnails := generateThumbnails(image)
+
+	lib.mutex.Lock()
+	defer lib.mutex.Unlock()
+
+	book, found := lib.index[id]
+	if !found {
+		return nil, BookNotFound
+	}
+
+	oldImagePath := book.Image
+	imagePath, err := lib.writeBookImage(id, image)
+	if err != nil {
+		return nil, err
+	}
+	if err = lib.commit(&journalEntry{Op: journalOpSetImage, ID: id, Image: imagePath}); err != nil {
+		return nil, err
+	}
+
+	// a cover of a different type is written alongside the old one
+	if oldImagePath != "" && oldImagePath != imagePath {
+		os.Remove(filepath.Join(lib.BaseDir, oldImagePath))
+	}
+	lib.writeThumbnails(id, thumbnails)
+	return book.copy(), nil
 }
 
-func (lib *FileLibrary) AddFileToBook(book *Ebook, name string, data []byte) error {
-	filePath := lib.fullPathToBookFile(name, book.ID)
-	if err := ioutil.WriteFile(filePath, data, 0700); err != nil {
+// RemoveBookImage deletes the cover of the book with the given id
+func (lib *FileLibrary) RemoveBookImage(id int) error {
+	lib.mutex.Lock()
+	defer lib.mutex.Unlock()
+
+	book, found := lib.index[id]
+	if !found {
+		return BookNotFound
+	}
+	if book.Image == "" {
+		return nil
+	}
+
+	oldImagePath := book.Image
+	if err := lib.commit(&journalEntry{Op: journalOpSetImage, ID: id}); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(lib.folderForThumbnails(id)); err != nil {
 		return err
 	}
+	return os.Remove(filepath.Join(lib.BaseDir, oldImagePath))
+}
+
+// OpenBookImage opens the cover of the book with the given id
+func (lib *FileLibrary) OpenBookImage(id int) (FileContent, error) {
+	lib.mutex.RLock()
+	defer lib.mutex.RUnlock()
 
-	// update map with path of file
-	book.Files[name] = lib.relativePathToBookFile(name, book.ID)
+	book, found := lib.index[id]
+	if !found {
+		return nil, BookNotFound
+	}
+	if book.Image == "" {
+		return nil, BookHasNoImage
+	}
+	return os.Open(filepath.Join(lib.BaseDir, book.Image))
+}
+
+// OpenThumbnail opens the thumbnail of the given size for the book's
+// cover. If the thumbnail has not been generated the cover itself is
+// opened instead.
+func (lib *FileLibrary) OpenThumbnail(id int, sizeName string) (FileContent, error) {
+	if _, err := thumbnailSizeByName(sizeName); err != nil {
+		return nil, err
+	}
+
+	lib.mutex.RLock()
+	defer lib.mutex.RUnlock()
+
+	book, found := lib.index[id]
+	if !found {
+		return nil, BookNotFound
+	}
+	if book.Image == "" {
+		return nil, BookHasNoImage
+	}
+
+	thumbnail, err := os.Open(lib.fileForThumbnail(id, sizeName))
+	if err != nil {
+		return os.Open(filepath.Join(lib.BaseDir, book.Image))
+	}
+	return thumbnail, nil
+}
+
+// RebuildThumbnails regenerates the thumbnails of every book in the
+// library with a cover, e.g. after the thumbnail sizes have changed
+func (lib *FileLibrary) RebuildThumbnails() error {
+	for _, book := range lib.GetAll() {
+		if book.Image == "" {
+			continue
+		}
+
+		cover, err := ioutil.ReadFile(filepath.Join(lib.BaseDir, book.Image))
+		if err != nil {
+			return err
+		}
+		Logger.Printf("Rebuilding thumbnails for book=%d", book.ID)
+		thumbnails := generateThumbnails(cover)
+
+		lib.mutex.Lock()
+		// skip books whose cover changed or which were deleted meanwhile
+		if current, found := lib.index[book.ID]; found && current.Image == book.Image {
+			lib.writeThumbnails(book.ID, thumbnails)
+		}
+		lib.mutex.Unlock()
+	}
 	return nil
 }
 
-func (lib *FileLibrary) DeleteFileFromBook(fileName string, bookID int) error {
+// generateThumbnails returns a jpeg thumbnail of the cover for each size
+// by name. Thumbnails which cannot be generated are logged and left out,
+// the cover itself is served in their place.
+func generateThumbnails(cover []byte) map[string][]byte {
+	thumbnails := make(map[string][]byte)
+	if _, err := imageFileExtension(cover); err != nil {
+		return thumbnails
+	}
+	for _, size := range ThumbnailSizes {
+		thumbnail, err := generateThumbnail(cover, size)
+		if err != nil {
+			Logger.Printf("Error generating %s thumbnail: %v", size.Name, err)
+			continue
+		}
+		thumbnails[size.Name] = thumbnail
+	}
+	return thumbnails
+}
+
+// writeThumbnails replaces the book's cached thumbnails, errors are only
+// logged as the thumbnails can always be rebuilt from the cover. Callers
+// must hold the write lock.
+func (lib *FileLibrary) writeThumbnails(bookID int, thumbnails map[string][]byte) {
+	err := writeThumbnailFiles(lib.folderForThumbnails(bookID), thumbnails)
+	if err != nil {
+		Logger.Printf("Error writing thumbnails for book=%d: %v", bookID, err)
+	}
+}
+
+// writeThumbnailFiles replaces the contents of a book's thumbnails folder
+// with the given thumbnails
+func writeThumbnailFiles(thumbnailsFolder string, thumbnails map[string][]byte) error {
+	err := os.RemoveAll(thumbnailsFolder)
+	if err == nil && len(thumbnails) > 0 {
+		err = mkDirs(thumbnailsFolder)
+	}
+	for sizeName, thumbnail := range thumbnails {
+		if err != nil {
+			break
+		}
+		err = writeFileAtomically(filepath.Join(thumbnailsFolder, sizeName+".jpg"), thumbnail, 0700)
+	}
+	return err
+}
+
+// writeBookImage writes the cover image for a book and returns its path
+// relative to the base directory
+func (lib *FileLibrary) writeBookImage(bookID int, image []byte) (string, error) {
+	ext, err := imageFileExtension(image)
+	if err != nil {
+		return "", err
+	}
+
+	imagePath := filepath.Join(relativeFolderForBook(bookID), coverFileName+ext)
+	err = writeFileAtomically(filepath.Join(lib.BaseDir, imagePath), image, 0700)
+	return imagePath, err
+}
+
+// UpdateBook replaces the details of the book with the given id, the
+// book's files are left unchanged
+func (lib *FileLibrary) UpdateBook(id int, bookDetails *BookDetails) (*Ebook, error) {
+	lib.mutex.Lock()
+	defer lib.mutex.Unlock()
+
+	if _, found := lib.index[id]; !found {
+		return nil, BookNotFound
+	}
+
+	err := lib.commit(&journalEntry{Op: journalOpUpdate, ID: id, Book: bookDetails})
+	if err != nil {
+		return nil, err
+	}
+	return lib.index[id].copy(), nil
+}
+
+// AddFileToBook stores a file against the book with the given id,
+// replacing any existing file with the same name
+func (lib *FileLibrary) AddFileToBook(bookID int, name string, content io.Reader) error {
+	file, tempFile, err := lib.stageBookFile(name, content)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile)
+
+	lib.mutex.Lock()
+	defer lib.mutex.Unlock()
+
+	if _, found := lib.index[bookID]; !found {
+		return BookNotFound
+	}
+	if err = lib.blobs().adopt(tempFile, file.Checksum); err != nil {
+		return err
+	}
+	fileDetails := map[string]*BookFile{name: file}
+	return lib.commit(&journalEntry{Op: journalOpAddFile, ID: bookID, File: name, FileDetails: fileDetails})
+}
+
+// stageBookFile streams the contents of a file to a temp file in the blob
+// store and returns its record along with the temp file, the size and
+// checksum are computed on the way so the file is never held in memory.
+// The lock is not needed, so a large upload does not hold up the library.
+// Callers add the temp file to the store with adopt under the write lock
+// before committing the file, which then takes its place in the book's
+// Files map.
+func (lib *FileLibrary) stageBookFile(name string, content io.Reader) (*BookFile, string, error) {
+	tempFile, err := lib.blobs().createTemp()
+	if err != nil {
+		return nil, "", err
+	}
+	file, err := copyBookFile(tempFile, name, content, time.Time{})
+	if err == nil {
+		// the file must be on disk before a commit can refer to it
+		err = tempFile.Sync()
+	}
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tempFile.Name())
+		return nil, "", err
+	}
+	return file, tempFile.Name(), nil
+}
+
+// removeFiles deletes the files at the given paths, ignoring any which
+// have already been moved or deleted
+func removeFiles(paths map[string]string) {
+	for _, path := range paths {
+		os.Remove(path)
+	}
+}
+
+func (lib *FileLibrary) DeleteFileFromBook(bookID int, fileName string) error {
+	lib.mutex.Lock()
+	defer lib.mutex.Unlock()
+
 	book, found := lib.index[bookID]
 	if !found {
-		return fmt.Errorf("cannot delete file %s from book with id=%d, no book found with that id", fileName, bookID)
+		return BookNotFound
 	}
 
 	_, exists := book.Files[fileName]
 	if !exists {
-		return fmt.Errorf("no file with name %s found for book with id=%d", fileName, bookID)
+		return FileNotFound
 	}
 
-	err := fileutils.RemoveAll(lib.fullPathToBookFile(fileName, bookID))
-	delete(book.Files, fileName)
-	return err
+	return lib.commit(&journalEntry{Op: journalOpDeleteFile, ID: bookID, File: fileName})
+}
+
+// SetFileRole changes what a file of the book with the given id is to
+// the book
+func (lib *FileLibrary) SetFileRole(bookID int, fileName string, role FileRole) error {
+	if !role.IsValid() {
+		return InvalidFileRole
+	}
+
+	lib.mutex.Lock()
+	defer lib.mutex.Unlock()
+
+	book, found := lib.index[bookID]
+	if !found {
+		return BookNotFound
+	}
+	if _, exists := book.Files[fileName]; !exists {
+		return FileNotFound
+	}
+	return lib.commit(&journalEntry{Op: journalOpFileRole, ID: bookID, File: fileName, Role: role})
+}
+
+// OpenBookFile opens a file of the book with the given id
+func (lib *FileLibrary) OpenBookFile(bookID int, fileName string) (FileContent, error) {
+	lib.mutex.RLock()
+	defer lib.mutex.RUnlock()
+
+	book, found := lib.index[bookID]
+	if !found {
+		return nil, BookNotFound
+	}
+
+	file, exists := book.Files[fileName]
+	if !exists {
+		return nil, FileNotFound
+	}
+	return os.Open(filepath.Join(lib.BaseDir, file.Path))
+}
+
+// DeleteBook moves the book with the given id and all its files to the
+// trash, from where it can be restored or purged
+func (lib *FileLibrary) DeleteBook(id int) error {
+	lib.mutex.Lock()
+	defer lib.mutex.Unlock()
+
+	if _, found := lib.index[id]; !found {
+		return BookNotFound
+	}
+	return lib.commit(&journalEntry{Op: journalOpTrash, ID: id})
+}
+
+// RestoreBook moves the book with the given id out of the trash and back
+// into the library
+func (lib *FileLibrary) RestoreBook(id int) (*Ebook, error) {
+	lib.mutex.Lock()
+	defer lib.mutex.Unlock()
+
+	if _, found := lib.trash[id]; !found {
+		return nil, BookNotFound
+	}
+	if err := lib.commit(&journalEntry{Op: journalOpRestore, ID: id}); err != nil {
+		return nil, err
+	}
+	return lib.index[id].copy(), nil
 }
 
+// PurgeBook permanently deletes the book with the given id from the trash
+func (lib *FileLibrary) PurgeBook(id int) error {
+	lib.mutex.Lock()
+	defer lib.mutex.Unlock()
+
+	if _, found := lib.trash[id]; !found {
+		return BookNotFound
+	}
+	return lib.commit(&journalEntry{Op: journalOpPurge, ID: id})
+}
+
+// GetTrash returns copies of all deleted books which can be restored
+func (lib *FileLibrary) GetTrash() []*Ebook {
+	lib.mutex.RLock()
+	defer lib.mutex.RUnlock()
+
+	books := make([]*Ebook, 0, len(lib.trash))
+	for _, book := range lib.trash {
+		books = append(books, book.copy())
+	}
+	return books
+}
+
+// GetBookByID returns a copy of the book with the given id, changes to
+// the copy are not reflected in the library
 func (lib *FileLibrary) GetBookByID(id int) (*Ebook, error) {
+	lib.mutex.RLock()
+	defer lib.mutex.RUnlock()
+
 	book, found := lib.index[id]
 	if !found {
 		return nil, BookNotFound
 	}
-	return book, nil
+	return book.copy(), nil
 }
 
+// GetAll returns copies of all books currently in the library
 func (lib *FileLibrary) GetAll() ([]*Ebook) {
+	lib.mutex.RLock()
+	defer lib.mutex.RUnlock()
+
 	numBooks := len(lib.index)
 	books := make([]*Ebook, 0, numBooks)
 	for _, book := range lib.index {
-		books = append(books, book)
+		books = append(books, book.copy())
 	}
 	return books
 }
 
 func (lib *FileLibrary) SaveIndexToDisk() error {
-	indexFileName := lib.fileForIndex()
-	bookDetailsMap := lib.indexToBookDetailsJsonMap()
+	lib.mutex.Lock()
+	defer lib.mutex.Unlock()
+	return lib.saveIndexToDisk()
+}
 
-	jsonIndex, err := json.MarshalIndent(bookDetailsMap,"", " ")
+// Close writes the index to disk and releases the journal and the lock on
+// the library, the library must not be used afterwards
+func (lib *FileLibrary) Close() error {
+	lib.mutex.Lock()
+	defer lib.mutex.Unlock()
+
+	if !lib.migrated {
+		if err := lib.saveIndexToDisk(); err != nil {
+			return err
+		}
+	}
+	if err := lib.journal.close(); err != nil {
+		return err
+	}
+	return lib.lock.Close()
+}
+
+// saveIndexToDisk atomically replaces the index and trash index files and
+// then truncates the journal as all its entries are now in the indexes.
+// Callers must hold the write lock so that two writers never interleave.
+func (lib *FileLibrary) saveIndexToDisk() error {
+	err := writeIndexFile(lib.fileForIndex(), lib.indexToJsonMap())
 	if err != nil {
 		return err
 	}
 
-	err = ioutil.WriteFile(indexFileName, jsonIndex, 0700)
-	return err
+	err = writeIndexFile(lib.fileForTrashIndex(), toIndexJsonMap(lib.trash))
+	if err != nil || lib.journal == nil {
+		return err
+	}
+	return lib.journal.truncate()
 }
 
-func (lib *FileLibrary) indexToBookDetailsJsonMap() map[string]*BookDetails {
-	bookDetailsMap := make(map[string]*BookDetails)
-	for id, book := range(lib.index) {
-		bookDetailsMap[strconv.Itoa(id)] = book.BookDetails
+// commit stamps the entry with the current time, appends it to the
+// journal, applies it to the in-memory index and then updates the changed
+// book's metadata file. The index file is rewritten once enough entries
+// have built up. Callers must hold the write lock.
+func (lib *FileLibrary) commit(entry *journalEntry) error {
+	entry.Time = time.Now().UTC()
+	if err := lib.journal.append(entry); err != nil {
+		return err
 	}
-	return bookDetailsMap
+	if err := lib.applyJournalEntry(entry); err != nil {
+		return err
+	}
+	lib.saveBookMetadataOrLog(entry.ID)
+	if lib.journal.entries >= journalCheckpointInterval {
+		return lib.saveIndexToDisk()
+	}
+	return nil
 }
 
-func (lib *FileLibrary) loadIndexFromFile(file string) error {
-	bookDetailsJsonMap, err := lib.bookDetailsJsonMapFromFile(file)
+// applyJournalEntry updates the in-memory index with the change recorded
+// in the entry, entries may be applied more than once
+func (lib *FileLibrary) applyJournalEntry(entry *journalEntry) error {
+	switch entry.Op {
+	case journalOpAdd:
+		book := &Ebook{entry.ID, make(map[string]*BookFile), entry.Image, entry.Time, entry.Time, entry.Book}
+		if entry.Files == nil && entry.FileDetails == nil {
+			// written before files were recorded in the journal
+			if err := lib.loadFilesForBook(book, relativeFolderForBook(book.ID)); err != nil {
+				return err
+			}
+		}
+		for _, fileName := range entry.Files {
+			// written before the details of files were recorded
+			book.Files[fileName] = lib.bookFileFromDisk(fileName, book.ID, entry.Time)
+		}
+		lib.addFilesFromEntry(book, entry)
+		for _, file := range book.Files {
+			lib.retainFile(file)
+		}
+		if existing, found := lib.index[book.ID]; found {
+			// the entry is being applied again
+			for _, file := range existing.Files {
+				lib.releaseFile(file)
+			}
+		}
+		lib.index[book.ID] = book
+		if book.ID > lib.maxID {
+			lib.maxID = book.ID
+		}
+	case journalOpUpdate:
+		book, found := lib.index[entry.ID]
+		if !found {
+			return fmt.Errorf("cannot update book with id=%d, no book found with that id", entry.ID)
+		}
+		// replace rather than modify the details as they are shared with
+		// copies of the book handed out to callers
+		book.BookDetails = entry.Book
+		book.Updated = entry.Time
+	case journalOpSetImage:
+		book, found := lib.index[entry.ID]
+		if !found {
+			return fmt.Errorf("cannot set image for book with id=%d, no book found with that id", entry.ID)
+		}
+		book.Image = entry.Image
+		book.Updated = entry.Time
+	case journalOpAddFile:
+		book, found := lib.index[entry.ID]
+		if !found {
+			return fmt.Errorf("cannot add file to book with id=%d, no book found with that id", entry.ID)
+		}
+		replaced := book.Files[entry.File]
+		if entry.FileDetails == nil {
+			// written before the details of files were recorded
+			book.Files[entry.File] = lib.bookFileFromDisk(entry.File, entry.ID, entry.Time)
+		}
+		lib.addFilesFromEntry(book, entry)
+		// retain before releasing in case the contents are unchanged
+		lib.retainFile(book.Files[entry.File])
+		if replaced != nil {
+			lib.releaseFile(replaced)
+		}
+		book.Updated = entry.Time
+	case journalOpDeleteFile:
+		book, found := lib.index[entry.ID]
+		if !found {
+			return fmt.Errorf("cannot delete file from book with id=%d, no book found with that id", entry.ID)
+		}
+		if file, exists := book.Files[entry.File]; exists {
+			delete(book.Files, entry.File)
+			lib.releaseFile(file)
+		}
+		book.Updated = entry.Time
+	case journalOpFileRole:
+		book, found := lib.index[entry.ID]
+		if !found {
+			return fmt.Errorf("cannot set file role for book with id=%d, no book found with that id", entry.ID)
+		}
+		file, exists := book.Files[entry.File]
+		if !exists {
+			return fmt.Errorf("cannot set role of file %s for book with id=%d, no file found with that name", entry.File, entry.ID)
+		}
+		file.Role = entry.Role
+		book.Updated = entry.Time
+	case journalOpTrash:
+		return lib.moveBook(entry.ID, lib.index, lib.trash, relativeFolderForBook, relativeTrashFolderForBook)
+	case journalOpRestore:
+		return lib.moveBook(entry.ID, lib.trash, lib.index, relativeTrashFolderForBook, relativeFolderForBook)
+	case journalOpPurge:
+		if book, found := lib.trash[entry.ID]; found {
+			for _, file := range book.Files {
+				lib.releaseFile(file)
+			}
+		}
+		if err := os.RemoveAll(filepath.Join(lib.BaseDir, relativeTrashFolderForBook(entry.ID))); err != nil {
+			return err
+		}
+		delete(lib.trash, entry.ID)
+	default:
+		return fmt.Errorf("unknown journal operation '%s' for book with id=%d", entry.Op, entry.ID)
+	}
+	return nil
+}
+
+// addFilesFromEntry adds the files in the details of an add or addfile
+// entry to the book, as added at the time of the entry
+func (lib *FileLibrary) addFilesFromEntry(book *Ebook, entry *journalEntry) {
+	for fileName, details := range entry.FileDetails {
+		if lib.replaying {
+			lib.adoptLegacyFile(book.ID, fileName, details.Checksum)
+		}
+		file := details.withPath(lib.relativePathOfFile(relativeFolderForBook(book.ID), fileName, details))
+		file.Added = entry.Time
+		book.Files[fileName] = file
+	}
+}
+
+// bookFileFromDisk returns the record of a file of the book with the
+// given id read from its files folder, as added at the given time, and
+// moves the file into the blob store
+func (lib *FileLibrary) bookFileFromDisk(fileName string, bookID int, added time.Time) *BookFile {
+	file := &BookFile{Added: added}
+	if path := lib.findLegacyFile(bookID, fileName); path != "" {
+		file = bookFileFromDisk(path, added)
+		lib.adoptLegacyFile(bookID, fileName, file.Checksum)
+	}
+	return file.withPath(lib.relativePathOfFile(relativeFolderForBook(bookID), fileName, file))
+}
+
+// findLegacyFile returns the path of a file of the book with the given id
+// in the files folder where older versions of the library stored it, in
+// the library or the trash as the book may since have been moved, or an
+// empty string if there is no such file
+func (lib *FileLibrary) findLegacyFile(bookID int, fileName string) string {
+	for _, folder := range []string{relativeFolderForBook(bookID), relativeTrashFolderForBook(bookID)} {
+		path := filepath.Join(lib.BaseDir, folder, "files", fileName)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// adoptLegacyFile moves a file of the book with the given id left in its
+// files folder by an older version of the library into the blob store,
+// e.g. when replaying its journal. The file is left where it is unless
+// its contents match the checksum, as a later change may have replaced it.
+func (lib *FileLibrary) adoptLegacyFile(bookID int, fileName, checksum string) {
+	if checksum == "" || lib.blobs().exists(checksum) {
+		return
+	}
+	path := lib.findLegacyFile(bookID, fileName)
+	if path == "" {
+		return
+	}
+	if actual, err := checksumOfFile(path); err != nil || actual != checksum {
+		return
+	}
+	if err := lib.blobs().adopt(path, checksum); err != nil {
+		Logger.Printf("Cannot move %s into the blob store: %v\n", path, err)
+		return
+	}
+	// only succeeds once the folder is empty
+	os.Remove(filepath.Dir(path))
+}
+
+// relativePathOfFile returns where the library stores a file of the book
+// in the given folder relative to the base directory. Files are stored in
+// the blob store by checksum, files without one were not readable when
+// the library was upgraded and are left in the book's files folder.
+func (lib *FileLibrary) relativePathOfFile(bookFolder, fileName string, file *BookFile) string {
+	if file.Checksum == "" {
+		return filepath.Join(bookFolder, "files", fileName)
+	}
+	return relativePathToBlob(file.Checksum)
+}
+
+// retainFile records another reference to the blob holding the file
+func (lib *FileLibrary) retainFile(file *BookFile) {
+	if file.Checksum != "" {
+		lib.blobRefs[file.Checksum]++
+	}
+}
+
+// releaseFile drops a reference to the blob holding the file, deleting
+// the blob once nothing refers to it. Blobs are left in place while
+// replaying the journal as a later entry may have written them again,
+// any left unreferenced are removed by CollectGarbage.
+func (lib *FileLibrary) releaseFile(file *BookFile) {
+	if file.Checksum == "" {
+		if !lib.replaying {
+			os.Remove(filepath.Join(lib.BaseDir, file.Path))
+		}
+		return
+	}
+	lib.blobRefs[file.Checksum]--
+	if lib.blobRefs[file.Checksum] > 0 {
+		return
+	}
+	delete(lib.blobRefs, file.Checksum)
+	if !lib.replaying {
+		if err := lib.blobs().remove(file.Checksum); err != nil {
+			Logger.Printf("Cannot remove blob %s: %v\n", file.Checksum, err)
+		}
+	}
+}
+
+// CollectGarbage deletes every blob which no file of a book in the library
+// or its trash refers to, along with any temp files left by interrupted
+// writes, and returns how many files were deleted. Nothing is deleted
+// while there are book folders which are not in the index, as their files
+// may be the only copy of a book.
+func (lib *FileLibrary) CollectGarbage() (int, error) {
+	lib.mutex.Lock()
+	defer lib.mutex.Unlock()
+	return lib.collectGarbage()
+}
+
+func (lib *FileLibrary) collectGarbage() (int, error) {
+	// the files of a book whose folder is missing from the index, e.g. as
+	// it was skipped when rebuilding the index, would look unreferenced
+	if unindexed := lib.unindexedBookFolders(); len(unindexed) > 0 {
+		return 0, fmt.Errorf("cannot collect garbage while the book folders %v are not in the index", unindexed)
+	}
+	paths, err := lib.unreferencedBlobs()
 	if err != nil {
-		return err
+		return 0, err
 	}
-	index := make(map[int]*Ebook)
-	maxId := 0
-	for idStr, bookDetails := range bookDetailsJsonMap {
-		id, err := strconv.Atoi(idStr)
-		if err != nil {
-			return err
+	for removed, path := range paths {
+		if err = lib.blobs().removeFile(path); err != nil {
+			return removed, err
+		}
+	}
+	return len(paths), nil
+}
+
+// unindexedBookFolders returns the book folders in the library and its
+// trash, relative to the base directory, which are not in the index
+func (lib *FileLibrary) unindexedBookFolders() []string {
+	unindexed := []string{}
+	for _, folder := range []string{"", TrashDirName} {
+		books, bookFolder := lib.index, relativeFolderForBook
+		if folder == TrashDirName {
+			books, bookFolder = lib.trash, relativeTrashFolderForBook
+		}
+		ids, _ := bookFolderIDs(filepath.Join(lib.BaseDir, folder))
+		for _, id := range ids {
+			if _, found := books[id]; !found {
+				unindexed = append(unindexed, bookFolder(id))
+			}
 		}
+	}
+	return unindexed
+}
 
-		book := &Ebook{id, make(map[string]string), "", bookDetails}
-		err = lib.loadFilesForBook(book)
-		if err != nil {
+// unreferencedBlobs returns the paths of the blobs which no file of a book
+// in the library or its trash refers to
+func (lib *FileLibrary) unreferencedBlobs() ([]string, error) {
+	paths, err := lib.blobs().files()
+	if err != nil {
+		return nil, err
+	}
+	unreferenced := []string{}
+	for _, path := range paths {
+		if lib.blobRefs[filepath.Base(path)] == 0 {
+			unreferenced = append(unreferenced, path)
+		}
+	}
+	return unreferenced, nil
+}
+
+// moveBook moves the folder and index entry of the book with the given id
+// between the library and the trash. If the book has already been moved,
+// e.g. when replaying the journal, this does nothing. The index and trash
+// index are written one after the other so a crash in between can leave
+// the book in both or neither of them, when in neither it is read back
+// from its metadata file.
+func (lib *FileLibrary) moveBook(id int, from, to map[int]*Ebook, fromFolder, toFolder func(int) string) error {
+	book, found := from[id]
+	if existing, moved := to[id]; moved && !found {
+		return nil
+	} else if moved {
+		for _, file := range existing.Files {
+			lib.releaseFile(file)
+		}
+	}
+	if !found {
+		var err error
+		if book, _, err = lib.readBookFromFolder(id, toFolder); err != nil {
+			if book, _, err = lib.readBookFromFolder(id, fromFolder); err != nil {
+				return fmt.Errorf("cannot move book with id=%d, no book found with that id", id)
+			}
+		}
+		Logger.Printf("Recovered book %d missing from the index from its metadata file\n", id)
+		for _, file := range book.Files {
+			lib.retainFile(file)
+		}
+	}
+
+	src := filepath.Join(lib.BaseDir, fromFolder(id))
+	dest := filepath.Join(lib.BaseDir, toFolder(id))
+	if _, err := os.Stat(src); err == nil {
+		if err = os.RemoveAll(dest); err != nil {
+			return err
+		}
+		if err = os.Rename(src, dest); err != nil {
 			return err
 		}
+	}
+
+	imagePath := ""
+	if book.Image != "" {
+		imagePath = filepath.Join(toFolder(id), filepath.Base(book.Image))
+	}
+	movedBook := &Ebook{id, make(map[string]*BookFile), imagePath, book.Created, book.Updated, book.BookDetails}
+	for fileName, file := range book.Files {
+		movedBook.Files[fileName] = file.withPath(lib.relativePathOfFile(toFolder(id), fileName, file))
+	}
+	delete(from, id)
+	to[id] = movedBook
+	return nil
+}
 
-		index[id] = book
-		if id > maxId {
-			maxId = id
+// openAndReplayJournal applies any changes recorded in the journal since
+// the index was last written, e.g. if the process was killed, and then
+// opens the journal for new entries
+func (lib *FileLibrary) openAndReplayJournal() error {
+	journalFile := lib.fileForJournal()
+	entries, err := readJournal(journalFile)
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		Logger.Printf("Replaying %d changes from journal\n", len(entries))
+	}
+	lib.replaying = true
+	for _, entry := range entries {
+		if entry.Time.IsZero() {
+			// written before entries were timestamped, the journal was
+			// last changed no earlier than the entry
+			if info, err := os.Stat(journalFile); err == nil {
+				entry.Time = info.ModTime().UTC()
+			}
+		}
+		if err = lib.applyJournalEntry(entry); err != nil {
+			return err
 		}
 	}
+	lib.replaying = false
+	for _, entry := range entries {
+		// the changes may not have reached the metadata files
+		lib.saveBookMetadataOrLog(entry.ID)
+	}
+
+	lib.journal, err = openJournal(journalFile)
+	if err != nil {
+		return err
+	}
+
+	// Start from a clean journal, this also drops any incomplete entry
+	// left at the end by an interrupted append
+	info, err := os.Stat(journalFile)
+	if err != nil || info.Size() == 0 {
+		return err
+	}
+	return lib.saveIndexToDisk()
+}
+
+func (lib *FileLibrary) indexToJsonMap() map[string]*indexEntry {
+	return toIndexJsonMap(lib.index)
+}
+
+func toIndexJsonMap(books map[int]*Ebook) map[string]*indexEntry {
+	indexMap := make(map[string]*indexEntry)
+	for id, book := range(books) {
+		indexMap[strconv.Itoa(id)] = &indexEntry{book.BookDetails, book.Image, book.Files, book.Created, book.Updated}
+	}
+	return indexMap
+}
+
+func (lib *FileLibrary) loadIndexFromFile(file string) error {
+	index, err := lib.loadBooksFromFile(file, relativeFolderForBook)
+	if err != nil {
+		return err
+	}
 	lib.index = index
-	lib.maxID = maxId
 	return nil
 }
 
-func (lib *FileLibrary) loadFilesForBook(book *Ebook) error {
-	filesPath := filepath.Join(lib.folderForBook(book.ID), "files")
-	files, err := ioutil.ReadDir(filesPath)
+func (lib *FileLibrary) loadTrashFromFile(file string) error {
+	trash, err := lib.loadBooksFromFile(file, relativeTrashFolderForBook)
 	if err != nil {
 		return err
 	}
-	for _, file := range(files) {
-		fileName := file.Name()
-		book.Files[fileName] = lib.relativePathToBookFile(fileName, book.ID)
-	}
+	lib.trash = trash
 	return nil
 }
 
-func (lib *FileLibrary) bookDetailsJsonMapFromFile(file string) (map[string]*BookDetails, error) {
-	jsonBytes, err := ioutil.ReadFile(file)
+// loadBooksFromFile reads an index file, migrating it to the current
+// version first if needed, with the files of each book in the folder
+// returned by bookFolder. maxID is updated to cover the ids of the books
+// read.
+func (lib *FileLibrary) loadBooksFromFile(file string, bookFolder func(int) string) (map[int]*Ebook, error) {
+	index, err := lib.readIndexFile(file, bookFolder)
 	if err != nil {
 		return nil, err
 	}
+	books := make(map[int]*Ebook)
+	for idStr, entry := range index.Books {
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			return nil, err
+		}
+
+		book := &Ebook{id, make(map[string]*BookFile), entry.Image, entry.Created, entry.Updated, entry.BookDetails}
+		for fileName, file := range entry.Files {
+			book.Files[fileName] = file.withPath(lib.relativePathOfFile(bookFolder(id), fileName, file))
+			lib.retainFile(file)
+		}
+
+		books[id] = book
+		if id > lib.maxID {
+			lib.maxID = id
+		}
+	}
+	return books, nil
+}
 
-	detailsMap := make(map[string]*BookDetails)
-	err = json.Unmarshal(jsonBytes, &detailsMap)
+// loadFilesForBook adds every file in the files folder under the book's
+// folder, given relative to the base directory, to the book's Files map
+// as added when it was last modified
+func (lib *FileLibrary) loadFilesForBook(book *Ebook, bookFolder string) error {
+	filesPath := filepath.Join(lib.BaseDir, bookFolder, "files")
+	files, err := ioutil.ReadDir(filesPath)
+	if os.IsNotExist(err) && lib.replaying {
+		return nil
+	}
 	if err != nil {
-		return nil, err
+		return err
+	}
+	for _, file := range(files) {
+		book.Files[file.Name()] = lib.bookFileFromDisk(file.Name(), book.ID, file.ModTime().UTC())
 	}
-	return detailsMap, nil
+	return nil
 }
 
 func (lib *FileLibrary) fileForIndex() string {
 	return filepath.Join(lib.BaseDir, IndexFileName)
 }
 
+func (lib *FileLibrary) fileForJournal() string {
+	return filepath.Join(lib.BaseDir, JournalFileName)
+}
+
+func (lib *FileLibrary) fileForTrashIndex() string {
+	return filepath.Join(lib.folderForTrash(), IndexFileName)
+}
+
+func (lib *FileLibrary) folderForTrash() string {
+	return filepath.Join(lib.BaseDir, TrashDirName)
+}
+
 func (lib *FileLibrary) folderForBook(id int) string {
-	return filepath.Join(lib.BaseDir, strconv.Itoa(id))
+	return filepath.Join(lib.BaseDir, relativeFolderForBook(id))
+}
+
+func (lib *FileLibrary) folderForThumbnails(id int) string {
+	return filepath.Join(lib.folderForBook(id), thumbnailsDirName)
 }
 
-func (lib *FileLibrary) relativePathToBookFile(fileName string, bookID int) string {
-	return filepath.Join(strconv.Itoa(bookID), "files", fileName)
+func (lib *FileLibrary) fileForThumbnail(id int, sizeName string) string {
+	return filepath.Join(lib.folderForThumbnails(id), sizeName+".jpg")
 }
 
-func (lib *FileLibrary) fullPathToBookFile(fileName string, bookID int) string {
-	return filepath.Join(lib.folderForBook(bookID), "files", fileName)
+func relativeFolderForBook(id int) string {
+	return strconv.Itoa(id)
+}
+
+func relativeTrashFolderForBook(id int) string {
+	return filepath.Join(TrashDirName, strconv.Itoa(id))
+}
+
+func (lib *FileLibrary) blobs() *blobStore {
+	return &blobStore{filepath.Join(lib.BaseDir, BlobsDirName)}
 }
 
 func (lib *FileLibrary) createNewBookFiles(book *Ebook) error {
-	// Create directory structure
+	// Any existing folder for a new id was left by an add which never
+	// committed, its contents must not be picked up by the new book
 	bookFolder := lib.folderForBook(book.ID)
-	filesFolder := filepath.Join(bookFolder, "files")
-	err := mkDirs(bookFolder, filesFolder)
-	return err
+	if err := os.RemoveAll(bookFolder); err != nil {
+		return err
+	}
+
+	return mkDirs(bookFolder)
 }
 
 func mkDirs(dirs ...string) (err error) {
@@ -1,9 +1,19 @@
 package ebooks
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
+	"sync"
 	"testing"
 
 	"github.com/stephenhenderson/ebooklib/lib/testutils"
@@ -70,8 +80,9 @@ func TestSaveIndexToDiskSavesAnIndexFileInTheBaseDir_EmptyLib(t *testing.T) {
 
 	indexJson, err := ioutil.ReadFile(library.fileForIndex())
 	assert.NoError(t, err)
-	if string(indexJson) != "{}" {
-		t.Fatalf("Expected empty index '{}' but found '%v'", string(indexJson))
+	expected := fmt.Sprintf("{\n \"version\": %d,\n \"books\": {}\n}", currentIndexVersion)
+	if string(indexJson) != expected {
+		t.Fatalf("Expected empty index '%v' but found '%v'", expected, string(indexJson))
 	}
 }
 
@@ -87,9 +98,10 @@ func TestSaveIndexToDiskSavesAnIndexFileInTheBaseDir_NonEmptyLib(t *testing.T) {
 	_, err = ioutil.ReadFile(indexFileName)
 	assert.NoError(t, err)
 
-	expectedMap := library.indexToBookDetailsJsonMap()
-	actualMap, err := library.bookDetailsJsonMapFromFile(indexFileName)
+	expectedMap := library.indexToJsonMap()
+	indexOnDisk, err := library.readIndexFile(indexFileName, relativeFolderForBook)
 	assert.NoError(t, err)
+	actualMap := indexOnDisk.Books
 
 	if len(actualMap) != len(expectedMap) {
 		t.Fatalf("Index written to disk '%v' does not match expected '%v'", actualMap, expectedMap)
@@ -109,7 +121,7 @@ func TestSavingABookWithAFile(t *testing.T) {
 	library := newLibraryInTempFolder(t)
 	bookFiles := make(map[string][]byte)
 	bookFiles["file1.json"] = aJsonFile()
-	book, err := library.Add(aBook("book1", "mr writer", 2016, []string{"tag1"}), noImage, bookFiles)
+	book, err := library.Add(aBook("book1", "mr writer", 2016, []string{"tag1"}), noImage, fileReaders(bookFiles))
 
 	assert.NoError(t, err)
 
@@ -125,13 +137,14 @@ func TestAFileCanBeDeletedFromABook(t *testing.T) {
 	bookFiles := make(map[string][]byte)
 	bookData := aJsonFile()
 	bookFiles[fileName] = bookData
-	book, _ := library.Add(aBook("book1", "mr writer", 2016, []string{"tag1"}), noImage, bookFiles)
+	book, _ := library.Add(aBook("book1", "mr writer", 2016, []string{"tag1"}), noImage, fileReaders(bookFiles))
+	checksum := book.Files[fileName].Checksum
 
-	err := library.DeleteFileFromBook(fileName, book.ID)
+	err := library.DeleteFileFromBook(book.ID, fileName)
 	assert.NoError(t, err)
 
 	// check the file is no longer on disk
-	fileLocation := library.fullPathToBookFile(fileName, book.ID)
+	fileLocation := library.blobs().pathTo(checksum)
 	_, err = ioutil.ReadFile(fileLocation)
 	if err == nil {
 		t.Fatalf("file %s was not deleted from the file system", fileName)
@@ -146,11 +159,76 @@ func TestAFileCanBeDeletedFromABook(t *testing.T) {
 	}
 }
 
+func TestFilesAddedToAndDeletedFromABookAreRecoveredFromTheJournal(t *testing.T) {
+	library := newLibraryInTempFolder(t)
+	book, _ := library.Add(aBook("book1", "mr writer", 2016, nil), noImage, fileReaders(map[string][]byte{"file1.json": aJsonFile()}))
+	assert.NoError(t, library.AddFileToBook(book.ID, "file2.json", bytes.NewReader(aJsonFile())))
+	assert.NoError(t, library.DeleteFileFromBook(book.ID, "file1.json"))
+
+	reopened := reopenLibrary(library, t)
+	recovered, err := reopened.GetBookByID(book.ID)
+	assert.NoError(t, err)
+	file, found := recovered.Files["file2.json"]
+	if len(recovered.Files) != 1 || !found || file.Path != relativePathToBlob(file.Checksum) {
+		t.Fatalf("Expected only file2.json but found %v", recovered.Files)
+	}
+}
+
+func TestTimestampsAreKeptWhenTheLibraryIsReopened(t *testing.T) {
+	library := newLibraryInTempFolder(t)
+	book, _ := library.Add(aBook("book1", "mr writer", 2016, nil), noImage, fileReaders(map[string][]byte{"file1.json": aJsonFile()}))
+	assert.NoError(t, library.AddFileToBook(book.ID, "file2.json", bytes.NewReader(aJsonFile())))
+	book, _ = library.GetBookByID(book.ID)
+
+	// once replayed from the journal and then again from the index
+	for i := 0; i < 2; i++ {
+		library = reopenLibrary(library, t)
+		reopened, err := library.GetBookByID(book.ID)
+		assert.NoError(t, err)
+		if !reopened.Created.Equal(book.Created) || !reopened.Updated.Equal(book.Updated) ||
+			!reopened.Files["file1.json"].Added.Equal(book.Created) || !reopened.Files["file2.json"].Added.Equal(book.Updated) {
+			t.Fatalf("Expected timestamps of %v after reopening but found %v", book, reopened)
+		}
+	}
+}
+
+func TestFileDetailsAreKeptWhenTheLibraryIsReopened(t *testing.T) {
+	library := newLibraryInTempFolder(t)
+	book, _ := library.Add(aBook("book1", "mr writer", 2016, nil), noImage, fileReaders(map[string][]byte{"fixes.pdf": []byte("%PDF-1.4")}))
+	assert.NoError(t, library.SetFileRole(book.ID, "fixes.pdf", RoleErrata))
+
+	// once replayed from the journal and then again from the index
+	for i := 0; i < 2; i++ {
+		library = reopenLibrary(library, t)
+		reopened, err := library.GetBookByID(book.ID)
+		assert.NoError(t, err)
+		file := reopened.Files["fixes.pdf"]
+		if file.Size != 8 || file.MimeType != PdfMimeType || file.Role != RoleErrata {
+			t.Fatalf("Expected the size, type and role of the file after reopening but found %+v", file)
+		}
+	}
+}
+
+func TestFilesInJournalEntriesWithoutDetailsAreReadFromDisk(t *testing.T) {
+	library := newLibraryInTempFolder(t)
+	assert.NoError(t, library.Close())
+	writeBookFolder(library.BaseDir, "1", "a.pdf")
+	appendToFile(library.fileForJournal(), `{"Op":"add","ID":1,"Book":{"Title":"Book1"},"Files":["a.pdf"]}`+"\n", t)
+
+	reopened := reopenLibrary(library, t)
+	book, err := reopened.GetBookByID(1)
+	assert.NoError(t, err)
+	file := book.Files["a.pdf"]
+	if file == nil || file.Size != 5 || file.MimeType != PdfMimeType || file.Role != RoleEbook {
+		t.Fatalf("Expected the details of a.pdf to be read from disk but found %+v", file)
+	}
+}
+
 func TestReturnsAnErrorTryingToDeleteAFileWhichDoesNotExist(t *testing.T) {
 	library := newLibraryInTempFolder(t)
-	book, _ := library.Add(aBook("book1", "mr writer", 2016, []string{"tag1"}), noImage, make(map[string][]byte))
+	book, _ := library.Add(aBook("book1", "mr writer", 2016, []string{"tag1"}), noImage, fileReaders(make(map[string][]byte)))
 
-	err := library.DeleteFileFromBook("a_file_which_is_not_there", book.ID)
+	err := library.DeleteFileFromBook(book.ID, "a_file_which_is_not_there")
 	if err == nil {
 		t.Fatal("No error was returned trying to delete a nonexistent file")
 	}
@@ -158,12 +236,875 @@ func TestReturnsAnErrorTryingToDeleteAFileWhichDoesNotExist(t *testing.T) {
 
 func TestReturnsAnErrorTryingToDeleteAFileFromABookWhichDoesNotExist(t *testing.T) {
 	library := newLibraryInTempFolder(t)
-	err := library.DeleteFileFromBook("a_file_which_is_not_there", 123)
+	err := library.DeleteFileFromBook(123, "a_file_which_is_not_there")
 	if err == nil {
 		t.Fatal("No error was returned trying to delete a nonexistent file")
 	}
 }
 
+func TestABooksDetailsCanBeUpdated(t *testing.T) {
+	library := newLibraryInTempFolder(t)
+	bookFiles := map[string][]byte{"file1.json": aJsonFile()}
+	book, _ := library.Add(aBook("Bok1", "mr writer", 2016, []string{"tag1"}), noImage, fileReaders(bookFiles))
+
+	updatedDetails := aBook("Book1", "mr writer", 2015, []string{"tag1", "tag2"})
+	_, err := library.UpdateBook(book.ID, updatedDetails)
+	assert.NoError(t, err)
+
+	for _, lib := range []*FileLibrary{library, reopenLibrary(library, t)} {
+		updatedBook, err := lib.GetBookByID(book.ID)
+		assert.NoError(t, err)
+		if !updatedBook.Equals(updatedDetails) {
+			t.Fatalf("Expected updated details %v but found %v", updatedDetails, updatedBook.BookDetails)
+		}
+		if _, found := updatedBook.Files["file1.json"]; !found {
+			t.Fatalf("Expected files to be unchanged by update but found %v", updatedBook.Files)
+		}
+	}
+}
+
+func TestUpdatingABookWhichDoesNotExistReturnsBookNotFound(t *testing.T) {
+	library := newLibraryInTempFolder(t)
+	_, err := library.UpdateBook(123, aBook("Book1", "mr writer", 2016, nil))
+	if err != BookNotFound {
+		t.Fatalf("Expected BookNotFound but got %v", err)
+	}
+}
+
+func TestADeletedBookIsMovedToTheTrash(t *testing.T) {
+	library := newLibraryInTempFolder(t)
+	bookFiles := map[string][]byte{"file1.json": aJsonFile()}
+	book, _ := library.Add(aBook("Book1", "mr writer", 2016, []string{"tag1"}), noImage, fileReaders(bookFiles))
+
+	err := library.DeleteBook(book.ID)
+	assert.NoError(t, err)
+
+	for _, lib := range []*FileLibrary{library, reopenLibrary(library, t)} {
+		if _, err := lib.GetBookByID(book.ID); err != BookNotFound {
+			t.Fatalf("Expected deleted book to no longer be in the library but got %v", err)
+		}
+		trash := lib.GetTrash()
+		if len(trash) != 1 || !trash[0].Equals(book.BookDetails) {
+			t.Fatalf("Expected deleted book in the trash but found %v", trash)
+		}
+		if _, found := trash[0].Files["file1.json"]; !found {
+			t.Fatalf("Expected deleted book's files in the trash but found %v", trash[0].Files)
+		}
+	}
+	if _, err := os.Stat(library.folderForBook(book.ID)); !os.IsNotExist(err) {
+		t.Fatalf("Expected book folder to be moved to the trash")
+	}
+}
+
+func TestABookCanBeRestoredFromTheTrash(t *testing.T) {
+	library := newLibraryInTempFolder(t)
+	bookFiles := map[string][]byte{"file1.json": aJsonFile()}
+	book, _ := library.Add(aBook("Book1", "mr writer", 2016, []string{"tag1"}), noImage, fileReaders(bookFiles))
+	assert.NoError(t, library.DeleteBook(book.ID))
+
+	_, err := library.RestoreBook(book.ID)
+	assert.NoError(t, err)
+
+	for _, lib := range []*FileLibrary{library, reopenLibrary(library, t)} {
+		restoredBook, err := lib.GetBookByID(book.ID)
+		assert.NoError(t, err)
+		if !reflect.DeepEqual(restoredBook.Files, book.Files) {
+			t.Fatalf("Expected restored files %v but found %v", book.Files, restoredBook.Files)
+		}
+		if len(lib.GetTrash()) != 0 {
+			t.Fatalf("Expected trash to be empty but found %v", lib.GetTrash())
+		}
+	}
+}
+
+func TestABookCanBePurgedFromTheTrash(t *testing.T) {
+	library := newLibraryInTempFolder(t)
+	book, _ := library.Add(aBook("Book1", "mr writer", 2016, []string{"tag1"}), noImage, emptyFileMap())
+	assert.NoError(t, library.DeleteBook(book.ID))
+
+	err := library.PurgeBook(book.ID)
+	assert.NoError(t, err)
+
+	for _, lib := range []*FileLibrary{library, reopenLibrary(library, t)} {
+		if len(lib.GetTrash()) != 0 || len(lib.GetAll()) != 0 {
+			t.Fatalf("Expected purged book to be gone but found %v and %v in trash", lib.GetAll(), lib.GetTrash())
+		}
+	}
+	if _, err := os.Stat(filepath.Join(library.BaseDir, relativeTrashFolderForBook(book.ID))); !os.IsNotExist(err) {
+		t.Fatalf("Expected book folder to be removed from the trash")
+	}
+}
+
+func TestOnlyBooksInTheTrashCanBeRestoredOrPurged(t *testing.T) {
+	library := newLibraryInTempFolder(t)
+	book, _ := library.Add(aBook("Book1", "mr writer", 2016, []string{"tag1"}), noImage, emptyFileMap())
+
+	if _, err := library.RestoreBook(book.ID); err != BookNotFound {
+		t.Fatalf("Expected BookNotFound restoring a book not in the trash but got %v", err)
+	}
+	if err := library.PurgeBook(book.ID); err != BookNotFound {
+		t.Fatalf("Expected BookNotFound purging a book not in the trash but got %v", err)
+	}
+	if err := library.DeleteBook(123); err != BookNotFound {
+		t.Fatalf("Expected BookNotFound deleting a book which does not exist but got %v", err)
+	}
+}
+
+func TestIdsOfBooksInTheTrashAreNotReused(t *testing.T) {
+	library := newLibraryInTempFolder(t)
+	book, _ := library.Add(aBook("Book1", "mr writer", 2016, []string{"tag1"}), noImage, emptyFileMap())
+	assert.NoError(t, library.DeleteBook(book.ID))
+	assert.NoError(t, library.SaveIndexToDisk())
+
+	newBook, err := reopenLibrary(library, t).Add(aBook("Book2", "mrs writer", 2015, nil), noImage, emptyFileMap())
+	assert.NoError(t, err)
+	if newBook.ID == book.ID {
+		t.Fatalf("New book was given the id %d of a book in the trash", book.ID)
+	}
+}
+
+func TestTrashOperationsAreRecoveredFromTheJournal(t *testing.T) {
+	library := newLibraryInTempFolder(t)
+	bookFiles := map[string][]byte{"file1.json": aJsonFile()}
+	purged, _ := library.Add(aBook("Book1", "mr writer", 2016, nil), noImage, fileReaders(bookFiles))
+	restored, _ := library.Add(aBook("Book2", "mrs writer", 2015, nil), noImage, fileReaders(bookFiles))
+	trashed, _ := library.Add(aBook("Book3", "mr writer", 2014, nil), noImage, fileReaders(bookFiles))
+	assert.NoError(t, library.DeleteBook(purged.ID))
+	assert.NoError(t, library.PurgeBook(purged.ID))
+	assert.NoError(t, library.DeleteBook(restored.ID))
+	_, err := library.RestoreBook(restored.ID)
+	assert.NoError(t, err)
+	assert.NoError(t, library.DeleteBook(trashed.ID))
+
+	// the first library is never closed, as if the process was killed
+	reopened := reopenLibrary(library, t)
+
+	assertSameBooks(library, reopened, t)
+	book, err := reopened.GetBookByID(restored.ID)
+	assert.NoError(t, err)
+	if _, found := book.Files["file1.json"]; !found {
+		t.Fatalf("Expected restored book's files but found %v", book.Files)
+	}
+	trash := reopened.GetTrash()
+	if len(trash) != 1 || trash[0].ID != trashed.ID {
+		t.Fatalf("Expected only book %d in the trash but found %v", trashed.ID, trash)
+	}
+}
+
+func TestBooksMovedToOrFromTheTrashJustBeforeACrashAreRecovered(t *testing.T) {
+	library := newLibraryInTempFolder(t)
+	trashed, _ := library.Add(aBook("Book1", "mr writer", 2016, nil), noImage, fileReaders(map[string][]byte{"a.json": []byte("first")}))
+	restored, _ := library.Add(aBook("Book2", "mrs writer", 2015, nil), noImage, fileReaders(map[string][]byte{"b.json": []byte("second")}))
+	assert.NoError(t, library.DeleteBook(restored.ID))
+	assert.NoError(t, library.SaveIndexToDisk())
+	assert.NoError(t, library.DeleteBook(trashed.ID))
+	_, err := library.RestoreBook(restored.ID)
+	assert.NoError(t, err)
+	// killed after the index was written but before the trash index was,
+	// leaving one book in neither and the other in both
+	assert.NoError(t, writeIndexFile(library.fileForIndex(), library.indexToJsonMap()))
+
+	reopened := reopenLibrary(library, t)
+	assertSameBooks(library, reopened, t)
+	trash := reopened.GetTrash()
+	if len(trash) != 1 || trash[0].ID != trashed.ID || trash[0].Files["a.json"] == nil {
+		t.Fatalf("Expected only book %d in the trash with its file but found %v", trashed.ID, trash)
+	}
+	assertNoProblems(reopened, t)
+
+	assert.NoError(t, reopened.PurgeBook(trashed.ID))
+	assertBlobs(reopened, 1, t)
+	assert.NoError(t, reopened.DeleteBook(restored.ID))
+	assert.NoError(t, reopened.PurgeBook(restored.ID))
+	assertBlobs(reopened, 0, t)
+}
+
+func TestABookCanBeAddedWithACoverImage(t *testing.T) {
+	library := newLibraryInTempFolder(t)
+	book, err := library.Add(aBook("Book1", "mr writer", 2016, nil), aPngImage(t), emptyFileMap())
+	assert.NoError(t, err)
+
+	for _, lib := range []*FileLibrary{library, reopenLibrary(library, t)} {
+		book, err = lib.GetBookByID(book.ID)
+		assert.NoError(t, err)
+		if filepath.Ext(book.Image) != ".png" {
+			t.Fatalf("Expected a png cover but image was '%s'", book.Image)
+		}
+		assertFileContents(filepath.Join(lib.BaseDir, book.Image), aPngImage(t), t)
+	}
+}
+
+func TestACoverCanBeReplacedWithAnImageOfADifferentType(t *testing.T) {
+	library := newLibraryInTempFolder(t)
+	book, _ := library.Add(aBook("Book1", "mr writer", 2016, nil), aPngImage(t), emptyFileMap())
+	oldImage := filepath.Join(library.BaseDir, book.Image)
+
+	updatedBook, err := library.SetBookImage(book.ID, aJpegImage(t))
+	assert.NoError(t, err)
+
+	if filepath.Ext(updatedBook.Image) != ".jpg" {
+		t.Fatalf("Expected a jpeg cover but image was '%s'", updatedBook.Image)
+	}
+	assertFileContents(filepath.Join(library.BaseDir, updatedBook.Image), aJpegImage(t), t)
+	if _, err := os.Stat(oldImage); !os.IsNotExist(err) {
+		t.Fatalf("Expected the old cover %s to be deleted", oldImage)
+	}
+	reopenedBook, _ := reopenLibrary(library, t).GetBookByID(book.ID)
+	if reopenedBook.Image != updatedBook.Image {
+		t.Fatalf("Expected image '%s' after reopening but was '%s'", updatedBook.Image, reopenedBook.Image)
+	}
+}
+
+func TestACoverCanBeRemoved(t *testing.T) {
+	library := newLibraryInTempFolder(t)
+	book, _ := library.Add(aBook("Book1", "mr writer", 2016, nil), aPngImage(t), emptyFileMap())
+
+	err := library.RemoveBookImage(book.ID)
+	assert.NoError(t, err)
+
+	for _, lib := range []*FileLibrary{library, reopenLibrary(library, t)} {
+		updatedBook, _ := lib.GetBookByID(book.ID)
+		if updatedBook.Image != "" {
+			t.Fatalf("Expected no cover but image was '%s'", updatedBook.Image)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(library.BaseDir, book.Image)); !os.IsNotExist(err) {
+		t.Fatalf("Expected the cover %s to be deleted", book.Image)
+	}
+}
+
+func TestImagesWhichAreNotJpegPngOrGifAreRejected(t *testing.T) {
+	library := newLibraryInTempFolder(t)
+	_, err := library.Add(aBook("Book1", "mr writer", 2016, nil), aJsonFile(), emptyFileMap())
+	if err != UnsupportedImageType {
+		t.Fatalf("Expected UnsupportedImageType adding a book but got %v", err)
+	}
+
+	book, _ := library.Add(aBook("Book1", "mr writer", 2016, nil), noImage, emptyFileMap())
+	_, err = library.SetBookImage(book.ID, aJsonFile())
+	if err != UnsupportedImageType {
+		t.Fatalf("Expected UnsupportedImageType setting a cover but got %v", err)
+	}
+}
+
+func TestTheCoverMovesWithABookToTheTrash(t *testing.T) {
+	library := newLibraryInTempFolder(t)
+	book, _ := library.Add(aBook("Book1", "mr writer", 2016, nil), aPngImage(t), emptyFileMap())
+	assert.NoError(t, library.DeleteBook(book.ID))
+
+	trashedBook := library.GetTrash()[0]
+	assertFileContents(filepath.Join(library.BaseDir, trashedBook.Image), aPngImage(t), t)
+
+	restoredBook, err := library.RestoreBook(book.ID)
+	assert.NoError(t, err)
+	if restoredBook.Image != book.Image {
+		t.Fatalf("Expected restored image '%s' but was '%s'", book.Image, restoredBook.Image)
+	}
+}
+
+func TestThumbnailsAreGeneratedForCovers(t *testing.T) {
+	library := newLibraryInTempFolder(t)
+	book, _ := library.Add(aBook("Book1", "mr writer", 2016, nil), aPngImage(t), emptyFileMap())
+
+	for _, size := range ThumbnailSizes {
+		thumbnail, err := library.OpenThumbnail(book.ID, size.Name)
+		assert.NoError(t, err)
+		assertContentMatchesFile(thumbnail, library.fileForThumbnail(book.ID, size.Name), t)
+	}
+}
+
+func TestThumbnailsAreReplacedWhenTheCoverChanges(t *testing.T) {
+	library := newLibraryInTempFolder(t)
+	book, _ := library.Add(aBook("Book1", "mr writer", 2016, nil), aPngImage(t), emptyFileMap())
+	thumbnailFile := library.fileForThumbnail(book.ID, SmallThumbnail.Name)
+	oldThumbnail, _ := ioutil.ReadFile(thumbnailFile)
+
+	buf := &bytes.Buffer{}
+	assert.NoError(t, png.Encode(buf, image.NewRGBA(image.Rect(0, 0, 40, 30))))
+	_, err := library.SetBookImage(book.ID, buf.Bytes())
+	assert.NoError(t, err)
+
+	newThumbnail, err := ioutil.ReadFile(thumbnailFile)
+	assert.NoError(t, err)
+	if bytes.Equal(oldThumbnail, newThumbnail) {
+		t.Fatal("Expected thumbnail to be regenerated for the new cover")
+	}
+
+	assert.NoError(t, library.RemoveBookImage(book.ID))
+	if _, err := library.OpenThumbnail(book.ID, SmallThumbnail.Name); err != BookHasNoImage {
+		t.Fatalf("Expected BookHasNoImage after removing the cover but got %v", err)
+	}
+	if _, err := os.Stat(library.folderForThumbnails(book.ID)); !os.IsNotExist(err) {
+		t.Fatal("Expected thumbnails to be deleted with the cover")
+	}
+}
+
+func TestTheCoverIsUsedWhenAThumbnailIsMissing(t *testing.T) {
+	library := newLibraryInTempFolder(t)
+	book, _ := library.Add(aBook("Book1", "mr writer", 2016, nil), aPngImage(t), emptyFileMap())
+	assert.NoError(t, os.RemoveAll(library.folderForThumbnails(book.ID)))
+
+	thumbnail, err := library.OpenThumbnail(book.ID, SmallThumbnail.Name)
+	assert.NoError(t, err)
+	assertContentMatchesFile(thumbnail, filepath.Join(library.BaseDir, book.Image), t)
+}
+
+func TestBookFilesAndCoversCanBeOpened(t *testing.T) {
+	library := newLibraryInTempFolder(t)
+	bookFiles := map[string][]byte{"file1.json": aJsonFile()}
+	book, _ := library.Add(aBook("Book1", "mr writer", 2016, nil), aPngImage(t), fileReaders(bookFiles))
+
+	file, err := library.OpenBookFile(book.ID, "file1.json")
+	assert.NoError(t, err)
+	assertContentMatchesFile(file, library.blobs().pathTo(book.Files["file1.json"].Checksum), t)
+
+	image, err := library.OpenBookImage(book.ID)
+	assert.NoError(t, err)
+	assertContentMatchesFile(image, filepath.Join(library.BaseDir, book.Image), t)
+
+	if _, err := library.OpenBookFile(book.ID, "missing.json"); err != FileNotFound {
+		t.Fatalf("Expected FileNotFound opening a missing file but got %v", err)
+	}
+	if _, err := library.OpenBookFile(123, "file1.json"); err != BookNotFound {
+		t.Fatalf("Expected BookNotFound opening a file of a missing book but got %v", err)
+	}
+}
+
+func TestRebuildThumbnailsRegeneratesMissingThumbnails(t *testing.T) {
+	library := newLibraryInTempFolder(t)
+	book, _ := library.Add(aBook("Book1", "mr writer", 2016, nil), aPngImage(t), emptyFileMap())
+	library.Add(aBook("Book2", "mrs writer", 2015, nil), noImage, emptyFileMap())
+	assert.NoError(t, os.RemoveAll(library.folderForThumbnails(book.ID)))
+
+	err := library.RebuildThumbnails()
+	assert.NoError(t, err)
+
+	for _, size := range ThumbnailSizes {
+		if _, err := os.Stat(library.fileForThumbnail(book.ID, size.Name)); err != nil {
+			t.Fatalf("Expected %s thumbnail to be rebuilt but got %v", size.Name, err)
+		}
+	}
+}
+
+func TestConcurrentAddsAreAssignedUniqueIds(t *testing.T) {
+	library := newLibraryInTempFolder(t)
+	numBooks := 50
+
+	ids := make(chan int, numBooks)
+	var wg sync.WaitGroup
+	for i := 0; i < numBooks; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			title := fmt.Sprintf("Book%d", i)
+			book, err := library.Add(aBook(title, "mr writer", 2016, []string{"tag1"}), noImage, emptyFileMap())
+			if err != nil {
+				t.Errorf("Error adding book %s: %v", title, err)
+				return
+			}
+			ids <- book.ID
+		}(i)
+	}
+	wg.Wait()
+	close(ids)
+
+	seen := make(map[int]bool)
+	for id := range ids {
+		if seen[id] {
+			t.Fatalf("Two books cannot have the same id. id=%v", id)
+		}
+		seen[id] = true
+	}
+	if len(library.GetAll()) != numBooks {
+		t.Fatalf("Expected %d books but found %d", numBooks, len(library.GetAll()))
+	}
+}
+
+func TestConcurrentReadsAndWritesOfBookFiles(t *testing.T) {
+	library := newLibraryInTempFolder(t)
+	book, err := library.Add(aBook("book1", "mr writer", 2016, []string{"tag1"}), noImage, emptyFileMap())
+	assert.NoError(t, err)
+
+	numWriters := 20
+	var wg sync.WaitGroup
+	for i := 0; i < numWriters; i++ {
+		wg.Add(3)
+		fileName := fmt.Sprintf("file%d.json", i)
+		go func() {
+			defer wg.Done()
+			if err := library.AddFileToBook(book.ID, fileName, bytes.NewReader(aJsonFile())); err != nil {
+				t.Errorf("Error adding file %s: %v", fileName, err)
+			}
+			if err := library.DeleteFileFromBook(book.ID, fileName); err != nil {
+				t.Errorf("Error deleting file %s: %v", fileName, err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for _, b := range library.GetAll() {
+				for range b.Files {
+				}
+			}
+			if b, err := library.GetBookByID(book.ID); err == nil {
+				for range b.Files {
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if err := library.SaveIndexToDisk(); err != nil {
+				t.Errorf("Error saving index: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	book, err = library.GetBookByID(book.ID)
+	assert.NoError(t, err)
+	if len(book.Files) != 0 {
+		t.Fatalf("Expected all files to be deleted but found %v", book.Files)
+	}
+}
+
+func TestBooksReturnedByTheLibraryAreCopies(t *testing.T) {
+	library := newLibraryInTempFolder(t)
+	book, _ := library.Add(aBook("book1", "mr writer", 2016, []string{"tag1"}), noImage, emptyFileMap())
+
+	book.Files["not_really_added.json"] = &BookFile{Path: "somewhere"}
+
+	book, err := library.GetBookByID(book.ID)
+	assert.NoError(t, err)
+	if len(book.Files) != 0 {
+		t.Fatalf("Changes to a returned book should not affect the library, found files %v", book.Files)
+	}
+}
+
+func TestBooksAddedBeforeACrashAreRecoveredFromTheJournal(t *testing.T) {
+	library := newLibraryInTempFolder(t)
+	library.Add(aBook("Book1", "mr writer", 2016, []string{"tag1"}), noImage, emptyFileMap())
+	library.Add(aBook("Book2", "mrs writer", 2015, []string{"tag2"}), noImage, emptyFileMap())
+
+	// the first library is never closed, as if the process was killed
+	reopened := reopenLibrary(library, t)
+
+	assertSameBooks(library, reopened, t)
+	indexOnDisk, err := reopened.readIndexFile(reopened.fileForIndex(), relativeFolderForBook)
+	assert.NoError(t, err)
+	if len(indexOnDisk.Books) != 2 {
+		t.Fatalf("Expected replayed books to be written to the index but found %v", indexOnDisk.Books)
+	}
+}
+
+func TestAnIncompleteJournalEntryIsIgnoredOnStartup(t *testing.T) {
+	library := newLibraryInTempFolder(t)
+	library.Add(aBook("Book1", "mr writer", 2016, []string{"tag1"}), noImage, emptyFileMap())
+	appendToFile(library.fileForJournal(), `{"Op":"add","ID":2,"Bo`, t)
+
+	reopened := reopenLibrary(library, t)
+	assertSameBooks(library, reopened, t)
+
+	// new entries must not be appended onto the incomplete one
+	book, err := reopened.Add(aBook("Book2", "mrs writer", 2015, []string{"tag2"}), noImage, emptyFileMap())
+	assert.NoError(t, err)
+	if book.ID != 2 {
+		t.Fatalf("Expected new book to have id 2 but was %d", book.ID)
+	}
+	assertSameBooks(reopened, reopenLibrary(reopened, t), t)
+}
+
+func TestAnInterruptedIndexWriteLeavesThePreviousIndexIntact(t *testing.T) {
+	library := newLibraryInTempFolder(t)
+	library.Add(aBook("Book1", "mr writer", 2016, []string{"tag1"}), noImage, emptyFileMap())
+	assert.NoError(t, library.SaveIndexToDisk())
+
+	// a temp file half way through being written when the process died
+	tmpFile := library.fileForIndex() + tmpFileSuffix + "123456"
+	err := ioutil.WriteFile(tmpFile, []byte(`{"1": {"Title": "Bo`), 0700)
+	assert.NoError(t, err)
+
+	reopened := reopenLibrary(library, t)
+	assertSameBooks(library, reopened, t)
+	if _, err := os.Stat(tmpFile); !os.IsNotExist(err) {
+		t.Fatalf("Expected temp file %s to be removed on startup", tmpFile)
+	}
+}
+
+func TestReplayingAJournalWhichIsAlreadyInTheIndexIsHarmless(t *testing.T) {
+	library := newLibraryInTempFolder(t)
+	library.Add(aBook("Book1", "mr writer", 2016, []string{"tag1"}), noImage, emptyFileMap())
+	library.Add(aBook("Book2", "mrs writer", 2015, []string{"tag2"}), noImage, emptyFileMap())
+
+	// killed after the index was written but before the journal was truncated
+	journalContents, err := ioutil.ReadFile(library.fileForJournal())
+	assert.NoError(t, err)
+	assert.NoError(t, library.SaveIndexToDisk())
+	appendToFile(library.fileForJournal(), string(journalContents), t)
+
+	reopened := reopenLibrary(library, t)
+	assertSameBooks(library, reopened, t)
+	book, err := reopened.Add(aBook("Book3", "mr writer", 2014, []string{"tag3"}), noImage, emptyFileMap())
+	assert.NoError(t, err)
+	if book.ID != 3 {
+		t.Fatalf("Expected new book to have id 3 but was %d", book.ID)
+	}
+}
+
+func TestFilesLeftByAnUncommittedAddAreNotPickedUpByTheNextBook(t *testing.T) {
+	library := newLibraryInTempFolder(t)
+	library.Add(aBook("Book1", "mr writer", 2016, []string{"tag1"}), noImage, emptyFileMap())
+
+	// killed after writing the files for book 2 but before committing it
+	strayFile := filepath.Join(library.folderForBook(2), "files", "stray.json")
+	assert.NoError(t, os.MkdirAll(filepath.Dir(strayFile), 0700))
+	assert.NoError(t, ioutil.WriteFile(strayFile, aJsonFile(), 0700))
+
+	reopened := reopenLibrary(library, t)
+	if len(reopened.GetAll()) != 1 {
+		t.Fatalf("Expected only the committed book but found %d books", len(reopened.GetAll()))
+	}
+	book, err := reopened.Add(aBook("Book2", "mrs writer", 2015, []string{"tag2"}), noImage, emptyFileMap())
+	assert.NoError(t, err)
+	if len(book.Files) != 0 {
+		t.Fatalf("Expected new book to have no files but found %v", book.Files)
+	}
+}
+
+func TestTheJournalIsCheckpointedIntoTheIndex(t *testing.T) {
+	library := newLibraryInTempFolder(t)
+	for i := 0; i < journalCheckpointInterval; i++ {
+		library.Add(aBook("Book", "mr writer", 2016, []string{"tag1"}), noImage, emptyFileMap())
+	}
+
+	indexOnDisk, err := library.readIndexFile(library.fileForIndex(), relativeFolderForBook)
+	assert.NoError(t, err)
+	if len(indexOnDisk.Books) != journalCheckpointInterval {
+		t.Fatalf("Expected %d books in the index file but found %d", journalCheckpointInterval, len(indexOnDisk.Books))
+	}
+	entries, err := readJournal(library.fileForJournal())
+	assert.NoError(t, err)
+	if len(entries) != 0 {
+		t.Fatalf("Expected journal to be truncated but found %d entries", len(entries))
+	}
+}
+
+func TestIdenticalFilesAreStoredOnce(t *testing.T) {
+	library := newLibraryInTempFolder(t)
+	book1, _ := library.Add(aBook("Book1", "mr writer", 2016, nil), noImage, fileReaders(map[string][]byte{"a.json": aJsonFile()}))
+	book2, _ := library.Add(aBook("Book2", "mr writer", 2016, nil), noImage, fileReaders(map[string][]byte{"b.json": aJsonFile()}))
+	assert.NoError(t, library.AddFileToBook(book1.ID, "c.json", bytes.NewReader(aJsonFile())))
+
+	if book1.Files["a.json"].Path != book2.Files["b.json"].Path {
+		t.Fatalf("Expected identical files to share a blob but found %s and %s",
+			book1.Files["a.json"].Path, book2.Files["b.json"].Path)
+	}
+	assertBlobs(library, 1, t)
+	if library.blobRefs[book1.Files["a.json"].Checksum] != 3 {
+		t.Fatalf("Expected the blob to be referenced by 3 files but found %v", library.blobRefs)
+	}
+}
+
+func TestABlobIsDeletedWithTheLastFileReferringToIt(t *testing.T) {
+	library := newLibraryInTempFolder(t)
+	book1, _ := library.Add(aBook("Book1", "mr writer", 2016, nil), noImage, fileReaders(map[string][]byte{"a.json": aJsonFile()}))
+	book2, _ := library.Add(aBook("Book2", "mr writer", 2016, nil), noImage, fileReaders(map[string][]byte{"b.json": aJsonFile()}))
+	blob := library.blobs().pathTo(book1.Files["a.json"].Checksum)
+
+	assert.NoError(t, library.DeleteFileFromBook(book1.ID, "a.json"))
+	assertFileContents(blob, aJsonFile(), t)
+
+	assert.NoError(t, library.DeleteBook(book2.ID))
+	assertFileContents(blob, aJsonFile(), t)
+
+	assert.NoError(t, library.PurgeBook(book2.ID))
+	if _, err := os.Stat(blob); !os.IsNotExist(err) {
+		t.Fatalf("Expected the blob to be deleted once no file refers to it but got %v", err)
+	}
+}
+
+func TestReplacingAFileWithIdenticalContentsKeepsItsBlob(t *testing.T) {
+	library := newLibraryInTempFolder(t)
+	book, _ := library.Add(aBook("Book1", "mr writer", 2016, nil), noImage, fileReaders(map[string][]byte{"a.json": aJsonFile()}))
+	assert.NoError(t, library.AddFileToBook(book.ID, "a.json", bytes.NewReader(aJsonFile())))
+
+	assertFileContents(library.blobs().pathTo(book.Files["a.json"].Checksum), aJsonFile(), t)
+	reopened := reopenLibrary(library, t)
+	assertSameBooks(library, reopened, t)
+	assertBlobs(reopened, 1, t)
+}
+
+func TestBlobsReleasedBeforeACrashAreKeptUntilGarbageIsCollected(t *testing.T) {
+	library := newLibraryInTempFolder(t)
+	book, _ := library.Add(aBook("Book1", "mr writer", 2016, nil), noImage, fileReaders(map[string][]byte{"a.json": []byte("first")}))
+	assert.NoError(t, library.SaveIndexToDisk())
+	assert.NoError(t, library.AddFileToBook(book.ID, "a.json", bytes.NewReader([]byte("second"))))
+	// killed before the replaced blob was deleted
+	writeBlob(library, []byte("first"), t)
+
+	reopened := reopenLibrary(library, t)
+	recovered, err := reopened.GetBookByID(book.ID)
+	assert.NoError(t, err)
+	assertFileContents(filepath.Join(reopened.BaseDir, recovered.Files["a.json"].Path), []byte("second"), t)
+	assertBlobs(reopened, 2, t)
+
+	removed, err := reopened.CollectGarbage()
+	assert.NoError(t, err)
+	if removed != 1 {
+		t.Fatalf("Expected the released blob to be deleted but %d were", removed)
+	}
+	assertBlobs(reopened, 1, t)
+}
+
+func TestCollectGarbageDeletesUnreferencedBlobs(t *testing.T) {
+	library := newLibraryInTempFolder(t)
+	book, _ := library.Add(aBook("Book1", "mr writer", 2016, nil), noImage, fileReaders(map[string][]byte{"a.json": aJsonFile()}))
+	// left by an add which never committed
+	stray := writeBlob(library, []byte("stray"), t)
+
+	removed, err := library.CollectGarbage()
+	assert.NoError(t, err)
+	if removed != 1 || library.blobs().exists(stray) {
+		t.Fatalf("Expected only the stray blob to be deleted but %d were", removed)
+	}
+	assertFileContents(library.blobs().pathTo(book.Files["a.json"].Checksum), aJsonFile(), t)
+}
+
+func TestFilesInTheFilesFolderOfABookFromAnOlderJournalAreMovedIntoTheBlobStore(t *testing.T) {
+	library := newLibraryInTempFolder(t)
+	writeBookFolder(library.BaseDir, "1", "a.pdf")
+	appendToFile(library.fileForJournal(), `{"Op":"add","ID":1,"Book":{"Title":"Book1"},"Files":["a.pdf"]}`+"\n", t)
+
+	reopened := reopenLibrary(library, t)
+	book, err := reopened.GetBookByID(1)
+	assert.NoError(t, err)
+	file := book.Files["a.pdf"]
+	if file.Checksum != aPdfChecksum || file.Path != relativePathToBlob(aPdfChecksum) {
+		t.Fatalf("Expected a.pdf to be moved into the blob store but found %+v", file)
+	}
+	assertFileContents(filepath.Join(reopened.BaseDir, file.Path), []byte("a.pdf"), t)
+	if _, err := os.Stat(filepath.Join(reopened.BaseDir, "1", "files")); !os.IsNotExist(err) {
+		t.Fatalf("Expected the empty files folder to be removed but got %v", err)
+	}
+}
+
+func TestAFailedUploadLeavesNoTempFiles(t *testing.T) {
+	library := newLibraryInTempFolder(t)
+	book, _ := library.Add(aBook("Book1", "mr writer", 2016, nil), noImage, emptyFileMap())
+
+	if err := library.AddFileToBook(book.ID, "file.txt", anUploadWhichFails()); err != errUploadFailed {
+		t.Fatalf("Expected the upload's error but got %v", err)
+	}
+	if err := library.AddFileToBook(123, "file.txt", bytes.NewReader(aJsonFile())); err != BookNotFound {
+		t.Fatalf("Expected BookNotFound adding a file to a missing book but got %v", err)
+	}
+	files, err := ioutil.ReadDir(filepath.Join(library.BaseDir, BlobsDirName, blobTempDirName))
+	assert.NoError(t, err)
+	if len(files) != 0 {
+		t.Fatalf("Expected no temp files but found %d", len(files))
+	}
+}
+
+func TestALibraryCannotBeOpenedTwiceUntilItIsClosed(t *testing.T) {
+	library := newLibraryInTempFolder(t)
+	if _, err := NewFileLibrary(library.BaseDir); err == nil {
+		t.Fatal("Expected opening a library which is already open to fail")
+	}
+	assert.NoError(t, library.Close())
+
+	reopened, err := NewFileLibrary(library.BaseDir)
+	assert.NoError(t, err, "Expected a closed library to be opened again")
+	assert.NoError(t, reopened.Close())
+}
+
+func TestUploadsInterruptedByACrashAreRemovedWhenTheLibraryIsOpened(t *testing.T) {
+	library := newLibraryInTempFolder(t)
+	tempFile, err := library.blobs().createTemp()
+	assert.NoError(t, err)
+	tempFile.Close()
+
+	reopenLibrary(library, t)
+	if _, err := os.Stat(tempFile.Name()); !os.IsNotExist(err) {
+		t.Fatalf("Expected the temp file to be removed but got %v", err)
+	}
+}
+
+func TestAddingALargeFileDoesNotHoldItInMemory(t *testing.T) {
+	const size = 32 << 20
+	library := newLibraryInTempFolder(t)
+
+	before, after := &runtime.MemStats{}, &runtime.MemStats{}
+	runtime.ReadMemStats(before)
+	book, err := library.Add(aBook("Book1", "mr writer", 2016, nil), noImage, map[string]io.Reader{"course.mp4": aLargeFile(size)})
+	runtime.ReadMemStats(after)
+
+	assert.NoError(t, err)
+	if book.Files["course.mp4"].Size != size {
+		t.Fatalf("Expected a file of %d bytes but found %+v", size, book.Files["course.mp4"])
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > size/8 {
+		t.Fatalf("Expected adding a %d byte file to allocate far less than its size but allocated %d bytes", size, allocated)
+	}
+}
+
+// The bytes allocated per op should stay flat as the size of the file grows
+func BenchmarkAddingLargeFiles(b *testing.B) {
+	for _, size := range []int64{1 << 20, 16 << 20, 128 << 20} {
+		b.Run(fmt.Sprintf("%dMB", size>>20), func(b *testing.B) {
+			library, err := NewFileLibrary(testutils.CreateTempDir(b))
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ReportAllocs()
+			b.SetBytes(size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				files := map[string]io.Reader{"course.mp4": aLargeFile(size)}
+				if _, err := library.Add(aBook("Book1", "mr writer", 2016, nil), noImage, files); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// Uploading a pdf reads its metadata and indexes its text, the bytes
+// allocated per op should stop growing once the pdf is too large for its
+// text to be indexed
+func BenchmarkAddingLargePdfs(b *testing.B) {
+	for _, size := range []int64{1 << 20, 16 << 20, 128 << 20} {
+		b.Run(fmt.Sprintf("%dMB", size>>20), func(b *testing.B) {
+			dir := testutils.CreateTempDir(b)
+			fileLibrary, err := NewFileLibrary(dir)
+			if err != nil {
+				b.Fatal(err)
+			}
+			library := aSearchableLibrary(fileLibrary)
+			upload, err := ioutil.TempFile(dir, "upload")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer upload.Close()
+			pdf := aPdfWithObjects("trailer << /Info 1 0 R >>", "<< /Title (Book1) >>")
+			if _, err = io.Copy(upload, io.MultiReader(bytes.NewReader(pdf), aLargeFile(size-int64(len(pdf))))); err != nil {
+				b.Fatal(err)
+			}
+
+			b.ReportAllocs()
+			b.SetBytes(size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				metadata := ExtractMetadata(map[string]io.ReadSeeker{"book.pdf": upload})
+				if metadata.Title != "Book1" {
+					b.Fatalf("Expected the title of the pdf but found %+v", metadata.BookDetails)
+				}
+				if _, err := library.Add(metadata.BookDetails, noImage, map[string]io.Reader{"book.pdf": upload}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// aLargeFile returns the content of a file of the given size without
+// holding it in memory
+func aLargeFile(size int64) io.Reader {
+	return io.LimitReader(repeatingReader('x'), size)
+}
+
+// A reader of the same byte over and over
+type repeatingReader byte
+
+func (b repeatingReader) Read(data []byte) (int, error) {
+	for i := range data {
+		data[i] = byte(b)
+	}
+	return len(data), nil
+}
+
+// reopenLibrary opens a second library on the same directory, the original
+// is left open as if the process had been killed and only its lock, which
+// the OS would release, is dropped
+func reopenLibrary(library *FileLibrary, t *testing.T) *FileLibrary {
+	library.lock.Close()
+	reopened, err := NewFileLibrary(library.BaseDir)
+	if err != nil {
+		t.Fatalf("Error reopening library %v", err)
+	}
+	return reopened
+}
+
+func assertSameBooks(expected, actual Library, t *testing.T) {
+	expectedBooks := expected.GetAll()
+	actualBooks := actual.GetAll()
+	if len(expectedBooks) != len(actualBooks) {
+		t.Fatalf("Expected %d books but found %d", len(expectedBooks), len(actualBooks))
+	}
+	for _, expectedBook := range expectedBooks {
+		actualBook, err := actual.GetBookByID(expectedBook.ID)
+		if err != nil {
+			t.Fatalf("Missing book with id=%d", expectedBook.ID)
+		}
+		if !actualBook.Equals(expectedBook.BookDetails) {
+			t.Fatalf("Book %v does not match expected %v", actualBook.BookDetails, expectedBook.BookDetails)
+		}
+	}
+}
+
+func appendToFile(path string, data string, t *testing.T) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0700)
+	assert.NoError(t, err)
+	defer file.Close()
+	_, err = file.WriteString(data)
+	assert.NoError(t, err)
+}
+
+// writeBlob stores the data in the library's blob store without any file
+// referring to it and returns its checksum
+func writeBlob(library *FileLibrary, data []byte, t *testing.T) string {
+	file, tempFile, err := library.stageBookFile("blob", bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.NoError(t, library.blobs().adopt(tempFile, file.Checksum))
+	return file.Checksum
+}
+
+// assertBlobs checks the library's blob store holds the expected number
+// of files
+func assertBlobs(library *FileLibrary, expected int, t *testing.T) {
+	blobs, err := library.blobs().files()
+	assert.NoError(t, err)
+	if len(blobs) != expected {
+		t.Fatalf("Expected %d blobs but found %v", expected, blobs)
+	}
+}
+
+// assertContentMatchesFile reads and closes the content and checks it is
+// the same as the file at path
+func assertContentMatchesFile(content FileContent, path string, t *testing.T) {
+	defer content.Close()
+	data, err := ioutil.ReadAll(content)
+	assert.NoError(t, err)
+	assertFileContents(path, data, t)
+}
+
+func assertFileContents(path string, expected []byte, t *testing.T) {
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	if !bytes.Equal(data, expected) {
+		t.Fatalf("File %s does not contain the expected data", path)
+	}
+}
+
+func aPngImage(t *testing.T) []byte {
+	buf := &bytes.Buffer{}
+	assert.NoError(t, png.Encode(buf, image.NewRGBA(image.Rect(0, 0, 20, 30))))
+	return buf.Bytes()
+}
+
+func aJpegImage(t *testing.T) []byte {
+	buf := &bytes.Buffer{}
+	assert.NoError(t, jpeg.Encode(buf, image.NewRGBA(image.Rect(0, 0, 20, 30)), nil))
+	return buf.Bytes()
+}
+
 func aJsonFile() []byte {
 	someData := make(map[string]string)
 	someData["key1"] = "value1"
@@ -172,8 +1113,18 @@ func aJsonFile() []byte {
 	return data
 }
 
-func emptyFileMap() map[string][]byte {
-	return make(map[string][]byte)
+func emptyFileMap() map[string]io.Reader {
+	return make(map[string]io.Reader)
+}
+
+// fileReaders returns readers of the contents of each file for adding them
+// to a library
+func fileReaders(files map[string][]byte) map[string]io.Reader {
+	readers := make(map[string]io.Reader, len(files))
+	for fileName, data := range files {
+		readers[fileName] = bytes.NewReader(data)
+	}
+	return readers
 }
 
 func aBook(name string, author string, year int, tags []string) *BookDetails {
@@ -189,7 +1140,7 @@ func newLibraryInTempFolder(t *testing.T) *FileLibrary {
 	folder := testutils.CreateTempDir(t)
 	library, err := NewFileLibrary(folder)
 	if err != nil {
-		t.Fatalf("Error creating library", err)
+		t.Fatalf("Error creating library %v", err)
 	}
 
 	return library
@@ -0,0 +1,455 @@
+package ebooks
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// Folder under the base directory of a file library where repairing it
+// moves anything found on disk which the index does not account for, so
+// that it can be inspected before it is deleted
+const LostAndFoundDirName = "lost+found"
+
+var CheckNotSupported = errors.New("The library's backend does not support checking")
+
+// A library whose index can be checked against the files it stores on disk
+type CheckableLibrary interface {
+	// Check returns every inconsistency between the index and the files
+	// on disk, repairing those it can if repair is true
+	Check(repair bool) (*CheckReport, error)
+}
+
+// A kind of inconsistency between a library's index and its files on disk
+type ProblemKind string
+
+const (
+	// The folder of a book in the index does not exist
+	MissingFolder ProblemKind = "missing folder"
+
+	// A cover or file recorded in the index does not exist
+	MissingFile ProblemKind = "missing file"
+
+	// A folder named like a book's which no book in the index has
+	OrphanFolder ProblemKind = "orphan folder"
+
+	// A file which is not recorded in the index
+	UnindexedFile ProblemKind = "unindexed file"
+
+	// A file whose contents do not match the checksum recorded for it
+	ChecksumMismatch ProblemKind = "checksum mismatch"
+
+	// A file recorded in the index which exists but cannot be read
+	UnreadableFile ProblemKind = "unreadable file"
+)
+
+// An inconsistency found by checking a library
+type Problem struct {
+	Kind ProblemKind
+
+	// Where the problem is, relative to the base directory of the library
+	Path string
+
+	// Id of the book the problem affects or 0 if it affects no book
+	BookID int
+
+	// What is wrong
+	Description string
+
+	// What repairing the library does about it, or an empty string if
+	// it cannot be repaired
+	Fix string
+
+	// Whether the problem was repaired by the check
+	Repaired bool
+}
+
+// The problems found by checking a library ordered by path
+type CheckReport struct {
+	Problems []*Problem
+
+	// Whether the check repaired the problems it found
+	Repair bool
+}
+
+// Unrepaired returns the number of problems found which were not repaired
+func (report *CheckReport) Unrepaired() int {
+	unrepaired := 0
+	for _, problem := range report.Problems {
+		if !problem.Repaired {
+			unrepaired++
+		}
+	}
+	return unrepaired
+}
+
+var _ CheckableLibrary = &FileLibrary{}
+
+// Check compares the index and trash index with the book folders and blob
+// store and returns every inconsistency. If repair is true, missing folders
+// and metadata files are recreated, records of missing covers and files
+// are removed, the contents of corrupt files are moved to the lost+found
+// folder along with anything not recorded in the index and the records of
+// the corrupt files are removed. Files which cannot be read are only
+// reported.
+// Every stored file is read to verify its checksum before the library is
+// locked, as blobs never change once written, and only a repair takes the
+// write lock.
+func (lib *FileLibrary) Check(repair bool) (*CheckReport, error) {
+	checker := &libraryChecker{lib: lib, report: &CheckReport{Repair: repair}, checksums: make(map[string]string)}
+	checker.checksumBlobs()
+	if repair {
+		lib.mutex.Lock()
+		defer lib.mutex.Unlock()
+	} else {
+		lib.mutex.RLock()
+		defer lib.mutex.RUnlock()
+	}
+
+	if err := checker.checkBooks(lib.index, relativeFolderForBook); err != nil {
+		return nil, err
+	}
+	if err := checker.checkBooks(lib.trash, relativeTrashFolderForBook); err != nil {
+		return nil, err
+	}
+	if err := checker.checkForOrphanFolders("", lib.index); err != nil {
+		return nil, err
+	}
+	if err := checker.checkForOrphanFolders(TrashDirName, lib.trash); err != nil {
+		return nil, err
+	}
+	if err := checker.checkBlobs(); err != nil {
+		return nil, err
+	}
+
+	if checker.indexChanged {
+		if err := lib.saveIndexToDisk(); err != nil {
+			return nil, err
+		}
+		for _, books := range []map[int]*Ebook{lib.index, lib.trash} {
+			for id := range books {
+				lib.saveBookMetadataOrLog(id)
+			}
+		}
+	}
+	sort.Sort(byPathThenKind(checker.report.Problems))
+	return checker.report, nil
+}
+
+// The state of a check of a file library, the library's read lock is held
+// while checking and its write lock while repairing
+type libraryChecker struct {
+	lib    *FileLibrary
+	report *CheckReport
+
+	// Checksums of the files read so far by path, as blobs are shared.
+	// Blobs are read before the library is locked.
+	checksums map[string]string
+
+	// Whether a repair changed the in-memory index, which is then written
+	// to disk in full
+	indexChanged bool
+}
+
+// found records a problem and, when repairing, repairs it with fix. A
+// failed repair is recorded against the problem rather than failing the
+// check.
+func (checker *libraryChecker) found(problem *Problem, fix func() error) {
+	checker.report.Problems = append(checker.report.Problems, problem)
+	if !checker.report.Repair || fix == nil {
+		return
+	}
+	if err := fix(); err != nil {
+		problem.Fix += fmt.Sprintf(" (failed: %v)", err)
+		return
+	}
+	problem.Repaired = true
+}
+
+// checkBooks checks the folder, cover and files of each of the books,
+// whose folders are given by bookFolder
+func (checker *libraryChecker) checkBooks(books map[int]*Ebook, bookFolder func(int) string) error {
+	lib := checker.lib
+	for _, id := range sortedBookIDs(books) {
+		book := books[id]
+		folder := bookFolder(id)
+		if !bookFolderExists(filepath.Join(lib.BaseDir, folder)) {
+			checker.found(&Problem{Kind: MissingFolder, Path: folder, BookID: id,
+				Description: fmt.Sprintf("The folder of book %d does not exist", id),
+				Fix:         "Create an empty folder"},
+				func() error { return mkDirs(filepath.Join(lib.BaseDir, folder)) })
+		}
+
+		metadataFile := filepath.Join(folder, BookMetadataFileName)
+		if !fileExists(filepath.Join(lib.BaseDir, metadataFile)) {
+			checker.found(&Problem{Kind: MissingFile, Path: metadataFile, BookID: id,
+				Description: fmt.Sprintf("The metadata file of book %d does not exist, the book is lost if the index is", id),
+				Fix:         "Write the metadata file from the index"},
+				func() error { return lib.saveBookMetadata(id) })
+		}
+
+		if book.Image != "" && !fileExists(filepath.Join(lib.BaseDir, book.Image)) {
+			checker.found(&Problem{Kind: MissingFile, Path: book.Image, BookID: id,
+				Description: fmt.Sprintf("The cover of book %d does not exist", id),
+				Fix:         "Remove the cover from the book"},
+				func() error {
+					book.Image = ""
+					checker.indexChanged = true
+					return os.RemoveAll(filepath.Join(lib.BaseDir, folder, thumbnailsDirName))
+				})
+		}
+
+		for _, fileName := range sortedFileNames(book.Files) {
+			if err := checker.checkFile(book, fileName); err != nil {
+				return err
+			}
+		}
+
+		if err := checker.checkBookFolder(book, folder); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkFile checks the file of the book with the given name exists and
+// matches its checksum
+func (checker *libraryChecker) checkFile(book *Ebook, fileName string) error {
+	lib := checker.lib
+	file := book.Files[fileName]
+	if file == nil {
+		// removed by repairing another file sharing its contents
+		return nil
+	}
+	if !fileExists(filepath.Join(lib.BaseDir, file.Path)) {
+		checker.found(&Problem{Kind: MissingFile, Path: file.Path, BookID: book.ID,
+			Description: fmt.Sprintf("The contents of file %s of book %d do not exist", fileName, book.ID),
+			Fix:         "Remove the file from the book"},
+			func() error {
+				delete(book.Files, fileName)
+				lib.releaseFile(file)
+				checker.indexChanged = true
+				return nil
+			})
+		return nil
+	}
+	if file.Checksum == "" {
+		// left in the book's files folder as it was unreadable when the
+		// library was upgraded
+		return nil
+	}
+
+	actual, err := checker.checksumOf(file.Path)
+	if err != nil {
+		checker.found(&Problem{Kind: UnreadableFile, Path: file.Path, BookID: book.ID,
+			Description: fmt.Sprintf("The contents of file %s of book %d cannot be read: %v", fileName, book.ID, err)}, nil)
+		return nil
+	}
+	if actual != file.Checksum {
+		checker.found(&Problem{Kind: ChecksumMismatch, Path: file.Path, BookID: book.ID,
+			Description: fmt.Sprintf("The contents of file %s of book %d do not match its checksum, they are corrupt",
+				fileName, book.ID),
+			Fix: "Move the contents to " + LostAndFoundDirName + " and remove the file from every book sharing them"},
+			func() error { return checker.removeCorruptBlob(file.Checksum) })
+	}
+	return nil
+}
+
+// removeCorruptBlob moves the blob stored under the checksum, whose
+// contents no longer match it, to the lost+found folder and removes every
+// file referring to it from its book
+func (checker *libraryChecker) removeCorruptBlob(checksum string) error {
+	lib := checker.lib
+	if err := lib.moveToLostAndFound(relativePathToBlob(checksum)); err != nil {
+		return err
+	}
+	for _, books := range []map[int]*Ebook{lib.index, lib.trash} {
+		for _, book := range books {
+			for fileName, file := range book.Files {
+				if file.Checksum == checksum {
+					delete(book.Files, fileName)
+					lib.releaseFile(file)
+				}
+			}
+		}
+	}
+	checker.indexChanged = true
+	return nil
+}
+
+// checkBookFolder checks the book's folder holds nothing but its cover,
+// thumbnails and any files left in its files folder by older versions of
+// the library
+func (checker *libraryChecker) checkBookFolder(book *Ebook, folder string) error {
+	expected := map[string]bool{filepath.Join(folder, BookMetadataFileName): true}
+	if book.Image != "" {
+		expected[filepath.Join(folder, filepath.Base(book.Image))] = true
+	}
+	for _, file := range book.Files {
+		if file.Checksum == "" {
+			expected[filepath.Join(folder, "files")] = true
+			expected[file.Path] = true
+		}
+	}
+
+	var checkFolder func(path string) error
+	checkFolder = func(path string) error {
+		entries, err := ioutil.ReadDir(filepath.Join(checker.lib.BaseDir, path))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			entryPath := filepath.Join(path, entry.Name())
+			switch {
+			case entryPath == filepath.Join(folder, thumbnailsDirName):
+				// thumbnails are a cache which is rebuilt from the cover
+			case expected[entryPath] && entry.IsDir():
+				if err = checkFolder(entryPath); err != nil {
+					return err
+				}
+			case !expected[entryPath]:
+				checker.foundUnindexedFile(entryPath, book.ID)
+			}
+		}
+		return nil
+	}
+	return checkFolder(folder)
+}
+
+// checkForOrphanFolders checks every folder named like a book's id in the
+// given folder, relative to the base directory, belongs to one of the
+// books. Anything else in the folder is left alone.
+func (checker *libraryChecker) checkForOrphanFolders(folder string, books map[int]*Ebook) error {
+	entries, err := ioutil.ReadDir(filepath.Join(checker.lib.BaseDir, folder))
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		id, err := strconv.Atoi(entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+		if _, found := books[id]; found {
+			continue
+		}
+		path := filepath.Join(folder, entry.Name())
+		checker.found(&Problem{Kind: OrphanFolder, Path: path,
+			Description: fmt.Sprintf("The folder is named like that of book %d but there is no such book", id),
+			Fix:         "Move the folder to " + LostAndFoundDirName},
+			func() error { return checker.lib.moveToLostAndFound(path) })
+	}
+	return nil
+}
+
+// checkBlobs checks every blob in the blob store is referred to by a file
+// of a book in the library or its trash
+func (checker *libraryChecker) checkBlobs() error {
+	paths, err := checker.lib.blobs().files()
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		checksum := filepath.Base(path)
+		relativePath := filepath.Join(BlobsDirName, path)
+		if len(checksum) > 2 && relativePathToBlob(checksum) == relativePath && checker.lib.blobRefs[checksum] > 0 {
+			continue
+		}
+		checker.foundUnindexedFile(relativePath, 0)
+	}
+	return nil
+}
+
+func (checker *libraryChecker) foundUnindexedFile(path string, bookID int) {
+	checker.found(&Problem{Kind: UnindexedFile, Path: path, BookID: bookID,
+		Description: "No book in the index refers to this file",
+		Fix:         "Move the file to " + LostAndFoundDirName},
+		func() error { return checker.lib.moveToLostAndFound(path) })
+}
+
+// checksumBlobs reads every blob which a file in the library or its trash
+// refers to, without holding the library's lock while reading them.
+// Blobs which cannot be read are read again by checkFile to report them.
+func (checker *libraryChecker) checksumBlobs() {
+	lib := checker.lib
+	lib.mutex.RLock()
+	paths := []string{}
+	for checksum := range lib.blobRefs {
+		paths = append(paths, relativePathToBlob(checksum))
+	}
+	lib.mutex.RUnlock()
+
+	for _, path := range paths {
+		if checksum, err := checksumOfFile(filepath.Join(lib.BaseDir, path)); err == nil {
+			checker.checksums[path] = checksum
+		}
+	}
+}
+
+// checksumOf returns the checksum of the file at the given path relative
+// to the base directory, reading each file only once
+func (checker *libraryChecker) checksumOf(path string) (string, error) {
+	if checksum, found := checker.checksums[path]; found {
+		return checksum, nil
+	}
+	checksum, err := checksumOfFile(filepath.Join(checker.lib.BaseDir, path))
+	if err != nil {
+		return "", err
+	}
+	checker.checksums[path] = checksum
+	return checksum, nil
+}
+
+// moveToLostAndFound moves the file or folder at the given path relative
+// to the base directory to the same path under the lost+found folder, with
+// a numbered suffix if something has already been moved there
+func (lib *FileLibrary) moveToLostAndFound(path string) error {
+	dest := filepath.Join(lib.BaseDir, LostAndFoundDirName, path)
+	for suffix := 1; fileExists(dest); suffix++ {
+		dest = filepath.Join(lib.BaseDir, LostAndFoundDirName, path+"."+strconv.Itoa(suffix))
+	}
+	if err := mkDirs(filepath.Dir(dest)); err != nil {
+		return err
+	}
+	return os.Rename(filepath.Join(lib.BaseDir, path), dest)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func sortedBookIDs(books map[int]*Ebook) []int {
+	ids := make([]int, 0, len(books))
+	for id := range books {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+func sortedFileNames(files map[string]*BookFile) []string {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type byPathThenKind []*Problem
+
+func (problems byPathThenKind) Len() int      { return len(problems) }
+func (problems byPathThenKind) Swap(i, j int) { problems[i], problems[j] = problems[j], problems[i] }
+func (problems byPathThenKind) Less(i, j int) bool {
+	if problems[i].Path != problems[j].Path {
+		return problems[i].Path < problems[j].Path
+	}
+	return problems[i].Kind < problems[j].Kind
+}
@@ -0,0 +1,268 @@
+package ebooks
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stephenhenderson/ebooklib/lib/testutils/assert"
+)
+
+func TestCheckFindsNoProblemsInAConsistentLibrary(t *testing.T) {
+	library := newLibraryInTempFolder(t)
+	files := fileReaders(map[string][]byte{"book.pdf": []byte("%PDF"), "code.zip": []byte("code")})
+	book, err := library.Add(aBook("Go in Action", "mr writer", 2016, nil), aPngImage(t), files)
+	assert.NoError(t, err)
+	trashed, err := library.Add(aBook("Go Again", "mr writer", 2016, nil), aPngImage(t), fileReaders(map[string][]byte{"copy.pdf": []byte("%PDF")}))
+	assert.NoError(t, err)
+	assert.NoError(t, library.DeleteBook(trashed.ID))
+	assert.NoError(t, library.DeleteFileFromBook(book.ID, "code.zip"))
+
+	report, err := library.Check(false)
+	assert.NoError(t, err)
+	assertProblems(report, map[string]ProblemKind{}, t)
+}
+
+func TestCheckLeavesFilesItDoesNotOwnInTheBaseDirectoryAlone(t *testing.T) {
+	library := newLibraryInTempFolder(t)
+	writeTestFile(filepath.Join(library.BaseDir, "notes.txt"), "notes")
+	os.Mkdir(filepath.Join(library.BaseDir, "backups"), 0700)
+	writeTestFile(filepath.Join(library.BaseDir, IndexFileName+".v0"+indexBackupSuffix), "{}")
+
+	report, err := library.Check(true)
+	assert.NoError(t, err)
+	assertProblems(report, map[string]ProblemKind{}, t)
+	assertFileContents(filepath.Join(library.BaseDir, "notes.txt"), []byte("notes"), t)
+}
+
+func TestCheckRecreatesMissingBookFoldersAndMetadataFilesWhenRepairing(t *testing.T) {
+	library := newLibraryInTempFolder(t)
+	book, err := library.Add(aBook("Go in Action", "mr writer", 2016, nil), noImage, emptyFileMap())
+	assert.NoError(t, err)
+	assert.NoError(t, os.RemoveAll(library.folderForBook(book.ID)))
+
+	report, err := library.Check(false)
+	assert.NoError(t, err)
+	assertProblems(report, map[string]ProblemKind{"1": MissingFolder, "1/book.json": MissingFile}, t)
+	if report.Unrepaired() != 2 || fileExists(library.folderForBook(book.ID)) {
+		t.Fatalf("Expected checking without repairing to change nothing")
+	}
+
+	report, err = library.Check(true)
+	assert.NoError(t, err)
+	if report.Unrepaired() != 0 || !fileExists(library.folderForBook(book.ID)) {
+		t.Fatalf("Expected the folder to be recreated but found %v", report.Problems[0])
+	}
+	assertBookMetadataFile(library, book.ID, library.index[book.ID], t)
+	assertNoProblems(library, t)
+}
+
+func TestCheckRemovesMissingCoversWhenRepairing(t *testing.T) {
+	library := newLibraryInTempFolder(t)
+	book, err := library.Add(aBook("Go in Action", "mr writer", 2016, nil), aPngImage(t), emptyFileMap())
+	assert.NoError(t, err)
+	assert.NoError(t, os.Remove(filepath.Join(library.BaseDir, book.Image)))
+
+	report, err := library.Check(true)
+	assert.NoError(t, err)
+	assertProblems(report, map[string]ProblemKind{"1/cover.png": MissingFile}, t)
+	for _, lib := range []*FileLibrary{library, reopenLibrary(library, t)} {
+		if book, _ = lib.GetBookByID(book.ID); book.Image != "" {
+			t.Fatalf("Expected the missing cover to be removed from the book but was %s", book.Image)
+		}
+	}
+	if fileExists(library.folderForThumbnails(book.ID)) {
+		t.Fatalf("Expected the thumbnails of the missing cover to be removed")
+	}
+	assertNoProblems(library, t)
+}
+
+func TestCheckRemovesMissingFilesWhenRepairing(t *testing.T) {
+	library := newLibraryInTempFolder(t)
+	files := fileReaders(map[string][]byte{"book.pdf": []byte("%PDF"), "code.zip": []byte("code")})
+	book, err := library.Add(aBook("Go in Action", "mr writer", 2016, nil), noImage, files)
+	assert.NoError(t, err)
+	missing := book.Files["book.pdf"]
+	assert.NoError(t, os.Remove(filepath.Join(library.BaseDir, missing.Path)))
+
+	report, err := library.Check(true)
+	assert.NoError(t, err)
+	assertProblems(report, map[string]ProblemKind{missing.Path: MissingFile}, t)
+	for _, lib := range []*FileLibrary{library, reopenLibrary(library, t)} {
+		book, _ = lib.GetBookByID(book.ID)
+		if len(book.Files) != 1 || book.Files["code.zip"] == nil {
+			t.Fatalf("Expected only the missing file to be removed from the book but found %v", book.Files)
+		}
+	}
+	assertNoProblems(library, t)
+}
+
+func TestCheckMovesOrphanFoldersToLostAndFoundWhenRepairing(t *testing.T) {
+	library := newLibraryInTempFolder(t)
+	trashed, err := library.Add(aBook("Go in Action", "mr writer", 2016, nil), noImage, emptyFileMap())
+	assert.NoError(t, err)
+	assert.NoError(t, library.DeleteBook(trashed.ID))
+	// a copy of the trashed book's folder left behind in the library
+	writeBookFolder(library.BaseDir, "1", "a.pdf")
+	writeBookFolder(library.folderForTrash(), "7", "b.pdf")
+
+	report, err := library.Check(true)
+	assert.NoError(t, err)
+	assertProblems(report, map[string]ProblemKind{"1": OrphanFolder, "trash/7": OrphanFolder}, t)
+	assertFileContents(filepath.Join(library.BaseDir, LostAndFoundDirName, "1", "files", "a.pdf"), []byte("a.pdf"), t)
+	assertFileContents(filepath.Join(library.BaseDir, LostAndFoundDirName, "trash", "7", "files", "b.pdf"), []byte("b.pdf"), t)
+	if fileExists(library.folderForBook(1)) || !fileExists(filepath.Join(library.BaseDir, relativeTrashFolderForBook(1))) {
+		t.Fatalf("Expected only the orphan folders to be moved")
+	}
+	assertNoProblems(library, t)
+}
+
+func TestCheckMovesFilesNotInTheIndexToLostAndFoundWhenRepairing(t *testing.T) {
+	library := newLibraryInTempFolder(t)
+	book, err := library.Add(aBook("Go in Action", "mr writer", 2016, nil), aPngImage(t), fileReaders(map[string][]byte{"book.pdf": []byte("%PDF")}))
+	assert.NoError(t, err)
+	writeBookFolder(library.BaseDir, "1", "stray.pdf")
+	writeTestFile(filepath.Join(library.folderForBook(book.ID), "notes.txt"), "notes")
+	unreferenced := writeBlob(library, []byte("unreferenced"), t)
+
+	report, err := library.Check(true)
+	assert.NoError(t, err)
+	assertProblems(report, map[string]ProblemKind{
+		"1/files":                        UnindexedFile,
+		"1/notes.txt":                    UnindexedFile,
+		relativePathToBlob(unreferenced): UnindexedFile,
+	}, t)
+	lostAndFound := filepath.Join(library.BaseDir, LostAndFoundDirName)
+	assertFileContents(filepath.Join(lostAndFound, "1", "files", "stray.pdf"), []byte("stray.pdf"), t)
+	assertFileContents(filepath.Join(lostAndFound, "1", "notes.txt"), []byte("notes"), t)
+	assertFileContents(filepath.Join(lostAndFound, relativePathToBlob(unreferenced)), []byte("unreferenced"), t)
+	assertNoProblems(library, t)
+}
+
+func TestCheckKeepsFilesLeftInTheFilesFolderByOlderVersions(t *testing.T) {
+	library := newLibraryInTempFolder(t)
+	writeBookFolder(library.BaseDir, "1", "unreadable.pdf")
+	book := &Ebook{ID: 1, Files: map[string]*BookFile{"unreadable.pdf": {Path: "1/files/unreadable.pdf"}}, BookDetails: aBook("Go", "mr writer", 2016, nil)}
+	library.index[book.ID] = book
+	assert.NoError(t, library.saveBookMetadata(book.ID))
+
+	report, err := library.Check(true)
+	assert.NoError(t, err)
+	assertProblems(report, map[string]ProblemKind{}, t)
+	assertFileContents(filepath.Join(library.BaseDir, "1", "files", "unreadable.pdf"), []byte("unreadable.pdf"), t)
+}
+
+func TestCheckMovesCorruptFilesToLostAndFoundWhenRepairing(t *testing.T) {
+	library := newLibraryInTempFolder(t)
+	original, err := library.Add(aBook("Go in Action", "mr writer", 2016, nil), noImage, fileReaders(map[string][]byte{"book.pdf": []byte("%PDF")}))
+	assert.NoError(t, err)
+	duplicate, err := library.Add(aBook("Go Again", "mr writer", 2016, nil), noImage, fileReaders(map[string][]byte{"copy.pdf": []byte("%PDF"), "code.zip": []byte("code")}))
+	assert.NoError(t, err)
+	blob := original.Files["book.pdf"].Path
+	writeTestFile(filepath.Join(library.BaseDir, blob), "corrupt")
+
+	report, err := library.Check(false)
+	assert.NoError(t, err)
+	if len(report.Problems) != 2 || report.Problems[0].Kind != ChecksumMismatch || report.Problems[1].Kind != ChecksumMismatch {
+		t.Fatalf("Expected both files sharing the corrupt blob to be reported but found %v", report.Problems)
+	}
+
+	report, err = library.Check(true)
+	assert.NoError(t, err)
+	assertProblems(report, map[string]ProblemKind{blob: ChecksumMismatch}, t)
+	assertFileContents(filepath.Join(library.BaseDir, LostAndFoundDirName, blob), []byte("corrupt"), t)
+	for _, lib := range []*FileLibrary{library, reopenLibrary(library, t)} {
+		book, _ := lib.GetBookByID(original.ID)
+		if len(book.Files) != 0 {
+			t.Fatalf("Expected the corrupt file to be removed from the book but found %v", book.Files)
+		}
+		book, _ = lib.GetBookByID(duplicate.ID)
+		if len(book.Files) != 1 || book.Files["code.zip"] == nil {
+			t.Fatalf("Expected only the corrupt file to be removed from the book sharing it but found %v", book.Files)
+		}
+	}
+	assertBlobs(library, 1, t)
+	assertNoProblems(library, t)
+}
+
+func TestCheckReportsFilesWhichCannotBeReadAndCarriesOn(t *testing.T) {
+	library := newLibraryInTempFolder(t)
+	book, err := library.Add(aBook("Go in Action", "mr writer", 2016, nil), noImage, fileReaders(map[string][]byte{"book.pdf": []byte("%PDF")}))
+	assert.NoError(t, err)
+	// a folder where the blob should be can be stat'ed but not read
+	blob := book.Files["book.pdf"].Path
+	assert.NoError(t, os.Remove(filepath.Join(library.BaseDir, blob)))
+	assert.NoError(t, os.Mkdir(filepath.Join(library.BaseDir, blob), 0700))
+	writeBookFolder(library.BaseDir, "7")
+
+	report, err := library.Check(true)
+	assert.NoError(t, err)
+	if len(report.Problems) != 2 || report.Problems[0].Kind != OrphanFolder || report.Problems[1].Kind != UnreadableFile {
+		t.Fatalf("Expected the unreadable file to be reported along with the other problems but found %v", report.Problems)
+	}
+	if report.Problems[1].Repaired || report.Unrepaired() != 1 {
+		t.Fatalf("Expected the unreadable file to be left unrepaired but found %v", report.Problems[1])
+	}
+}
+
+func TestCheckingWithoutRepairingOnlyTakesTheReadLock(t *testing.T) {
+	library := newLibraryInTempFolder(t)
+	_, err := library.Add(aBook("Go in Action", "mr writer", 2016, nil), noImage, fileReaders(map[string][]byte{"book.pdf": []byte("%PDF")}))
+	assert.NoError(t, err)
+
+	// as if a reader were listing the library throughout the check
+	library.mutex.RLock()
+	defer library.mutex.RUnlock()
+	checked := make(chan error)
+	go func() {
+		_, err := library.Check(false)
+		checked <- err
+	}()
+	select {
+	case err = <-checked:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the check to run alongside readers of the library")
+	}
+}
+
+func TestMovingToLostAndFoundKeepsWhatWasMovedThereBefore(t *testing.T) {
+	library := newLibraryInTempFolder(t)
+	for _, contents := range []string{"first", "second"} {
+		writeTestFile(filepath.Join(library.BaseDir, "notes.txt"), contents)
+		assert.NoError(t, library.moveToLostAndFound("notes.txt"))
+	}
+
+	lostAndFound := filepath.Join(library.BaseDir, LostAndFoundDirName)
+	assertFileContents(filepath.Join(lostAndFound, "notes.txt"), []byte("first"), t)
+	assertFileContents(filepath.Join(lostAndFound, "notes.txt.1"), []byte("second"), t)
+}
+
+// assertProblems checks the report has exactly the expected problems, by
+// kind and path
+func assertProblems(report *CheckReport, expected map[string]ProblemKind, t *testing.T) {
+	found := make(map[string]ProblemKind)
+	for _, problem := range report.Problems {
+		found[problem.Path] = problem.Kind
+		if report.Repair && !problem.Repaired {
+			t.Fatalf("Expected %s at %s to be repaired: %s", problem.Kind, problem.Path, problem.Fix)
+		}
+	}
+	if len(report.Problems) != len(expected) {
+		t.Fatalf("Expected problems %v but found %v", expected, found)
+	}
+	for path, kind := range expected {
+		if found[path] != kind {
+			t.Fatalf("Expected problems %v but found %v", expected, found)
+		}
+	}
+}
+
+// assertNoProblems checks the library is consistent, e.g. after it has
+// been repaired
+func assertNoProblems(library *FileLibrary, t *testing.T) {
+	report, err := library.Check(false)
+	assert.NoError(t, err)
+	assertProblems(report, map[string]ProblemKind{}, t)
+}
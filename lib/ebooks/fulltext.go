@@ -0,0 +1,492 @@
+package ebooks
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	. "github.com/stephenhenderson/ebooklib/lib/logging"
+)
+
+const (
+	// Folder under the library's base directory holding its full-text index
+	FullTextDirName = "fulltext"
+
+	// Extension of the file holding the extracted text of each book
+	fullTextFileExt = ".json.gz"
+
+	// BM25 ranking parameters, how quickly repeats of a term stop adding to
+	// a book's score and how much long books are penalised
+	bm25K1 = 1.2
+	bm25B  = 0.75
+
+	// Characters of context either side of a match in a snippet
+	snippetContext = 80
+
+	// Most snippets shown for a single book, one per file
+	maxSnippetsPerBook = 3
+)
+
+// OpenFullTextIndex loads the full-text index stored in the given
+// directory, creating it if it does not exist. If dir is empty the index
+// is only held in memory.
+func OpenFullTextIndex(dir string) (*FullTextIndex, error) {
+	index := &FullTextIndex{
+		dir:      dir,
+		books:    make(map[int]*fullTextBook),
+		postings: make(map[string]map[int]int),
+	}
+	if dir == "" {
+		return index, nil
+	}
+	if err := mkDirs(dir); err != nil {
+		return nil, err
+	}
+	removeStaleTempFiles(dir, "*"+fullTextFileExt)
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasSuffix(name, fullTextFileExt) {
+			continue
+		}
+		id, err := strconv.Atoi(strings.TrimSuffix(name, fullTextFileExt))
+		if err != nil {
+			continue
+		}
+		book, err := readFullTextBook(filepath.Join(dir, name))
+		if err != nil {
+			// the book is indexed again when the library is next synced
+			Logger.Printf("Ignoring unreadable full-text index for book=%d: %v", id, err)
+			continue
+		}
+		index.addBook(id, book)
+	}
+	return index, nil
+}
+
+// An index of the text inside the files of each book, ranked with BM25.
+// The extracted text is stored so snippets can be shown for matches. All
+// methods are safe to call from multiple goroutines.
+type FullTextIndex struct {
+	// Directory the extracted text is stored in, empty if not persisted
+	dir string
+
+	// Guards books, postings and totalWords
+	mutex sync.RWMutex
+
+	// Every indexed book by id
+	books map[int]*fullTextBook
+
+	// Number of times each term appears in each book by term then book id
+	postings map[string]map[int]int
+
+	// Sum of the number of words in every book, for the average length
+	totalWords int
+}
+
+// The indexed text of a book
+type fullTextBook struct {
+	// Text extracted from each file of the book by file name
+	Files map[string]string
+
+	// Number of times each term appears in all files
+	terms map[string]int
+
+	// Number of words in all files
+	words int
+}
+
+// A book whose contents match a full-text search
+type FullTextMatch struct {
+	BookID   int
+	Score    float64
+	Snippets []Snippet
+}
+
+// An extract from a file around a match with the matching words marked
+type Snippet struct {
+	FileName string
+	Parts    []SnippetPart
+}
+
+type SnippetPart struct {
+	Text      string
+	Highlight bool
+}
+
+// IndexedFiles returns the names of the files indexed for the book, false
+// if the book has not been indexed
+func (index *FullTextIndex) IndexedFiles(id int) ([]string, bool) {
+	index.mutex.RLock()
+	defer index.mutex.RUnlock()
+
+	book, found := index.books[id]
+	if !found {
+		return nil, false
+	}
+	names := make([]string, 0, len(book.Files))
+	for name := range book.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, true
+}
+
+// IndexedBookIDs returns the ids of every indexed book
+func (index *FullTextIndex) IndexedBookIDs() []int {
+	index.mutex.RLock()
+	defer index.mutex.RUnlock()
+
+	ids := make([]int, 0, len(index.books))
+	for id := range index.books {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// IndexBook replaces the indexed text of the book with the given text of
+// each of its files by file name
+func (index *FullTextIndex) IndexBook(id int, texts map[string]string) error {
+	book := &fullTextBook{Files: make(map[string]string, len(texts))}
+	for name, text := range texts {
+		book.Files[name] = text
+	}
+
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	index.removeBook(id)
+	index.addBook(id, book)
+	return index.writeBook(id, book)
+}
+
+// SetFileText replaces the indexed text of a single file of the book
+func (index *FullTextIndex) SetFileText(id int, fileName, text string) error {
+	return index.changeFiles(id, func(files map[string]string) {
+		files[fileName] = text
+	})
+}
+
+// RemoveFile removes a file from the indexed text of the book
+func (index *FullTextIndex) RemoveFile(id int, fileName string) error {
+	return index.changeFiles(id, func(files map[string]string) {
+		delete(files, fileName)
+	})
+}
+
+// changeFiles applies the change to a copy of the book's indexed files and
+// reindexes the book with them
+func (index *FullTextIndex) changeFiles(id int, change func(files map[string]string)) error {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	files := make(map[string]string)
+	if book, found := index.books[id]; found {
+		for name, text := range book.Files {
+			files[name] = text
+		}
+	}
+	change(files)
+
+	book := &fullTextBook{Files: files}
+	index.removeBook(id)
+	index.addBook(id, book)
+	return index.writeBook(id, book)
+}
+
+// RemoveBook removes the book from the index
+func (index *FullTextIndex) RemoveBook(id int) error {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	index.removeBook(id)
+	if index.dir == "" {
+		return nil
+	}
+	err := os.Remove(index.fileForBook(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Search returns the books containing every word in the query, best
+// matches first, with a snippet from each file showing the first match
+func (index *FullTextIndex) Search(query string) []*FullTextMatch {
+	terms := uniqueTerms(tokenize(query))
+	if len(terms) == 0 {
+		return []*FullTextMatch{}
+	}
+
+	index.mutex.RLock()
+	defer index.mutex.RUnlock()
+
+	numBooks := float64(len(index.books))
+	avgWords := float64(index.totalWords) / math.Max(numBooks, 1)
+	scores := make(map[int]float64)
+	for i, term := range terms {
+		books := index.postings[term]
+		docFreq := float64(len(books))
+		idf := math.Log(1 + (numBooks-docFreq+0.5)/(docFreq+0.5))
+		for id, count := range books {
+			if _, found := scores[id]; !found && i > 0 {
+				continue
+			}
+			tf := float64(count)
+			norm := bm25K1 * (1 - bm25B + bm25B*float64(index.books[id].words)/math.Max(avgWords, 1))
+			scores[id] += idf * tf * (bm25K1 + 1) / (tf + norm)
+		}
+		// drop books which did not contain this term
+		for id := range scores {
+			if _, found := books[id]; !found {
+				delete(scores, id)
+			}
+		}
+	}
+
+	matches := make([]*FullTextMatch, 0, len(scores))
+	for id, score := range scores {
+		matches = append(matches, &FullTextMatch{id, score, index.snippets(id, terms)})
+	}
+	sort.Sort(byFullTextScore(matches))
+	return matches
+}
+
+// snippets returns a snippet from each of the book's files containing one
+// of the terms, callers must hold the read lock
+func (index *FullTextIndex) snippets(id int, terms []string) []Snippet {
+	book := index.books[id]
+	names := make([]string, 0, len(book.Files))
+	for name := range book.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	isTerm := make(map[string]bool, len(terms))
+	for _, term := range terms {
+		isTerm[term] = true
+	}
+
+	snippets := []Snippet{}
+	for _, name := range names {
+		if parts := snippet(book.Files[name], isTerm); parts != nil {
+			snippets = append(snippets, Snippet{name, parts})
+			if len(snippets) == maxSnippetsPerBook {
+				break
+			}
+		}
+	}
+	return snippets
+}
+
+// snippet returns the text around the first word which is one of the
+// terms split into parts with each matching word highlighted, nil if no
+// word matches
+func snippet(text string, isTerm map[string]bool) []SnippetPart {
+	words := wordOffsets(text)
+	first := -1
+	for i, word := range words {
+		if isTerm[strings.ToLower(text[word[0]:word[1]])] {
+			first = i
+			break
+		}
+	}
+	if first < 0 {
+		return nil
+	}
+
+	// expand to whole words around the match
+	start, end := words[first][0], words[first][1]
+	for i := first - 1; i >= 0 && words[first][0]-words[i][0] <= snippetContext; i-- {
+		start = words[i][0]
+	}
+	for i := first + 1; i < len(words) && words[i][1]-words[first][1] <= snippetContext; i++ {
+		end = words[i][1]
+	}
+
+	parts := []SnippetPart{}
+	if start > 0 {
+		parts = append(parts, SnippetPart{"…", false})
+	}
+	plainStart := start
+	for _, word := range words {
+		if word[0] < start || word[1] > end {
+			continue
+		}
+		if isTerm[strings.ToLower(text[word[0]:word[1]])] {
+			if word[0] > plainStart {
+				parts = append(parts, SnippetPart{collapseSpace(text[plainStart:word[0]]), false})
+			}
+			parts = append(parts, SnippetPart{text[word[0]:word[1]], true})
+			plainStart = word[1]
+		}
+	}
+	if end > plainStart {
+		parts = append(parts, SnippetPart{collapseSpace(text[plainStart:end]), false})
+	}
+	if end < len(text) {
+		parts = append(parts, SnippetPart{"…", false})
+	}
+	return parts
+}
+
+// wordOffsets returns the start and end byte offsets of each word in the
+// text, words are split the same way as by tokenize
+func wordOffsets(text string) [][2]int {
+	words := [][2]int{}
+	start := -1
+	for i, r := range text {
+		isWordRune := unicode.IsLetter(r) || unicode.IsDigit(r)
+		if isWordRune && start < 0 {
+			start = i
+		} else if !isWordRune && start >= 0 {
+			words = append(words, [2]int{start, i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		words = append(words, [2]int{start, len(text)})
+	}
+	return words
+}
+
+// collapseSpace replaces each run of white space with a single space
+func collapseSpace(text string) string {
+	collapsed := strings.Join(strings.Fields(text), " ")
+	if text != "" {
+		if first, _ := utf8.DecodeRuneInString(text); unicode.IsSpace(first) {
+			collapsed = " " + collapsed
+		}
+		if last, _ := utf8.DecodeLastRuneInString(text); unicode.IsSpace(last) && collapsed != " " {
+			collapsed += " "
+		}
+	}
+	return collapsed
+}
+
+// addBook adds the book's terms to the index, callers must hold the write
+// lock
+func (index *FullTextIndex) addBook(id int, book *fullTextBook) {
+	book.terms = make(map[string]int)
+	book.words = 0
+	for _, text := range book.Files {
+		for _, term := range tokenize(text) {
+			book.terms[term]++
+			book.words++
+		}
+	}
+	for term, count := range book.terms {
+		books, found := index.postings[term]
+		if !found {
+			books = make(map[int]int)
+			index.postings[term] = books
+		}
+		books[id] = count
+	}
+	index.books[id] = book
+	index.totalWords += book.words
+}
+
+// removeBook removes the book's terms from the index, callers must hold
+// the write lock
+func (index *FullTextIndex) removeBook(id int) {
+	book, found := index.books[id]
+	if !found {
+		return
+	}
+	for term := range book.terms {
+		delete(index.postings[term], id)
+		if len(index.postings[term]) == 0 {
+			delete(index.postings, term)
+		}
+	}
+	delete(index.books, id)
+	index.totalWords -= book.words
+}
+
+// writeBook stores the book's text if the index is persisted, callers
+// must hold the write lock
+func (index *FullTextIndex) writeBook(id int, book *fullTextBook) error {
+	if index.dir == "" {
+		return nil
+	}
+	data, err := json.Marshal(book)
+	if err != nil {
+		return err
+	}
+
+	compressed := &bytes.Buffer{}
+	writer := gzip.NewWriter(compressed)
+	if _, err = writer.Write(data); err != nil {
+		return err
+	}
+	if err = writer.Close(); err != nil {
+		return err
+	}
+	return writeFileAtomically(index.fileForBook(id), compressed.Bytes(), 0700)
+}
+
+func readFullTextBook(path string) (*fullTextBook, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	book := &fullTextBook{}
+	if err = json.NewDecoder(reader).Decode(book); err != nil {
+		return nil, err
+	}
+	if book.Files == nil {
+		book.Files = make(map[string]string)
+	}
+	return book, nil
+}
+
+func (index *FullTextIndex) fileForBook(id int) string {
+	return filepath.Join(index.dir, strconv.Itoa(id)+fullTextFileExt)
+}
+
+// uniqueTerms returns the terms without duplicates, keeping their order
+func uniqueTerms(terms []string) []string {
+	seen := make(map[string]bool)
+	unique := []string{}
+	for _, term := range terms {
+		if !seen[term] {
+			seen[term] = true
+			unique = append(unique, term)
+		}
+	}
+	return unique
+}
+
+// byFullTextScore orders matches highest score first, then by book id
+type byFullTextScore []*FullTextMatch
+
+func (matches byFullTextScore) Len() int      { return len(matches) }
+func (matches byFullTextScore) Swap(i, j int) { matches[i], matches[j] = matches[j], matches[i] }
+func (matches byFullTextScore) Less(i, j int) bool {
+	if matches[i].Score != matches[j].Score {
+		return matches[i].Score > matches[j].Score
+	}
+	return matches[i].BookID < matches[j].BookID
+}
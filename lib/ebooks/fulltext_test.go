@@ -0,0 +1,156 @@
+package ebooks
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stephenhenderson/ebooklib/lib/testutils"
+	"github.com/stephenhenderson/ebooklib/lib/testutils/assert"
+)
+
+func TestFullTextSearchFindsBooksContainingEveryWord(t *testing.T) {
+	index := anInMemoryFullTextIndex(t)
+	assert.NoError(t, index.IndexBook(1, map[string]string{"book.txt": "goroutines and channels"}))
+	assert.NoError(t, index.IndexBook(2, map[string]string{"book.txt": "goroutines and mutexes"}))
+
+	assertFullTextMatches(index, "Channels goroutines", []int{1}, t)
+	assertFullTextMatches(index, "chan", []int{}, t)
+	assertFullTextMatches(index, "", []int{}, t)
+}
+
+func TestFullTextSearchRanksBooksMentioningTheWordMoreOftenFirst(t *testing.T) {
+	index := anInMemoryFullTextIndex(t)
+	assert.NoError(t, index.IndexBook(1, map[string]string{"a.txt": "a channel sends values between goroutines"}))
+	assert.NoError(t, index.IndexBook(2, map[string]string{"b.txt": "channel channel channel, every chapter is about a channel"}))
+	assert.NoError(t, index.IndexBook(3, map[string]string{"c.txt": "nothing to see here"}))
+
+	assertFullTextMatches(index, "channel", []int{2, 1}, t)
+}
+
+func TestFullTextSearchHighlightsMatchesInSnippets(t *testing.T) {
+	index := anInMemoryFullTextIndex(t)
+	text := strings.Repeat("filler ", 50) + "call http.ListenAndServe to\n\n start   the server" + strings.Repeat(" filler", 50)
+	assert.NoError(t, index.IndexBook(1, map[string]string{"book.txt": text, "code.zip": ""}))
+
+	matches := index.Search("listenandserve server")
+	if len(matches) != 1 || len(matches[0].Snippets) != 1 {
+		t.Fatalf("Expected one match with one snippet but found %v", matches)
+	}
+	snippet := matches[0].Snippets[0]
+	if snippet.FileName != "book.txt" {
+		t.Fatalf("Expected snippet from book.txt but was from %s", snippet.FileName)
+	}
+
+	rendered := ""
+	for _, part := range snippet.Parts {
+		if part.Highlight {
+			rendered += "[" + part.Text + "]"
+		} else {
+			rendered += part.Text
+		}
+	}
+	if !strings.Contains(rendered, "call http.[ListenAndServe] to start the [server] filler") {
+		t.Fatalf("Expected matches to be highlighted but snippet was '%s'", rendered)
+	}
+	if !strings.HasPrefix(rendered, "…") || !strings.HasSuffix(rendered, "…") || len(rendered) > 3*snippetContext {
+		t.Fatalf("Expected snippet to be an extract from the text but was '%s'", rendered)
+	}
+}
+
+func TestFullTextIndexIsPersisted(t *testing.T) {
+	dir := testutils.CreateTempDir(t)
+	index, err := OpenFullTextIndex(dir)
+	assert.NoError(t, err)
+	assert.NoError(t, index.IndexBook(1, map[string]string{"book.txt": "goroutines"}))
+	assert.NoError(t, index.IndexBook(2, map[string]string{"book.txt": "channels"}))
+	assert.NoError(t, index.SetFileText(2, "notes.txt", "goroutines"))
+	assert.NoError(t, index.RemoveBook(1))
+
+	reopened, err := OpenFullTextIndex(dir)
+	assert.NoError(t, err)
+	assertFullTextMatches(reopened, "goroutines", []int{2}, t)
+	if files, _ := reopened.IndexedFiles(2); len(files) != 2 {
+		t.Fatalf("Expected both files of book 2 to be indexed but found %v", files)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "1"+fullTextFileExt)); !os.IsNotExist(err) {
+		t.Fatal("Expected index file for removed book to be deleted")
+	}
+}
+
+func TestSearchableLibraryKeepsTheFullTextIndexUpToDate(t *testing.T) {
+	library := aSearchableLibrary(NewMemoryLibrary())
+	book, _ := library.Add(aBook("Book1", "mr writer", 2016, nil), noImage, fileReaders(map[string][]byte{"a.txt": []byte("goroutines")}))
+	assertContentMatches(library, "goroutines", []int{book.ID}, t)
+
+	assert.NoError(t, library.AddFileToBook(book.ID, "b.txt", bytes.NewReader([]byte("channels"))))
+	assertContentMatches(library, "channels", []int{book.ID}, t)
+
+	assert.NoError(t, library.DeleteFileFromBook(book.ID, "a.txt"))
+	assertContentMatches(library, "goroutines", []int{}, t)
+
+	assert.NoError(t, library.DeleteBook(book.ID))
+	assertContentMatches(library, "channels", []int{}, t)
+
+	_, err := library.RestoreBook(book.ID)
+	assert.NoError(t, err)
+	assertContentMatches(library, "channels", []int{book.ID}, t)
+}
+
+func TestSearchableLibraryIndexesContentsChangedWhileTheIndexWasClosed(t *testing.T) {
+	fileLibrary := newLibraryInTempFolder(t)
+	indexed, _ := fileLibrary.Add(aBook("Book1", "mr writer", 2016, nil), noImage, fileReaders(map[string][]byte{"a.txt": []byte("goroutines")}))
+	deleted, _ := fileLibrary.Add(aBook("Book2", "mr writer", 2016, nil), noImage, fileReaders(map[string][]byte{"a.txt": []byte("goroutines")}))
+	fullText, err := OpenFullTextIndex(filepath.Join(fileLibrary.BaseDir, FullTextDirName))
+	assert.NoError(t, err)
+	NewSearchableLibrary(fileLibrary, fullText)
+
+	// changes made without the searchable library
+	assert.NoError(t, fileLibrary.AddFileToBook(indexed.ID, "b.txt", bytes.NewReader([]byte("channels"))))
+	assert.NoError(t, fileLibrary.DeleteBook(deleted.ID))
+	added, _ := fileLibrary.Add(aBook("Book3", "mr writer", 2016, nil), noImage, fileReaders(map[string][]byte{"a.txt": []byte("goroutines")}))
+
+	fullText, err = OpenFullTextIndex(filepath.Join(fileLibrary.BaseDir, FullTextDirName))
+	assert.NoError(t, err)
+	library := NewSearchableLibrary(fileLibrary, fullText)
+	assertContentMatches(library, "channels", []int{indexed.ID}, t)
+	// the shorter book ranks first
+	assertContentMatches(library, "goroutines", []int{added.ID, indexed.ID}, t)
+}
+
+func assertFullTextMatches(index *FullTextIndex, query string, expectedIDs []int, t *testing.T) {
+	matches := index.Search(query)
+	ids := make([]int, len(matches))
+	for i, match := range matches {
+		ids[i] = match.BookID
+	}
+	assertSameIDs(query, ids, expectedIDs, t)
+}
+
+func assertContentMatches(library *SearchableLibrary, query string, expectedIDs []int, t *testing.T) {
+	matches := library.SearchContents(query)
+	ids := make([]int, len(matches))
+	for i, match := range matches {
+		ids[i] = match.ID
+	}
+	assertSameIDs(query, ids, expectedIDs, t)
+}
+
+func assertSameIDs(query string, ids, expectedIDs []int, t *testing.T) {
+	if len(ids) != len(expectedIDs) {
+		t.Fatalf("Searching for '%s' expected books %v but found %v", query, expectedIDs, ids)
+	}
+	for i := range ids {
+		if ids[i] != expectedIDs[i] {
+			t.Fatalf("Searching for '%s' expected books %v but found %v", query, expectedIDs, ids)
+		}
+	}
+}
+
+func anInMemoryFullTextIndex(t *testing.T) *FullTextIndex {
+	index, err := OpenFullTextIndex("")
+	assert.NoError(t, err)
+	return index
+}
@@ -0,0 +1,415 @@
+package ebooks
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	. "github.com/stephenhenderson/ebooklib/lib/logging"
+)
+
+// Suffix of the copy of an index file kept before it is migrated, after
+// the version it was migrated from, e.g. index.json.v0.bak
+const indexBackupSuffix = ".bak"
+
+// indexMigrations[v] upgrades an index file from version v to v+1. Index
+// files written before versioning are version 0. New versions must only
+// ever be added to the end of the list.
+var indexMigrations = []indexMigration{
+	migrateIndexFromV0,
+	migrateIndexFromV1,
+	migrateIndexFromV2,
+	migrateIndexFromV3,
+	migrateIndexFromV4,
+	migrateIndexFromV5,
+}
+
+// The version of the index files written by this version of the library
+var currentIndexVersion = len(indexMigrations)
+
+// An indexMigration returns the contents of an index file upgraded by one
+// version. bookFolder gives the folder of each book in the index relative
+// to the base directory.
+type indexMigration func(lib *FileLibrary, data []byte, bookFolder func(int) string) ([]byte, error)
+
+// The contents of an index file
+type indexFile struct {
+	Version int                    `json:"version"`
+	Books   map[string]*indexEntry `json:"books"`
+}
+
+func writeIndexFile(file string, books map[string]*indexEntry) error {
+	jsonIndex, err := json.MarshalIndent(&indexFile{currentIndexVersion, books}, "", " ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(file, jsonIndex, 0700)
+}
+
+// readIndexFile reads an index file, migrating it to the current version
+// if it was written by an older version of the library
+func (lib *FileLibrary) readIndexFile(file string, bookFolder func(int) string) (*indexFile, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	version, err := indexFileVersion(data)
+	if err != nil {
+		return nil, fmt.Errorf("corrupt index file %s: %v", file, err)
+	}
+	if version > currentIndexVersion {
+		return nil, fmt.Errorf("index file %s has version %d but only versions up to %d are supported",
+			file, version, currentIndexVersion)
+	}
+	if version < currentIndexVersion {
+		if data, err = lib.migrateIndexFile(file, data, version, bookFolder); err != nil {
+			return nil, err
+		}
+	}
+
+	index := &indexFile{}
+	if err = json.Unmarshal(data, index); err != nil {
+		return nil, err
+	}
+	if index.Books == nil {
+		index.Books = make(map[string]*indexEntry)
+	}
+	return index, nil
+}
+
+// indexFileVersion returns the version of the index file contents, an index
+// file without a version is version 0
+func indexFileVersion(data []byte) (int, error) {
+	header := &struct {
+		Version int `json:"version"`
+	}{}
+	err := json.Unmarshal(data, header)
+	return header.Version, err
+}
+
+// migrateIndexFile upgrades the contents of the index file one version at
+// a time from the given version to the current one. The original file is
+// copied to a backup first and then replaced with the migrated contents.
+// Migrations only ever copy files, those they have made redundant are
+// removed once the migrated index is on disk so that a migration
+// interrupted part way can be run again from the start.
+func (lib *FileLibrary) migrateIndexFile(file string, data []byte, version int, bookFolder func(int) string) ([]byte, error) {
+	backup := file + ".v" + strconv.Itoa(version) + indexBackupSuffix
+	Logger.Printf("Migrating %s from version %d to %d, the original is kept in %s\n",
+		file, version, currentIndexVersion, backup)
+	if err := writeFileAtomically(backup, data, 0700); err != nil {
+		return nil, err
+	}
+
+	var err error
+	for ; version < currentIndexVersion; version++ {
+		data, err = indexMigrations[version](lib, data, bookFolder)
+		if err != nil {
+			return nil, fmt.Errorf("error migrating %s from version %d: %v", file, version, err)
+		}
+	}
+	if err = writeFileAtomically(file, data, 0700); err != nil {
+		return nil, err
+	}
+	lib.removeLegacyFiles(data, bookFolder)
+	return data, nil
+}
+
+// removeLegacyFiles deletes each file left in the files folder of a book in
+// the index by older versions of the library once its contents are in the
+// blob store, and then the files folder if it is empty
+func (lib *FileLibrary) removeLegacyFiles(data []byte, bookFolder func(int) string) {
+	index := &indexFile{}
+	if err := json.Unmarshal(data, index); err != nil {
+		return
+	}
+	for idStr, entry := range index.Books {
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			continue
+		}
+		filesFolder := filepath.Join(lib.BaseDir, bookFolder(id), "files")
+		for fileName, file := range entry.Files {
+			if file.Checksum != "" && lib.blobs().exists(file.Checksum) {
+				os.Remove(filepath.Join(filesFolder, fileName))
+			}
+		}
+		// only succeeds once the folder is empty
+		os.Remove(filesFolder)
+	}
+}
+
+// An index file at version 1, which only had the names of each book's files
+type v1IndexFile struct {
+	Version int                      `json:"version"`
+	Books   map[string]*v1IndexEntry `json:"books"`
+}
+
+type v1IndexEntry struct {
+	*BookDetails
+	Image string   `json:",omitempty"`
+	Files []string `json:",omitempty"`
+}
+
+// migrateIndexFromV0 wraps the map of books by id in a versioned index and
+// records the names of each book's files, which were previously found by
+// listing its files folder on load. Books whose folder is missing are left
+// without files rather than failing to open the library.
+func migrateIndexFromV0(lib *FileLibrary, data []byte, bookFolder func(int) string) ([]byte, error) {
+	books := make(map[string]*v1IndexEntry)
+	if err := json.Unmarshal(data, &books); err != nil {
+		return nil, err
+	}
+	for idStr, entry := range books {
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			return nil, err
+		}
+		filesFolder := filepath.Join(lib.BaseDir, bookFolder(id), "files")
+		files, err := ioutil.ReadDir(filesFolder)
+		if os.IsNotExist(err) {
+			// the check reports the missing folder once the library is open
+			Logger.Printf("Cannot list the files of book %d, %s does not exist", id, filesFolder)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			entry.Files = append(entry.Files, file.Name())
+		}
+	}
+	return json.MarshalIndent(&v1IndexFile{1, books}, "", " ")
+}
+
+// migrateIndexFromV1 adds when each book was created and last updated and
+// when each of its files was added, backfilled from the modification times
+// of the book's folder, files and cover
+func migrateIndexFromV1(lib *FileLibrary, data []byte, bookFolder func(int) string) ([]byte, error) {
+	index := &v1IndexFile{}
+	if err := json.Unmarshal(data, index); err != nil {
+		return nil, err
+	}
+	books := make(map[string]*v2IndexEntry, len(index.Books))
+	for idStr, old := range index.Books {
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			return nil, err
+		}
+		folder := filepath.Join(lib.BaseDir, bookFolder(id))
+		others := []string{folder}
+		if old.Image != "" {
+			others = append(others, filepath.Join(folder, filepath.Base(old.Image)))
+		}
+		times := modTimesOfBook(folder, old.Files, others...)
+
+		entry := &v2IndexEntry{old.BookDetails, old.Image, make(map[string]*v2BookFile), times.created, times.updated}
+		for _, fileName := range old.Files {
+			entry.Files[fileName] = &v2BookFile{times.added[fileName]}
+		}
+		books[idStr] = entry
+	}
+	return json.MarshalIndent(&v2IndexFile{2, books}, "", " ")
+}
+
+// An index file at version 2, which only had when each file was added
+type v2IndexFile struct {
+	Version int                      `json:"version"`
+	Books   map[string]*v2IndexEntry `json:"books"`
+}
+
+type v2IndexEntry struct {
+	*BookDetails
+	Image   string `json:",omitempty"`
+	Files   map[string]*v2BookFile
+	Created time.Time
+	Updated time.Time
+}
+
+type v2BookFile struct {
+	Added time.Time
+}
+
+// migrateIndexFromV2 adds the size, MIME type and role of each file, read
+// from the file in the book's files folder
+func migrateIndexFromV2(lib *FileLibrary, data []byte, bookFolder func(int) string) ([]byte, error) {
+	index := &v2IndexFile{}
+	if err := json.Unmarshal(data, index); err != nil {
+		return nil, err
+	}
+	books := make(map[string]*v3IndexEntry, len(index.Books))
+	for idStr, old := range index.Books {
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			return nil, err
+		}
+		entry := &v3IndexEntry{old.BookDetails, old.Image, make(map[string]*v3BookFile), old.Created, old.Updated}
+		for fileName, file := range old.Files {
+			onDisk := bookFileFromDisk(filepath.Join(lib.BaseDir, bookFolder(id), "files", fileName), file.Added)
+			entry.Files[fileName] = &v3BookFile{onDisk.Added, onDisk.Size, onDisk.MimeType, onDisk.Role}
+		}
+		books[idStr] = entry
+	}
+	return json.MarshalIndent(&v3IndexFile{3, books}, "", " ")
+}
+
+// An index file at version 3, which had no checksums of the files
+type v3IndexFile struct {
+	Version int                      `json:"version"`
+	Books   map[string]*v3IndexEntry `json:"books"`
+}
+
+type v3IndexEntry struct {
+	*BookDetails
+	Image   string `json:",omitempty"`
+	Files   map[string]*v3BookFile
+	Created time.Time
+	Updated time.Time
+}
+
+type v3BookFile struct {
+	Added    time.Time
+	Size     int64
+	MimeType string
+	Role     FileRole
+}
+
+// migrateIndexFromV3 adds the checksum of each file, read from the file in
+// the book's files folder. Files which cannot be read are left without one.
+func migrateIndexFromV3(lib *FileLibrary, data []byte, bookFolder func(int) string) ([]byte, error) {
+	index := &v3IndexFile{}
+	if err := json.Unmarshal(data, index); err != nil {
+		return nil, err
+	}
+	books := make(map[string]*indexEntry, len(index.Books))
+	for idStr, old := range index.Books {
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			return nil, err
+		}
+		entry := &indexEntry{old.BookDetails, old.Image, make(map[string]*BookFile), old.Created, old.Updated}
+		for fileName, file := range old.Files {
+			path := filepath.Join(lib.BaseDir, bookFolder(id), "files", fileName)
+			checksum, err := checksumOfFile(path)
+			if err != nil {
+				Logger.Printf("Cannot compute the checksum of %s: %v", path, err)
+			}
+			entry.Files[fileName] = &BookFile{Added: file.Added, Size: file.Size, MimeType: file.MimeType, Role: file.Role,
+				Checksum: checksum}
+		}
+		books[idStr] = entry
+	}
+	return json.MarshalIndent(&indexFile{4, books}, "", " ")
+}
+
+// migrateIndexFromV4 copies each file from the book's files folder into
+// the blob store, where identical files are stored once. The checksums are
+// taken again from the files as a journal entry written since the index
+// may have replaced them. A file no longer in the files folder keeps its
+// checksum if its contents are already in the blob store, e.g. when an
+// interrupted migration is run again, otherwise it is left without one as
+// are files which cannot be read.
+func migrateIndexFromV4(lib *FileLibrary, data []byte, bookFolder func(int) string) ([]byte, error) {
+	index := &indexFile{}
+	if err := json.Unmarshal(data, index); err != nil {
+		return nil, err
+	}
+	store := lib.blobs()
+	for idStr, entry := range index.Books {
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			return nil, err
+		}
+		filesFolder := filepath.Join(lib.BaseDir, bookFolder(id), "files")
+		for fileName, file := range entry.Files {
+			path := filepath.Join(filesFolder, fileName)
+			if _, err = os.Stat(path); os.IsNotExist(err) && file.Checksum != "" && store.exists(file.Checksum) {
+				continue
+			}
+			if file.Checksum, err = checksumOfFile(path); err != nil {
+				Logger.Printf("Cannot copy %s into the blob store: %v", path, err)
+				continue
+			}
+			if err = store.copyIn(path, file.Checksum); err != nil {
+				return nil, err
+			}
+		}
+	}
+	index.Version = 5
+	return json.MarshalIndent(index, "", " ")
+}
+
+// migrateIndexFromV5 writes the metadata file of each book to its folder,
+// from which the index can be rebuilt if it is lost. Books whose folder is
+// missing are skipped.
+func migrateIndexFromV5(lib *FileLibrary, data []byte, bookFolder func(int) string) ([]byte, error) {
+	index := &indexFile{}
+	if err := json.Unmarshal(data, index); err != nil {
+		return nil, err
+	}
+	for idStr, entry := range index.Books {
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			return nil, err
+		}
+		folder := filepath.Join(lib.BaseDir, bookFolder(id))
+		if !bookFolderExists(folder) {
+			Logger.Printf("Cannot write the metadata file of book %d, %s does not exist", id, folder)
+			continue
+		}
+		if err = writeBookMetadataFile(folder, entry); err != nil {
+			return nil, err
+		}
+	}
+	index.Version = 6
+	return json.MarshalIndent(index, "", " ")
+}
+
+// Timestamps of a book taken from the modification times of its files
+type bookModTimes struct {
+	created time.Time
+	updated time.Time
+
+	// When each file was last modified by name
+	added map[string]time.Time
+}
+
+// modTimesOfBook returns when each of the named files in the files folder
+// under bookFolder was last modified, the book was created at the earliest
+// of these and the modification times of the other paths given and last
+// updated at the latest. Paths which cannot be read are skipped, files are
+// added when the book was created if they cannot be read.
+func modTimesOfBook(bookFolder string, fileNames []string, others ...string) *bookModTimes {
+	times := &bookModTimes{added: make(map[string]time.Time, len(fileNames))}
+	include := func(path string) time.Time {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}
+		}
+		modTime := info.ModTime().UTC()
+		if times.created.IsZero() || modTime.Before(times.created) {
+			times.created = modTime
+		}
+		if modTime.After(times.updated) {
+			times.updated = modTime
+		}
+		return modTime
+	}
+
+	for _, path := range others {
+		include(path)
+	}
+	for _, fileName := range fileNames {
+		times.added[fileName] = include(filepath.Join(bookFolder, "files", fileName))
+	}
+	for fileName, added := range times.added {
+		if added.IsZero() {
+			times.added[fileName] = times.created
+		}
+	}
+	return times
+}
@@ -0,0 +1,326 @@
+package ebooks
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stephenhenderson/ebooklib/lib/testutils"
+	"github.com/stephenhenderson/ebooklib/lib/testutils/assert"
+	"github.com/stephenhenderson/ebooklib/lib/utils"
+)
+
+// An index written before versioning, from before covers were supported
+const v0Index = `{
+ "1": {"Title": "Book1", "Authors": ["mr writer"], "Year": 2016, "Tags": ["tag1"]},
+ "3": {"Title": "Book3", "Authors": ["mrs writer"], "Year": 2015, "Tags": [], "Image": "3/cover.png"}
+}`
+
+const v0TrashIndex = `{
+ "2": {"Title": "Book2", "Authors": ["mr writer"], "Year": 2014, "Tags": []}
+}`
+
+// SHA-256 of a.pdf written by writeBookFolder, whose contents are its name
+const aPdfChecksum = "a7949e623819aa32baf4c32d0457e275b4eff130ec61f43cf284ffdef26efcf4"
+
+func TestMigrateIndexFromV0RecordsTheFilesOfEachBook(t *testing.T) {
+	library := &FileLibrary{BaseDir: testutils.CreateTempDir(t)}
+	writeBookFolder(library.BaseDir, "1", "a.pdf", "b.zip")
+	writeBookFolder(library.BaseDir, "3")
+
+	migrated, err := migrateIndexFromV0(library, []byte(v0Index), relativeFolderForBook)
+	assert.NoError(t, err)
+
+	version, err := indexFileVersion(migrated)
+	assert.NoError(t, err)
+	if version != 1 {
+		t.Fatalf("Expected migrated index to be version 1 but was %d", version)
+	}
+	index := &v1IndexFile{}
+	assert.NoError(t, json.Unmarshal(migrated, index))
+	if len(index.Books) != 2 || index.Books["1"].Title != "Book1" || index.Books["3"].Image != "3/cover.png" {
+		t.Fatalf("Expected the books to be kept but found %v", index.Books)
+	}
+	if !utils.StringSliceEquals(index.Books["1"].Files, []string{"a.pdf", "b.zip"}) || len(index.Books["3"].Files) != 0 {
+		t.Fatalf("Expected the files of each book to be recorded but found %v and %v",
+			index.Books["1"].Files, index.Books["3"].Files)
+	}
+}
+
+func TestMigrateIndexFromV0LeavesBooksWhoseFolderIsMissingWithoutFiles(t *testing.T) {
+	library := &FileLibrary{BaseDir: testutils.CreateTempDir(t)}
+	writeBookFolder(library.BaseDir, "1", "a.pdf")
+
+	migrated, err := migrateIndexFromV0(library, []byte(v0Index), relativeFolderForBook)
+	assert.NoError(t, err)
+
+	index := &v1IndexFile{}
+	assert.NoError(t, json.Unmarshal(migrated, index))
+	if len(index.Books) != 2 || len(index.Books["3"].Files) != 0 || len(index.Books["1"].Files) != 1 {
+		t.Fatalf("Expected book 3 to be kept without files but found %v", index.Books)
+	}
+}
+
+func TestMigrateIndexFromV1BackfillsTimestampsFromModificationTimes(t *testing.T) {
+	library := &FileLibrary{BaseDir: testutils.CreateTempDir(t)}
+	writeBookFolder(library.BaseDir, "1", "a.pdf", "b.zip")
+	writeTestFile(filepath.Join(library.BaseDir, "1", "cover.png"), "cover")
+	day := func(d int) time.Time { return time.Date(2016, 5, d, 0, 0, 0, 0, time.UTC) }
+	setModTime(filepath.Join(library.BaseDir, "1", "files", "a.pdf"), day(2))
+	setModTime(filepath.Join(library.BaseDir, "1", "files", "b.zip"), day(5))
+	setModTime(filepath.Join(library.BaseDir, "1", "cover.png"), day(7))
+	setModTime(filepath.Join(library.BaseDir, "1"), day(1))
+	v1Index := `{"version": 1, "books": {"1": {"Title": "Book1", "Image": "1/cover.png", "Files": ["a.pdf", "b.zip"]}}}`
+
+	migrated, err := migrateIndexFromV1(library, []byte(v1Index), relativeFolderForBook)
+	assert.NoError(t, err)
+
+	index := &v2IndexFile{}
+	assert.NoError(t, json.Unmarshal(migrated, index))
+	book := index.Books["1"]
+	if index.Version != 2 || book.Title != "Book1" || book.Image != "1/cover.png" {
+		t.Fatalf("Expected book 1 in a version 2 index but found %+v", index)
+	}
+	if !book.Created.Equal(day(1)) || !book.Updated.Equal(day(7)) {
+		t.Fatalf("Expected book to be created on day 1 and updated on day 7 but was %v and %v", book.Created, book.Updated)
+	}
+	if len(book.Files) != 2 || !book.Files["a.pdf"].Added.Equal(day(2)) || !book.Files["b.zip"].Added.Equal(day(5)) {
+		t.Fatalf("Expected files to be added when last modified but found %v", book.Files)
+	}
+}
+
+func TestMigrateIndexFromV2RecordsTheSizeTypeAndRoleOfEachFile(t *testing.T) {
+	library := &FileLibrary{BaseDir: testutils.CreateTempDir(t)}
+	writeBookFolder(library.BaseDir, "1", "a.pdf", "code.zip")
+	v2Index := `{"version": 2, "books": {"1": {"Title": "Book1", "Created": "2016-05-01T00:00:00Z",
+		"Files": {"a.pdf": {"Added": "2016-05-02T00:00:00Z"}, "code.zip": {"Added": "2016-05-03T00:00:00Z"}}}}}`
+
+	migrated, err := migrateIndexFromV2(library, []byte(v2Index), relativeFolderForBook)
+	assert.NoError(t, err)
+
+	index := &v3IndexFile{}
+	assert.NoError(t, json.Unmarshal(migrated, index))
+	book := index.Books["1"]
+	if index.Version != 3 || book.Title != "Book1" || !book.Created.Equal(time.Date(2016, 5, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("Expected book 1 in a version 3 index but found %+v", index)
+	}
+	pdf, code := book.Files["a.pdf"], book.Files["code.zip"]
+	if pdf.Size != 5 || pdf.MimeType != PdfMimeType || pdf.Role != RoleEbook || !pdf.Added.Equal(time.Date(2016, 5, 2, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("Expected the details of a.pdf to be read from disk but found %+v", pdf)
+	}
+	if code.Size != 8 || code.Role != RoleCode {
+		t.Fatalf("Expected the details of code.zip to be read from disk but found %+v", code)
+	}
+}
+
+func TestMigrateIndexFromV3RecordsTheChecksumOfEachFile(t *testing.T) {
+	library := &FileLibrary{BaseDir: testutils.CreateTempDir(t)}
+	writeBookFolder(library.BaseDir, "1", "a.pdf")
+	v3Index := `{"version": 3, "books": {"1": {"Title": "Book1", "Files": {
+		"a.pdf": {"Added": "2016-05-02T00:00:00Z", "Size": 5, "MimeType": "application/pdf", "Role": "errata"},
+		"missing.pdf": {"Added": "2016-05-02T00:00:00Z", "Size": 3, "MimeType": "application/pdf", "Role": "ebook"}}}}}`
+
+	migrated, err := migrateIndexFromV3(library, []byte(v3Index), relativeFolderForBook)
+	assert.NoError(t, err)
+
+	index := &indexFile{}
+	assert.NoError(t, json.Unmarshal(migrated, index))
+	file := index.Books["1"].Files["a.pdf"]
+	if index.Version != 4 || file.Role != RoleErrata || file.Size != 5 || !file.Added.Equal(time.Date(2016, 5, 2, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("Expected the details of a.pdf to be kept in a version 4 index but found %+v", index)
+	}
+	if file.Checksum != aPdfChecksum {
+		t.Fatalf("Expected the checksum of a.pdf to be read from disk but was %s", file.Checksum)
+	}
+	if missing := index.Books["1"].Files["missing.pdf"]; missing.Checksum != "" || missing.Size != 3 {
+		t.Fatalf("Expected a file missing from disk to be kept without a checksum but found %+v", missing)
+	}
+}
+
+func TestMigrateIndexFromV4CopiesFilesIntoTheBlobStore(t *testing.T) {
+	library := &FileLibrary{BaseDir: testutils.CreateTempDir(t)}
+	writeBookFolder(library.BaseDir, "1", "a.pdf")
+	writeBookFolder(library.BaseDir, "2", "a.pdf")
+	v4Index := `{"version": 4, "books": {
+		"1": {"Title": "Book1", "Files": {"a.pdf": {"Size": 5, "Role": "errata", "Checksum": "stale"}, "missing.pdf": {"Size": 3}}},
+		"2": {"Title": "Book2", "Files": {"a.pdf": {"Size": 5, "Role": "ebook"}}}}}`
+
+	migrated, err := migrateIndexFromV4(library, []byte(v4Index), relativeFolderForBook)
+	assert.NoError(t, err)
+
+	index := &indexFile{}
+	assert.NoError(t, json.Unmarshal(migrated, index))
+	first, second := index.Books["1"].Files["a.pdf"], index.Books["2"].Files["a.pdf"]
+	if index.Version != 5 || first.Role != RoleErrata || first.Checksum != aPdfChecksum || second.Checksum != aPdfChecksum {
+		t.Fatalf("Expected both files to have the checksum of their contents in a version 5 index but found %+v and %+v", first, second)
+	}
+	if missing := index.Books["1"].Files["missing.pdf"]; missing.Checksum != "" {
+		t.Fatalf("Expected a file missing from disk to be kept without a checksum but found %+v", missing)
+	}
+	blobs, err := library.blobs().files()
+	assert.NoError(t, err)
+	if len(blobs) != 1 || !library.blobs().exists(aPdfChecksum) {
+		t.Fatalf("Expected the identical files to be stored once but found %v", blobs)
+	}
+	for _, id := range []string{"1", "2"} {
+		// only removed once the migrated index has been written
+		assertFileContents(filepath.Join(library.BaseDir, id, "files", "a.pdf"), []byte("a.pdf"), t)
+	}
+}
+
+func TestAMigrationFromV4InterruptedByACrashIsCompletedWhenTheLibraryIsReopened(t *testing.T) {
+	baseDir := testutils.CreateTempDir(t)
+	library := &FileLibrary{BaseDir: baseDir}
+	writeBookFolder(baseDir, "1", "a.pdf")
+	writeBookFolder(baseDir, "2", "b.pdf")
+	bPdfChecksum, err := checksumOfFile(filepath.Join(baseDir, "2", "files", "b.pdf"))
+	assert.NoError(t, err)
+	// a.pdf was moved into the blob store before the process was killed
+	assert.NoError(t, library.blobs().adopt(filepath.Join(baseDir, "1", "files", "a.pdf"), aPdfChecksum))
+	writeTestFile(filepath.Join(baseDir, IndexFileName), `{"version": 4, "books": {
+		"1": {"Title": "Book1", "Files": {"a.pdf": {"Size": 5, "Checksum": "`+aPdfChecksum+`"}}},
+		"2": {"Title": "Book2", "Files": {"b.pdf": {"Size": 5, "Checksum": "`+bPdfChecksum+`"}}}}}`)
+
+	reopened, err := NewFileLibrary(baseDir)
+	assert.NoError(t, err)
+	for id, fileName := range map[int]string{1: "a.pdf", 2: "b.pdf"} {
+		book, err := reopened.GetBookByID(id)
+		assert.NoError(t, err)
+		file := book.Files[fileName]
+		if file == nil || file.Path != relativePathToBlob(file.Checksum) {
+			t.Fatalf("Expected %s to be in the blob store but found %+v", fileName, file)
+		}
+		assertFileContents(filepath.Join(baseDir, file.Path), []byte(fileName), t)
+		if fileExists(filepath.Join(baseDir, strconv.Itoa(id), "files")) {
+			t.Fatalf("Expected the files folder of book %d to be removed", id)
+		}
+	}
+	assertBlobs(reopened, 2, t)
+	assertNoProblems(reopened, t)
+}
+
+func TestMigrateIndexFromV5WritesTheMetadataFileOfEachBook(t *testing.T) {
+	library := &FileLibrary{BaseDir: testutils.CreateTempDir(t)}
+	os.Mkdir(filepath.Join(library.BaseDir, "1"), 0700)
+	v5Index := `{"version": 5, "books": {
+ "1": {"Title": "Book1", "Image": "1/cover.png", "Files": {"a.pdf": {"Size": 5, "Role": "errata", "Checksum": "` + aPdfChecksum + `"}}},
+ "2": {"Title": "Book2"}
+}}`
+
+	migrated, err := migrateIndexFromV5(library, []byte(v5Index), relativeFolderForBook)
+	assert.NoError(t, err)
+
+	if version, _ := indexFileVersion(migrated); version != 6 {
+		t.Fatalf("Expected migrated index to be version 6 but was %d", version)
+	}
+	entry, err := readBookMetadataFile(filepath.Join(library.BaseDir, "1"))
+	assert.NoError(t, err)
+	if entry.Title != "Book1" || entry.Image != "1/cover.png" || entry.Files["a.pdf"].Checksum != aPdfChecksum {
+		t.Fatalf("Expected the metadata file to hold the book's entry but found %+v", entry)
+	}
+	if _, err := os.Stat(filepath.Join(library.BaseDir, "2")); !os.IsNotExist(err) {
+		t.Fatalf("Expected the missing folder of book 2 to be left missing but got %v", err)
+	}
+}
+
+func TestAnUnversionedLibraryIsMigratedWhenOpened(t *testing.T) {
+	baseDir := testutils.CreateTempDir(t)
+	writeBookFolder(baseDir, "1", "book1.pdf")
+	writeBookFolder(baseDir, "3")
+	writeBookFolder(filepath.Join(baseDir, TrashDirName), "2", "book2.epub")
+	writeTestFile(filepath.Join(baseDir, IndexFileName), v0Index)
+	writeTestFile(filepath.Join(baseDir, TrashDirName, IndexFileName), v0TrashIndex)
+
+	library, err := NewFileLibrary(baseDir)
+	assert.NoError(t, err)
+
+	book, err := library.GetBookByID(1)
+	assert.NoError(t, err)
+	if book.Title != "Book1" || book.Files["book1.pdf"] == nil {
+		t.Fatalf("Expected book 1 with its file but found %v with files %v", book.BookDetails, book.Files)
+	}
+	trash := library.GetTrash()
+	if len(trash) != 1 || trash[0].Files["book2.epub"] == nil {
+		t.Fatalf("Expected book 2 in the trash with its file but found %v", trash)
+	}
+	for fileName, file := range map[string]*BookFile{"book1.pdf": book.Files["book1.pdf"], "book2.epub": trash[0].Files["book2.epub"]} {
+		contents, err := ioutil.ReadFile(filepath.Join(baseDir, file.Path))
+		if err != nil || string(contents) != fileName || file.Path != relativePathToBlob(file.Checksum) {
+			t.Fatalf("Expected %s to be moved into the blob store but was at %s", fileName, file.Path)
+		}
+	}
+	for _, folder := range []string{"1", filepath.Join(TrashDirName, "2")} {
+		if fileExists(filepath.Join(baseDir, folder, "files")) {
+			t.Fatalf("Expected the files folder in %s to be removed once migrated", folder)
+		}
+	}
+
+	for file, original := range map[string]string{IndexFileName: v0Index, filepath.Join(TrashDirName, IndexFileName): v0TrashIndex} {
+		backup, err := ioutil.ReadFile(filepath.Join(baseDir, file+".v0"+indexBackupSuffix))
+		assert.NoError(t, err, "Expected a backup of "+file)
+		if string(backup) != original {
+			t.Fatalf("Expected the backup of %s to be the original but was %s", file, backup)
+		}
+
+		migrated, err := ioutil.ReadFile(filepath.Join(baseDir, file))
+		assert.NoError(t, err)
+		if version, _ := indexFileVersion(migrated); version != currentIndexVersion {
+			t.Fatalf("Expected %s to be migrated to version %d but was %d", file, currentIndexVersion, version)
+		}
+	}
+}
+
+func TestAnIndexAtTheCurrentVersionIsNotMigrated(t *testing.T) {
+	library := newLibraryInTempFolder(t)
+	library.Add(aBook("Book1", "mr writer", 2016, nil), noImage, emptyFileMap())
+	assert.NoError(t, library.Close())
+
+	reopenLibrary(library, t)
+	backups, _ := filepath.Glob(filepath.Join(library.BaseDir, "*"+indexBackupSuffix))
+	if len(backups) != 0 {
+		t.Fatalf("Expected no backups but found %v", backups)
+	}
+}
+
+func TestAnIndexFromANewerVersionOfTheLibraryIsRejected(t *testing.T) {
+	baseDir := testutils.CreateTempDir(t)
+	writeTestFile(filepath.Join(baseDir, IndexFileName), `{"version": 1000, "books": {}}`)
+
+	_, err := NewFileLibrary(baseDir)
+	if err == nil || !strings.Contains(err.Error(), "version 1000") {
+		t.Fatalf("Expected an error opening an index from a newer version but got %v", err)
+	}
+}
+
+func TestIndexFilesWithoutAVersionAreVersion0(t *testing.T) {
+	for data, expected := range map[string]int{v0Index: 0, "{}": 0, `{"version": 2, "books": {}}`: 2} {
+		version, err := indexFileVersion([]byte(data))
+		assert.NoError(t, err)
+		if version != expected {
+			t.Fatalf("Expected version %d for %s but was %d", expected, data, version)
+		}
+	}
+}
+
+// writeBookFolder creates the folder of the book with the given id under
+// dir with the named files in it
+func writeBookFolder(dir, id string, fileNames ...string) {
+	filesFolder := filepath.Join(dir, id, "files")
+	os.MkdirAll(filesFolder, 0700)
+	for _, fileName := range fileNames {
+		writeTestFile(filepath.Join(filesFolder, fileName), fileName)
+	}
+}
+
+func setModTime(path string, modTime time.Time) {
+	os.Chtimes(path, modTime, modTime)
+}
+
+func writeTestFile(path, contents string) {
+	ioutil.WriteFile(path, []byte(contents), 0700)
+}
@@ -0,0 +1,197 @@
+package ebooks
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/stephenhenderson/ebooklib/lib/logging"
+)
+
+const (
+	JournalFileName = "journal.log"
+
+	// Number of journal entries after which the index is rewritten and
+	// the journal truncated
+	journalCheckpointInterval = 100
+
+	// Suffix of the temporary files written by writeFileAtomically, any
+	// found on startup are left over from an interrupted write
+	tmpFileSuffix = ".tmp"
+
+	journalOpAdd        = "add"
+	journalOpUpdate     = "update"
+	journalOpSetImage   = "image"
+	journalOpAddFile    = "addfile"
+	journalOpDeleteFile = "deletefile"
+	journalOpFileRole   = "filerole"
+	journalOpTrash      = "trash"
+	journalOpRestore    = "restore"
+	journalOpPurge      = "purge"
+)
+
+// A single mutation of the library index. Entries are appended to the
+// journal before the change is applied in memory so they can be replayed
+// if the process dies before the index file is next written.
+type journalEntry struct {
+	Op   string
+	ID   int
+	Book *BookDetails `json:",omitempty"`
+
+	// When the change was made
+	Time time.Time
+
+	// Path to the book's cover for add and image entries, empty if the
+	// book has no cover
+	Image string `json:",omitempty"`
+
+	// Names of the book's files in add entries written before the
+	// details of each file were recorded
+	Files []string `json:",omitempty"`
+
+	// Size, type and role of the files added by add and addfile entries
+	// by name, the files are added at the time of the entry
+	FileDetails map[string]*BookFile `json:",omitempty"`
+
+	// Name of the file for addfile, deletefile and filerole entries
+	File string `json:",omitempty"`
+
+	// New role of the file for filerole entries
+	Role FileRole `json:",omitempty"`
+}
+
+// An append-only log of index mutations, one json entry per line
+type journal struct {
+	file *os.File
+
+	// Number of entries appended since the journal was last truncated
+	entries int
+}
+
+func openJournal(path string) (*journal, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &journal{file: file}, nil
+}
+
+// append writes the entry to the end of the journal and syncs it to disk,
+// once this returns the change is committed
+func (j *journal) append(entry *journalEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if _, err = j.file.Write(line); err != nil {
+		return err
+	}
+	if err = j.file.Sync(); err != nil {
+		return err
+	}
+	j.entries++
+	return nil
+}
+
+// truncate discards all entries, should only be called once the index
+// containing them has been safely written
+func (j *journal) truncate() error {
+	if err := j.file.Truncate(0); err != nil {
+		return err
+	}
+	j.entries = 0
+	return j.file.Sync()
+}
+
+func (j *journal) close() error {
+	return j.file.Close()
+}
+
+// readJournal returns all complete entries in the journal at the given
+// path. A trailing line without a newline is the result of an interrupted
+// append and is ignored, any other unreadable line is an error.
+func readJournal(path string) ([]*journalEntry, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []*journalEntry{}
+	reader := bufio.NewReader(bytes.NewReader(data))
+	for lineNum := 1; ; lineNum++ {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				Logger.Printf("Ignoring incomplete entry at end of journal %s", path)
+			}
+			return entries, nil
+		}
+
+		entry := &journalEntry{}
+		if err = json.Unmarshal(line, entry); err != nil {
+			return nil, fmt.Errorf("corrupt journal %s at line %d: %v", path, lineNum, err)
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// writeFileAtomically replaces the file at path with data such that a
+// crash at any point leaves either the old or the new contents in place,
+// never a partial file
+func writeFileAtomically(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmpFile, err := ioutil.TempFile(dir, filepath.Base(path)+tmpFileSuffix)
+	if err != nil {
+		return err
+	}
+	tmpName := tmpFile.Name()
+
+	_, err = tmpFile.Write(data)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmpName, perm)
+	}
+	if err == nil {
+		err = os.Rename(tmpName, path)
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir flushes directory entries (e.g. a rename) to disk
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// removeStaleTempFiles deletes temp files left behind in dir by an
+// interrupted call to writeFileAtomically
+func removeStaleTempFiles(dir, baseName string) {
+	matches, _ := filepath.Glob(filepath.Join(dir, baseName+tmpFileSuffix+"*"))
+	for _, match := range matches {
+		Logger.Printf("Removing temp file %s left by an interrupted write", match)
+		os.Remove(match)
+	}
+}
@@ -0,0 +1,66 @@
+package ebooks
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stephenhenderson/ebooklib/lib/testutils"
+	"github.com/stephenhenderson/ebooklib/lib/testutils/assert"
+)
+
+func TestReadingAMissingJournalReturnsNoEntries(t *testing.T) {
+	entries, err := readJournal(filepath.Join(testutils.CreateTempDir(t), JournalFileName))
+	assert.NoError(t, err)
+	if len(entries) != 0 {
+		t.Fatalf("Expected no entries but found %v", entries)
+	}
+}
+
+func TestJournalEntriesAreReadBackInOrder(t *testing.T) {
+	journalFile := filepath.Join(testutils.CreateTempDir(t), JournalFileName)
+	j, err := openJournal(journalFile)
+	assert.NoError(t, err)
+	defer j.close()
+
+	assert.NoError(t, j.append(&journalEntry{Op: journalOpAdd, ID: 1, Book: aBook("Book1", "mr writer", 2016, nil)}))
+	assert.NoError(t, j.append(&journalEntry{Op: journalOpAdd, ID: 2, Book: aBook("Book2", "mrs writer", 2015, nil)}))
+
+	entries, err := readJournal(journalFile)
+	assert.NoError(t, err)
+	if len(entries) != 2 || entries[0].ID != 1 || entries[1].ID != 2 {
+		t.Fatalf("Expected entries for books 1 and 2 but found %v", entries)
+	}
+	if entries[1].Book.Title != "Book2" {
+		t.Fatalf("Expected entry for Book2 but found %v", entries[1].Book)
+	}
+}
+
+func TestACorruptEntryBeforeTheEndOfTheJournalIsAnError(t *testing.T) {
+	journalFile := filepath.Join(testutils.CreateTempDir(t), JournalFileName)
+	data := "{\"Op\":\"add\",\"ID\":1}\nnot json\n{\"Op\":\"add\",\"ID\":2}\n"
+	assert.NoError(t, ioutil.WriteFile(journalFile, []byte(data), 0700))
+
+	_, err := readJournal(journalFile)
+	if err == nil {
+		t.Fatal("Expected error reading a corrupt journal")
+	}
+}
+
+func TestWriteFileAtomicallyReplacesTheFile(t *testing.T) {
+	tempDir := testutils.CreateTempDir(t)
+	path := filepath.Join(tempDir, "a_file.json")
+	assert.NoError(t, ioutil.WriteFile(path, []byte("old"), 0700))
+
+	assert.NoError(t, writeFileAtomically(path, []byte("new"), 0700))
+
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	if string(data) != "new" {
+		t.Fatalf("Expected file to contain 'new' but found '%s'", string(data))
+	}
+	files, _ := ioutil.ReadDir(tempDir)
+	if len(files) != 1 {
+		t.Fatalf("Expected no temp files to be left behind but found %d files", len(files))
+	}
+}
@@ -0,0 +1,522 @@
+package ebooks
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stephenhenderson/ebooklib/lib/testutils/assert"
+)
+
+// Creates a new empty library of the implementation under test
+type libraryFactory func(t *testing.T) Library
+
+// Every Library implementation, all must pass the conformance tests
+var libraryImplementations = map[string]libraryFactory{
+	"FileLibrary": func(t *testing.T) Library {
+		return newLibraryInTempFolder(t)
+	},
+	"MemoryLibrary": func(t *testing.T) Library {
+		return NewMemoryLibrary()
+	},
+	"BoltLibrary": func(t *testing.T) Library {
+		return newBoltLibraryInTempFolder(t)
+	},
+	"SearchableLibrary": func(t *testing.T) Library {
+		return aSearchableLibrary(newLibraryInTempFolder(t))
+	},
+}
+
+// Behaviour shared by all Library implementations
+var conformanceTests = map[string]func(t *testing.T, library Library){
+	"BooksAreAssignedSequentialIds":      testBooksAreAssignedSequentialIds,
+	"BooksCanBeRetrievedAfterAdding":     testBooksCanBeRetrievedAfterAdding,
+	"MissingBooksAreNotFound":            testMissingBooksAreNotFound,
+	"BooksReturnedAreCopies":             testBooksReturnedAreCopies,
+	"BookDetailsCanBeUpdated":            testBookDetailsCanBeUpdated,
+	"FilesCanBeAddedReplacedAndDeleted":  testFilesCanBeAddedReplacedAndDeleted,
+	"BooksCanBeTrashedRestoredAndPurged": testBooksCanBeTrashedRestoredAndPurged,
+	"IdsOfBooksInTheTrashAreNotReused":   testIdsOfBooksInTheTrashAreNotReused,
+	"CoversCanBeSetAndRemoved":           testCoversCanBeSetAndRemoved,
+	"UnsupportedImagesAreRejected":       testUnsupportedImagesAreRejected,
+	"ThumbnailsAreServedForCovers":       testThumbnailsAreServedForCovers,
+	"ConcurrentChangesAreSafe":           testConcurrentChangesAreSafe,
+	"ChangesAreTimestamped":              testChangesAreTimestamped,
+	"FilesRecordTheirSizeTypeAndRole":    testFilesRecordTheirSizeTypeAndRole,
+	"FileRolesCanBeChanged":              testFileRolesCanBeChanged,
+	"FilesRecordTheirChecksums":          testFilesRecordTheirChecksums,
+	"FailedUploadsChangeNothing":         testFailedUploadsChangeNothing,
+	"ChangesCarryOnDuringUploads":        testChangesCarryOnDuringUploads,
+}
+
+func TestLibraryConformance(t *testing.T) {
+	for implName, newLibrary := range libraryImplementations {
+		for testName, test := range conformanceTests {
+			newLibrary, test := newLibrary, test
+			t.Run(implName+"/"+testName, func(t *testing.T) {
+				test(t, newLibrary(t))
+			})
+		}
+	}
+}
+
+func testBooksAreAssignedSequentialIds(t *testing.T, library Library) {
+	for expectedID := 1; expectedID <= 3; expectedID++ {
+		book, err := library.Add(aBook("Book", "mr writer", 2016, nil), noImage, emptyFileMap())
+		assert.NoError(t, err)
+		if book.ID != expectedID {
+			t.Fatalf("Expected id %d but was %d", expectedID, book.ID)
+		}
+	}
+}
+
+func testBooksCanBeRetrievedAfterAdding(t *testing.T, library Library) {
+	details := aBook("Book1", "mr writer", 2016, []string{"tag1"})
+	bookFiles := map[string][]byte{"file1.json": aJsonFile()}
+	added, err := library.Add(details, noImage, fileReaders(bookFiles))
+	assert.NoError(t, err)
+
+	book, err := library.GetBookByID(added.ID)
+	assert.NoError(t, err)
+	if !book.Equals(details) || book.Image != "" {
+		t.Fatalf("Retrieved book %v is not same as added book: %v", book.BookDetails, details)
+	}
+	assertBookFiles(library, book.ID, bookFiles, t)
+
+	all := library.GetAll()
+	if len(all) != 1 || all[0].ID != added.ID {
+		t.Fatalf("Expected only the added book in the library but found %v", all)
+	}
+}
+
+func testMissingBooksAreNotFound(t *testing.T, library Library) {
+	missingID := 123
+	if _, err := library.GetBookByID(missingID); err != BookNotFound {
+		t.Fatalf("GetBookByID: expected BookNotFound but got %v", err)
+	}
+	if _, err := library.UpdateBook(missingID, aBook("Book1", "mr writer", 2016, nil)); err != BookNotFound {
+		t.Fatalf("UpdateBook: expected BookNotFound but got %v", err)
+	}
+	if err := library.AddFileToBook(missingID, "file1.json", bytes.NewReader(aJsonFile())); err != BookNotFound {
+		t.Fatalf("AddFileToBook: expected BookNotFound but got %v", err)
+	}
+	if err := library.DeleteFileFromBook(missingID, "file1.json"); err != BookNotFound {
+		t.Fatalf("DeleteFileFromBook: expected BookNotFound but got %v", err)
+	}
+	if err := library.SetFileRole(missingID, "file1.json", RoleOther); err != BookNotFound {
+		t.Fatalf("SetFileRole: expected BookNotFound but got %v", err)
+	}
+	if _, err := library.OpenBookFile(missingID, "file1.json"); err != BookNotFound {
+		t.Fatalf("OpenBookFile: expected BookNotFound but got %v", err)
+	}
+	if _, err := library.SetBookImage(missingID, aPngImage(t)); err != BookNotFound {
+		t.Fatalf("SetBookImage: expected BookNotFound but got %v", err)
+	}
+	if err := library.RemoveBookImage(missingID); err != BookNotFound {
+		t.Fatalf("RemoveBookImage: expected BookNotFound but got %v", err)
+	}
+	if _, err := library.OpenBookImage(missingID); err != BookNotFound {
+		t.Fatalf("OpenBookImage: expected BookNotFound but got %v", err)
+	}
+	if _, err := library.OpenThumbnail(missingID, SmallThumbnail.Name); err != BookNotFound {
+		t.Fatalf("OpenThumbnail: expected BookNotFound but got %v", err)
+	}
+	if err := library.DeleteBook(missingID); err != BookNotFound {
+		t.Fatalf("DeleteBook: expected BookNotFound but got %v", err)
+	}
+	if _, err := library.RestoreBook(missingID); err != BookNotFound {
+		t.Fatalf("RestoreBook: expected BookNotFound but got %v", err)
+	}
+	if err := library.PurgeBook(missingID); err != BookNotFound {
+		t.Fatalf("PurgeBook: expected BookNotFound but got %v", err)
+	}
+}
+
+func testBooksReturnedAreCopies(t *testing.T, library Library) {
+	book, _ := library.Add(aBook("Book1", "mr writer", 2016, nil), noImage, emptyFileMap())
+	book.Files["not_really_added.json"] = &BookFile{Path: "somewhere"}
+	book.Image = "not_really_a_cover.png"
+
+	book, err := library.GetBookByID(book.ID)
+	assert.NoError(t, err)
+	if len(book.Files) != 0 || book.Image != "" {
+		t.Fatalf("Changes to a returned book should not affect the library, found %v", book)
+	}
+}
+
+func testBookDetailsCanBeUpdated(t *testing.T, library Library) {
+	bookFiles := map[string][]byte{"file1.json": aJsonFile()}
+	book, _ := library.Add(aBook("Bok1", "mr writer", 2016, nil), noImage, fileReaders(bookFiles))
+
+	updatedDetails := aBook("Book1", "mrs writer", 2015, []string{"tag1"})
+	updated, err := library.UpdateBook(book.ID, updatedDetails)
+	assert.NoError(t, err)
+
+	book, _ = library.GetBookByID(book.ID)
+	if !updated.Equals(updatedDetails) || !book.Equals(updatedDetails) {
+		t.Fatalf("Expected updated details %v but found %v", updatedDetails, book.BookDetails)
+	}
+	assertBookFiles(library, book.ID, bookFiles, t)
+}
+
+func testFilesCanBeAddedReplacedAndDeleted(t *testing.T, library Library) {
+	book, _ := library.Add(aBook("Book1", "mr writer", 2016, nil), noImage, fileReaders(map[string][]byte{"file1.json": aJsonFile()}))
+
+	assert.NoError(t, library.AddFileToBook(book.ID, "file2.txt", bytes.NewReader([]byte("file 2"))))
+	assert.NoError(t, library.AddFileToBook(book.ID, "file1.json", bytes.NewReader([]byte("{}"))))
+	assertBookFiles(library, book.ID, map[string][]byte{"file1.json": []byte("{}"), "file2.txt": []byte("file 2")}, t)
+
+	assert.NoError(t, library.DeleteFileFromBook(book.ID, "file1.json"))
+	assertBookFiles(library, book.ID, map[string][]byte{"file2.txt": []byte("file 2")}, t)
+
+	if err := library.DeleteFileFromBook(book.ID, "file1.json"); err != FileNotFound {
+		t.Fatalf("Expected FileNotFound deleting a deleted file but got %v", err)
+	}
+	if _, err := library.OpenBookFile(book.ID, "file1.json"); err != FileNotFound {
+		t.Fatalf("Expected FileNotFound opening a deleted file but got %v", err)
+	}
+}
+
+func testChangesAreTimestamped(t *testing.T, library Library) {
+	before := time.Now()
+	book, _ := library.Add(aBook("Book1", "mr writer", 2016, nil), noImage, fileReaders(map[string][]byte{"file1.json": aJsonFile()}))
+	if book.Created.Before(before) || !book.Updated.Equal(book.Created) || !book.Files["file1.json"].Added.Equal(book.Created) {
+		t.Fatalf("Expected a new book and its files to be timestamped when added but found %v", book)
+	}
+
+	changes := map[string]func() error{
+		"updating details": func() error {
+			_, err := library.UpdateBook(book.ID, aBook("Book1", "mrs writer", 2016, nil))
+			return err
+		},
+		"setting the cover": func() error {
+			_, err := library.SetBookImage(book.ID, aPngImage(t))
+			return err
+		},
+		"removing the cover":   func() error { return library.RemoveBookImage(book.ID) },
+		"adding a file":        func() error { return library.AddFileToBook(book.ID, "file2.txt", bytes.NewReader([]byte("file 2"))) },
+		"changing a file role": func() error { return library.SetFileRole(book.ID, "file1.json", RoleOther) },
+		"deleting a file":      func() error { return library.DeleteFileFromBook(book.ID, "file2.txt") },
+	}
+	changeOrder := []string{"updating details", "setting the cover", "removing the cover", "changing a file role", "adding a file", "deleting a file"}
+	for _, change := range changeOrder {
+		previous, _ := library.GetBookByID(book.ID)
+		time.Sleep(time.Millisecond)
+		assert.NoError(t, changes[change]())
+
+		changed, _ := library.GetBookByID(book.ID)
+		if !changed.Updated.After(previous.Updated) || !changed.Created.Equal(book.Created) {
+			t.Fatalf("Expected %s to update the book but was created %v and updated %v", change, changed.Created, changed.Updated)
+		}
+		if file, found := changed.Files["file2.txt"]; found && !file.Added.Equal(changed.Updated) {
+			t.Fatalf("Expected an added file to be timestamped when added but found %v", file.Added)
+		}
+	}
+}
+
+func testFilesRecordTheirSizeTypeAndRole(t *testing.T, library Library) {
+	pdf := []byte("%PDF-1.4 a book")
+	codeSamples := []byte("PK\x03\x04 some code")
+	book, _ := library.Add(aBook("Book1", "mr writer", 2016, nil), noImage, fileReaders(map[string][]byte{"book.pdf": pdf, "code.zip": codeSamples}))
+	assert.NoError(t, library.AddFileToBook(book.ID, "errata.txt", bytes.NewReader([]byte("page 1 is wrong"))))
+
+	book, _ = library.GetBookByID(book.ID)
+	expectedFiles := map[string]BookFile{
+		"book.pdf":   {Size: int64(len(pdf)), MimeType: PdfMimeType, Role: RoleEbook},
+		"code.zip":   {Size: int64(len(codeSamples)), MimeType: "application/zip", Role: RoleCode},
+		"errata.txt": {Size: 15, MimeType: "text/plain", Role: RoleErrata},
+	}
+	for fileName, expected := range expectedFiles {
+		file := book.Files[fileName]
+		if file == nil || file.Size != expected.Size || file.MimeType != expected.MimeType || file.Role != expected.Role {
+			t.Fatalf("Expected %s to be %d bytes of %s with role %s but was %+v",
+				fileName, expected.Size, expected.MimeType, expected.Role, file)
+		}
+	}
+}
+
+func testFileRolesCanBeChanged(t *testing.T, library Library) {
+	book, _ := library.Add(aBook("Book1", "mr writer", 2016, nil), noImage, fileReaders(map[string][]byte{"fixes.pdf": []byte("%PDF")}))
+
+	assert.NoError(t, library.SetFileRole(book.ID, "fixes.pdf", RoleErrata))
+	book, _ = library.GetBookByID(book.ID)
+	if book.Files["fixes.pdf"].Role != RoleErrata || book.Files["fixes.pdf"].MimeType != PdfMimeType {
+		t.Fatalf("Expected only the role of the file to change but was %+v", book.Files["fixes.pdf"])
+	}
+
+	if err := library.SetFileRole(book.ID, "fixes.pdf", FileRole("poster")); err != InvalidFileRole {
+		t.Fatalf("Expected InvalidFileRole setting an unknown role but got %v", err)
+	}
+	if err := library.SetFileRole(book.ID, "missing.pdf", RoleEbook); err != FileNotFound {
+		t.Fatalf("Expected FileNotFound setting the role of a missing file but got %v", err)
+	}
+}
+
+func testFilesRecordTheirChecksums(t *testing.T, library Library) {
+	book, _ := library.Add(aBook("Book1", "mr writer", 2016, nil), noImage, fileReaders(map[string][]byte{"file.txt": []byte("file 1")}))
+	if book.Files["file.txt"].Checksum != "83bf7fcd913e81d35f0d0e94ed1ec0611e8e3b4909c23b00ef9f076f205e67c6" {
+		t.Fatalf("Expected the SHA-256 of the added file but was %s", book.Files["file.txt"].Checksum)
+	}
+
+	assert.NoError(t, library.AddFileToBook(book.ID, "file.txt", bytes.NewReader([]byte("file 2"))))
+	book, _ = library.GetBookByID(book.ID)
+	if book.Files["file.txt"].Checksum != "fe7f1034d4a63dde9192739732fb553a720788f422c5723ec7ca1c683280837e" {
+		t.Fatalf("Expected the SHA-256 of the replacement file but was %s", book.Files["file.txt"].Checksum)
+	}
+}
+
+func testFailedUploadsChangeNothing(t *testing.T, library Library) {
+	bookFiles := map[string][]byte{"file.txt": []byte("file 1")}
+	book, _ := library.Add(aBook("Book1", "mr writer", 2016, nil), noImage, fileReaders(bookFiles))
+
+	if err := library.AddFileToBook(book.ID, "file.txt", anUploadWhichFails()); err != errUploadFailed {
+		t.Fatalf("Expected the upload's error replacing a file but got %v", err)
+	}
+	assertBookFiles(library, book.ID, bookFiles, t)
+
+	failedFiles := map[string]io.Reader{"file.txt": anUploadWhichFails()}
+	if _, err := library.Add(aBook("Book2", "mr writer", 2016, nil), noImage, failedFiles); err != errUploadFailed {
+		t.Fatalf("Expected the upload's error adding a book but got %v", err)
+	}
+	if books := library.GetAll(); len(books) != 1 {
+		t.Fatalf("Expected only the first book but found %d books", len(books))
+	}
+}
+
+func testBooksCanBeTrashedRestoredAndPurged(t *testing.T, library Library) {
+	bookFiles := map[string][]byte{"file1.json": aJsonFile()}
+	book, _ := library.Add(aBook("Book1", "mr writer", 2016, nil), aPngImage(t), fileReaders(bookFiles))
+
+	assert.NoError(t, library.DeleteBook(book.ID))
+	if _, err := library.GetBookByID(book.ID); err != BookNotFound {
+		t.Fatalf("Expected deleted book to be removed from the library but got %v", err)
+	}
+	if trash := library.GetTrash(); len(trash) != 1 || trash[0].ID != book.ID {
+		t.Fatalf("Expected deleted book in the trash but found %v", trash)
+	}
+
+	restored, err := library.RestoreBook(book.ID)
+	assert.NoError(t, err)
+	if restored.ID != book.ID || restored.Image == "" || len(library.GetTrash()) != 0 {
+		t.Fatalf("Expected book %v to be restored from the trash but got %v", book, restored)
+	}
+	assertBookFiles(library, book.ID, bookFiles, t)
+	assertContent(library.OpenBookImage(book.ID))(aPngImage(t), t)
+
+	assert.NoError(t, library.DeleteBook(book.ID))
+	assert.NoError(t, library.PurgeBook(book.ID))
+	if len(library.GetTrash()) != 0 || len(library.GetAll()) != 0 {
+		t.Fatalf("Expected purged book to be gone but found %v and %v in trash", library.GetAll(), library.GetTrash())
+	}
+}
+
+func testIdsOfBooksInTheTrashAreNotReused(t *testing.T, library Library) {
+	book, _ := library.Add(aBook("Book1", "mr writer", 2016, nil), noImage, emptyFileMap())
+	assert.NoError(t, library.DeleteBook(book.ID))
+
+	newBook, err := library.Add(aBook("Book2", "mrs writer", 2015, nil), noImage, emptyFileMap())
+	assert.NoError(t, err)
+	if newBook.ID == book.ID {
+		t.Fatalf("New book was given the id %d of a book in the trash", book.ID)
+	}
+}
+
+func testCoversCanBeSetAndRemoved(t *testing.T, library Library) {
+	book, _ := library.Add(aBook("Book1", "mr writer", 2016, nil), noImage, emptyFileMap())
+	if _, err := library.OpenBookImage(book.ID); err != BookHasNoImage {
+		t.Fatalf("Expected BookHasNoImage for a book without a cover but got %v", err)
+	}
+
+	updated, err := library.SetBookImage(book.ID, aJpegImage(t))
+	assert.NoError(t, err)
+	if updated.Image == "" {
+		t.Fatal("Expected book to have a cover")
+	}
+	assertContent(library.OpenBookImage(book.ID))(aJpegImage(t), t)
+
+	assert.NoError(t, library.RemoveBookImage(book.ID))
+	book, _ = library.GetBookByID(book.ID)
+	if book.Image != "" {
+		t.Fatalf("Expected no cover but image was '%s'", book.Image)
+	}
+	if _, err := library.OpenThumbnail(book.ID, SmallThumbnail.Name); err != BookHasNoImage {
+		t.Fatalf("Expected BookHasNoImage for a removed cover but got %v", err)
+	}
+}
+
+func testUnsupportedImagesAreRejected(t *testing.T, library Library) {
+	if _, err := library.Add(aBook("Book1", "mr writer", 2016, nil), aJsonFile(), emptyFileMap()); err != UnsupportedImageType {
+		t.Fatalf("Expected UnsupportedImageType adding a book but got %v", err)
+	}
+
+	book, err := library.Add(aBook("Book1", "mr writer", 2016, nil), noImage, emptyFileMap())
+	assert.NoError(t, err)
+	if book.ID != 1 {
+		t.Fatalf("Expected a rejected book not to use up an id but new book has id %d", book.ID)
+	}
+	if _, err = library.SetBookImage(book.ID, aJsonFile()); err != UnsupportedImageType {
+		t.Fatalf("Expected UnsupportedImageType setting a cover but got %v", err)
+	}
+}
+
+func testThumbnailsAreServedForCovers(t *testing.T, library Library) {
+	book, _ := library.Add(aBook("Book1", "mr writer", 2016, nil), aPngImage(t), emptyFileMap())
+
+	for _, size := range ThumbnailSizes {
+		thumbnail, err := library.OpenThumbnail(book.ID, size.Name)
+		assert.NoError(t, err)
+		data, err := ioutil.ReadAll(thumbnail)
+		thumbnail.Close()
+		assert.NoError(t, err)
+
+		_, format, err := image.DecodeConfig(bytes.NewReader(data))
+		assert.NoError(t, err)
+		if format != "jpeg" {
+			t.Fatalf("Expected a jpeg %s thumbnail but was %s", size.Name, format)
+		}
+	}
+
+	if _, err := library.OpenThumbnail(book.ID, "huge"); err == nil {
+		t.Fatal("Expected error opening an unknown thumbnail size")
+	}
+}
+
+func testConcurrentChangesAreSafe(t *testing.T, library Library) {
+	numWriters := 20
+	var wg sync.WaitGroup
+	for i := 0; i < numWriters; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			book, err := library.Add(aBook(fmt.Sprintf("Book%d", i), "mr writer", 2016, nil), noImage, emptyFileMap())
+			if err != nil {
+				t.Errorf("Error adding book: %v", err)
+				return
+			}
+			library.AddFileToBook(book.ID, "file1.json", bytes.NewReader(aJsonFile()))
+			library.UpdateBook(book.ID, aBook("Updated", "mr writer", 2016, nil))
+			if i%2 == 0 {
+				library.DeleteBook(book.ID)
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for _, book := range library.GetAll() {
+				for range book.Files {
+				}
+			}
+			library.GetTrash()
+		}()
+	}
+	wg.Wait()
+
+	ids := []int{}
+	for _, book := range append(library.GetAll(), library.GetTrash()...) {
+		ids = append(ids, book.ID)
+	}
+	sort.Ints(ids)
+	for i, id := range ids {
+		if id != i+1 {
+			t.Fatalf("Expected ids 1 to %d but found %v", numWriters, ids)
+		}
+	}
+}
+
+func testChangesCarryOnDuringUploads(t *testing.T, library Library) {
+	book, _ := library.Add(aBook("Book1", "mr writer", 2016, nil), noImage, emptyFileMap())
+	rename := func(title string) func() error {
+		return func() error {
+			_, err := library.UpdateBook(book.ID, aBook(title, "mr writer", 2016, nil))
+			return err
+		}
+	}
+
+	whileUploading(func(content io.Reader) error {
+		_, err := library.Add(aBook("Book2", "mr writer", 2016, nil), noImage, map[string]io.Reader{"file.txt": content})
+		return err
+	}, rename("Renamed during an upload"), t)
+	whileUploading(func(content io.Reader) error {
+		return library.AddFileToBook(book.ID, "file.txt", content)
+	}, rename("Renamed during another upload"), t)
+
+	book, _ = library.GetBookByID(book.ID)
+	if book.Title != "Renamed during another upload" {
+		t.Fatalf("Expected the change made during the upload to be kept but the title was %s", book.Title)
+	}
+	assertBookFiles(library, book.ID, map[string][]byte{"file.txt": []byte("the start of the file")}, t)
+}
+
+// whileUploading starts an upload of a file, makes the change once the
+// library has started reading the file and checks the change is made
+// before the upload finishes
+func whileUploading(upload func(content io.Reader) error, change func() error, t *testing.T) {
+	content, uploader := io.Pipe()
+	uploaded := make(chan error, 1)
+	go func() { uploaded <- upload(content) }()
+	// returns once the library has read it
+	uploader.Write([]byte("the start of the file"))
+
+	changed := make(chan error, 1)
+	go func() { changed <- change() }()
+	select {
+	case err := <-changed:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		uploader.Close()
+		t.Fatal("Expected the library to be changed while a file was being uploaded")
+	}
+	uploader.Close()
+	assert.NoError(t, <-uploaded)
+}
+
+var errUploadFailed = errors.New("connection reset")
+
+// anUploadWhichFails returns the content of an upload which fails part way
+// through
+func anUploadWhichFails() io.Reader {
+	return io.MultiReader(bytes.NewReader([]byte("the start of the file")), failingReader{})
+}
+
+type failingReader struct{}
+
+func (failingReader) Read(data []byte) (int, error) {
+	return 0, errUploadFailed
+}
+
+// assertBookFiles checks the book with the given id has exactly the
+// expected files with the expected contents
+func assertBookFiles(library Library, bookID int, expected map[string][]byte, t *testing.T) {
+	book, err := library.GetBookByID(bookID)
+	assert.NoError(t, err)
+	if len(book.Files) != len(expected) {
+		t.Fatalf("Expected %d files but found %v", len(expected), book.Files)
+	}
+	for name, data := range expected {
+		if _, found := book.Files[name]; !found {
+			t.Fatalf("Expected a file called %s but found %v", name, book.Files)
+		}
+		assertContent(library.OpenBookFile(bookID, name))(data, t)
+	}
+}
+
+// assertContent returns a check that the content opened without error
+// and contains the expected data, e.g.
+// assertContent(library.OpenBookImage(id))(expectedImage, t)
+func assertContent(content FileContent, err error) func(expected []byte, t *testing.T) {
+	return func(expected []byte, t *testing.T) {
+		assert.NoError(t, err)
+		defer content.Close()
+		data, err := ioutil.ReadAll(content)
+		assert.NoError(t, err)
+		if !bytes.Equal(data, expected) {
+			t.Fatalf("Expected content '%s' but found '%s'", expected, data)
+		}
+	}
+}
@@ -0,0 +1,22 @@
+package ebooks
+
+import (
+	"fmt"
+	"os"
+)
+
+// Name of the file in the base directory of a file library which the
+// process using the library holds a lock on, so that another process
+// cannot change the library at the same time
+const LockFileName = "library.lock"
+
+// lockLibrary takes an exclusive lock on the lock file at the given path,
+// creating it if needed. The lock is held until the returned file is
+// closed or the process exits.
+func lockLibrary(path string) (*os.File, error) {
+	file, err := lockFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot lock %s, the library may be in use by another process: %v", path, err)
+	}
+	return file, nil
+}
@@ -0,0 +1,23 @@
+//go:build !windows
+// +build !windows
+
+package ebooks
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile opens the file at the given path and takes an exclusive flock
+// on it, failing rather than waiting if another process holds it
+func lockFile(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
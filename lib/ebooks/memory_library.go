@@ -0,0 +1,353 @@
+package ebooks
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"time"
+)
+
+var _ Library = &MemoryLibrary{}
+
+// NewMemoryLibrary creates an empty library which keeps all books and the
+// contents of their files in memory, nothing is persisted
+func NewMemoryLibrary() *MemoryLibrary {
+	return &MemoryLibrary{
+		index: make(map[int]*memoryBook),
+		trash: make(map[int]*memoryBook),
+	}
+}
+
+// A library held entirely in memory, e.g. for tests and demos. It behaves
+// the same as a FileLibrary, including ids and errors. All methods are
+// safe to call from multiple goroutines.
+type MemoryLibrary struct {
+
+	// Guards maxID, index, trash and every book in them
+	mutex sync.RWMutex
+
+	// Counter tracking the largest book id currently in the library or
+	// its trash
+	maxID int
+
+	// All books currently in the library indexed by id
+	index map[int]*memoryBook
+
+	// Deleted books which can still be restored indexed by id
+	trash map[int]*memoryBook
+}
+
+// A book in a MemoryLibrary with the contents of its files and cover
+type memoryBook struct {
+	*Ebook
+
+	// Contents of each file by name
+	fileData map[string][]byte
+
+	image []byte
+
+	// Thumbnails of the cover by size name
+	thumbnails map[string][]byte
+}
+
+// memoryContent is the FileContent of a file held in memory
+type memoryContent struct {
+	*bytes.Reader
+}
+
+func (content memoryContent) Close() error {
+	return nil
+}
+
+func newMemoryContent(data []byte) FileContent {
+	return memoryContent{bytes.NewReader(data)}
+}
+
+func (lib *MemoryLibrary) Add(bookDetails *BookDetails, image []byte, files map[string]io.Reader) (*Ebook, error) {
+	imageName, err := memoryImageName(image)
+	if err != nil {
+		return nil, err
+	}
+	thumbnails := generateThumbnails(image)
+
+	now := time.Now().UTC()
+	book := &memoryBook{
+		Ebook:      &Ebook{0, make(map[string]*BookFile), imageName, now, now, bookDetails},
+		fileData:   make(map[string][]byte),
+		image:      copyBytes(image),
+		thumbnails: thumbnails,
+	}
+	for fileName, content := range files {
+		file, data, err := readMemoryFile(fileName, content, now)
+		if err != nil {
+			return nil, err
+		}
+		book.Files[fileName], book.fileData[fileName] = file, data
+	}
+
+	lib.mutex.Lock()
+	defer lib.mutex.Unlock()
+
+	lib.maxID += 1
+	book.ID = lib.maxID
+	lib.index[book.ID] = book
+	return book.copy(), nil
+}
+
+func (lib *MemoryLibrary) UpdateBook(id int, bookDetails *BookDetails) (*Ebook, error) {
+	lib.mutex.Lock()
+	defer lib.mutex.Unlock()
+
+	book, found := lib.index[id]
+	if !found {
+		return nil, BookNotFound
+	}
+	book.BookDetails = bookDetails
+	book.Updated = time.Now().UTC()
+	return book.copy(), nil
+}
+
+func (lib *MemoryLibrary) SetBookImage(id int, image []byte) (*Ebook, error) {
+	imageName, err := memoryImageName(image)
+	if err != nil {
+		return nil, err
+	}
+	thumbnails := generateThumbnails(image)
+
+	lib.mutex.Lock()
+	defer lib.mutex.Unlock()
+
+	book, found := lib.index[id]
+	if !found {
+		return nil, BookNotFound
+	}
+	book.Image = imageName
+	book.image = copyBytes(image)
+	book.thumbnails = thumbnails
+	book.Updated = time.Now().UTC()
+	return book.copy(), nil
+}
+
+func (lib *MemoryLibrary) RemoveBookImage(id int) error {
+	lib.mutex.Lock()
+	defer lib.mutex.Unlock()
+
+	book, found := lib.index[id]
+	if !found {
+		return BookNotFound
+	}
+	book.Image = ""
+	book.image = nil
+	book.thumbnails = nil
+	book.Updated = time.Now().UTC()
+	return nil
+}
+
+func (lib *MemoryLibrary) OpenBookImage(id int) (FileContent, error) {
+	lib.mutex.RLock()
+	defer lib.mutex.RUnlock()
+
+	book, found := lib.index[id]
+	if !found {
+		return nil, BookNotFound
+	}
+	if book.Image == "" {
+		return nil, BookHasNoImage
+	}
+	return newMemoryContent(book.image), nil
+}
+
+func (lib *MemoryLibrary) OpenThumbnail(id int, sizeName string) (FileContent, error) {
+	if _, err := thumbnailSizeByName(sizeName); err != nil {
+		return nil, err
+	}
+
+	lib.mutex.RLock()
+	defer lib.mutex.RUnlock()
+
+	book, found := lib.index[id]
+	if !found {
+		return nil, BookNotFound
+	}
+	if book.Image == "" {
+		return nil, BookHasNoImage
+	}
+
+	thumbnail, found := book.thumbnails[sizeName]
+	if !found {
+		return newMemoryContent(book.image), nil
+	}
+	return newMemoryContent(thumbnail), nil
+}
+
+func (lib *MemoryLibrary) AddFileToBook(bookID int, name string, content io.Reader) error {
+	now := time.Now().UTC()
+	file, data, err := readMemoryFile(name, content, now)
+	if err != nil {
+		return err
+	}
+
+	lib.mutex.Lock()
+	defer lib.mutex.Unlock()
+
+	book, found := lib.index[bookID]
+	if !found {
+		return BookNotFound
+	}
+	book.Files[name], book.fileData[name] = file, data
+	book.Updated = now
+	return nil
+}
+
+func (lib *MemoryLibrary) DeleteFileFromBook(bookID int, fileName string) error {
+	lib.mutex.Lock()
+	defer lib.mutex.Unlock()
+
+	book, found := lib.index[bookID]
+	if !found {
+		return BookNotFound
+	}
+	if _, exists := book.Files[fileName]; !exists {
+		return FileNotFound
+	}
+	delete(book.Files, fileName)
+	delete(book.fileData, fileName)
+	book.Updated = time.Now().UTC()
+	return nil
+}
+
+func (lib *MemoryLibrary) SetFileRole(bookID int, fileName string, role FileRole) error {
+	if !role.IsValid() {
+		return InvalidFileRole
+	}
+
+	lib.mutex.Lock()
+	defer lib.mutex.Unlock()
+
+	book, found := lib.index[bookID]
+	if !found {
+		return BookNotFound
+	}
+	file, exists := book.Files[fileName]
+	if !exists {
+		return FileNotFound
+	}
+	file.Role = role
+	book.Updated = time.Now().UTC()
+	return nil
+}
+
+func (lib *MemoryLibrary) OpenBookFile(bookID int, fileName string) (FileContent, error) {
+	lib.mutex.RLock()
+	defer lib.mutex.RUnlock()
+
+	book, found := lib.index[bookID]
+	if !found {
+		return nil, BookNotFound
+	}
+	data, exists := book.fileData[fileName]
+	if !exists {
+		return nil, FileNotFound
+	}
+	return newMemoryContent(data), nil
+}
+
+func (lib *MemoryLibrary) DeleteBook(id int) error {
+	lib.mutex.Lock()
+	defer lib.mutex.Unlock()
+
+	book, found := lib.index[id]
+	if !found {
+		return BookNotFound
+	}
+	delete(lib.index, id)
+	lib.trash[id] = book
+	return nil
+}
+
+func (lib *MemoryLibrary) RestoreBook(id int) (*Ebook, error) {
+	lib.mutex.Lock()
+	defer lib.mutex.Unlock()
+
+	book, found := lib.trash[id]
+	if !found {
+		return nil, BookNotFound
+	}
+	delete(lib.trash, id)
+	lib.index[id] = book
+	return book.copy(), nil
+}
+
+func (lib *MemoryLibrary) PurgeBook(id int) error {
+	lib.mutex.Lock()
+	defer lib.mutex.Unlock()
+
+	if _, found := lib.trash[id]; !found {
+		return BookNotFound
+	}
+	delete(lib.trash, id)
+	return nil
+}
+
+func (lib *MemoryLibrary) GetTrash() []*Ebook {
+	lib.mutex.RLock()
+	defer lib.mutex.RUnlock()
+	return copyMemoryBooks(lib.trash)
+}
+
+func (lib *MemoryLibrary) GetBookByID(id int) (*Ebook, error) {
+	lib.mutex.RLock()
+	defer lib.mutex.RUnlock()
+
+	book, found := lib.index[id]
+	if !found {
+		return nil, BookNotFound
+	}
+	return book.copy(), nil
+}
+
+func (lib *MemoryLibrary) GetAll() []*Ebook {
+	lib.mutex.RLock()
+	defer lib.mutex.RUnlock()
+	return copyMemoryBooks(lib.index)
+}
+
+// readMemoryFile reads the whole of a file with the given name and returns
+// its record, as added at the given time, along with its contents. The
+// file's name doubles as where it is stored.
+func readMemoryFile(name string, content io.Reader, added time.Time) (*BookFile, []byte, error) {
+	data := &bytes.Buffer{}
+	file, err := copyBookFile(data, name, content, added)
+	if err != nil {
+		return nil, nil, err
+	}
+	return file.withPath(name), data.Bytes(), nil
+}
+
+func copyMemoryBooks(books map[int]*memoryBook) []*Ebook {
+	copies := make([]*Ebook, 0, len(books))
+	for _, book := range books {
+		copies = append(copies, book.copy())
+	}
+	return copies
+}
+
+// memoryImageName returns the name a cover is stored under, the same as
+// a FileLibrary uses, or an error if the image type is not supported
+func memoryImageName(image []byte) (string, error) {
+	if image == nil {
+		return "", nil
+	}
+	ext, err := imageFileExtension(image)
+	if err != nil {
+		return "", err
+	}
+	return coverFileName + ext, nil
+}
+
+func copyBytes(data []byte) []byte {
+	if data == nil {
+		return nil
+	}
+	return append([]byte{}, data...)
+}
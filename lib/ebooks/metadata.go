@@ -0,0 +1,301 @@
+package ebooks
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	. "github.com/stephenhenderson/ebooklib/lib/logging"
+)
+
+// Largest file metadata is extracted from by extractors which need the
+// whole file in memory, MetadataFileExtractors read files of any size
+var MaxMetadataFileSize int64 = 32 << 20
+
+// MIME types of the book formats which are sniffed from their contents
+const (
+	EpubMimeType = "application/epub+zip"
+	PdfMimeType  = "application/pdf"
+	MobiMimeType = "application/x-mobipocket-ebook"
+)
+
+// Metadata extracted from a book file
+type ExtractedMetadata struct {
+	// The details found in the file, any of which may be blank
+	*BookDetails
+
+	// The cover image embedded in the file, nil if there is none
+	Cover []byte
+}
+
+// CompleteBookDetails fills in any of the title, authors, year and tags
+// which are blank in the book details from the extracted metadata, fields
+// which are already set are kept
+func (metadata *ExtractedMetadata) CompleteBookDetails(details *BookDetails) {
+	if metadata.BookDetails == nil {
+		return
+	}
+	if details.Title == "" {
+		details.Title = metadata.Title
+	}
+	if len(details.Authors) == 0 && len(metadata.Authors) > 0 {
+		details.Authors = metadata.Authors
+	}
+	if details.Year == 0 {
+		details.Year = metadata.Year
+	}
+	if len(details.Tags) == 0 && len(metadata.Tags) > 0 {
+		details.Tags = metadata.Tags
+	}
+}
+
+// A MetadataExtractor reads the details of a book, and optionally its
+// cover, from the contents of one of the book's files
+type MetadataExtractor interface {
+	ExtractMetadata(data []byte) (*ExtractedMetadata, error)
+}
+
+// A MetadataFileExtractor is a MetadataExtractor which can also read the
+// metadata from a file without reading the whole of it into memory, which
+// ExtractFile does in preference for contents which are an io.ReaderAt
+type MetadataFileExtractor interface {
+	MetadataExtractor
+	ExtractMetadataFromFile(content io.ReaderAt, size int64) (*ExtractedMetadata, error)
+}
+
+// MetadataExtractorFunc adapts a function to a MetadataExtractor
+type MetadataExtractorFunc func(data []byte) (*ExtractedMetadata, error)
+
+func (extract MetadataExtractorFunc) ExtractMetadata(data []byte) (*ExtractedMetadata, error) {
+	return extract(data)
+}
+
+// MetadataExtractors is a registry of extractors by file extension and by
+// MIME type. The extractor for a file's extension is used if there is one,
+// otherwise the extractor for the MIME type sniffed from its contents.
+type MetadataExtractors struct {
+	mutex       sync.RWMutex
+	byExtension map[string]MetadataExtractor
+	byMimeType  map[string]MetadataExtractor
+}
+
+// NewMetadataExtractors returns an empty registry
+func NewMetadataExtractors() *MetadataExtractors {
+	return &MetadataExtractors{
+		byExtension: make(map[string]MetadataExtractor),
+		byMimeType:  make(map[string]MetadataExtractor),
+	}
+}
+
+// RegisterExtension sets the extractor for files with the extension, e.g.
+// ".epub", replacing any extractor already registered for it
+func (extractors *MetadataExtractors) RegisterExtension(ext string, extractor MetadataExtractor) {
+	ext = strings.ToLower(ext)
+	if !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+	extractors.mutex.Lock()
+	defer extractors.mutex.Unlock()
+	extractors.byExtension[ext] = extractor
+}
+
+// RegisterMimeType sets the extractor for files whose contents are sniffed
+// as the MIME type, replacing any extractor already registered for it
+func (extractors *MetadataExtractors) RegisterMimeType(mimeType string, extractor MetadataExtractor) {
+	extractors.mutex.Lock()
+	defer extractors.mutex.Unlock()
+	extractors.byMimeType[strings.ToLower(mimeType)] = extractor
+}
+
+// ExtractFile returns the metadata of the file from the extractor for its
+// extension or MIME type, nil if there is no extractor for the file. Only
+// the start of the file is read unless there is an extractor for it. Unless
+// the extractor is a MetadataFileExtractor and the content an io.ReaderAt,
+// e.g. an uploaded or stored file, it needs the whole file in memory so
+// files larger than MaxMetadataFileSize are rejected. The content is left
+// at its start to be read again.
+func (extractors *MetadataExtractors) ExtractFile(fileName string, content io.ReadSeeker) (*ExtractedMetadata, error) {
+	defer content.Seek(0, io.SeekStart)
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	head, err := ioutil.ReadAll(io.LimitReader(content, mimeSniffLength))
+	if err != nil {
+		return nil, err
+	}
+
+	extractors.mutex.RLock()
+	extractor, found := extractors.byExtension[strings.ToLower(filepath.Ext(fileName))]
+	if !found {
+		extractor, found = extractors.byMimeType[sniffMimeType(head)]
+	}
+	extractors.mutex.RUnlock()
+
+	if !found {
+		return nil, nil
+	}
+	size, err := content.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if fileExtractor, ok := extractor.(MetadataFileExtractor); ok {
+		if readerAt, ok := content.(io.ReaderAt); ok {
+			return fileExtractor.ExtractMetadataFromFile(readerAt, size)
+		}
+	}
+	if size > MaxMetadataFileSize {
+		return nil, fmt.Errorf("file is %d bytes, metadata is only read from files up to %d bytes", size, MaxMetadataFileSize)
+	}
+	if _, err = content.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(content)
+	if err != nil {
+		return nil, err
+	}
+	return extractor.ExtractMetadata(data)
+}
+
+// Extract returns the metadata of all the files merged together. Files are
+// read in order of file name and each field is taken from the first file
+// which has it, so is the cover if it is a supported image type. Files
+// whose metadata cannot be read are logged and skipped.
+//
+// Details entered by the user take precedence over the extracted ones, so
+// they should be completed with the result rather than the other way round.
+func (extractors *MetadataExtractors) Extract(files map[string]io.ReadSeeker) *ExtractedMetadata {
+	fileNames := []string{}
+	for fileName := range files {
+		fileNames = append(fileNames, fileName)
+	}
+	sort.Strings(fileNames)
+
+	merged := &ExtractedMetadata{BookDetails: &BookDetails{Authors: []string{}, Tags: []string{}}}
+	for _, fileName := range fileNames {
+		metadata, err := extractors.ExtractFile(fileName, files[fileName])
+		if err != nil {
+			Logger.Printf("Unable to read metadata from %s: %v", fileName, err)
+			continue
+		}
+		if metadata == nil {
+			continue
+		}
+		metadata.CompleteBookDetails(merged.BookDetails)
+		if merged.Cover == nil && metadata.Cover != nil {
+			if _, err := imageFileExtension(metadata.Cover); err == nil {
+				merged.Cover = metadata.Cover
+			}
+		}
+	}
+	return merged
+}
+
+// BackfillCovers sets the cover of every book in the library which has none
+// to the first cover embedded in its files, which also generates its
+// thumbnails. It returns the number of books given a cover and the number
+// which failed, books whose files cannot be read or whose cover cannot be
+// saved are logged and skipped.
+func (extractors *MetadataExtractors) BackfillCovers(library Library) (backfilled int, failed int) {
+	for _, book := range library.GetAll() {
+		if book.Image != "" {
+			continue
+		}
+
+		cover := extractors.extractCoverOfBook(library, book)
+		if cover == nil {
+			continue
+		}
+		if _, err := library.SetBookImage(book.ID, cover); err != nil {
+			Logger.Printf("Error setting cover of book=%d: %v", book.ID, err)
+			failed++
+			continue
+		}
+		backfilled++
+	}
+	return backfilled, failed
+}
+
+// extractCoverOfBook returns the first cover embedded in the files of the
+// book, nil if there is none
+func (extractors *MetadataExtractors) extractCoverOfBook(library Library, book *Ebook) []byte {
+	files := make(map[string]io.ReadSeeker, len(book.Files))
+	for fileName := range book.Files {
+		content, err := library.OpenBookFile(book.ID, fileName)
+		if err != nil {
+			Logger.Printf("Error reading %s of book=%d for its cover: %v", fileName, book.ID, err)
+			continue
+		}
+		defer content.Close()
+		files[fileName] = content
+	}
+	return extractors.Extract(files).Cover
+}
+
+// The registry used by the webservice with extractors for epubs, pdfs and
+// mobis, in-house extractors can be added to it with RegisterExtension and
+// RegisterMimeType
+var DefaultMetadataExtractors = newDefaultMetadataExtractors()
+
+func newDefaultMetadataExtractors() *MetadataExtractors {
+	extractors := NewMetadataExtractors()
+	epub := epubMetadataExtractor{}
+	extractors.RegisterExtension(".epub", epub)
+	extractors.RegisterMimeType(EpubMimeType, epub)
+
+	pdf := pdfMetadataExtractor{}
+	extractors.RegisterExtension(".pdf", pdf)
+	extractors.RegisterMimeType(PdfMimeType, pdf)
+
+	mobi := MetadataExtractorFunc(extractMobiMetadata)
+	for _, ext := range []string{".mobi", ".azw", ".azw3"} {
+		extractors.RegisterExtension(ext, mobi)
+	}
+	extractors.RegisterMimeType(MobiMimeType, mobi)
+	return extractors
+}
+
+// ExtractMetadata returns the merged metadata of the files using the
+// default registry
+func ExtractMetadata(files map[string]io.ReadSeeker) *ExtractedMetadata {
+	return DefaultMetadataExtractors.Extract(files)
+}
+
+// sniffMimeType returns the MIME type of the file contents without any
+// parameters, recognising epubs and mobis as well as the types known to
+// http.DetectContentType
+func sniffMimeType(data []byte) string {
+	// an epub is a zip whose first entry is an uncompressed file called
+	// mimetype containing its MIME type
+	if len(data) > 30 && bytes.HasPrefix(data[30:], []byte("mimetype"+EpubMimeType)) {
+		return EpubMimeType
+	}
+	if len(data) >= palmDBHeaderLength && string(data[palmDBTypeOffset:palmDBTypeOffset+8]) == "BOOKMOBI" {
+		return MobiMimeType
+	}
+	mimeType, _, err := mime.ParseMediaType(http.DetectContentType(data))
+	if err != nil {
+		return ""
+	}
+	return mimeType
+}
+
+// yearFromDate returns the year from a date starting with a four digit
+// year, 0 if it does not
+func yearFromDate(date string) int {
+	if len(date) < 4 {
+		return 0
+	}
+	year, err := strconv.Atoi(date[:4])
+	if err != nil || year < 0 {
+		return 0
+	}
+	return year
+}
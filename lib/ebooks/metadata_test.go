@@ -0,0 +1,199 @@
+package ebooks
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// anInHouseExtractor reads "title|author" files
+var anInHouseExtractor = MetadataExtractorFunc(func(data []byte) (*ExtractedMetadata, error) {
+	fields := strings.Split(string(data), "|")
+	if len(fields) != 2 {
+		return nil, errors.New("Invalid in-house file")
+	}
+	return &ExtractedMetadata{BookDetails: &BookDetails{Title: fields[0], Authors: []string{fields[1]}}}, nil
+})
+
+func TestRegisteredExtractorsAreUsedForTheirExtension(t *testing.T) {
+	extractors := NewMetadataExtractors()
+	extractors.RegisterExtension("XYZ", anInHouseExtractor)
+
+	metadata, err := extractors.ExtractFile("book.xyz", bytes.NewReader([]byte("Title|Author")))
+	if err != nil {
+		t.Fatalf("Error extracting metadata: %v", err)
+	}
+	if metadata.Title != "Title" {
+		t.Fatalf("Expected title from the in-house extractor but was %+v", metadata.BookDetails)
+	}
+
+	metadata, err = extractors.ExtractFile("book.txt", bytes.NewReader([]byte("Title|Author")))
+	if metadata != nil || err != nil {
+		t.Fatalf("Expected no metadata for a file without an extractor but was %v, %v", metadata, err)
+	}
+}
+
+func TestExtractorsAreChosenByMimeTypeWhenTheExtensionIsUnknown(t *testing.T) {
+	pdf := aPdfWithObjects("trailer << /Info 1 0 R >>", "<< /Title (Sniffed) >>")
+	epub := anEpub(map[string]string{
+		"mimetype":               EpubMimeType,
+		"META-INF/container.xml": epubContainerXml,
+		"OEBPS/content.opf":      epub3Opf,
+	}, t)
+
+	for _, data := range [][]byte{pdf, epub, aMobi("Title", mobiUTF8, nil)} {
+		metadata, err := DefaultMetadataExtractors.ExtractFile("download.bin", bytes.NewReader(data))
+		if err != nil || metadata == nil || metadata.Title == "" {
+			t.Fatalf("Expected metadata to be extracted from a file with an unknown extension but was %v, %v", metadata, err)
+		}
+	}
+}
+
+func TestOnlyTheStartOfAFileWithoutAnExtractorIsRead(t *testing.T) {
+	content := &countingReadSeeker{ReadSeeker: bytes.NewReader(make([]byte, 1<<20))}
+	metadata, err := DefaultMetadataExtractors.ExtractFile("course.mp4", content)
+	if metadata != nil || err != nil {
+		t.Fatalf("Expected no metadata for a file without an extractor but was %v, %v", metadata, err)
+	}
+	if content.read > mimeSniffLength {
+		t.Fatalf("Expected only the start of the file to be read but %d bytes were", content.read)
+	}
+	if position, _ := content.Seek(0, io.SeekCurrent); position != 0 {
+		t.Fatalf("Expected the file to be left at its start but was at %d", position)
+	}
+}
+
+func TestMetadataIsNotReadFromFilesLargerThanTheLimit(t *testing.T) {
+	defer func(limit int64) { MaxMetadataFileSize = limit }(MaxMetadataFileSize)
+	MaxMetadataFileSize = 10
+	extractors := NewMetadataExtractors()
+	extractors.RegisterExtension(".xyz", anInHouseExtractor)
+
+	metadata, err := extractors.ExtractFile("book.xyz", bytes.NewReader([]byte("Long Title|Author")))
+	if metadata != nil || err == nil {
+		t.Fatalf("Expected an error for a file over the limit but was %v, %v", metadata, err)
+	}
+}
+
+func TestMetadataOfALargePdfIsReadFromItsStartAndEnd(t *testing.T) {
+	defer func(limit int64) { MaxMetadataFileSize = limit }(MaxMetadataFileSize)
+	MaxMetadataFileSize = 10
+	pdf := aPdfWithObjects("", "<< /Title (Concurrency in Go) >>")
+	pdf = append(pdf, bytes.Repeat([]byte("x"), 2*pdfMetadataWindow)...)
+	pdf = append(pdf, "\ntrailer << /Info 1 0 R >>\n%%EOF\n"...)
+
+	metadata, err := DefaultMetadataExtractors.ExtractFile("book.pdf", bytes.NewReader(pdf))
+	if err != nil || metadata.Title != "Concurrency in Go" {
+		t.Fatalf("Expected the title from the start of the pdf but was %v, %v", metadata, err)
+	}
+}
+
+func TestSniffMimeTypeRecognisesBookFormats(t *testing.T) {
+	epub := &bytes.Buffer{}
+	epub.WriteString("PK\x03\x04")
+	epub.Write(make([]byte, 26))
+	epub.WriteString("mimetypeapplication/epub+zip")
+
+	tests := map[string][]byte{
+		EpubMimeType: epub.Bytes(),
+		PdfMimeType:  aPdfWithObjects("trailer << >>"),
+		MobiMimeType: aMobi("Title", mobiUTF8, nil),
+		"image/png":  aPngImage(t),
+		"text/plain": []byte("notes"),
+	}
+	for expected, data := range tests {
+		if mimeType := sniffMimeType(data); mimeType != expected {
+			t.Fatalf("Expected MIME type %s but was %s", expected, mimeType)
+		}
+	}
+}
+
+func TestExtractTakesEachFieldFromTheFirstFileWhichHasIt(t *testing.T) {
+	extractors := NewMetadataExtractors()
+	extractors.RegisterExtension(".xyz", anInHouseExtractor)
+	extractors.RegisterExtension(".cover", MetadataExtractorFunc(func(data []byte) (*ExtractedMetadata, error) {
+		return &ExtractedMetadata{BookDetails: &BookDetails{Year: 2016, Tags: []string{"tag"}}, Cover: data}, nil
+	}))
+
+	cover := aPngImage(t)
+	metadata := extractors.Extract(fileSeekers(map[string][]byte{
+		"a.xyz":          []byte("not valid"),
+		"b.xyz":          []byte("First|First Author"),
+		"c.cover":        []byte("not an image"),
+		"d.cover":        cover,
+		"e.xyz":          []byte("Second|Second Author"),
+		"no-metadata.md": []byte("# notes"),
+	}))
+
+	expected := &BookDetails{Title: "First", Authors: []string{"First Author"}, Year: 2016, Tags: []string{"tag"}}
+	if !metadata.BookDetails.Equals(expected) {
+		t.Fatalf("Expected merged details %v but was %v", expected, metadata.BookDetails)
+	}
+	if !bytes.Equal(metadata.Cover, cover) {
+		t.Fatal("Expected the first cover which is a supported image")
+	}
+}
+
+func TestDetailsEnteredByTheUserTakePrecedenceOverExtractedMetadata(t *testing.T) {
+	metadata := &ExtractedMetadata{BookDetails: &BookDetails{
+		Title: "Extracted", Authors: []string{"Extracted Author"}, Year: 2015, Tags: []string{"extracted"},
+	}}
+	details := &BookDetails{Title: "Entered", Authors: []string{}, Tags: []string{"entered"}}
+
+	metadata.CompleteBookDetails(details)
+
+	expected := &BookDetails{Title: "Entered", Authors: []string{"Extracted Author"}, Year: 2015, Tags: []string{"entered"}}
+	if !details.Equals(expected) {
+		t.Fatalf("Expected book details %v but was %v", expected, details)
+	}
+}
+
+func TestBackfillCoversSetsTheCoverOfBooksWithoutOne(t *testing.T) {
+	library := NewMemoryLibrary()
+	cover := aPngImage(t)
+	mobi := aMobi("Title", mobiUTF8, []exthRecord{{exthCoverOffset, []byte{0, 0, 0, 0}}}, cover)
+	withoutCover, _ := library.Add(aBook("Book1", "mr writer", 2016, nil), noImage, fileReaders(map[string][]byte{"book.mobi": mobi}))
+	withCover, _ := library.Add(aBook("Book2", "mr writer", 2016, nil), aJpegImage(t), fileReaders(map[string][]byte{"book.mobi": mobi}))
+	noEmbeddedCover, _ := library.Add(aBook("Book3", "mr writer", 2016, nil), noImage, fileReaders(map[string][]byte{"book.txt": []byte("text")}))
+
+	backfilled, failed := DefaultMetadataExtractors.BackfillCovers(library)
+	if backfilled != 1 || failed != 0 {
+		t.Fatalf("Expected 1 cover to be backfilled but was %d with %d failures", backfilled, failed)
+	}
+
+	assertContent(library.OpenBookImage(withoutCover.ID))(cover, t)
+	thumbnail, err := library.OpenThumbnail(withoutCover.ID, SmallThumbnail.Name)
+	if err != nil {
+		t.Fatalf("Expected thumbnails to be generated for the cover: %v", err)
+	}
+	thumbnail.Close()
+
+	assertContent(library.OpenBookImage(withCover.ID))(aJpegImage(t), t)
+	if _, err = library.OpenBookImage(noEmbeddedCover.ID); err != BookHasNoImage {
+		t.Fatalf("Expected book without an embedded cover to have no image but got %v", err)
+	}
+}
+
+// fileSeekers returns readers of the contents of each file for extracting
+// their metadata
+func fileSeekers(files map[string][]byte) map[string]io.ReadSeeker {
+	seekers := make(map[string]io.ReadSeeker, len(files))
+	for fileName, data := range files {
+		seekers[fileName] = bytes.NewReader(data)
+	}
+	return seekers
+}
+
+// A reader which counts the bytes read from it
+type countingReadSeeker struct {
+	io.ReadSeeker
+	read int
+}
+
+func (content *countingReadSeeker) Read(data []byte) (int, error) {
+	n, err := content.ReadSeeker.Read(data)
+	content.read += n
+	return n, err
+}
@@ -0,0 +1,254 @@
+package ebooks
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+	"unicode/utf8"
+)
+
+var InvalidMobi = errors.New("Invalid mobi, not a PalmDB BOOKMOBI file")
+
+// Offsets and sizes in the PalmDB header
+const (
+	palmDBNameLength     = 32
+	palmDBTypeOffset     = 60
+	palmDBRecordsOffset  = 76
+	palmDBHeaderLength   = 78
+	palmDBRecordInfoSize = 8
+)
+
+// Offsets in record 0, which has a 16 byte PalmDOC header followed by the
+// MOBI header
+const (
+	mobiHeaderOffset       = 16
+	mobiHeaderLengthOffset = 20
+	mobiEncodingOffset     = 28
+	mobiFullNameOffset     = 84
+	mobiFullNameLength     = 88
+	mobiFirstImageOffset   = 108
+	mobiExthFlagsOffset    = 128
+	mobiExthFlag           = 0x40
+)
+
+// Text encodings of the MOBI header
+const (
+	mobiCP1252 = 1252
+	mobiUTF8   = 65001
+)
+
+// EXTH record types
+const (
+	exthAuthor          = 100
+	exthPublisher       = 101
+	exthISBN            = 104
+	exthSubject         = 105
+	exthPublicationDate = 106
+	exthCoverOffset     = 201
+	exthUpdatedTitle    = 503
+)
+
+// Metadata from the PalmDB, MOBI and EXTH headers of a Kindle mobi, azw or
+// azw3 file
+type MobiMetadata struct {
+	Title     string
+	Authors   []string
+	Publisher string
+	ISBN      string
+	Date      string
+	Subjects  []string
+
+	// The embedded cover image, nil if the book has none
+	CoverImage []byte
+}
+
+// Year returns the year the book was published, 0 if it has no date
+func (metadata *MobiMetadata) Year() int {
+	return yearFromDate(metadata.Date)
+}
+
+// BookDetails returns the title, authors, year and tags from the metadata,
+// any of which may be blank
+func (metadata *MobiMetadata) BookDetails() *BookDetails {
+	return &BookDetails{
+		Title:   metadata.Title,
+		Authors: metadata.Authors,
+		Year:    metadata.Year(),
+		Tags:    metadata.Subjects,
+	}
+}
+
+// extractMobiMetadata is the MetadataExtractor for mobis
+func extractMobiMetadata(data []byte) (*ExtractedMetadata, error) {
+	metadata, err := ReadMobiMetadata(data)
+	if err != nil {
+		return nil, err
+	}
+	return &ExtractedMetadata{BookDetails: metadata.BookDetails(), Cover: metadata.CoverImage}, nil
+}
+
+// ReadMobiMetadata reads the title, authors, publisher, ISBN, publication
+// date, subjects and cover image from a mobi file
+func ReadMobiMetadata(data []byte) (*MobiMetadata, error) {
+	if len(data) < palmDBHeaderLength || string(data[palmDBTypeOffset:palmDBTypeOffset+8]) != "BOOKMOBI" {
+		return nil, InvalidMobi
+	}
+	records := palmDBRecords(data)
+	if len(records) == 0 {
+		return nil, InvalidMobi
+	}
+
+	metadata := &MobiMetadata{Authors: []string{}, Subjects: []string{}}
+	header := records[0]
+	if len(header) < mobiHeaderOffset+8 || string(header[mobiHeaderOffset:mobiHeaderOffset+4]) != "MOBI" {
+		// a plain PalmDOC book only has the database name
+		metadata.Title = palmDBName(data)
+		return metadata, nil
+	}
+
+	encoding := readUint32(header, mobiEncodingOffset)
+	decode := func(text []byte) string {
+		return strings.TrimSpace(decodeMobiText(text, encoding))
+	}
+
+	nameOffset := int(readUint32(header, mobiFullNameOffset))
+	nameLength := int(readUint32(header, mobiFullNameLength))
+	if nameOffset > 0 && nameOffset+nameLength <= len(header) {
+		metadata.Title = decode(header[nameOffset : nameOffset+nameLength])
+	}
+	if metadata.Title == "" {
+		metadata.Title = palmDBName(data)
+	}
+
+	if readUint32(header, mobiExthFlagsOffset)&mobiExthFlag == 0 {
+		return metadata, nil
+	}
+	exthOffset := mobiHeaderOffset + int(readUint32(header, mobiHeaderLengthOffset))
+	coverOffset := -1
+	for _, record := range exthRecords(header, exthOffset) {
+		switch record.recordType {
+		case exthAuthor:
+			if author := decode(record.data); author != "" {
+				metadata.Authors = append(metadata.Authors, author)
+			}
+		case exthPublisher:
+			metadata.Publisher = decode(record.data)
+		case exthISBN:
+			metadata.ISBN = decode(record.data)
+		case exthSubject:
+			if subject := decode(record.data); subject != "" {
+				metadata.Subjects = append(metadata.Subjects, subject)
+			}
+		case exthPublicationDate:
+			metadata.Date = decode(record.data)
+		case exthUpdatedTitle:
+			if title := decode(record.data); title != "" {
+				metadata.Title = title
+			}
+		case exthCoverOffset:
+			if len(record.data) == 4 {
+				coverOffset = int(binary.BigEndian.Uint32(record.data))
+			}
+		}
+	}
+
+	// the cover offset is relative to the first image record
+	firstImage := int(readUint32(header, mobiFirstImageOffset))
+	if coverOffset >= 0 && firstImage > 0 && firstImage+coverOffset < len(records) {
+		metadata.CoverImage = records[firstImage+coverOffset]
+	}
+	return metadata, nil
+}
+
+// palmDBRecords returns the data of each record in the database, records
+// whose offsets are out of order or outside the file are empty
+func palmDBRecords(data []byte) [][]byte {
+	count := int(binary.BigEndian.Uint16(data[palmDBRecordsOffset:]))
+	if palmDBHeaderLength+count*palmDBRecordInfoSize > len(data) {
+		return nil
+	}
+
+	offsets := make([]int, count+1)
+	for i := 0; i < count; i++ {
+		offsets[i] = int(binary.BigEndian.Uint32(data[palmDBHeaderLength+i*palmDBRecordInfoSize:]))
+	}
+	// the last record runs to the end of the file
+	offsets[count] = len(data)
+
+	records := make([][]byte, count)
+	for i := range records {
+		if offsets[i] <= offsets[i+1] && offsets[i+1] <= len(data) {
+			records[i] = data[offsets[i]:offsets[i+1]]
+		}
+	}
+	return records
+}
+
+// palmDBName returns the name of the database, which is the title of the
+// book with spaces replaced by underscores
+func palmDBName(data []byte) string {
+	name := data[:palmDBNameLength]
+	if end := strings.IndexByte(string(name), 0); end >= 0 {
+		name = name[:end]
+	}
+	return strings.TrimSpace(strings.Replace(decodeMobiText(name, mobiCP1252), "_", " ", -1))
+}
+
+// An EXTH record in the MOBI header
+type exthRecord struct {
+	recordType uint32
+	data       []byte
+}
+
+// exthRecords returns the records of the EXTH header at offset in record 0,
+// stopping at the first record which runs past the end of the header
+func exthRecords(header []byte, offset int) []exthRecord {
+	records := []exthRecord{}
+	if offset+12 > len(header) || string(header[offset:offset+4]) != "EXTH" {
+		return records
+	}
+	count := int(readUint32(header, offset+8))
+	offset += 12
+	for i := 0; i < count && offset+8 <= len(header); i++ {
+		recordType := readUint32(header, offset)
+		length := int(readUint32(header, offset+4))
+		if length < 8 || offset+length > len(header) {
+			break
+		}
+		records = append(records, exthRecord{recordType, header[offset+8 : offset+length]})
+		offset += length
+	}
+	return records
+}
+
+// readUint32 reads a big-endian uint32 at offset, 0 if the data is too short
+func readUint32(data []byte, offset int) uint32 {
+	if offset < 0 || offset+4 > len(data) {
+		return 0
+	}
+	return binary.BigEndian.Uint32(data[offset:])
+}
+
+// Characters of windows-1252 between 0x80 and 0x9f which differ from latin-1
+var cp1252Runes = map[byte]rune{
+	0x80: '€', 0x82: '‚', 0x83: 'ƒ', 0x84: '„', 0x85: '…', 0x86: '†', 0x87: '‡',
+	0x88: 'ˆ', 0x89: '‰', 0x8a: 'Š', 0x8b: '‹', 0x8c: 'Œ', 0x8e: 'Ž', 0x91: '‘',
+	0x92: '’', 0x93: '“', 0x94: '”', 0x95: '•', 0x96: '–', 0x97: '—', 0x98: '˜',
+	0x99: '™', 0x9a: 'š', 0x9b: '›', 0x9c: 'œ', 0x9e: 'ž', 0x9f: 'Ÿ',
+}
+
+// decodeMobiText decodes text in the encoding given by the MOBI header
+func decodeMobiText(text []byte, encoding uint32) string {
+	if encoding == mobiUTF8 && utf8.Valid(text) {
+		return string(text)
+	}
+	runes := make([]rune, len(text))
+	for i, c := range text {
+		if r, found := cp1252Runes[c]; found {
+			runes[i] = r
+		} else {
+			runes[i] = rune(c)
+		}
+	}
+	return string(runes)
+}
@@ -0,0 +1,118 @@
+package ebooks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stephenhenderson/ebooklib/lib/utils"
+)
+
+func TestReadMobiMetadataFromTheExthHeader(t *testing.T) {
+	cover := aJpegImage(t)
+	mobi := aMobi("Full_Name", mobiUTF8, []exthRecord{
+		{exthAuthor, []byte("Alan Donovan")},
+		{exthAuthor, []byte("Brian Kernighan")},
+		{exthPublisher, []byte("Addison-Wesley")},
+		{exthISBN, []byte("9780134190440")},
+		{exthPublicationDate, []byte("2015-10-26T00:00:00+00:00")},
+		{exthSubject, []byte("golang")},
+		{exthUpdatedTitle, []byte("The Go Programming Language — 1st edition")},
+		{exthCoverOffset, []byte{0, 0, 0, 1}},
+	}, aPngImage(t), cover)
+
+	metadata, err := ReadMobiMetadata(mobi)
+	if err != nil {
+		t.Fatalf("Error reading mobi metadata: %v", err)
+	}
+	if metadata.Title != "The Go Programming Language — 1st edition" ||
+		!utils.StringSliceEquals(metadata.Authors, []string{"Alan Donovan", "Brian Kernighan"}) ||
+		metadata.Publisher != "Addison-Wesley" || metadata.ISBN != "9780134190440" ||
+		metadata.Year() != 2015 || !utils.StringSliceEquals(metadata.Subjects, []string{"golang"}) {
+		t.Fatalf("Unexpected mobi metadata %+v", metadata)
+	}
+	if !bytes.Equal(metadata.CoverImage, cover) {
+		t.Fatal("Expected the cover to be the image record the EXTH header refers to")
+	}
+}
+
+func TestReadMobiMetadataDecodesWindows1252Text(t *testing.T) {
+	mobi := aMobi("Caf\xe9 \x93Society\x94", mobiCP1252, nil)
+
+	metadata, err := ReadMobiMetadata(mobi)
+	if err != nil {
+		t.Fatalf("Error reading mobi metadata: %v", err)
+	}
+	if metadata.Title != "Café “Society”" {
+		t.Fatalf("Expected title to be decoded from windows-1252 but was '%s'", metadata.Title)
+	}
+	if metadata.CoverImage != nil || len(metadata.Authors) != 0 {
+		t.Fatalf("Expected no cover or authors without an EXTH header but was %+v", metadata)
+	}
+}
+
+func TestReadMobiMetadataFailsForAFileWhichIsNotAMobi(t *testing.T) {
+	if _, err := ReadMobiMetadata(aJsonFile()); err != InvalidMobi {
+		t.Fatalf("Expected error %v but was %v", InvalidMobi, err)
+	}
+
+	truncated := aMobi("Title", mobiUTF8, nil)[:palmDBHeaderLength+4]
+	if _, err := ReadMobiMetadata(truncated); err != InvalidMobi {
+		t.Fatalf("Expected error %v for a truncated mobi but was %v", InvalidMobi, err)
+	}
+}
+
+func TestExtractMetadataReturnsTheCoverOfAMobi(t *testing.T) {
+	cover := aPngImage(t)
+	mobi := aMobi("Title", mobiUTF8, []exthRecord{{exthCoverOffset, []byte{0, 0, 0, 0}}}, cover)
+	notAnImage := aMobi("Title", mobiUTF8, []exthRecord{{exthCoverOffset, []byte{0, 0, 0, 0}}}, []byte("text"))
+
+	if found := ExtractMetadata(fileSeekers(map[string][]byte{"a.azw3": notAnImage, "b.mobi": mobi})).Cover; !bytes.Equal(found, cover) {
+		t.Fatal("Expected to find the cover of b.mobi")
+	}
+	if found := ExtractMetadata(fileSeekers(map[string][]byte{"a.azw3": notAnImage, "b.txt": aJsonFile()})).Cover; found != nil {
+		t.Fatal("Expected no cover to be found")
+	}
+}
+
+// aMobi returns a mobi whose record 0 has the full name and EXTH records,
+// followed by a text record and the image records
+func aMobi(fullName string, encoding uint32, exth []exthRecord, images ...[]byte) []byte {
+	const mobiHeaderLength = 232
+	header := make([]byte, mobiHeaderOffset+mobiHeaderLength)
+	copy(header[mobiHeaderOffset:], "MOBI")
+	binary.BigEndian.PutUint32(header[mobiHeaderLengthOffset:], mobiHeaderLength)
+	binary.BigEndian.PutUint32(header[mobiEncodingOffset:], encoding)
+	binary.BigEndian.PutUint32(header[mobiFirstImageOffset:], 2)
+
+	if exth != nil {
+		binary.BigEndian.PutUint32(header[mobiExthFlagsOffset:], mobiExthFlag)
+		records := &bytes.Buffer{}
+		for _, record := range exth {
+			binary.Write(records, binary.BigEndian, record.recordType)
+			binary.Write(records, binary.BigEndian, uint32(8+len(record.data)))
+			records.Write(record.data)
+		}
+		exthHeader := &bytes.Buffer{}
+		exthHeader.WriteString("EXTH")
+		binary.Write(exthHeader, binary.BigEndian, uint32(12+records.Len()))
+		binary.Write(exthHeader, binary.BigEndian, uint32(len(exth)))
+		exthHeader.Write(records.Bytes())
+		header = append(header, exthHeader.Bytes()...)
+	}
+	binary.BigEndian.PutUint32(header[mobiFullNameOffset:], uint32(len(header)))
+	binary.BigEndian.PutUint32(header[mobiFullNameLength:], uint32(len(fullName)))
+	header = append(header, fullName...)
+	header = append(header, 0, 0)
+
+	records := append([][]byte{header, []byte("<html>text</html>")}, images...)
+	palmDB := make([]byte, palmDBHeaderLength+len(records)*palmDBRecordInfoSize)
+	copy(palmDB, "Database_Name")
+	copy(palmDB[palmDBTypeOffset:], "BOOKMOBI")
+	binary.BigEndian.PutUint16(palmDB[palmDBRecordsOffset:], uint16(len(records)))
+	for i, record := range records {
+		binary.BigEndian.PutUint32(palmDB[palmDBHeaderLength+i*palmDBRecordInfoSize:], uint32(len(palmDB)))
+		palmDB = append(palmDB, record...)
+	}
+	return palmDB
+}
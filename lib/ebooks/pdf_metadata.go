@@ -0,0 +1,451 @@
+package ebooks
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var InvalidPdf = errors.New("Invalid pdf, missing %PDF header")
+
+// Metadata from the document information dictionary and XMP packet of a
+// pdf, the XMP values take precedence when a pdf has both
+type PdfMetadata struct {
+	Title    string
+	Authors  []string
+	Date     string
+	Keywords []string
+}
+
+// Year returns the year the pdf was created, 0 if it has no creation date
+func (metadata *PdfMetadata) Year() int {
+	// info dates are of the form D:YYYYMMDDHHmmSS and xmp dates YYYY-MM-DD
+	return yearFromDate(strings.TrimPrefix(metadata.Date, "D:"))
+}
+
+// BookDetails returns the title, authors, year and tags from the metadata,
+// any of which may be blank
+func (metadata *PdfMetadata) BookDetails() *BookDetails {
+	return &BookDetails{
+		Title:   metadata.Title,
+		Authors: metadata.Authors,
+		Year:    metadata.Year(),
+		Tags:    metadata.Keywords,
+	}
+}
+
+// How much of the start and of the end of a pdf is read for its metadata,
+// the trailer and the objects it refers to are usually in one or the other
+const pdfMetadataWindow = 4 << 20
+
+// The extractor for pdfs, the metadata of a pdf larger than twice
+// pdfMetadataWindow is read from its start and end so it is never read
+// into memory whole
+type pdfMetadataExtractor struct{}
+
+func (pdfMetadataExtractor) ExtractMetadata(data []byte) (*ExtractedMetadata, error) {
+	metadata, err := ReadPdfMetadata(data)
+	if err != nil {
+		return nil, err
+	}
+	return &ExtractedMetadata{BookDetails: metadata.BookDetails()}, nil
+}
+
+func (extractor pdfMetadataExtractor) ExtractMetadataFromFile(content io.ReaderAt, size int64) (*ExtractedMetadata, error) {
+	if size <= 2*pdfMetadataWindow {
+		data := make([]byte, size)
+		if _, err := content.ReadAt(data, 0); err != nil && err != io.EOF {
+			return nil, err
+		}
+		return extractor.ExtractMetadata(data)
+	}
+	// objects are found by searching for their headers rather than through
+	// the cross-reference table, so the start and end can be joined
+	data := make([]byte, 2*pdfMetadataWindow+1)
+	if _, err := content.ReadAt(data[:pdfMetadataWindow], 0); err != nil {
+		return nil, err
+	}
+	data[pdfMetadataWindow] = '\n'
+	if _, err := content.ReadAt(data[pdfMetadataWindow+1:], size-pdfMetadataWindow); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return extractor.ExtractMetadata(data)
+}
+
+// References to the info dictionary and the catalog in the trailer, the
+// last ones in the file are from the latest incremental update
+var pdfInfoRef = regexp.MustCompile(`/Info\s+(\d+)\s+\d+\s+R`)
+var pdfRootRef = regexp.MustCompile(`/Root\s+(\d+)\s+\d+\s+R`)
+
+// ReadPdfMetadata reads the title, authors, creation date and keywords from
+// the pdf's document information dictionary and XMP metadata stream. Only
+// uncompressed and deflate compressed objects can be read.
+func ReadPdfMetadata(data []byte) (*PdfMetadata, error) {
+	if !bytes.HasPrefix(bytes.TrimLeft(data, "\x00\t\n\r "), []byte("%PDF-")) {
+		return nil, InvalidPdf
+	}
+	pdf := &pdfFile{data: data, streams: pdfStreams(data)}
+
+	metadata := &PdfMetadata{Authors: []string{}, Keywords: []string{}}
+	if info := pdf.trailerObject(pdfInfoRef); info != nil {
+		metadata.Title = collapseSpace(strings.TrimSpace(pdf.textString(info["Title"])))
+		metadata.Authors = splitPdfAuthors(pdf.textString(info["Author"]))
+		metadata.Date = strings.TrimSpace(pdf.textString(info["CreationDate"]))
+		metadata.Keywords = splitPdfList(pdf.textString(info["Keywords"]))
+	}
+	if xmp := pdf.xmpPacket(); xmp != nil {
+		readXmpMetadata(xmp, metadata)
+	}
+	return metadata, nil
+}
+
+// A pdf read just far enough to find its metadata
+type pdfFile struct {
+	data    []byte
+	streams []*pdfStream
+}
+
+// A reference to an indirect object in a pdf
+type pdfReference int
+
+// A name in a pdf dictionary, e.g. /Type
+type pdfName string
+
+// trailerObject returns the dictionary which the last match of the
+// reference pattern refers to, nil if there is none
+func (pdf *pdfFile) trailerObject(ref *regexp.Regexp) map[string]interface{} {
+	matches := ref.FindAllSubmatch(pdf.data, -1)
+	if len(matches) == 0 {
+		return nil
+	}
+	number, _ := strconv.Atoi(string(matches[len(matches)-1][1]))
+	if dictionary, ok := pdf.resolve(pdfReference(number)).(map[string]interface{}); ok {
+		return dictionary
+	}
+	return nil
+}
+
+// resolve returns the value of the object a reference refers to, any other
+// value is returned as is
+func (pdf *pdfFile) resolve(value interface{}) interface{} {
+	ref, isRef := value.(pdfReference)
+	if !isRef {
+		return value
+	}
+	body := pdf.objectBody(int(ref))
+	if body == nil {
+		return nil
+	}
+	resolved := (&pdfLexer{data: body}).readValue()
+	if _, isRef = resolved.(pdfReference); isRef {
+		// a reference to a reference is not valid, don't follow loops
+		return nil
+	}
+	return resolved
+}
+
+// textString resolves the value to a string, "" if it is not a string
+func (pdf *pdfFile) textString(value interface{}) string {
+	if str, ok := pdf.resolve(value).([]byte); ok {
+		return decodePdfTextString(str)
+	}
+	return ""
+}
+
+// objectBody returns the data from the start of the object with the given
+// number, either from the file itself or from an object stream
+func (pdf *pdfFile) objectBody(number int) []byte {
+	header := regexp.MustCompile(fmt.Sprintf(`(?:^|[^0-9])%d\s+\d+\s+obj`, number))
+	if matches := header.FindAllIndex(pdf.data, -1); len(matches) > 0 {
+		return pdf.data[matches[len(matches)-1][1]:]
+	}
+
+	for _, stream := range pdf.streams {
+		if !bytes.Contains(stream.dictionary, []byte("/ObjStm")) {
+			continue
+		}
+		lexer := &pdfLexer{data: stream.dictionary, pos: bytes.Index(stream.dictionary, []byte("<<"))}
+		if lexer.pos < 0 {
+			continue
+		}
+		dictionary, _ := lexer.readValue().(map[string]interface{})
+		first, _ := dictionary["First"].(int)
+		count, _ := dictionary["N"].(int)
+
+		// the stream starts with pairs of object numbers and offsets
+		lexer = &pdfLexer{data: stream.content}
+		for i := 0; i < count; i++ {
+			objectNumber, _ := lexer.readValue().(int)
+			offset, _ := lexer.readValue().(int)
+			if objectNumber == number && first+offset < len(stream.content) {
+				return stream.content[first+offset:]
+			}
+		}
+	}
+	return nil
+}
+
+// xmpPacket returns the XMP metadata stream the catalog refers to or, if it
+// cannot be found, the first XMP metadata stream in the pdf
+func (pdf *pdfFile) xmpPacket() []byte {
+	metadataNumber := -1
+	if catalog := pdf.trailerObject(pdfRootRef); catalog != nil {
+		if ref, ok := catalog["Metadata"].(pdfReference); ok {
+			metadataNumber = int(ref)
+		}
+	}
+
+	var packet []byte
+	for _, stream := range pdf.streams {
+		if !bytes.Contains(stream.content, []byte("xmpmeta")) {
+			continue
+		}
+		if stream.number == metadataNumber {
+			return stream.content
+		}
+		if packet == nil && bytes.Contains(stream.dictionary, []byte("/Metadata")) {
+			packet = stream.content
+		}
+	}
+	return packet
+}
+
+// Namespaces of the XMP properties which are read
+const (
+	dcNamespace  = "http://purl.org/dc/elements/1.1/"
+	pdfNamespace = "http://ns.adobe.com/pdf/1.3/"
+	xmpNamespace = "http://ns.adobe.com/xap/1.0/"
+	rdfNamespace = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+)
+
+var (
+	xmpTitle       = xml.Name{Space: dcNamespace, Local: "title"}
+	xmpCreator     = xml.Name{Space: dcNamespace, Local: "creator"}
+	xmpSubject     = xml.Name{Space: dcNamespace, Local: "subject"}
+	xmpKeywords    = xml.Name{Space: pdfNamespace, Local: "Keywords"}
+	xmpCreateDate  = xml.Name{Space: xmpNamespace, Local: "CreateDate"}
+	rdfDescription = xml.Name{Space: rdfNamespace, Local: "Description"}
+	rdfListItem    = xml.Name{Space: rdfNamespace, Local: "li"}
+)
+
+// readXmpMetadata overwrites the metadata with any of the title, creators,
+// creation date and keywords in the XMP packet
+func readXmpMetadata(packet []byte, metadata *PdfMetadata) {
+	properties := xmpProperties(packet)
+	if titles := properties[xmpTitle]; len(titles) > 0 {
+		metadata.Title = collapseSpace(titles[0])
+	}
+	if creators := properties[xmpCreator]; len(creators) > 0 {
+		metadata.Authors = creators
+	}
+	if dates := properties[xmpCreateDate]; len(dates) > 0 {
+		metadata.Date = dates[0]
+	}
+	keywords := []string{}
+	for _, subject := range properties[xmpSubject] {
+		keywords = append(keywords, splitPdfList(subject)...)
+	}
+	if len(keywords) == 0 {
+		for _, keywordList := range properties[xmpKeywords] {
+			keywords = append(keywords, splitPdfList(keywordList)...)
+		}
+	}
+	if len(keywords) > 0 {
+		metadata.Keywords = keywords
+	}
+}
+
+// xmpProperties returns the values of each property of the rdf:Description
+// elements in the XMP packet, properties may be written as attributes,
+// elements or rdf:Alt, rdf:Bag and rdf:Seq lists of values
+func xmpProperties(packet []byte) map[xml.Name][]string {
+	decoder := xml.NewDecoder(bytes.NewReader(packet))
+	decoder.Strict = false
+	decoder.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+
+	properties := map[xml.Name][]string{}
+	addValue := func(property xml.Name, value string) {
+		if value = strings.TrimSpace(value); value != "" {
+			properties[property] = append(properties[property], value)
+		}
+	}
+
+	// the names of the enclosing elements
+	elements := []xml.Name{}
+	// the property being read, its text and whether it is a list
+	var property xml.Name
+	text := &bytes.Buffer{}
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return properties
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			parent := xml.Name{}
+			if len(elements) > 0 {
+				parent = elements[len(elements)-1]
+			}
+			elements = append(elements, t.Name)
+			if t.Name == rdfDescription {
+				for _, attr := range t.Attr {
+					if attr.Name.Space != rdfNamespace && attr.Name.Space != "xmlns" && attr.Name.Space != "" {
+						addValue(attr.Name, attr.Value)
+					}
+				}
+			} else if parent == rdfDescription {
+				property = t.Name
+				text.Reset()
+			} else if t.Name == rdfListItem {
+				text.Reset()
+			}
+		case xml.EndElement:
+			elements = elements[:len(elements)-1]
+			if t.Name == rdfListItem || t.Name == property {
+				addValue(property, text.String())
+				text.Reset()
+			}
+			if t.Name == property {
+				property = xml.Name{}
+			}
+		case xml.CharData:
+			if property.Local != "" {
+				text.Write(t)
+			}
+		}
+	}
+}
+
+// splitPdfList splits a comma or semicolon separated list of keywords
+func splitPdfList(list string) []string {
+	values := []string{}
+	for _, value := range strings.FieldsFunc(list, func(r rune) bool { return r == ',' || r == ';' }) {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// splitPdfAuthors splits the single author string of the info dictionary,
+// e.g. "Alan Donovan and Brian Kernighan", into the individual authors
+func splitPdfAuthors(authors string) []string {
+	authors = strings.Replace(authors, " and ", ",", -1)
+	authors = strings.Replace(authors, "&", ",", -1)
+	return splitPdfList(authors)
+}
+
+// A minimal reader of pdf objects for reading metadata dictionaries
+type pdfLexer struct {
+	data []byte
+	pos  int
+}
+
+// The end of a dictionary or array
+type pdfEnd struct{}
+
+// readValue reads the next object, returning a []byte for strings, an int
+// for integers, a pdfReference for "<number> <generation> R" references,
+// a pdfName for names, a map of the values for dictionaries and nil for
+// anything else. Arrays and other values are skipped.
+func (lexer *pdfLexer) readValue() interface{} {
+	lexer.skipSpace()
+	if lexer.pos >= len(lexer.data) {
+		return pdfEnd{}
+	}
+	data := lexer.data
+	switch c := data[lexer.pos]; {
+	case c == '(':
+		str, end := readPdfString(data, lexer.pos)
+		lexer.pos = end
+		return str
+	case c == '<' && lexer.pos+1 < len(data) && data[lexer.pos+1] == '<':
+		lexer.pos += 2
+		dictionary := map[string]interface{}{}
+		for {
+			key, isName := lexer.readValue().(pdfName)
+			if !isName {
+				// the end of the dictionary or a corrupt one
+				return dictionary
+			}
+			dictionary[string(key)] = lexer.readValue()
+		}
+	case c == '<':
+		end := bytes.IndexByte(data[lexer.pos:], '>')
+		if end < 0 {
+			lexer.pos = len(data)
+			return nil
+		}
+		str := pdfHexBytes(data[lexer.pos+1 : lexer.pos+end])
+		lexer.pos += end + 1
+		return str
+	case c == '>' || c == ']':
+		lexer.pos++
+		if c == '>' && lexer.pos < len(data) && data[lexer.pos] == '>' {
+			lexer.pos++
+		}
+		return pdfEnd{}
+	case c == '[':
+		lexer.pos++
+		for {
+			if _, isEnd := lexer.readValue().(pdfEnd); isEnd {
+				return nil
+			}
+		}
+	case c == '/':
+		lexer.pos++
+		return pdfName(lexer.readWord())
+	}
+
+	word := lexer.readWord()
+	number, err := strconv.Atoi(word)
+	if err != nil {
+		if word == "" {
+			// a stray delimiter
+			lexer.pos++
+		}
+		return nil
+	}
+
+	// look ahead for the generation and R of a reference
+	start := lexer.pos
+	lexer.skipSpace()
+	if _, err = strconv.Atoi(lexer.readWord()); err == nil {
+		lexer.skipSpace()
+		if lexer.readWord() == "R" {
+			return pdfReference(number)
+		}
+	}
+	lexer.pos = start
+	return number
+}
+
+func (lexer *pdfLexer) skipSpace() {
+	for lexer.pos < len(lexer.data) {
+		c := lexer.data[lexer.pos]
+		if c == '%' {
+			// a comment up to the end of the line
+			for lexer.pos < len(lexer.data) && lexer.data[lexer.pos] != '\n' && lexer.data[lexer.pos] != '\r' {
+				lexer.pos++
+			}
+		} else if !isPdfSpace(c) {
+			return
+		}
+		lexer.pos++
+	}
+}
+
+func (lexer *pdfLexer) readWord() string {
+	start := lexer.pos
+	for lexer.pos < len(lexer.data) && !isPdfSpace(lexer.data[lexer.pos]) && !isPdfDelimiter(lexer.data[lexer.pos]) {
+		lexer.pos++
+	}
+	return string(lexer.data[start:lexer.pos])
+}
@@ -0,0 +1,138 @@
+package ebooks
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"testing"
+
+	"github.com/stephenhenderson/ebooklib/lib/utils"
+)
+
+const xmpPacket = `<?xpacket begin="" id="W5M0MpCehiHzreSzNTczkc9d"?>
+<x:xmpmeta xmlns:x="adobe:ns:meta/">
+  <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+    <rdf:Description rdf:about="" xmlns:xmp="http://ns.adobe.com/xap/1.0/" xmp:CreateDate="2016-03-01T10:00:00Z"/>
+    <rdf:Description rdf:about="" xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:pdf="http://ns.adobe.com/pdf/1.3/">
+      <dc:title><rdf:Alt><rdf:li xml:lang="x-default">Concurrency in Go</rdf:li></rdf:Alt></dc:title>
+      <dc:creator><rdf:Seq><rdf:li>Katherine Cox-Buday</rdf:li></rdf:Seq></dc:creator>
+      <pdf:Keywords>golang; concurrency</pdf:Keywords>
+    </rdf:Description>
+  </rdf:RDF>
+</x:xmpmeta>
+<?xpacket end="w"?>`
+
+func TestReadPdfMetadataFromTheInfoDictionary(t *testing.T) {
+	pdf := aPdfWithObjects("trailer << /Size 3 /Root 2 0 R /Info 1 0 R >>",
+		`<< /Title <FEFF00540068006500200047006F> /Author (Alan Donovan and Brian Kernighan)
+		   /Subject (A \(nested\) string with /Author in it) /Keywords 3 0 R
+		   /CreationDate (D:20151026120000+01'00') /Producer (pdfTeX) >>`,
+		"<< /Type /Catalog /Pages 4 0 R >>",
+		"(golang, programming)")
+
+	metadata, err := ReadPdfMetadata(pdf)
+	if err != nil {
+		t.Fatalf("Error reading pdf metadata: %v", err)
+	}
+	expected := &PdfMetadata{
+		Title:    "The Go",
+		Authors:  []string{"Alan Donovan", "Brian Kernighan"},
+		Date:     "D:20151026120000+01'00'",
+		Keywords: []string{"golang", "programming"},
+	}
+	assertPdfMetadata(metadata, expected, t)
+	if metadata.Year() != 2015 {
+		t.Fatalf("Expected year 2015 but was %d", metadata.Year())
+	}
+}
+
+func TestReadPdfMetadataPrefersTheXmpMetadataOfTheCatalog(t *testing.T) {
+	pdf := aPdfWithObjects("trailer << /Root 2 0 R /Info 1 0 R >>",
+		"<< /Title (Untitled) /Author (Someone Else) /CreationDate (D:20170101) >>",
+		"<< /Type /Catalog /Metadata 4 0 R >>",
+		aStream("/Type /XObject /Subtype /Image /Filter /FlateDecode", `<x:xmpmeta xmlns:x="adobe:ns:meta/">
+			<rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+			<rdf:Description xmlns:dc="http://purl.org/dc/elements/1.1/" dc:title="An image"/>
+			</rdf:RDF></x:xmpmeta>`),
+		aStream("/Type /Metadata /Subtype /XML /Filter /FlateDecode", xmpPacket))
+
+	metadata, err := ReadPdfMetadata(pdf)
+	if err != nil {
+		t.Fatalf("Error reading pdf metadata: %v", err)
+	}
+	expected := &PdfMetadata{
+		Title:    "Concurrency in Go",
+		Authors:  []string{"Katherine Cox-Buday"},
+		Date:     "2016-03-01T10:00:00Z",
+		Keywords: []string{"golang", "concurrency"},
+	}
+	assertPdfMetadata(metadata, expected, t)
+}
+
+func TestReadPdfMetadataFromAnInfoDictionaryInAnObjectStream(t *testing.T) {
+	objects := "5 0 6 26 << /Title (Compressed) >> << /Type /Catalog >>"
+	pdf := aPdfWithObjects("<< /Type /XRef /Root 6 0 R /Info 5 0 R >>",
+		aStream("/Type /ObjStm /N 2 /First 9 /Filter /FlateDecode", objects))
+
+	metadata, err := ReadPdfMetadata(pdf)
+	if err != nil {
+		t.Fatalf("Error reading pdf metadata: %v", err)
+	}
+	if metadata.Title != "Compressed" {
+		t.Fatalf("Expected title 'Compressed' but was '%s'", metadata.Title)
+	}
+}
+
+func TestReadPdfMetadataFailsForAFileWhichIsNotAPdf(t *testing.T) {
+	if _, err := ReadPdfMetadata([]byte("<html></html>")); err != InvalidPdf {
+		t.Fatalf("Expected error %v but was %v", InvalidPdf, err)
+	}
+}
+
+func TestCompleteBookDetailsFromAPdf(t *testing.T) {
+	pdf := aPdfWithObjects("trailer << /Info 1 0 R >>",
+		"<< /Title (The Go Programming Language) /Author (Alan Donovan) /Keywords (golang) >>")
+	details := &BookDetails{Authors: []string{}, Year: 2016, Tags: []string{}}
+
+	ExtractMetadata(fileSeekers(map[string][]byte{"gopl.pdf": pdf})).CompleteBookDetails(details)
+
+	expected := &BookDetails{
+		Title:   "The Go Programming Language",
+		Authors: []string{"Alan Donovan"},
+		Year:    2016,
+		Tags:    []string{"golang"},
+	}
+	if !details.Equals(expected) {
+		t.Fatalf("Expected book details %v but was %v", expected, details)
+	}
+}
+
+func assertPdfMetadata(metadata, expected *PdfMetadata, t *testing.T) {
+	if metadata.Title != expected.Title || metadata.Date != expected.Date ||
+		!utils.StringSliceEquals(metadata.Authors, expected.Authors) ||
+		!utils.StringSliceEquals(metadata.Keywords, expected.Keywords) {
+		t.Fatalf("Expected pdf metadata %+v but was %+v", expected, metadata)
+	}
+}
+
+// aPdfWithObjects returns a pdf containing the objects, numbered from 1,
+// followed by the trailer
+func aPdfWithObjects(trailer string, objects ...string) []byte {
+	pdf := &bytes.Buffer{}
+	pdf.WriteString("%PDF-1.5\n")
+	for i, object := range objects {
+		fmt.Fprintf(pdf, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+	fmt.Fprintf(pdf, "%s\nstartxref\n0\n%%%%EOF\n", trailer)
+	return pdf.Bytes()
+}
+
+// aStream returns a stream object with the given dictionary entries whose
+// content is deflate compressed
+func aStream(dictionary, content string) string {
+	compressed := &bytes.Buffer{}
+	writer := zlib.NewWriter(compressed)
+	writer.Write([]byte(content))
+	writer.Close()
+	return fmt.Sprintf("<< %s /Length %d >>\nstream\n%s\nendstream", dictionary, compressed.Len(), compressed.String())
+}
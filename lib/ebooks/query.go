@@ -0,0 +1,497 @@
+package ebooks
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// A parsed library query which can be matched against the details of a
+// book, see ParseQuery for the syntax
+type Query interface {
+	Matches(book *BookDetails) bool
+}
+
+// A syntax error in a query, Pos is the position of the offending
+// character counting from 1
+type QuerySyntaxError struct {
+	Pos int
+	Msg string
+}
+
+func (err *QuerySyntaxError) Error() string {
+	return fmt.Sprintf("syntax error at position %d: %s", err.Pos, err.Msg)
+}
+
+// Fields of BookDetails which can be used in queries
+const (
+	titleField  = "title"
+	authorField = "author"
+	tagField    = "tag"
+	yearField   = "year"
+)
+
+// ParseQuery parses a query such as
+//
+//	tag:golang author:"Rob Pike" year>=2015 -tag:draft
+//
+// Terms separated by spaces (or AND) must all match, terms joined with OR
+// match if either does and brackets group terms. A term is negated by a
+// leading "-" or NOT. The keywords must be upper case. Terms are:
+//
+//	word             any word of the details starts with word
+//	"some phrase"    any field contains the phrase
+//	title:value      the title contains value
+//	author:value     one of the authors contains value
+//	tag:value        one of the tags is value
+//	year:2015        published in 2015, also year:2010..2015, year:2010..
+//	year>=2015       also year>2015, year<=2015, year<2015 and year=2015
+//
+// All text matching ignores case. An empty query matches every book.
+func ParseQuery(query string) (Query, error) {
+	tokens, err := lexQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	parser := &queryParser{tokens: tokens}
+	if parser.peek().kind == tokenEOF {
+		return andQuery{}, nil
+	}
+
+	parsed, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if next := parser.peek(); next.kind != tokenEOF {
+		return nil, &QuerySyntaxError{next.pos, fmt.Sprintf("unexpected %s", next)}
+	}
+	return parsed, nil
+}
+
+type queryTokenKind int
+
+const (
+	tokenEOF queryTokenKind = iota
+	tokenWord
+	tokenPhrase
+	tokenOperator
+	tokenNegate
+	tokenOpenBracket
+	tokenCloseBracket
+)
+
+type queryToken struct {
+	kind queryTokenKind
+	text string
+	pos  int
+
+	// Set if the token directly follows the previous one without a space
+	attached bool
+}
+
+func (token queryToken) String() string {
+	switch token.kind {
+	case tokenEOF:
+		return "end of query"
+	case tokenPhrase:
+		return strconv.Quote(token.text)
+	}
+	return "'" + token.text + "'"
+}
+
+// Operators between a field and its value, longest first
+var queryOperators = []string{">=", "<=", ":", ">", "<", "="}
+
+// lexQuery splits the query into tokens, positions count characters
+// rather than bytes
+func lexQuery(query string) ([]queryToken, error) {
+	runes := []rune(query)
+	tokens := []queryToken{}
+	attached := false
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		pos := i + 1
+		switch {
+		case unicode.IsSpace(r):
+			i++
+			attached = false
+			continue
+		case r == '(':
+			tokens = append(tokens, queryToken{tokenOpenBracket, "(", pos, attached})
+			i++
+		case r == ')':
+			tokens = append(tokens, queryToken{tokenCloseBracket, ")", pos, attached})
+			i++
+		case r == '-' && !attached:
+			tokens = append(tokens, queryToken{tokenNegate, "-", pos, attached})
+			i++
+		case r == '"':
+			end := i + 1
+			for end < len(runes) && runes[end] != '"' {
+				end++
+			}
+			if end == len(runes) {
+				return nil, &QuerySyntaxError{pos, "unterminated quote"}
+			}
+			tokens = append(tokens, queryToken{tokenPhrase, string(runes[i+1 : end]), pos, attached})
+			i = end + 1
+		case isOperatorRune(r):
+			op := ""
+			for _, candidate := range queryOperators {
+				if strings.HasPrefix(string(runes[i:]), candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, &QuerySyntaxError{pos, fmt.Sprintf("unexpected '%c'", r)}
+			}
+			tokens = append(tokens, queryToken{tokenOperator, op, pos, attached})
+			i += len([]rune(op))
+		default:
+			end := i
+			for end < len(runes) && !unicode.IsSpace(runes[end]) && !isSpecialRune(runes[end]) {
+				end++
+			}
+			tokens = append(tokens, queryToken{tokenWord, string(runes[i:end]), pos, attached})
+			i = end
+		}
+		attached = true
+	}
+	return append(tokens, queryToken{tokenEOF, "", len(runes) + 1, false}), nil
+}
+
+func isOperatorRune(r rune) bool {
+	return r == ':' || r == '<' || r == '>' || r == '='
+}
+
+// isSpecialRune returns true for characters which end a word
+func isSpecialRune(r rune) bool {
+	return isOperatorRune(r) || r == '(' || r == ')' || r == '"'
+}
+
+// A recursive descent parser over the tokens of a query
+type queryParser struct {
+	tokens []queryToken
+	next   int
+}
+
+func (parser *queryParser) peek() queryToken {
+	return parser.tokens[parser.next]
+}
+
+func (parser *queryParser) take() queryToken {
+	token := parser.tokens[parser.next]
+	if token.kind != tokenEOF {
+		parser.next++
+	}
+	return token
+}
+
+func isKeyword(token queryToken, keyword string) bool {
+	return token.kind == tokenWord && token.text == keyword
+}
+
+// parseOr parses terms joined by OR
+func (parser *queryParser) parseOr() (Query, error) {
+	first, err := parser.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	terms := orQuery{first}
+	for isKeyword(parser.peek(), "OR") {
+		parser.take()
+		term, err := parser.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, term)
+	}
+	if len(terms) == 1 {
+		return first, nil
+	}
+	return terms, nil
+}
+
+// parseAnd parses terms which must all match, either next to each other
+// or joined by AND
+func (parser *queryParser) parseAnd() (Query, error) {
+	first, err := parser.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	terms := andQuery{first}
+	for {
+		next := parser.peek()
+		if next.kind == tokenEOF || next.kind == tokenCloseBracket || isKeyword(next, "OR") {
+			break
+		}
+		if isKeyword(next, "AND") {
+			parser.take()
+		}
+		term, err := parser.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, term)
+	}
+	if len(terms) == 1 {
+		return first, nil
+	}
+	return terms, nil
+}
+
+// parseUnary parses a term with any number of negations
+func (parser *queryParser) parseUnary() (Query, error) {
+	next := parser.peek()
+	if next.kind == tokenNegate || isKeyword(next, "NOT") {
+		parser.take()
+		term, err := parser.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notQuery{term}, nil
+	}
+	return parser.parseTerm()
+}
+
+// parseTerm parses a bracketed query, a field comparison or text
+func (parser *queryParser) parseTerm() (Query, error) {
+	token := parser.take()
+	switch token.kind {
+	case tokenOpenBracket:
+		inner, err := parser.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing := parser.take(); closing.kind != tokenCloseBracket {
+			return nil, &QuerySyntaxError{closing.pos, fmt.Sprintf("expected ')' to close '(' at position %d but found %s", token.pos, closing)}
+		}
+		return inner, nil
+	case tokenPhrase:
+		return textQuery{strings.ToLower(token.text), true}, nil
+	case tokenWord:
+		if next := parser.peek(); next.kind == tokenOperator && next.attached {
+			return parser.parseField(token)
+		}
+		if isKeyword(token, "AND") || isKeyword(token, "OR") || isKeyword(token, "NOT") {
+			return nil, &QuerySyntaxError{token.pos, fmt.Sprintf("expected a term before %s", token)}
+		}
+		return textQuery{strings.ToLower(token.text), false}, nil
+	}
+	return nil, &QuerySyntaxError{token.pos, fmt.Sprintf("expected a term but found %s", token)}
+}
+
+// parseField parses the operator and value following a field name
+func (parser *queryParser) parseField(field queryToken) (Query, error) {
+	op := parser.take()
+	value := parser.take()
+	if (value.kind != tokenWord && value.kind != tokenPhrase) || !value.attached {
+		return nil, &QuerySyntaxError{op.pos + len(op.text), fmt.Sprintf("expected a value directly after %s%s", field.text, op.text)}
+	}
+
+	name := strings.ToLower(field.text)
+	switch name {
+	case titleField, authorField, tagField:
+		if op.text != ":" {
+			return nil, &QuerySyntaxError{op.pos, fmt.Sprintf("%s can only be compared with ':'", name)}
+		}
+		return fieldQuery{name, strings.ToLower(value.text)}, nil
+	case yearField:
+		return parseYear(op, value)
+	}
+	return nil, &QuerySyntaxError{field.pos, fmt.Sprintf("unknown field '%s'", field.text)}
+}
+
+// parseYear parses a comparison with the year, "year:" takes either a
+// single year or a range of the form from..to where either end may be left
+// out
+func parseYear(op, value queryToken) (Query, error) {
+	parseBound := func(text string, offset int) (int, error) {
+		year, err := strconv.Atoi(text)
+		if err != nil {
+			return 0, &QuerySyntaxError{value.pos + offset, fmt.Sprintf("invalid year '%s'", text)}
+		}
+		return year, nil
+	}
+
+	if op.text == ":" && strings.Contains(value.text, "..") {
+		parts := strings.SplitN(value.text, "..", 2)
+		query := yearQuery{min: minYear, max: maxYear}
+		var err error
+		if parts[0] != "" {
+			if query.min, err = parseBound(parts[0], 0); err != nil {
+				return nil, err
+			}
+		}
+		if parts[1] != "" {
+			if query.max, err = parseBound(parts[1], len([]rune(parts[0]))+2); err != nil {
+				return nil, err
+			}
+		}
+		if parts[0] == "" && parts[1] == "" {
+			return nil, &QuerySyntaxError{value.pos, "year range needs at least one end"}
+		}
+		return query, nil
+	}
+
+	year, err := parseBound(value.text, 0)
+	if err != nil {
+		return nil, err
+	}
+	switch op.text {
+	case ">=":
+		return yearQuery{year, maxYear}, nil
+	case ">":
+		return yearQuery{year + 1, maxYear}, nil
+	case "<=":
+		return yearQuery{minYear, year}, nil
+	case "<":
+		return yearQuery{minYear, year - 1}, nil
+	}
+	return yearQuery{year, year}, nil
+}
+
+// Bounds of an open ended year range
+const (
+	minYear = -1 << 31
+	maxYear = 1<<31 - 1
+)
+
+// Matches books matching every one of the queries
+type andQuery []Query
+
+func (queries andQuery) Matches(book *BookDetails) bool {
+	for _, query := range queries {
+		if !query.Matches(book) {
+			return false
+		}
+	}
+	return true
+}
+
+// Matches books matching any of the queries
+type orQuery []Query
+
+func (queries orQuery) Matches(book *BookDetails) bool {
+	for _, query := range queries {
+		if query.Matches(book) {
+			return true
+		}
+	}
+	return false
+}
+
+// Matches books not matching the query
+type notQuery struct {
+	Query
+}
+
+func (query notQuery) Matches(book *BookDetails) bool {
+	return !query.Query.Matches(book)
+}
+
+// Matches books with the lower case value in a text field, "tag" matches
+// whole tags and the other fields any part of the field
+type fieldQuery struct {
+	field string
+	value string
+}
+
+func (query fieldQuery) Matches(book *BookDetails) bool {
+	switch query.field {
+	case titleField:
+		return strings.Contains(strings.ToLower(book.Title), query.value)
+	case authorField:
+		return anyContains(book.Authors, query.value)
+	case tagField:
+		for _, tag := range book.Tags {
+			if strings.ToLower(tag) == query.value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Matches books published between min and max inclusive, books without a
+// year are never matched as their year is not known
+type yearQuery struct {
+	min int
+	max int
+}
+
+func (query yearQuery) Matches(book *BookDetails) bool {
+	if book.Year == 0 {
+		return false
+	}
+	return book.Year >= query.min && book.Year <= query.max
+}
+
+// Matches lower case text in any field of a book. A phrase may appear
+// anywhere in a field, otherwise each word of the text must be the start
+// of a word in the details as for SearchableLibrary.Search.
+type textQuery struct {
+	text   string
+	phrase bool
+}
+
+func (query textQuery) Matches(book *BookDetails) bool {
+	fields := append([]string{book.Title}, book.Authors...)
+	fields = append(fields, book.Tags...)
+	if book.Year != 0 {
+		fields = append(fields, strconv.Itoa(book.Year))
+	}
+	if query.phrase {
+		return anyContains(fields, query.text)
+	}
+
+	words := tokenize(strings.Join(fields, " "))
+	for _, term := range tokenize(query.text) {
+		if !anyHasPrefix(words, term) {
+			return false
+		}
+	}
+	return true
+}
+
+// freeText returns the text of a query made up only of words which must
+// all match, which can be answered from the search index
+func freeText(query Query) (string, bool) {
+	switch q := query.(type) {
+	case textQuery:
+		return q.text, !q.phrase
+	case andQuery:
+		words := make([]string, 0, len(q))
+		for _, term := range q {
+			text, ok := freeText(term)
+			if !ok {
+				return "", false
+			}
+			words = append(words, text)
+		}
+		return strings.Join(words, " "), true
+	}
+	return "", false
+}
+
+// anyContains returns true if any of the values contains the lower case
+// text, ignoring case
+func anyContains(values []string, text string) bool {
+	for _, value := range values {
+		if strings.Contains(strings.ToLower(value), text) {
+			return true
+		}
+	}
+	return false
+}
+
+func anyHasPrefix(words []string, prefix string) bool {
+	for _, word := range words {
+		if strings.HasPrefix(word, prefix) {
+			return true
+		}
+	}
+	return false
+}
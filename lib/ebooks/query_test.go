@@ -0,0 +1,142 @@
+package ebooks
+
+import (
+	"testing"
+)
+
+var goBook = &BookDetails{
+	Title:   "The Go Programming Language",
+	Authors: []string{"Alan Donovan", "Brian Kernighan"},
+	Year:    2015,
+	Tags:    []string{"golang", "programming"},
+}
+
+var draftBook = &BookDetails{
+	Title:   "Go Notes",
+	Authors: []string{"Rob Pike"},
+	Year:    2016,
+	Tags:    []string{"golang", "draft"},
+}
+
+func TestQueriesMatchBookDetails(t *testing.T) {
+	tests := []struct {
+		query         string
+		matchesGoBook bool
+	}{
+		{"", true},
+		{"programming", true},
+		{"PROG", true},
+		{"gramming", false},
+		{`"go programming"`, true},
+		{`"kernighan alan"`, false},
+		{"title:language", true},
+		{"title:go", true},
+		{`title:"go programming"`, true},
+		{"author:kernighan", true},
+		{`author:"Rob Pike"`, false},
+		{"tag:golang", true},
+		{"tag:go", false},
+		{"year:2015", true},
+		{"year=2016", false},
+		{"year>=2015", true},
+		{"year>2015", false},
+		{"year<=2015", true},
+		{"year<2015", false},
+		{"year:2010..2015", true},
+		{"year:2016..", false},
+		{"year:..2015", true},
+		{"tag:golang -tag:draft", true},
+		{"tag:golang NOT tag:programming", false},
+		{"tag:golang AND year:2016", false},
+		{"year:2016 OR author:donovan", true},
+		{"tag:draft OR year:2016", false},
+		{"(tag:draft OR year:2015) -author:pike", true},
+		{"-(tag:golang year:2015)", false},
+		{"Tag:GOLANG", true},
+	}
+
+	for _, test := range tests {
+		query, err := ParseQuery(test.query)
+		if err != nil {
+			t.Fatalf("Error parsing query '%s': %v", test.query, err)
+		}
+		if matches := query.Matches(goBook); matches != test.matchesGoBook {
+			t.Fatalf("Expected query '%s' matching %v to be %v", test.query, goBook, test.matchesGoBook)
+		}
+	}
+}
+
+func TestQueryFromTheRequestMatchesOnlyNonDraftBooks(t *testing.T) {
+	query, err := ParseQuery(`tag:golang author:"Alan Donovan" year>=2015 -tag:draft`)
+	if err != nil {
+		t.Fatalf("Error parsing query: %v", err)
+	}
+	if !query.Matches(goBook) || query.Matches(draftBook) {
+		t.Fatal("Expected query to only match the book which is not a draft")
+	}
+}
+
+func TestYearQueriesNeverMatchBooksWithoutAYear(t *testing.T) {
+	undated := &BookDetails{Title: "Undated", Authors: []string{"mr writer"}}
+	for _, text := range []string{"year:0", "year<2015", "year<=2015", "year:..2015", "year>=0", "year:-5..5"} {
+		query, err := ParseQuery(text)
+		if err != nil {
+			t.Fatalf("Error parsing query '%s': %v", text, err)
+		}
+		if query.Matches(undated) {
+			t.Fatalf("Expected query '%s' not to match a book without a year", text)
+		}
+	}
+}
+
+func TestQuerySyntaxErrorsReportThePosition(t *testing.T) {
+	tests := []struct {
+		query       string
+		expectedPos int
+	}{
+		{`author:"Rob Pike`, 8},
+		{"tag:", 5},
+		{"tag: golang", 5},
+		{"publisher:foo", 1},
+		{"year:two", 6},
+		{"year:2010..later", 12},
+		{"year:..", 6},
+		{"title>=go", 6},
+		{"(tag:golang", 12},
+		{"tag:golang)", 11},
+		{"golang OR", 10},
+		{"AND golang", 1},
+		{"go : lang", 4},
+		{"ü tag:", 7},
+	}
+
+	for _, test := range tests {
+		_, err := ParseQuery(test.query)
+		syntaxErr, isSyntaxErr := err.(*QuerySyntaxError)
+		if !isSyntaxErr {
+			t.Fatalf("Expected syntax error for query '%s' but got %v", test.query, err)
+		}
+		if syntaxErr.Pos != test.expectedPos {
+			t.Fatalf("Expected syntax error for query '%s' at position %d but was %v", test.query, test.expectedPos, syntaxErr)
+		}
+	}
+}
+
+func TestFindFiltersBooksByQueryOrderedByTitle(t *testing.T) {
+	library := aSearchableLibrary(NewMemoryLibrary())
+	draft, _ := library.Add(draftBook, noImage, emptyFileMap())
+	book, _ := library.Add(goBook, noImage, emptyFileMap())
+	library.Add(aBook("Learning Python", "Mark Lutz", 2013, []string{"python"}), noImage, emptyFileMap())
+
+	books, err := library.Find("tag:golang")
+	if err != nil {
+		t.Fatalf("Error finding books: %v", err)
+	}
+	if len(books) != 2 || books[0].ID != draft.ID || books[1].ID != book.ID {
+		t.Fatalf("Expected books %d and %d ordered by title but found %v", draft.ID, book.ID, books)
+	}
+
+	if _, err = library.Find("tag:"); err == nil {
+		t.Fatal("Expected error finding books with an invalid query")
+	}
+}
@@ -0,0 +1,505 @@
+package ebooks
+
+import (
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	. "github.com/stephenhenderson/ebooklib/lib/logging"
+)
+
+// How much a query term matching each field of a book adds to its score,
+// books matching in their title rank above those matching a tag
+const (
+	titleWeight  = 4
+	authorWeight = 3
+	tagWeight    = 2
+	yearWeight   = 1
+)
+
+// NewSearchableLibrary wraps the library with an inverted index over the
+// details of its books and keeps the full-text index of their contents up
+// to date. Changes must be made through the returned library for the
+// indexes to stay up to date. Books changed since the full-text index was
+// last updated are indexed before returning.
+func NewSearchableLibrary(library Library, fullText *FullTextIndex) *SearchableLibrary {
+	searchable := &SearchableLibrary{Library: library, fullText: fullText}
+	searchable.reindex()
+	searchable.syncFullText()
+	return searchable
+}
+
+// A Library which can be searched by the title, authors, tags and year of
+// its books and by the text inside their files. All methods are safe to
+// call from multiple goroutines.
+type SearchableLibrary struct {
+	Library
+
+	fullText *FullTextIndex
+
+	// Guards postings, terms and bookTerms. Writers hold it across quick changes
+	// to the wrapped library so the index is updated in the same order.
+	// Files are stored and their text read without it, the index is then
+	// brought in line with the book as it is by then, see refreshBook.
+	mutex sync.RWMutex
+
+	// Score of every book containing each term by term and then book id
+	postings map[string]map[int]int
+
+	// Every term in postings in order, so the terms starting with a query
+	// term are found with a binary search
+	terms []string
+
+	// Terms indexed for each book by id so they can be removed
+	bookTerms map[int][]string
+}
+
+// Search returns the books matching every term in the query, best matches
+// first. A term matches any word in a book's details which starts with
+// it, ignoring case. An empty query matches every book.
+func (lib *SearchableLibrary) Search(query string) []*Ebook {
+	terms := tokenize(query)
+	if len(terms) == 0 {
+		return SortBooksByTitle(lib.GetAll())
+	}
+
+	lib.mutex.RLock()
+	scores := lib.matchingTerm(terms[0])
+	for _, term := range terms[1:] {
+		termScores := lib.matchingTerm(term)
+		for id, score := range scores {
+			if termScore, found := termScores[id]; found {
+				scores[id] = score + termScore
+			} else {
+				delete(scores, id)
+			}
+		}
+	}
+	lib.mutex.RUnlock()
+
+	books := make([]*Ebook, 0, len(scores))
+	for id := range scores {
+		// a book may be deleted after searching
+		if book, err := lib.GetBookByID(id); err == nil {
+			books = append(books, book)
+		}
+	}
+	sort.Sort(byTitle(books))
+	sort.Stable(byScore{books, scores})
+	return books
+}
+
+// Find returns the books matching the query, see ParseQuery for the
+// syntax. Queries made up only of words are answered from the index and
+// ranked as for Search, the results of other queries are ordered by title.
+func (lib *SearchableLibrary) Find(query string) ([]*Ebook, error) {
+	parsed, err := ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	if text, isFreeText := freeText(parsed); isFreeText {
+		return lib.Search(text), nil
+	}
+
+	books := []*Ebook{}
+	for _, book := range lib.GetAll() {
+		if parsed.Matches(book.BookDetails) {
+			books = append(books, book)
+		}
+	}
+	return SortBooksByTitle(books), nil
+}
+
+// matchingTerm returns the score of every book with a word starting with
+// the term by book id, callers must hold the read lock
+func (lib *SearchableLibrary) matchingTerm(term string) map[int]int {
+	scores := make(map[int]int)
+	for i := sort.SearchStrings(lib.terms, term); i < len(lib.terms) && strings.HasPrefix(lib.terms[i], term); i++ {
+		for id, score := range lib.postings[lib.terms[i]] {
+			// a book matching the term with several words only counts the best
+			if score > scores[id] {
+				scores[id] = score
+			}
+		}
+	}
+	return scores
+}
+
+// A book whose contents match a full-text search, with extracts showing
+// where
+type ContentMatch struct {
+	*Ebook
+	Snippets []Snippet
+}
+
+// SearchContents returns the books whose files contain every word in the
+// query, best matches first
+func (lib *SearchableLibrary) SearchContents(query string) []*ContentMatch {
+	results := []*ContentMatch{}
+	for _, match := range lib.fullText.Search(query) {
+		// a book may be deleted after searching
+		if book, err := lib.GetBookByID(match.BookID); err == nil {
+			results = append(results, &ContentMatch{book, match.Snippets})
+		}
+	}
+	return results
+}
+
+// Add adds the book to the wrapped library and indexes it. Searches and
+// other changes carry on while its files are stored and their text, which
+// is extracted from the stored files, is read.
+func (lib *SearchableLibrary) Add(bookDetails *BookDetails, image []byte, files map[string]io.Reader) (*Ebook, error) {
+	book, err := lib.Library.Add(bookDetails, image, files)
+	if err != nil {
+		return nil, err
+	}
+	texts := lib.textsOfFiles(book)
+
+	lib.mutex.Lock()
+	defer lib.mutex.Unlock()
+	lib.refreshBook(book.ID, book.Files, texts)
+	return book, nil
+}
+
+// AddFileToBook adds the file to the book in the wrapped library and
+// indexes its text, without holding the lock while the file is stored
+func (lib *SearchableLibrary) AddFileToBook(bookID int, name string, content io.Reader) error {
+	if err := lib.Library.AddFileToBook(bookID, name, content); err != nil {
+		return err
+	}
+	book, err := lib.Library.GetBookByID(bookID)
+	if err != nil || book.Files[name] == nil {
+		// deleted since, whoever deleted it updated the index
+		return nil
+	}
+	files := map[string]*BookFile{name: book.Files[name]}
+	texts := map[string]string{name: lib.textOfFile(bookID, name)}
+
+	lib.mutex.Lock()
+	defer lib.mutex.Unlock()
+	lib.refreshBook(bookID, files, texts)
+	return nil
+}
+
+func (lib *SearchableLibrary) DeleteFileFromBook(bookID int, fileName string) error {
+	lib.mutex.Lock()
+	defer lib.mutex.Unlock()
+
+	err := lib.Library.DeleteFileFromBook(bookID, fileName)
+	if err == nil {
+		logFullTextError(bookID, lib.fullText.RemoveFile(bookID, fileName))
+	}
+	return err
+}
+
+func (lib *SearchableLibrary) UpdateBook(id int, bookDetails *BookDetails) (*Ebook, error) {
+	lib.mutex.Lock()
+	defer lib.mutex.Unlock()
+
+	book, err := lib.Library.UpdateBook(id, bookDetails)
+	if err == nil {
+		lib.unindexBook(id)
+		lib.indexBook(id, book.BookDetails)
+	}
+	return book, err
+}
+
+func (lib *SearchableLibrary) DeleteBook(id int) error {
+	lib.mutex.Lock()
+	defer lib.mutex.Unlock()
+
+	err := lib.Library.DeleteBook(id)
+	if err == nil {
+		lib.unindexBook(id)
+		logFullTextError(id, lib.fullText.RemoveBook(id))
+	}
+	return err
+}
+
+// RestoreBook restores the book in the wrapped library and indexes it, the
+// text of its files is read without holding the lock as for Add
+func (lib *SearchableLibrary) RestoreBook(id int) (*Ebook, error) {
+	book, err := lib.Library.RestoreBook(id)
+	if err != nil {
+		return nil, err
+	}
+	texts := lib.textsOfFiles(book)
+
+	lib.mutex.Lock()
+	defer lib.mutex.Unlock()
+	lib.refreshBook(id, book.Files, texts)
+	return book, nil
+}
+
+// refreshBook indexes the details of the book with the given id as they
+// are now in the wrapped library, along with the text read from the given
+// files of the book without holding the lock. A file which has since been
+// replaced or deleted is skipped as whoever changed it indexes it, as is a
+// book which has since been deleted. Callers must hold the write lock.
+func (lib *SearchableLibrary) refreshBook(id int, files map[string]*BookFile, texts map[string]string) {
+	book, err := lib.Library.GetBookByID(id)
+	if err != nil {
+		return
+	}
+	lib.unindexBook(id)
+	lib.indexBook(id, book.BookDetails)
+
+	unchanged := make(map[string]string, len(files))
+	for fileName, file := range files {
+		if current := book.Files[fileName]; current != nil && current.Checksum == file.Checksum {
+			unchanged[fileName] = texts[fileName]
+		}
+	}
+	if _, found := lib.fullText.IndexedFiles(id); !found {
+		logFullTextError(id, lib.fullText.IndexBook(id, unchanged))
+		return
+	}
+	for fileName, text := range unchanged {
+		logFullTextError(id, lib.fullText.SetFileText(id, fileName, text))
+	}
+}
+
+// Check checks the wrapped library if it is a CheckableLibrary, otherwise
+// returns CheckNotSupported. After a repair the books are indexed again
+// and the full-text index is brought back in line with any files the
+// repair removed. Searches carry on while the library is checked as it can
+// take a while.
+func (lib *SearchableLibrary) Check(repair bool) (*CheckReport, error) {
+	checkable, ok := lib.Library.(CheckableLibrary)
+	if !ok {
+		return nil, CheckNotSupported
+	}
+
+	report, err := checkable.Check(repair)
+	if err == nil && repair {
+		lib.mutex.Lock()
+		defer lib.mutex.Unlock()
+		lib.reindex()
+		lib.syncFullText()
+	}
+	return report, err
+}
+
+// syncFullText indexes the contents of books whose files differ from those
+// in the full-text index, e.g. the first time it is used with a library,
+// and removes books which are no longer in the library
+func (lib *SearchableLibrary) syncFullText() {
+	inLibrary := make(map[int]bool)
+	for _, book := range lib.GetAll() {
+		inLibrary[book.ID] = true
+		indexed, found := lib.fullText.IndexedFiles(book.ID)
+		if found && sameFileNames(indexed, book.Files) {
+			continue
+		}
+		Logger.Printf("Indexing contents of book=%d", book.ID)
+		lib.indexContents(book)
+	}
+
+	for _, id := range lib.fullText.IndexedBookIDs() {
+		if !inLibrary[id] {
+			logFullTextError(id, lib.fullText.RemoveBook(id))
+		}
+	}
+}
+
+// indexContents reads every file of the book and replaces its text in the
+// full-text index, files which cannot be read are indexed without text
+func (lib *SearchableLibrary) indexContents(book *Ebook) {
+	logFullTextError(book.ID, lib.fullText.IndexBook(book.ID, lib.textsOfFiles(book)))
+}
+
+// textsOfFiles returns the searchable text of every file of the book by
+// file name, see textOfFile
+func (lib *SearchableLibrary) textsOfFiles(book *Ebook) map[string]string {
+	texts := make(map[string]string, len(book.Files))
+	for fileName := range book.Files {
+		texts[fileName] = lib.textOfFile(book.ID, fileName)
+	}
+	return texts
+}
+
+// textOfFile returns the searchable text of the stored file of the book,
+// "" if text cannot be extracted from that type of file or the file cannot
+// be read or is larger than MaxTextExtractionFileSize
+func (lib *SearchableLibrary) textOfFile(bookID int, fileName string) string {
+	if !hasExtractableText(fileName) {
+		return ""
+	}
+	data, err := readBookFile(lib.Library, bookID, fileName, MaxTextExtractionFileSize)
+	if err != nil {
+		Logger.Printf("Error reading %s of book=%d to index: %v", fileName, bookID, err)
+		return ""
+	}
+	text, _ := extractText(fileName, data)
+	return text
+}
+
+// logFullTextError logs errors updating the full-text index rather than
+// failing the change to the library, the book is indexed again the next
+// time the library is opened
+func logFullTextError(bookID int, err error) {
+	if err != nil {
+		Logger.Printf("Error updating full-text index for book=%d: %v", bookID, err)
+	}
+}
+
+func sameFileNames(names []string, files map[string]*BookFile) bool {
+	if len(names) != len(files) {
+		return false
+	}
+	for _, name := range names {
+		if _, found := files[name]; !found {
+			return false
+		}
+	}
+	return true
+}
+
+// reindex replaces the index with the details of every book in the wrapped
+// library, callers must hold the write lock
+func (lib *SearchableLibrary) reindex() {
+	lib.postings = make(map[string]map[int]int)
+	lib.bookTerms = make(map[int][]string)
+	for _, book := range lib.Library.GetAll() {
+		lib.postBook(book.ID, book.BookDetails)
+	}
+	lib.terms = make([]string, 0, len(lib.postings))
+	for term := range lib.postings {
+		lib.terms = append(lib.terms, term)
+	}
+	sort.Strings(lib.terms)
+}
+
+// indexBook adds the terms in the book's details to the index, callers
+// must hold the write lock
+func (lib *SearchableLibrary) indexBook(id int, details *BookDetails) {
+	for _, term := range lib.postBook(id, details) {
+		i := sort.SearchStrings(lib.terms, term)
+		lib.terms = append(lib.terms, "")
+		copy(lib.terms[i+1:], lib.terms[i:])
+		lib.terms[i] = term
+	}
+}
+
+// postBook adds the book to the postings of each term in its details and
+// returns the terms which were not in the index before, callers must hold
+// the write lock
+func (lib *SearchableLibrary) postBook(id int, details *BookDetails) []string {
+	scores := make(map[string]int)
+	addTerms := func(text string, weight int) {
+		for _, term := range tokenize(text) {
+			scores[term] += weight
+		}
+	}
+	addTerms(details.Title, titleWeight)
+	for _, author := range details.Authors {
+		addTerms(author, authorWeight)
+	}
+	for _, tag := range details.Tags {
+		addTerms(tag, tagWeight)
+	}
+	if details.Year != 0 {
+		addTerms(strconv.Itoa(details.Year), yearWeight)
+	}
+
+	terms := make([]string, 0, len(scores))
+	newTerms := []string{}
+	for term, score := range scores {
+		books, found := lib.postings[term]
+		if !found {
+			books = make(map[int]int)
+			lib.postings[term] = books
+			newTerms = append(newTerms, term)
+		}
+		books[id] = score
+		terms = append(terms, term)
+	}
+	lib.bookTerms[id] = terms
+	return newTerms
+}
+
+// unindexBook removes all terms for the book from the index, callers must
+// hold the write lock
+func (lib *SearchableLibrary) unindexBook(id int) {
+	for _, term := range lib.bookTerms[id] {
+		delete(lib.postings[term], id)
+		if len(lib.postings[term]) == 0 {
+			delete(lib.postings, term)
+			i := sort.SearchStrings(lib.terms, term)
+			lib.terms = append(lib.terms[:i], lib.terms[i+1:]...)
+		}
+	}
+	delete(lib.bookTerms, id)
+}
+
+// tokenize splits the text into lower case words of letters and digits
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// SortBooksByTitle sorts the books by title ignoring case, books with the
+// same title are ordered by id
+func SortBooksByTitle(books []*Ebook) []*Ebook {
+	sort.Sort(byTitle(books))
+	return books
+}
+
+type byTitle []*Ebook
+
+func (books byTitle) Len() int      { return len(books) }
+func (books byTitle) Swap(i, j int) { books[i], books[j] = books[j], books[i] }
+func (books byTitle) Less(i, j int) bool {
+	titleI, titleJ := strings.ToLower(books[i].Title), strings.ToLower(books[j].Title)
+	if titleI != titleJ {
+		return titleI < titleJ
+	}
+	return books[i].ID < books[j].ID
+}
+
+// SortBooksByCreated sorts the books with the most recently added first,
+// books added at the same time are ordered by id
+func SortBooksByCreated(books []*Ebook) []*Ebook {
+	sort.Sort(byTime{books, func(book *Ebook) time.Time { return book.Created }})
+	return books
+}
+
+// SortBooksByUpdated sorts the books with the most recently updated first,
+// books updated at the same time are ordered by id
+func SortBooksByUpdated(books []*Ebook) []*Ebook {
+	sort.Sort(byTime{books, func(book *Ebook) time.Time { return book.Updated }})
+	return books
+}
+
+// byTime orders books by one of their timestamps, latest first
+type byTime struct {
+	books []*Ebook
+	time  func(book *Ebook) time.Time
+}
+
+func (s byTime) Len() int      { return len(s.books) }
+func (s byTime) Swap(i, j int) { s.books[i], s.books[j] = s.books[j], s.books[i] }
+func (s byTime) Less(i, j int) bool {
+	timeI, timeJ := s.time(s.books[i]), s.time(s.books[j])
+	if !timeI.Equal(timeJ) {
+		return timeI.After(timeJ)
+	}
+	return s.books[i].ID < s.books[j].ID
+}
+
+// byScore orders books by their score in a search, highest first
+type byScore struct {
+	books  []*Ebook
+	scores map[int]int
+}
+
+func (s byScore) Len() int      { return len(s.books) }
+func (s byScore) Swap(i, j int) { s.books[i], s.books[j] = s.books[j], s.books[i] }
+func (s byScore) Less(i, j int) bool {
+	return s.scores[s.books[i].ID] > s.scores[s.books[j].ID]
+}
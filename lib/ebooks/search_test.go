@@ -0,0 +1,174 @@
+package ebooks
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/stephenhenderson/ebooklib/lib/testutils/assert"
+)
+
+func TestSearchMatchesTitleAuthorTagAndYearIgnoringCase(t *testing.T) {
+	library := aSearchableLibrary(NewMemoryLibrary())
+	book, _ := library.Add(aBook("The Go Programming Language", "Alan Donovan", 2015, []string{"golang"}), noImage, emptyFileMap())
+	library.Add(aBook("Learning Python", "Mark Lutz", 2013, []string{"python"}), noImage, emptyFileMap())
+
+	for _, query := range []string{"programming", "DONOVAN", "golang", "2015", "go language"} {
+		assertSearchFinds(library, query, []int{book.ID}, t)
+	}
+}
+
+func TestSearchMatchesTheStartOfWords(t *testing.T) {
+	library := aSearchableLibrary(NewMemoryLibrary())
+	book, _ := library.Add(aBook("Concurrency in Go", "Katherine Cox-Buday", 2017, nil), noImage, emptyFileMap())
+
+	assertSearchFinds(library, "concur", []int{book.ID}, t)
+	assertSearchFinds(library, "buday", []int{book.ID}, t)
+	assertSearchFinds(library, "currency", []int{}, t)
+}
+
+func TestSearchOnlyFindsBooksMatchingEveryTerm(t *testing.T) {
+	library := aSearchableLibrary(NewMemoryLibrary())
+	goBook, _ := library.Add(aBook("Go in Action", "mr writer", 2016, nil), noImage, emptyFileMap())
+	library.Add(aBook("Python in Action", "mr writer", 2016, nil), noImage, emptyFileMap())
+
+	assertSearchFinds(library, "action go", []int{goBook.ID}, t)
+}
+
+func TestSearchRanksTitleMatchesFirst(t *testing.T) {
+	library := aSearchableLibrary(NewMemoryLibrary())
+	taggedBook, _ := library.Add(aBook("A Book", "mr writer", 2016, []string{"golang"}), noImage, emptyFileMap())
+	titledBook, _ := library.Add(aBook("Golang Patterns", "mr writer", 2016, nil), noImage, emptyFileMap())
+
+	assertSearchFinds(library, "golang", []int{titledBook.ID, taggedBook.ID}, t)
+}
+
+func TestEmptySearchReturnsEveryBookOrderedByTitle(t *testing.T) {
+	library := aSearchableLibrary(NewMemoryLibrary())
+	c, _ := library.Add(aBook("c book", "mr writer", 2016, nil), noImage, emptyFileMap())
+	a, _ := library.Add(aBook("A book", "mr writer", 2016, nil), noImage, emptyFileMap())
+	b, _ := library.Add(aBook("B book", "mr writer", 2016, nil), noImage, emptyFileMap())
+
+	assertSearchFinds(library, "  ", []int{a.ID, b.ID, c.ID}, t)
+}
+
+func TestBooksCanBeSortedByWhenTheyWereAddedOrUpdated(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2016, 5, d, 0, 0, 0, 0, time.UTC) }
+	books := []*Ebook{
+		{ID: 1, Created: day(1), Updated: day(9)},
+		{ID: 2, Created: day(3), Updated: day(3)},
+		{ID: 3, Created: day(2), Updated: day(9)},
+	}
+
+	assertBookOrder(SortBooksByCreated(books), []int{2, 3, 1}, t)
+	assertBookOrder(SortBooksByUpdated(books), []int{1, 3, 2}, t)
+}
+
+func TestSearchIndexIsUpdatedWhenBooksChange(t *testing.T) {
+	library := aSearchableLibrary(NewMemoryLibrary())
+	book, _ := library.Add(aBook("Go in Action", "mr writer", 2016, nil), noImage, emptyFileMap())
+
+	_, err := library.UpdateBook(book.ID, aBook("Rust in Action", "mr writer", 2016, nil))
+	assert.NoError(t, err)
+	assertSearchFinds(library, "go", []int{}, t)
+	assertSearchFinds(library, "rust", []int{book.ID}, t)
+
+	assert.NoError(t, library.DeleteBook(book.ID))
+	assertSearchFinds(library, "rust", []int{}, t)
+
+	_, err = library.RestoreBook(book.ID)
+	assert.NoError(t, err)
+	assertSearchFinds(library, "rust", []int{book.ID}, t)
+}
+
+func TestSearchTermsStayInOrderAsBooksChange(t *testing.T) {
+	library := aSearchableLibrary(NewMemoryLibrary())
+	goBook, _ := library.Add(aBook("Go in Action", "mr writer", 2016, []string{"golang"}), noImage, emptyFileMap())
+	library.Add(aBook("Python in Action", "ms writer", 2017, nil), noImage, emptyFileMap())
+	_, err := library.UpdateBook(goBook.ID, aBook("Rust in Action", "mr writer", 2018, nil))
+	assert.NoError(t, err)
+
+	expected := []string{"2017", "2018", "action", "in", "mr", "ms", "python", "rust", "writer"}
+	if !reflect.DeepEqual(library.terms, expected) {
+		t.Fatalf("Expected the terms %v but found %v", expected, library.terms)
+	}
+	assertSearchFinds(library, "go", []int{}, t)
+	assertSearchFinds(library, "r", []int{goBook.ID}, t)
+}
+
+func TestRepairingTheLibraryIndexesItsBooksAgain(t *testing.T) {
+	fileLibrary := newLibraryInTempFolder(t)
+	library := aSearchableLibrary(fileLibrary)
+	book, err := library.Add(aBook("Go in Action", "mr writer", 2016, nil), noImage, fileReaders(map[string][]byte{"notes.txt": []byte("goroutines")}))
+	assert.NoError(t, err)
+	// changed without the searchable library and corrupted on disk
+	_, err = fileLibrary.UpdateBook(book.ID, aBook("Rust in Action", "mr writer", 2016, nil))
+	assert.NoError(t, err)
+	writeTestFile(filepath.Join(fileLibrary.BaseDir, book.Files["notes.txt"].Path), "corrupt")
+
+	_, err = library.Check(true)
+	assert.NoError(t, err)
+	assertSearchFinds(library, "go", []int{}, t)
+	assertSearchFinds(library, "rust", []int{book.ID}, t)
+	assertContentMatches(library, "goroutines", []int{}, t)
+}
+
+func TestSearchableLibraryIndexesBooksAlreadyInTheLibrary(t *testing.T) {
+	memoryLibrary := NewMemoryLibrary()
+	book, _ := memoryLibrary.Add(aBook("Go in Action", "mr writer", 2016, nil), noImage, emptyFileMap())
+
+	library := aSearchableLibrary(memoryLibrary)
+	assertSearchFinds(library, "action", []int{book.ID}, t)
+}
+
+func TestFilesTooLargeToExtractTheirTextAreIndexedWithoutIt(t *testing.T) {
+	defer func(limit int64) { MaxTextExtractionFileSize = limit }(MaxTextExtractionFileSize)
+	MaxTextExtractionFileSize = 16
+	library := aSearchableLibrary(NewMemoryLibrary())
+	files := fileReaders(map[string][]byte{"notes.txt": []byte("goroutines"), "book.txt": []byte("channels and more channels")})
+	book, err := library.Add(aBook("Book1", "mr writer", 2016, nil), noImage, files)
+	assert.NoError(t, err)
+
+	assertContentMatches(library, "goroutines", []int{book.ID}, t)
+	assertContentMatches(library, "channels", []int{}, t)
+	if indexed, _ := library.fullText.IndexedFiles(book.ID); len(indexed) != 2 {
+		t.Fatalf("Expected both files to be indexed but found %v", indexed)
+	}
+}
+
+func assertSearchFinds(library *SearchableLibrary, query string, expectedIDs []int, t *testing.T) {
+	books := library.Search(query)
+	ids := make([]int, len(books))
+	for i, book := range books {
+		ids[i] = book.ID
+	}
+	if len(ids) != len(expectedIDs) {
+		t.Fatalf("Searching for '%s' expected books %v but found %v", query, expectedIDs, ids)
+	}
+	for i := range ids {
+		if ids[i] != expectedIDs[i] {
+			t.Fatalf("Searching for '%s' expected books %v but found %v", query, expectedIDs, ids)
+		}
+	}
+}
+
+func assertBookOrder(books []*Ebook, expectedIDs []int, t *testing.T) {
+	ids := make([]int, len(books))
+	for i, book := range books {
+		ids[i] = book.ID
+	}
+	if len(ids) != len(expectedIDs) {
+		t.Fatalf("Expected books in order %v but were %v", expectedIDs, ids)
+	}
+	for i := range ids {
+		if ids[i] != expectedIDs[i] {
+			t.Fatalf("Expected books in order %v but were %v", expectedIDs, ids)
+		}
+	}
+}
+
+func aSearchableLibrary(library Library) *SearchableLibrary {
+	fullText, _ := OpenFullTextIndex("")
+	return NewSearchableLibrary(library, fullText)
+}
@@ -0,0 +1,491 @@
+package ebooks
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/zlib"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Largest file whose text is indexed, extracting the text needs the whole
+// file in memory so larger files are indexed without their text
+var MaxTextExtractionFileSize int64 = 64 << 20
+
+// Most read from any one compressed stream or document inside a file and
+// from all of them together when extracting its text, so that a small file
+// which decompresses to something huge cannot use up the memory. Anything
+// beyond them is left out of the text.
+var (
+	MaxTextExtractionStreamSize int64 = 16 << 20
+	MaxTextExtractionTotalSize  int64 = 128 << 20
+)
+
+// Extensions of the plain text files whose contents are searchable
+var plainTextExtensions = map[string]bool{
+	".txt":      true,
+	".text":     true,
+	".md":       true,
+	".markdown": true,
+	".rst":      true,
+}
+
+// Extensions of the other files whose contents are searchable
+var documentExtensions = map[string]bool{
+	".epub":  true,
+	".pdf":   true,
+	".html":  true,
+	".htm":   true,
+	".xhtml": true,
+}
+
+// hasExtractableText returns true if text can be extracted from a book file
+// with the given name, other files need not be read to index them
+func hasExtractableText(fileName string) bool {
+	ext := strings.ToLower(filepath.Ext(fileName))
+	return plainTextExtensions[ext] || documentExtensions[ext]
+}
+
+// extractText returns the searchable text in a book file based on its
+// extension, false if text cannot be extracted from that type of file
+func extractText(fileName string, data []byte) (string, bool) {
+	ext := strings.ToLower(filepath.Ext(fileName))
+	switch {
+	case plainTextExtensions[ext]:
+		return validUTF8(string(data)), true
+	case ext == ".epub":
+		return extractEpubText(data), true
+	case ext == ".pdf":
+		return extractPdfText(data), true
+	case ext == ".html" || ext == ".htm" || ext == ".xhtml":
+		return extractHtmlText(bytes.NewReader(data)), true
+	}
+	return "", false
+}
+
+// validUTF8 replaces any bytes which are not valid utf-8, e.g. from a
+// latin-1 text file, with spaces
+func validUTF8(text string) string {
+	if utf8.ValidString(text) {
+		return text
+	}
+	return strings.Map(func(r rune) rune {
+		if r == utf8.RuneError {
+			return ' '
+		}
+		return r
+	}, text)
+}
+
+// extractEpubText returns the text of every html document in the epub in
+// the order they are stored, errors reading the zip are ignored and
+// whatever text could be read is returned. Documents are read up to the
+// limits in MaxTextExtractionStreamSize and MaxTextExtractionTotalSize.
+func extractEpubText(data []byte) string {
+	reader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return ""
+	}
+
+	text := &bytes.Buffer{}
+	remaining := MaxTextExtractionTotalSize
+	for _, file := range reader.File {
+		ext := strings.ToLower(filepath.Ext(file.Name))
+		if ext != ".xhtml" && ext != ".html" && ext != ".htm" {
+			continue
+		}
+		if remaining <= 0 {
+			break
+		}
+		content, err := file.Open()
+		if err != nil {
+			continue
+		}
+		limited := &io.LimitedReader{R: content, N: extractionLimit(remaining)}
+		text.WriteString(extractHtmlText(limited))
+		text.WriteString("\n")
+		content.Close()
+		remaining -= extractionLimit(remaining) - limited.N
+	}
+	return text.String()
+}
+
+// extractionLimit returns how much of the next stream or document in a
+// file can be read given how much can still be read from the file
+func extractionLimit(remaining int64) int64 {
+	if remaining < MaxTextExtractionStreamSize {
+		return remaining
+	}
+	return MaxTextExtractionStreamSize
+}
+
+// Elements whose text is not part of the document
+var skippedHtmlElements = map[string]bool{
+	"head":   true,
+	"script": true,
+	"style":  true,
+}
+
+// Elements which separate words, e.g. "<p>one</p><p>two</p>"
+var blockHtmlElements = map[string]bool{
+	"address": true, "blockquote": true, "br": true, "dd": true, "div": true,
+	"dt": true, "h1": true, "h2": true, "h3": true, "h4": true, "h5": true,
+	"h6": true, "hr": true, "li": true, "p": true, "pre": true, "section": true,
+	"td": true, "th": true, "tr": true,
+}
+
+// extractHtmlText returns the text of the html or xhtml document without
+// its markup, leniently parsing html which is not well formed xml
+func extractHtmlText(r io.Reader) string {
+	decoder := xml.NewDecoder(r)
+	decoder.Strict = false
+	decoder.AutoClose = xml.HTMLAutoClose
+	decoder.Entity = xml.HTMLEntity
+	decoder.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+
+	text := &bytes.Buffer{}
+	skipping := 0
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			break
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			name := strings.ToLower(t.Name.Local)
+			if skippedHtmlElements[name] {
+				skipping++
+			} else if blockHtmlElements[name] {
+				text.WriteString("\n")
+			}
+		case xml.EndElement:
+			name := strings.ToLower(t.Name.Local)
+			if skippedHtmlElements[name] && skipping > 0 {
+				skipping--
+			} else if blockHtmlElements[name] {
+				text.WriteString("\n")
+			}
+		case xml.CharData:
+			if skipping == 0 {
+				text.Write(t)
+			}
+		}
+	}
+	return validUTF8(text.String())
+}
+
+// Adjustment in thousandths of an em between two strings in a TJ array
+// above which they are treated as separate words
+const pdfWordGap = 200
+
+// extractPdfText returns the text drawn by the content streams of the pdf.
+// Only uncompressed and deflate compressed streams are read and strings
+// are assumed to use a standard encoding, text in fonts with custom
+// encodings comes out garbled.
+func extractPdfText(data []byte) string {
+	text := &bytes.Buffer{}
+	for _, stream := range pdfStreams(data) {
+		if bytes.Contains(stream.content, []byte("BT")) && bytes.Contains(stream.content, []byte("ET")) {
+			extractPdfContentText(stream.content, text)
+		}
+	}
+	return validUTF8(text.String())
+}
+
+// A stream object in a pdf
+type pdfStream struct {
+	// The object number, -1 if the object header could not be read
+	number int
+
+	// The raw dictionary describing the stream
+	dictionary []byte
+
+	// The decoded contents of the stream
+	content []byte
+}
+
+// pdfStreams returns every stream in the pdf which is either uncompressed
+// or deflate compressed. Compressed streams are decompressed up to the
+// limits in MaxTextExtractionStreamSize and MaxTextExtractionTotalSize,
+// once the total is reached no more compressed streams are returned.
+func pdfStreams(data []byte) []*pdfStream {
+	streams := []*pdfStream{}
+	offset := 0
+	remaining := MaxTextExtractionTotalSize
+	for {
+		start := bytes.Index(data[offset:], []byte("stream"))
+		if start < 0 {
+			return streams
+		}
+		start += offset
+
+		// the stream's dictionary is between the object header and "stream"
+		objStart := bytes.LastIndex(data[:start], []byte("obj"))
+		if objStart < 0 {
+			objStart = 0
+		}
+		dictionary := data[objStart:start]
+
+		contentStart := start + len("stream")
+		if bytes.HasPrefix(data[contentStart:], []byte("\r\n")) {
+			contentStart += 2
+		} else if bytes.HasPrefix(data[contentStart:], []byte("\n")) {
+			contentStart++
+		} else {
+			// "endstream" or "stream" inside some other token
+			offset = contentStart
+			continue
+		}
+
+		end := bytes.Index(data[contentStart:], []byte("endstream"))
+		if end < 0 {
+			return streams
+		}
+		end += contentStart
+		offset = end + len("endstream")
+
+		content := data[contentStart:end]
+		if bytes.Contains(dictionary, []byte("/Filter")) {
+			if !bytes.Contains(dictionary, []byte("/FlateDecode")) || remaining <= 0 {
+				continue
+			}
+			reader, err := zlib.NewReader(bytes.NewReader(content))
+			if err != nil {
+				continue
+			}
+			// a truncated stream still gives us the text before the error
+			content, _ = ioutil.ReadAll(io.LimitReader(reader, extractionLimit(remaining)))
+			remaining -= int64(len(content))
+		}
+		streams = append(streams, &pdfStream{pdfObjectNumber(data, objStart), dictionary, content})
+	}
+}
+
+// pdfObjectNumber returns the object number from the "<number> <generation>
+// obj" header ending with the "obj" at objStart, -1 if there is no header
+func pdfObjectNumber(data []byte, objStart int) int {
+	headerStart := objStart - 32
+	if headerStart < 0 {
+		headerStart = 0
+	}
+	fields := bytes.Fields(data[headerStart:objStart])
+	if len(fields) < 2 {
+		return -1
+	}
+	number, err := strconv.Atoi(string(fields[len(fields)-2]))
+	if err != nil {
+		return -1
+	}
+	return number
+}
+
+// extractPdfContentText writes the strings shown by the text operators in
+// the content stream to text
+func extractPdfContentText(content []byte, text *bytes.Buffer) {
+	// operands seen since the last operator
+	operands := []string{}
+	inArray := false
+	for i := 0; i < len(content); {
+		c := content[i]
+		switch {
+		case c == '(':
+			str, end := readPdfString(content, i)
+			operands = append(operands, decodePdfTextString(str))
+			i = end
+		case c == '<' && i+1 < len(content) && content[i+1] != '<':
+			end := bytes.IndexByte(content[i:], '>')
+			if end < 0 {
+				return
+			}
+			operands = append(operands, decodePdfHexString(content[i+1:i+end]))
+			i += end + 1
+		case c == '[':
+			inArray = true
+			i++
+		case c == ']':
+			inArray = false
+			i++
+		case isPdfSpace(c):
+			i++
+		default:
+			end := i
+			for end < len(content) && !isPdfSpace(content[end]) && !isPdfDelimiter(content[end]) {
+				end++
+			}
+			if end == i {
+				end++
+			}
+			word := string(content[i:end])
+			i = end
+
+			if inArray {
+				// a large gap between strings in a TJ array is a space
+				if gap, err := strconv.ParseFloat(word, 64); err == nil && gap < -pdfWordGap {
+					operands = append(operands, " ")
+				}
+				continue
+			}
+			switch word {
+			case "Tj", "TJ":
+				text.WriteString(strings.Join(operands, ""))
+			case "'", "\"":
+				text.WriteString("\n")
+				text.WriteString(strings.Join(operands, ""))
+			case "Td", "TD", "T*", "Tm":
+				text.WriteString(" ")
+			case "ET":
+				text.WriteString("\n")
+			}
+			if !isPdfNumber(word) {
+				operands = operands[:0]
+			}
+		}
+	}
+}
+
+// readPdfString reads the literal string starting with the '(' at start,
+// returning its bytes and the offset after its closing ')'
+func readPdfString(content []byte, start int) ([]byte, int) {
+	str := &bytes.Buffer{}
+	depth := 0
+	for i := start; i < len(content); i++ {
+		c := content[i]
+		switch c {
+		case '(':
+			if depth > 0 {
+				str.WriteByte(c)
+			}
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return str.Bytes(), i + 1
+			}
+			str.WriteByte(c)
+		case '\\':
+			i++
+			if i == len(content) {
+				return str.Bytes(), i
+			}
+			switch esc := content[i]; esc {
+			case 'n', 'r':
+				str.WriteByte('\n')
+			case 't':
+				str.WriteByte('\t')
+			case 'b', 'f':
+			case '\r', '\n':
+				// a line continuation
+			default:
+				if esc >= '0' && esc <= '7' {
+					value := 0
+					for n := 0; n < 3 && i < len(content) && content[i] >= '0' && content[i] <= '7'; n++ {
+						value = value*8 + int(content[i]-'0')
+						i++
+					}
+					i--
+					str.WriteByte(byte(value))
+				} else {
+					str.WriteByte(esc)
+				}
+			}
+		default:
+			str.WriteByte(c)
+		}
+	}
+	return str.Bytes(), len(content)
+}
+
+// decodePdfHexString decodes a string written as hex digits, two byte
+// characters as used by many fonts are decoded as utf-16
+func decodePdfHexString(hex []byte) string {
+	decoded := pdfHexBytes(hex)
+	if len(decoded)%2 == 0 && len(decoded) > 0 && decoded[0] == 0 {
+		return decodeUTF16(decoded)
+	}
+	return decodePdfTextString(decoded)
+}
+
+// pdfHexBytes returns the bytes of a string written as hex digits
+func pdfHexBytes(hex []byte) []byte {
+	digits := make([]byte, 0, len(hex))
+	for _, c := range hex {
+		if !isPdfSpace(c) {
+			digits = append(digits, c)
+		}
+	}
+	if len(digits)%2 == 1 {
+		digits = append(digits, '0')
+	}
+
+	decoded := make([]byte, len(digits)/2)
+	for i := range decoded {
+		decoded[i] = hexValue(digits[2*i])<<4 | hexValue(digits[2*i+1])
+	}
+	return decoded
+}
+
+// decodePdfTextString decodes a string from the pdf as utf-16 if it starts
+// with a byte order mark, as is if it is valid utf-8 and otherwise as
+// latin-1, which is close enough to the pdf's own encodings for searching
+func decodePdfTextString(str []byte) string {
+	if bytes.HasPrefix(str, []byte{0xfe, 0xff}) {
+		return decodeUTF16(str[2:])
+	}
+	if utf8.Valid(str) {
+		return string(str)
+	}
+	runes := make([]rune, len(str))
+	for i, c := range str {
+		runes[i] = rune(c)
+	}
+	return string(runes)
+}
+
+// decodeUTF16 decodes big-endian utf-16, a trailing odd byte is dropped
+func decodeUTF16(str []byte) string {
+	units := make([]uint16, len(str)/2)
+	for i := range units {
+		units[i] = uint16(str[2*i])<<8 | uint16(str[2*i+1])
+	}
+	return string(utf16.Decode(units))
+}
+
+func hexValue(c byte) byte {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0'
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10
+	case c >= 'A' && c <= 'F':
+		return c - 'A' + 10
+	}
+	return 0
+}
+
+func isPdfSpace(c byte) bool {
+	return c == ' ' || c == '\n' || c == '\r' || c == '\t' || c == '\f' || c == 0
+}
+
+func isPdfDelimiter(c byte) bool {
+	return strings.IndexByte("()<>[]{}/%", c) >= 0
+}
+
+func isPdfNumber(word string) bool {
+	if word == "" {
+		return false
+	}
+	for _, c := range word {
+		if (c < '0' || c > '9') && c != '.' && c != '-' && c != '+' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,164 @@
+package ebooks
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestExtractTextFromPlainTextReplacesInvalidUtf8(t *testing.T) {
+	text, ok := extractText("notes.TXT", []byte("caf\xe9 society"))
+	if !ok {
+		t.Fatal("Expected text to be extracted from a .txt file")
+	}
+	if text != "caf  society" {
+		t.Fatalf("Expected invalid bytes to be replaced but text was '%s'", text)
+	}
+}
+
+func TestExtractTextIgnoresUnsupportedFiles(t *testing.T) {
+	if _, ok := extractText("code.zip", []byte("PK")); ok {
+		t.Fatal("Expected no text to be extracted from a zip file")
+	}
+}
+
+func TestExtractTextFromEpubReadsTheHtmlDocuments(t *testing.T) {
+	epub := anEpub(map[string]string{
+		"mimetype": "application/epub+zip",
+		"OEBPS/chapter1.xhtml": `<?xml version="1.0" encoding="utf-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml"><head><title>Ignored</title><style>p {}</style></head>
+<body><h1>Chapter&nbsp;1</h1><p>Goroutines are <em>cheap</em>.</p><p>Channels&amp;select</p></body></html>`,
+		"OEBPS/styles.css": "body { color: black }",
+	}, t)
+
+	text, _ := extractText("book.epub", epub)
+	for _, expected := range []string{"Chapter", "Goroutines are cheap.", "Channels&select"} {
+		if !strings.Contains(text, expected) {
+			t.Fatalf("Expected epub text to contain '%s' but was '%s'", expected, text)
+		}
+	}
+	for _, unexpected := range []string{"Ignored", "color", "p {}"} {
+		if strings.Contains(text, unexpected) {
+			t.Fatalf("Expected epub text not to contain '%s' but was '%s'", unexpected, text)
+		}
+	}
+	if strings.Contains(text, "Goroutines are cheap.Channels") {
+		t.Fatalf("Expected paragraphs to be separated but text was '%s'", text)
+	}
+}
+
+func TestExtractTextFromHtmlWhichIsNotWellFormed(t *testing.T) {
+	text, _ := extractText("page.html", []byte("<p>First<br>second<p>third &copy; 2016"))
+	for _, expected := range []string{"First", "second", "third © 2016"} {
+		if !strings.Contains(text, expected) {
+			t.Fatalf("Expected html text to contain '%s' but was '%s'", expected, text)
+		}
+	}
+}
+
+func TestExtractTextFromPdfContentStreams(t *testing.T) {
+	pdf := aPdf([]string{
+		"BT /F1 12 Tf 72 712 Td (Hello \\(PDF\\) world) Tj ET",
+		"BT /F1 12 Tf [(Kern)-20(ing)-400(works)] TJ T* (next\\040line) Tj ET",
+	}, t)
+
+	text, _ := extractText("book.pdf", pdf)
+	for _, expected := range []string{"Hello (PDF) world", "Kerning works", "next line"} {
+		if !strings.Contains(text, expected) {
+			t.Fatalf("Expected pdf text to contain '%s' but was '%s'", expected, text)
+		}
+	}
+}
+
+func TestExtractTextFromPdfDecodesHexStrings(t *testing.T) {
+	pdf := aPdf([]string{"BT <48656c6c6f> Tj <00470065006f> Tj ET"}, t)
+
+	text, _ := extractText("book.pdf", pdf)
+	if !strings.Contains(text, "HelloGeo") {
+		t.Fatalf("Expected hex strings to be decoded but text was '%s'", text)
+	}
+}
+
+func TestExtractTextFromPdfOnlyDecompressesStreamsUpToTheLimits(t *testing.T) {
+	defer func(stream, total int64) {
+		MaxTextExtractionStreamSize, MaxTextExtractionTotalSize = stream, total
+	}(MaxTextExtractionStreamSize, MaxTextExtractionTotalSize)
+	MaxTextExtractionStreamSize, MaxTextExtractionTotalSize = 1024, 1536
+	oversized := "BT (Hello) Tj ET " + strings.Repeat("0 0 Td ", 1<<20)
+	pdf := aPdf([]string{oversized, oversized, "BT (Goodbye) Tj ET"}, t)
+
+	streams := pdfStreams(pdf)
+	if len(streams) != 2 || len(streams[0].content) != 1024 || len(streams[1].content) != 512 {
+		t.Fatalf("Expected the streams to be cut off at the limits and the last left out but found %d streams", len(streams))
+	}
+	text, _ := extractText("book.pdf", pdf)
+	if !strings.Contains(text, "Hello") || strings.Contains(text, "Goodbye") {
+		t.Fatalf("Expected only the text within the limits but text was '%s'", text)
+	}
+}
+
+func TestExtractTextFromEpubOnlyReadsDocumentsUpToTheLimits(t *testing.T) {
+	defer func(stream, total int64) {
+		MaxTextExtractionStreamSize, MaxTextExtractionTotalSize = stream, total
+	}(MaxTextExtractionStreamSize, MaxTextExtractionTotalSize)
+	MaxTextExtractionStreamSize, MaxTextExtractionTotalSize = 1024, 1536
+	oversized := "<p>Hello " + strings.Repeat("again ", 1<<20) + "Goodbye</p>"
+	epub := anEpub(map[string]string{"OEBPS/chapter1.xhtml": oversized}, t)
+
+	text, _ := extractText("book.epub", epub)
+	if !strings.Contains(text, "Hello") || strings.Contains(text, "Goodbye") || len(text) > 1024 {
+		t.Fatalf("Expected the document to be cut off at the limit but read %d bytes of text", len(text))
+	}
+}
+
+// anEpub returns a zip of the files, the mimetype file is stored first and
+// uncompressed as in a real epub
+func anEpub(files map[string]string, t *testing.T) []byte {
+	buf := &bytes.Buffer{}
+	writer := zip.NewWriter(buf)
+	if mimeType, found := files["mimetype"]; found {
+		file, err := writer.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+		if err != nil {
+			t.Fatalf("Error creating epub %v", err)
+		}
+		file.Write([]byte(mimeType))
+	}
+	for name, content := range files {
+		if name == "mimetype" {
+			continue
+		}
+		file, err := writer.Create(name)
+		if err != nil {
+			t.Fatalf("Error creating epub %v", err)
+		}
+		file.Write([]byte(content))
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Error creating epub %v", err)
+	}
+	return buf.Bytes()
+}
+
+// aPdf returns a minimal pdf with a deflate compressed content stream for
+// each of the given page contents
+func aPdf(pageContents []string, t *testing.T) []byte {
+	pdf := &bytes.Buffer{}
+	pdf.WriteString("%PDF-1.4\n")
+	for i, content := range pageContents {
+		compressed := &bytes.Buffer{}
+		writer := zlib.NewWriter(compressed)
+		writer.Write([]byte(content))
+		if err := writer.Close(); err != nil {
+			t.Fatalf("Error compressing pdf stream %v", err)
+		}
+		fmt.Fprintf(pdf, "%d 0 obj\n<< /Length %d /Filter /FlateDecode >>\nstream\n", i+1, compressed.Len())
+		pdf.Write(compressed.Bytes())
+		pdf.WriteString("\nendstream\nendobj\n")
+	}
+	// an image stream which must be skipped
+	pdf.WriteString("9 0 obj\n<< /Filter /DCTDecode /Length 6 >>\nstream\nBT ET!\nendstream\nendobj\n%%EOF\n")
+	return pdf.Bytes()
+}
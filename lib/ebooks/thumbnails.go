@@ -0,0 +1,127 @@
+package ebooks
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+)
+
+const (
+	// Folder in each book's folder where the cover thumbnails are cached
+	thumbnailsDirName = "thumbnails"
+
+	thumbnailJpegQuality = 85
+)
+
+// A size of thumbnail generated for every book cover, covers are scaled
+// down to fit within the bounds keeping their aspect ratio
+type ThumbnailSize struct {
+	Name      string
+	MaxWidth  int
+	MaxHeight int
+}
+
+var (
+	SmallThumbnail  = ThumbnailSize{"small", 60, 90}
+	MediumThumbnail = ThumbnailSize{"medium", 200, 300}
+
+	ThumbnailSizes = []ThumbnailSize{SmallThumbnail, MediumThumbnail}
+)
+
+// thumbnailSizeByName returns the thumbnail size with the given name
+func thumbnailSizeByName(name string) (ThumbnailSize, error) {
+	for _, size := range ThumbnailSizes {
+		if size.Name == name {
+			return size, nil
+		}
+	}
+	return ThumbnailSize{}, fmt.Errorf("unknown thumbnail size '%s'", name)
+}
+
+// generateThumbnail decodes the cover image and returns a jpeg of it
+// scaled down to fit the given size. Images already smaller than the size
+// are not scaled up.
+func generateThumbnail(cover []byte, size ThumbnailSize) ([]byte, error) {
+	src, _, err := image.Decode(bytes.NewReader(cover))
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := src.Bounds()
+	width, height := thumbnailDimensions(bounds.Dx(), bounds.Dy(), size)
+	thumbnail := resizeImage(src, width, height)
+
+	// jpegs have no transparency so draw onto a white background first
+	flattened := image.NewRGBA(thumbnail.Bounds())
+	draw.Draw(flattened, flattened.Bounds(), image.White, image.ZP, draw.Src)
+	draw.Draw(flattened, flattened.Bounds(), thumbnail, image.ZP, draw.Over)
+
+	buf := &bytes.Buffer{}
+	err = jpeg.Encode(buf, flattened, &jpeg.Options{Quality: thumbnailJpegQuality})
+	return buf.Bytes(), err
+}
+
+// thumbnailDimensions returns the largest width and height no bigger than
+// the original which fit in the size while keeping the aspect ratio
+func thumbnailDimensions(width, height int, size ThumbnailSize) (int, int) {
+	if width <= size.MaxWidth && height <= size.MaxHeight {
+		return width, height
+	}
+
+	// scale by whichever side is furthest over its maximum
+	if width*size.MaxHeight > height*size.MaxWidth {
+		height = height * size.MaxWidth / width
+		width = size.MaxWidth
+	} else {
+		width = width * size.MaxHeight / height
+		height = size.MaxHeight
+	}
+
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+	return width, height
+}
+
+// resizeImage scales the image to the given dimensions, each pixel of the
+// result is the average of the pixels it covers in the source image
+func resizeImage(src image.Image, width, height int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	bounds := src.Bounds()
+	for y := 0; y < height; y++ {
+		y0, y1 := scaledRange(y, height, bounds.Min.Y, bounds.Dy())
+		for x := 0; x < width; x++ {
+			x0, x1 := scaledRange(x, width, bounds.Min.X, bounds.Dx())
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := src.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(pr), g+uint64(pg), b+uint64(pb), a+uint64(pa)
+					n++
+				}
+			}
+			dst.Set(x, y, color.RGBA64{uint16(r / n), uint16(g / n), uint16(b / n), uint16(a / n)})
+		}
+	}
+	return dst
+}
+
+// scaledRange returns the range of source pixels covered by pixel i of
+// the destination, always at least one pixel wide
+func scaledRange(i, dstSize, srcMin, srcSize int) (int, int) {
+	start := srcMin + i*srcSize/dstSize
+	end := srcMin + (i+1)*srcSize/dstSize
+	if end <= start {
+		end = start + 1
+	}
+	return start, end
+}
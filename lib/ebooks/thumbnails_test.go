@@ -0,0 +1,71 @@
+package ebooks
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+
+	"github.com/stephenhenderson/ebooklib/lib/testutils/assert"
+)
+
+func TestThumbnailDimensionsKeepTheAspectRatio(t *testing.T) {
+	size := ThumbnailSize{"test", 100, 150}
+	cases := []struct {
+		width, height, expectedWidth, expectedHeight int
+	}{
+		{200, 300, 100, 150},
+		{400, 300, 100, 75},
+		{100, 600, 25, 150},
+		{50, 60, 50, 60},
+		{1000, 1, 100, 1},
+	}
+
+	for _, c := range cases {
+		width, height := thumbnailDimensions(c.width, c.height, size)
+		if width != c.expectedWidth || height != c.expectedHeight {
+			t.Fatalf("Expected %dx%d to be scaled to %dx%d but got %dx%d",
+				c.width, c.height, c.expectedWidth, c.expectedHeight, width, height)
+		}
+	}
+}
+
+func TestResizeImageAveragesThePixelsCovered(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	src.Set(0, 0, color.White)
+	src.Set(1, 0, color.White)
+	src.Set(0, 1, color.Black)
+	src.Set(1, 1, color.Black)
+
+	resized := resizeImage(src, 1, 1)
+	expected := color.RGBA{127, 127, 127, 255}
+	if resized.RGBAAt(0, 0) != expected {
+		t.Fatalf("Expected a mid grey pixel %v but got %v", expected, resized.RGBAAt(0, 0))
+	}
+}
+
+func TestGeneratedThumbnailsAreJpegsWhichFitTheSize(t *testing.T) {
+	buf := &bytes.Buffer{}
+	assert.NoError(t, png.Encode(buf, image.NewRGBA(image.Rect(0, 0, 400, 600))))
+
+	thumbnail, err := generateThumbnail(buf.Bytes(), SmallThumbnail)
+	assert.NoError(t, err)
+
+	config, format, err := image.DecodeConfig(bytes.NewReader(thumbnail))
+	assert.NoError(t, err)
+	if format != "jpeg" {
+		t.Fatalf("Expected a jpeg thumbnail but was %s", format)
+	}
+	if config.Width != SmallThumbnail.MaxWidth || config.Height != SmallThumbnail.MaxHeight {
+		t.Fatalf("Expected a %dx%d thumbnail but was %dx%d",
+			SmallThumbnail.MaxWidth, SmallThumbnail.MaxHeight, config.Width, config.Height)
+	}
+}
+
+func TestGeneratingAThumbnailOfAnInvalidImageIsAnError(t *testing.T) {
+	_, err := generateThumbnail([]byte("not an image"), SmallThumbnail)
+	if err == nil {
+		t.Fatal("Expected error generating a thumbnail of an invalid image")
+	}
+}
@@ -20,10 +20,10 @@ func DeleteTempDirsCreatedDuringTesting() {
 	tempDirs = []string{}
 }
 
-func CreateTempDir(t *testing.T) string {
+func CreateTempDir(t testing.TB) string {
 	folder, err := ioutil.TempDir("", "ebook_tests")
 	if err != nil {
-		t.Fatalf("Error creating temp dir", err)
+		t.Fatalf("Error creating temp dir %v", err)
 	}
 	tempDirs = append(tempDirs, folder)
 	return folder
@@ -2,9 +2,11 @@ package webservice
 
 import (
 	"html/template"
+	"io"
 	"io/ioutil"
 	"mime/multipart"
 	"net/http"
+	"net/url"
 	"path/filepath"
 
 	"fmt"
@@ -12,23 +14,43 @@ import (
 	. "github.com/stephenhenderson/ebooklib/lib/logging"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const (
-	addBookTemplate  = "add_book.html"
-	indexTemplate    = "index.html"
-	viewBookTemplate = "view_book.html"
+	addBookTemplate        = "add_book.html"
+	checkLibraryTemplate   = "check_library.html"
+	duplicatesTemplate     = "duplicates.html"
+	editBookTemplate       = "edit_book.html"
+	indexTemplate          = "index.html"
+	searchContentsTemplate = "search_contents.html"
+	trashTemplate          = "trash.html"
+	viewBookTemplate       = "view_book.html"
 )
 
-// NewEbookWebService initialises a new webservice with the given library
-// and html template directory, returns error if there is any error loading
-// the templates
-func NewEbookWebService(library *ebooks.FileLibrary, templateDir string) (*EbookWebService, error) {
+const (
+	// Largest cover image which will be downloaded from an image url
+	maxImageSize = 10 << 20
+
+	imageFetchTimeout = 30 * time.Second
+)
+
+// Functions available to all html templates
+var templateFuncs = template.FuncMap{
+	"join":      strings.Join,
+	"fileSize":  formatFileSize,
+	"fileRoles": func() []ebooks.FileRole { return ebooks.FileRoles },
+}
+
+// NewEbookWebService initialises a new webservice with the given library,
+// full-text index of its contents and html template directory, returns
+// error if there is any error loading the templates
+func NewEbookWebService(library ebooks.Library, fullText *ebooks.FullTextIndex, templateDir string) (*EbookWebService, error) {
 	templates, err := loadTemplates(templateDir)
 	if err != nil {
 		return nil, err
 	}
-	return &EbookWebService{library: library, templates: templates}, nil
+	return &EbookWebService{library: ebooks.NewSearchableLibrary(library, fullText), templates: templates}, nil
 }
 
 func loadTemplates(templateDir string) (map[string]*template.Template, error) {
@@ -42,7 +64,7 @@ func loadTemplates(templateDir string) (map[string]*template.Template, error) {
 		fileName := file.Name()
 		if strings.HasSuffix(fileName, ".html") {
 			templatePath := filepath.Join(templateDir, fileName)
-			template, err := template.New(fileName).ParseFiles(templatePath)
+			template, err := template.New(fileName).Funcs(templateFuncs).ParseFiles(templatePath)
 			if err != nil {
 				return nil, err
 			}
@@ -55,7 +77,8 @@ func loadTemplates(templateDir string) (map[string]*template.Template, error) {
 }
 
 func checkAllRequiredTemplatesArePresent(templateMap map[string]*template.Template) error {
-	expectedTemplates := []string{addBookTemplate, viewBookTemplate, indexTemplate}
+	expectedTemplates := []string{addBookTemplate, editBookTemplate, viewBookTemplate, indexTemplate, searchContentsTemplate, trashTemplate,
+		duplicatesTemplate, checkLibraryTemplate}
 	for _, template := range expectedTemplates {
 		_, found := templateMap[template]
 		if !found {
@@ -67,7 +90,9 @@ func checkAllRequiredTemplatesArePresent(templateMap map[string]*template.Templa
 
 // EbookWebService a webservice/UI on top of an ebook library
 type EbookWebService struct {
-	library   *ebooks.FileLibrary
+	// All changes must go through the searchable library to keep its
+	// search index up to date
+	library   *ebooks.SearchableLibrary
 	templates map[string]*template.Template
 }
 
@@ -77,11 +102,26 @@ func (webservice *EbookWebService) StartService(host string) {
 	http.HandleFunc("/", webservice.listAllHandler)
 	http.HandleFunc("/"+addBookTemplate, webservice.addBookFormHandler)
 	http.HandleFunc("/"+viewBookTemplate, webservice.viewBookHandler)
-
-	http.Handle("/download_book/", http.StripPrefix("/download_book/", http.FileServer(http.Dir(webservice.library.BaseDir))))
+	http.HandleFunc("/"+editBookTemplate, webservice.editBookFormHandler)
+	http.HandleFunc("/"+trashTemplate, webservice.trashHandler)
+	http.HandleFunc("/"+searchContentsTemplate, webservice.searchContentsHandler)
+	http.HandleFunc("/"+duplicatesTemplate, webservice.duplicatesHandler)
+	http.HandleFunc("/"+checkLibraryTemplate, webservice.checkLibraryHandler)
+
+	http.Handle("/download_book/", http.StripPrefix("/download_book/", http.HandlerFunc(webservice.downloadBookFileHandler)))
+	http.HandleFunc("/cover", webservice.coverHandler)
 	http.HandleFunc("/delete_file", webservice.deleteFileHandler)
+	http.HandleFunc("/set_file_role", webservice.setFileRoleHandler)
 	http.HandleFunc("/addBook", webservice.addBookHandler)
+	http.HandleFunc("/update_book", webservice.updateBookHandler)
+	http.HandleFunc("/delete_book", webservice.deleteBookHandler)
+	http.HandleFunc("/restore_book", webservice.restoreBookHandler)
+	http.HandleFunc("/purge_book", webservice.purgeBookHandler)
+	http.HandleFunc("/set_image", webservice.setImageHandler)
+	http.HandleFunc("/remove_image", webservice.removeImageHandler)
+	http.HandleFunc("/thumbnail", webservice.thumbnailHandler)
 	http.HandleFunc("/add_files", webservice.addFilesToBookHandler)
+	http.HandleFunc("/repair_library", webservice.repairLibraryHandler)
 
 	http.ListenAndServe(host, nil)
 }
@@ -90,36 +130,325 @@ func (webservice *EbookWebService) deleteFileHandler(w http.ResponseWriter, r *h
 	bookID, err := strconv.Atoi(r.URL.Query().Get("bookid"))
 	if err != nil {
 		http.Error(w, "No book with this id", http.StatusBadRequest)
+		return
 	}
 
 	fileName := r.URL.Query().Get("filename")
 	if len(fileName) == 0 {
 		http.Error(w, "Missing filename to delete", http.StatusBadRequest)
+		return
 	}
 
-	err = webservice.library.DeleteFileFromBook(fileName, bookID)
+	err = webservice.library.DeleteFileFromBook(bookID, fileName)
+	if writeLibraryError(w, err) {
+		return
+	}
+
+	viewBookUrl := fmt.Sprintf("/%s?id=%d", viewBookTemplate, bookID)
+	http.Redirect(w, r, viewBookUrl, http.StatusFound)
+}
+
+// setFileRoleHandler changes the role of one of a book's files to the
+// "role" form value
+func (webservice *EbookWebService) setFileRoleHandler(w http.ResponseWriter, r *http.Request) {
+	bookID, err := strconv.Atoi(r.FormValue("bookid"))
 	if err != nil {
-		errMsg := fmt.Sprintf("Error deleting file %v", err)
-		http.Error(w, errMsg, http.StatusInternalServerError)
+		http.Error(w, "No book with this id", http.StatusBadRequest)
+		return
+	}
+
+	fileName := r.FormValue("filename")
+	if len(fileName) == 0 {
+		http.Error(w, "Missing filename to change", http.StatusBadRequest)
+		return
+	}
+
+	err = webservice.library.SetFileRole(bookID, fileName, ebooks.FileRole(r.FormValue("role")))
+	if writeLibraryError(w, err) {
+		return
 	}
 
 	viewBookUrl := fmt.Sprintf("/%s?id=%d", viewBookTemplate, bookID)
 	http.Redirect(w, r, viewBookUrl, http.StatusFound)
 }
 
-func (webservice *EbookWebService) viewBookHandler(w http.ResponseWriter, r *http.Request) {
+// downloadBookFileHandler serves a book's file from a path of the form
+// <book id>/<file name>
+func (webservice *EbookWebService) downloadBookFileHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(r.URL.Path, "/", 2)
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	bookID, err := strconv.Atoi(parts[0])
+	if err != nil {
+		http.Error(w, "No book with this id", http.StatusNotFound)
+		return
+	}
+	fileName := parts[1]
+
+	content, err := webservice.library.OpenBookFile(bookID, fileName)
+	if writeLibraryError(w, err) {
+		return
+	}
+	defer content.Close()
+	http.ServeContent(w, r, fileName, time.Time{}, content)
+}
+
+func (webservice *EbookWebService) coverHandler(w http.ResponseWriter, r *http.Request) {
 	bookID, err := strconv.Atoi(r.URL.Query().Get("id"))
 	if err != nil {
 		http.Error(w, "No book with this id", http.StatusNotFound)
 		return
 	}
 
-	book, err := webservice.library.GetBookByID(bookID)
+	content, err := webservice.library.OpenBookImage(bookID)
+	if writeLibraryError(w, err) {
+		return
+	}
+	defer content.Close()
+	http.ServeContent(w, r, "", time.Time{}, content)
+}
+
+func (webservice *EbookWebService) deleteBookHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Books must be deleted with a POST", http.StatusMethodNotAllowed)
+		return
+	}
+	bookID, err := strconv.Atoi(r.FormValue("id"))
 	if err != nil {
+		http.Error(w, "No book with this id", http.StatusNotFound)
+		return
+	}
+
+	err = webservice.library.DeleteBook(bookID)
+	if !writeLibraryError(w, err) {
+		http.Redirect(w, r, "/", http.StatusFound)
+	}
+}
+
+func (webservice *EbookWebService) restoreBookHandler(w http.ResponseWriter, r *http.Request) {
+	bookID, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "No book with this id", http.StatusNotFound)
+		return
+	}
+
+	_, err = webservice.library.RestoreBook(bookID)
+	if !writeLibraryError(w, err) {
+		viewBookUrl := fmt.Sprintf("/%s?id=%d", viewBookTemplate, bookID)
+		http.Redirect(w, r, viewBookUrl, http.StatusFound)
+	}
+}
+
+func (webservice *EbookWebService) purgeBookHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Books must be permanently deleted with a POST", http.StatusMethodNotAllowed)
+		return
+	}
+	bookID, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		http.Error(w, "No book with this id", http.StatusNotFound)
+		return
+	}
+
+	err = webservice.library.PurgeBook(bookID)
+	if !writeLibraryError(w, err) {
+		http.Redirect(w, r, "/"+trashTemplate, http.StatusFound)
+	}
+}
+
+func (webservice *EbookWebService) setImageHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseMultipartForm(100000)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	bookID, err := strconv.Atoi(url.Values(r.MultipartForm.Value).Get("bookID"))
+	if err != nil {
+		http.Error(w, "No book with this id", http.StatusNotFound)
+		return
+	}
+
+	image, err := readImageFromForm(r.MultipartForm)
+	if err == nil && image == nil {
+		err = fmt.Errorf("Missing image file or url")
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, err = webservice.library.SetBookImage(bookID, image)
+	if !writeLibraryError(w, err) {
+		viewBookUrl := fmt.Sprintf("/%s?id=%d", viewBookTemplate, bookID)
+		http.Redirect(w, r, viewBookUrl, http.StatusFound)
+	}
+}
+
+func (webservice *EbookWebService) removeImageHandler(w http.ResponseWriter, r *http.Request) {
+	bookID, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "No book with this id", http.StatusNotFound)
+		return
+	}
+
+	err = webservice.library.RemoveBookImage(bookID)
+	if !writeLibraryError(w, err) {
+		viewBookUrl := fmt.Sprintf("/%s?id=%d", viewBookTemplate, bookID)
+		http.Redirect(w, r, viewBookUrl, http.StatusFound)
+	}
+}
+
+func (webservice *EbookWebService) thumbnailHandler(w http.ResponseWriter, r *http.Request) {
+	bookID, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "No book with this id", http.StatusNotFound)
+		return
+	}
+
+	size := r.URL.Query().Get("size")
+	if size == "" {
+		size = ebooks.SmallThumbnail.Name
+	}
+
+	content, err := webservice.library.OpenThumbnail(bookID, size)
+	if writeLibraryError(w, err) {
+		return
+	}
+	defer content.Close()
+	http.ServeContent(w, r, "", time.Time{}, content)
+}
+
+func (webservice *EbookWebService) trashHandler(w http.ResponseWriter, r *http.Request) {
+	books := webservice.library.GetTrash()
+	err := webservice.templates[trashTemplate].Execute(w, books)
+	if err != nil {
+		fmt.Fprintf(w, "Unexpected error:%v", err)
+	}
+}
+
+// Data for the search contents template
+type contentSearch struct {
+	Query   string
+	Matches []*ebooks.ContentMatch
+}
+
+// searchContentsHandler lists the books whose files contain the words in
+// the "q" parameter, best matches first
+func (webservice *EbookWebService) searchContentsHandler(w http.ResponseWriter, r *http.Request) {
+	search := &contentSearch{Query: r.URL.Query().Get("q")}
+	search.Matches = webservice.library.SearchContents(search.Query)
+	err := webservice.templates[searchContentsTemplate].Execute(w, search)
+	if err != nil {
+		fmt.Fprintf(w, "Unexpected error:%v", err)
+	}
+}
+
+// formatFileSize returns a file size in bytes in the largest unit it is at
+// least one of, e.g. 1.5 MB
+func formatFileSize(size int64) string {
+	if size < 1024 {
+		return fmt.Sprintf("%d B", size)
+	}
+	units := []string{"KB", "MB", "GB"}
+	value := float64(size) / 1024
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
+
+// duplicatesHandler lists the groups of files in the library with
+// identical contents
+func (webservice *EbookWebService) duplicatesHandler(w http.ResponseWriter, r *http.Request) {
+	duplicates := ebooks.FindDuplicateFiles(webservice.library.GetAll())
+	err := webservice.templates[duplicatesTemplate].Execute(w, duplicates)
+	if err != nil {
+		fmt.Fprintf(w, "Unexpected error:%v", err)
+	}
+}
+
+// checkLibraryHandler lists the inconsistencies between the library's
+// index and the files it stores on disk. The check reads every file so
+// it is only run for a post, otherwise the form to start it is shown.
+func (webservice *EbookWebService) checkLibraryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		err := webservice.templates[checkLibraryTemplate].Execute(w, (*ebooks.CheckReport)(nil))
+		if err != nil {
+			fmt.Fprintf(w, "Unexpected error:%v", err)
+		}
+		return
+	}
+	webservice.checkLibrary(w, false)
+}
+
+// repairLibraryHandler repairs the inconsistencies between the library's
+// index and its files on disk and lists what was found, only posts are
+// accepted as the repair changes the library
+func (webservice *EbookWebService) repairLibraryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Repairs must be requested with a POST", http.StatusMethodNotAllowed)
+		return
+	}
+	webservice.checkLibrary(w, true)
+}
+
+func (webservice *EbookWebService) checkLibrary(w http.ResponseWriter, repair bool) {
+	report, err := webservice.library.Check(repair)
+	if writeLibraryError(w, err) {
+		return
+	}
+	err = webservice.templates[checkLibraryTemplate].Execute(w, report)
+	if err != nil {
+		fmt.Fprintf(w, "Unexpected error:%v", err)
+	}
+}
+
+// writeLibraryError writes an error response for an error returned by
+// the library and returns true, if there was no error it returns false
+func writeLibraryError(w http.ResponseWriter, err error) bool {
+	switch err {
+	case nil:
+		return false
+	case ebooks.BookNotFound, ebooks.FileNotFound, ebooks.BookHasNoImage:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case ebooks.UnsupportedImageType, ebooks.InvalidFileRole:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case ebooks.CheckNotSupported:
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+	default:
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
+	return true
+}
+
+// Data for the view book template
+type bookView struct {
+	*ebooks.Ebook
+
+	// Other files in the library with the same contents as each of the
+	// book's files by name, e.g. the same pdf uploaded to two books
+	Duplicates map[string][]*ebooks.FileLocation
+}
+
+func (webservice *EbookWebService) viewBookHandler(w http.ResponseWriter, r *http.Request) {
+	bookID, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "No book with this id", http.StatusNotFound)
+		return
+	}
 
-	err = webservice.templates["view_book.html"].Execute(w, book)
+	book, err := webservice.library.GetBookByID(bookID)
+	if writeLibraryError(w, err) {
+		return
+	}
+
+	view := &bookView{book, ebooks.DuplicatesOfBook(webservice.library.GetAll(), bookID)}
+	err = webservice.templates["view_book.html"].Execute(w, view)
 	if err != nil {
 		http.Error(w, "No book with this id", http.StatusNotFound)
 		return
@@ -127,111 +456,304 @@ func (webservice *EbookWebService) viewBookHandler(w http.ResponseWriter, r *htt
 }
 
 func (webservice *EbookWebService) addBookHandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Printf("content type received is %v\n", r.Header.Get("Content-Type"))
 	err := r.ParseMultipartForm(100000)
 	if err != nil {
-		fmt.Printf("Got error %v and some other stuff", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	title := r.MultipartForm.Value["title"][0]
-	authors := strings.Split(r.MultipartForm.Value["authors"][0], ",")
-	tags := strings.Split(r.MultipartForm.Value["tags"][0], ",")
-	yearStr := r.MultipartForm.Value["year"][0]
-	year := 0
-	if yearStr != "" {
-		year, err = strconv.Atoi(yearStr)
-		if err != nil {
-			errMsg := fmt.Sprintf("Invalid year '%s', err=%v", yearStr, err)
-			http.Error(w, errMsg, http.StatusBadRequest)
-			return
-		}
+	bookDetails, err := partialBookDetailsFromForm(url.Values(r.MultipartForm.Value))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
 	fileHeaders := r.MultipartForm.File["files"]
 	Logger.Printf("File headers: %v", fileHeaders)
-	bookFiles, err := readBookFilesFromFileHeaders(fileHeaders)
+	bookFiles, err := openUploadedFiles(fileHeaders)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	defer bookFiles.Close()
 
-	bookDetails := &ebooks.BookDetails{
-		Title:   title,
-		Authors: authors,
-		Year:    year,
-		Tags:    tags,
+	// fields left blank are filled in from the metadata of the uploaded files
+	metadata := ebooks.ExtractMetadata(bookFiles.seekers())
+	metadata.CompleteBookDetails(bookDetails)
+	if bookDetails.Title == "" {
+		http.Error(w, "Missing title", http.StatusBadRequest)
+		return
 	}
 
-	var image []byte = nil // TODO
-	book, err := webservice.library.Add(bookDetails, image, bookFiles)
+	image, err := readImageFromForm(r.MultipartForm)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if image == nil {
+		image = metadata.Cover
+	}
+
+	book, err := webservice.library.Add(bookDetails, image, bookFiles.readers())
+	if writeLibraryError(w, err) {
 		return
 	}
 	viewBookUrl := fmt.Sprintf("/%s?id=%d", viewBookTemplate, book.ID)
 	http.Redirect(w, r, viewBookUrl, http.StatusFound)
 }
 
+func (webservice *EbookWebService) editBookFormHandler(w http.ResponseWriter, r *http.Request) {
+	bookID, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "No book with this id", http.StatusNotFound)
+		return
+	}
+
+	book, err := webservice.library.GetBookByID(bookID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	err = webservice.templates[editBookTemplate].Execute(w, book)
+	if err != nil {
+		fmt.Fprintf(w, "Unexpected error:%v", err)
+	}
+}
+
+func (webservice *EbookWebService) updateBookHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	bookID, err := strconv.Atoi(r.PostForm.Get("bookID"))
+	if err != nil {
+		http.Error(w, "No book with this id", http.StatusNotFound)
+		return
+	}
+
+	bookDetails, err := bookDetailsFromForm(r.PostForm)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, err = webservice.library.UpdateBook(bookID, bookDetails)
+	if writeLibraryError(w, err) {
+		return
+	}
+
+	viewBookUrl := fmt.Sprintf("/%s?id=%d", viewBookTemplate, bookID)
+	http.Redirect(w, r, viewBookUrl, http.StatusFound)
+}
+
+// bookDetailsFromForm reads and validates the book details fields shared
+// by the add and edit book forms
+func bookDetailsFromForm(form url.Values) (*ebooks.BookDetails, error) {
+	bookDetails, err := partialBookDetailsFromForm(form)
+	if err != nil {
+		return nil, err
+	}
+	if bookDetails.Title == "" {
+		return nil, fmt.Errorf("Missing title")
+	}
+	return bookDetails, nil
+}
+
+// partialBookDetailsFromForm reads the book details from the form allowing
+// any of the fields, including the title, to be blank
+func partialBookDetailsFromForm(form url.Values) (*ebooks.BookDetails, error) {
+	title := strings.TrimSpace(form.Get("title"))
+
+	yearStr := strings.TrimSpace(form.Get("year"))
+	year := 0
+	if yearStr != "" {
+		var err error
+		year, err = strconv.Atoi(yearStr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid year '%s', err=%v", yearStr, err)
+		}
+	}
+
+	return &ebooks.BookDetails{
+		Title:   title,
+		Authors: splitCommaSeparated(form.Get("authors")),
+		Year:    year,
+		Tags:    splitCommaSeparated(form.Get("tags")),
+	}, nil
+}
+
+// splitCommaSeparated splits a comma-separated form field into its
+// trimmed, non-empty values
+func splitCommaSeparated(field string) []string {
+	values := []string{}
+	for _, value := range strings.Split(field, ",") {
+		value = strings.TrimSpace(value)
+		if value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
 func (webservice *EbookWebService) addFilesToBookHandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Printf("content type received is %v\n", r.Header.Get("Content-Type"))
 	err := r.ParseMultipartForm(100000)
 	if err != nil {
-		fmt.Printf("Got error %v and some other stuff", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	bookID, _ := strconv.Atoi(r.MultipartForm.Value["bookID"][0])
-
-	fileHeaders := r.MultipartForm.File["files"]
-	Logger.Printf("File headers: %v", fileHeaders)
-	bookFiles, err := readBookFilesFromFileHeaders(fileHeaders)
+	bookID, err := strconv.Atoi(url.Values(r.MultipartForm.Value).Get("bookID"))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, "Missing or invalid bookID", http.StatusBadRequest)
 		return
 	}
 
-	book, err := webservice.library.GetBookByID(bookID)
+	fileHeaders := r.MultipartForm.File["files"]
+	Logger.Printf("File headers: %v", fileHeaders)
+	bookFiles, err := openUploadedFiles(fileHeaders)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	defer bookFiles.Close()
 
-	for fileName, data := range bookFiles {
-		err = webservice.library.AddFileToBook(book, fileName, data)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+	for fileName, content := range bookFiles {
+		err = webservice.library.AddFileToBook(bookID, fileName, content)
+		if writeLibraryError(w, err) {
 			return
 		}
 	}
 
+	if writeLibraryError(w, webservice.completeBookFromMetadata(bookID, bookFiles)) {
+		return
+	}
+
 	viewBookUrl := fmt.Sprintf("/%s?id=%d", viewBookTemplate, bookID)
 	http.Redirect(w, r, viewBookUrl, http.StatusFound)
 }
 
-func readBookFilesFromFileHeaders(fileHeaders []*multipart.FileHeader) (map[string][]byte, error) {
-	bookFiles := make(map[string][]byte)
+// completeBookFromMetadata fills in any blank details of the book, and its
+// cover if it has none, from the metadata of files added to it
+func (webservice *EbookWebService) completeBookFromMetadata(bookID int, bookFiles uploadedFiles) error {
+	book, err := webservice.library.GetBookByID(bookID)
+	if err != nil {
+		return err
+	}
+	metadata := ebooks.ExtractMetadata(bookFiles.seekers())
+	details := *book.BookDetails
+	metadata.CompleteBookDetails(&details)
+	if !details.Equals(book.BookDetails) {
+		if _, err = webservice.library.UpdateBook(bookID, &details); err != nil {
+			return err
+		}
+	}
+
+	if book.Image == "" && metadata.Cover != nil {
+		_, err = webservice.library.SetBookImage(bookID, metadata.Cover)
+	}
+	return err
+}
+
+// readImageFromForm returns the uploaded image file if there is one,
+// otherwise the image downloaded from image_url, or nil if neither is set
+func readImageFromForm(form *multipart.Form) ([]byte, error) {
+	if fileHeaders := form.File["image"]; len(fileHeaders) > 0 {
+		return readBytesFromFileHeader(fileHeaders[0])
+	}
+
+	imageUrl := strings.TrimSpace(url.Values(form.Value).Get("image_url"))
+	if imageUrl == "" {
+		return nil, nil
+	}
+	return fetchImage(imageUrl)
+}
+
+// fetchImage downloads the image at the given url, failing if it is
+// larger than maxImageSize
+func fetchImage(imageUrl string) ([]byte, error) {
+	client := &http.Client{Timeout: imageFetchTimeout}
+	resp, err := client.Get(imageUrl)
+	if err != nil {
+		return nil, fmt.Errorf("Error fetching image %s, err=%v", imageUrl, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Error fetching image %s, status=%s", imageUrl, resp.Status)
+	}
+
+	image, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxImageSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("Error fetching image %s, err=%v", imageUrl, err)
+	}
+	if len(image) > maxImageSize {
+		return nil, fmt.Errorf("Image %s is larger than %d bytes", imageUrl, maxImageSize)
+	}
+	return image, nil
+}
+
+// The files uploaded in a multipart form by name, opened for reading. Any
+// larger than the memory given to ParseMultipartForm are read from the
+// temp files they were streamed to, so they are never held in memory.
+type uploadedFiles map[string]multipart.File
+
+func openUploadedFiles(fileHeaders []*multipart.FileHeader) (uploadedFiles, error) {
+	files := make(uploadedFiles)
 	for _, fileHeader := range fileHeaders {
-		data, err := readBytesFromFileHeader(fileHeader)
+		file, err := fileHeader.Open()
 		if err != nil {
+			files.Close()
 			return nil, err
 		}
-		bookFiles[fileHeader.Filename] = data
+		files[fileHeader.Filename] = file
 	}
-	return bookFiles, nil
+	return files, nil
 }
 
+// readers returns the files for adding to the library
+func (files uploadedFiles) readers() map[string]io.Reader {
+	readers := make(map[string]io.Reader, len(files))
+	for fileName, file := range files {
+		readers[fileName] = file
+	}
+	return readers
+}
+
+// seekers returns the files for extracting their metadata
+func (files uploadedFiles) seekers() map[string]io.ReadSeeker {
+	seekers := make(map[string]io.ReadSeeker, len(files))
+	for fileName, file := range files {
+		seekers[fileName] = file
+	}
+	return seekers
+}
+
+func (files uploadedFiles) Close() {
+	for _, file := range files {
+		file.Close()
+	}
+}
+
+// readBytesFromFileHeader reads an uploaded image file, failing if it is
+// larger than maxImageSize
 func readBytesFromFileHeader(fileHeader *multipart.FileHeader) ([]byte, error) {
 	file, err := fileHeader.Open()
+	if err != nil {
+		return nil, err
+	}
 	defer file.Close()
 
+	image, err := ioutil.ReadAll(io.LimitReader(file, maxImageSize+1))
 	if err != nil {
 		return nil, err
 	}
-
-	return ioutil.ReadAll(file)
+	if len(image) > maxImageSize {
+		return nil, fmt.Errorf("Image %s is larger than %d bytes", fileHeader.Filename, maxImageSize)
+	}
+	return image, nil
 }
 
 func (webservice *EbookWebService) addBookFormHandler(w http.ResponseWriter, r *http.Request) {
@@ -239,10 +761,46 @@ func (webservice *EbookWebService) addBookFormHandler(w http.ResponseWriter, r *
 	template.Execute(w, nil)
 }
 
+// Orders the listing can be sorted in by the "sort" parameter, books are
+// otherwise ordered by title or by relevance to a search
+var listingSorts = map[string]func(books []*ebooks.Ebook) []*ebooks.Ebook{
+	"added":   ebooks.SortBooksByCreated,
+	"updated": ebooks.SortBooksByUpdated,
+}
+
+// Data for the index template
+type bookListing struct {
+	// The search entered by the user, empty to list every book
+	Query string
+
+	// How the books are sorted, one of listingSorts or empty for the
+	// default order
+	Sort string
+
+	// Why the search could not be run, e.g. a syntax error
+	Error string
+
+	Books []*ebooks.Ebook
+}
+
+// listAllHandler lists the books in the library matching the optional
+// query in the "q" parameter, see ebooks.ParseQuery for the syntax. The
+// "sort" parameter lists the most recently "added" or "updated" first.
 func (webservice *EbookWebService) listAllHandler(w http.ResponseWriter, r *http.Request) {
-	books := webservice.library.GetAll()
+	listing := &bookListing{Query: r.URL.Query().Get("q")}
+	books, err := webservice.library.Find(listing.Query)
+	if err != nil {
+		listing.Error = err.Error()
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	if sortBooks, found := listingSorts[r.URL.Query().Get("sort")]; found {
+		listing.Sort = r.URL.Query().Get("sort")
+		books = sortBooks(books)
+	}
+	listing.Books = books
+
 	template := webservice.templates[indexTemplate]
-	err := template.Execute(w, books)
+	err = template.Execute(w, listing)
 	if err != nil {
 		fmt.Fprintf(w, "Unexpected error:%v", err)
 	}
@@ -1,18 +1,25 @@
 package webservice
 
 import (
+	"archive/zip"
 	"bytes"
 	"encoding/json"
 	"errors"
+	"image"
+	"image/png"
 	"io"
 	"io/ioutil"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stephenhenderson/ebooklib/lib/ebooks"
 	"github.com/stephenhenderson/ebooklib/lib/testutils"
@@ -25,7 +32,7 @@ func TestMain(m *testing.M) {
 }
 
 func TestNewEbookWebServiceReturnsErrorIfTemplatesDirDoesNotExist(t *testing.T) {
-	_, err := NewEbookWebService(&ebooks.FileLibrary{}, "/non-existant-dir")
+	_, err := NewEbookWebService(ebooks.NewMemoryLibrary(), aFullTextIndex(t), "/non-existant-dir")
 	if err == nil {
 		t.Fatal("Expected error creating webservice with non-existant template dir")
 	}
@@ -33,7 +40,7 @@ func TestNewEbookWebServiceReturnsErrorIfTemplatesDirDoesNotExist(t *testing.T)
 
 func TestNewEbookWebServiceReturnsErrorIfTemplatesDirIsEmpty(t *testing.T) {
 	emptyTempDir := testutils.CreateTempDir(t)
-	_, err := NewEbookWebService(&ebooks.FileLibrary{}, emptyTempDir)
+	_, err := NewEbookWebService(ebooks.NewMemoryLibrary(), aFullTextIndex(t), emptyTempDir)
 	if err == nil {
 		t.Fatal("Expected error creating webservice with non-existant template dir")
 	}
@@ -112,7 +119,7 @@ func TestAddFilesToBookParsesFilesAnBookIDFromForm(t *testing.T) {
 		Year: 2016,
 	}
 
-	book, err := webservice.library.Add(bookDetails, nil, make(map[string][]byte))
+	book, err := webservice.library.Add(bookDetails, nil, make(map[string]io.Reader))
 	if err != nil {
 		t.Fatalf("Error adding book to library: %v", err)
 	}
@@ -140,18 +147,1010 @@ func TestAddFilesToBookParsesFilesAnBookIDFromForm(t *testing.T) {
 
 
 
-func newWebserviceWithEmptyLibrary(t *testing.T) *EbookWebService {
-	library, err := ebooks.NewFileLibrary(testutils.CreateTempDir(t))
+func TestAddFilesToBookFillsInBlankFieldsFromThePdfMetadata(t *testing.T) {
+	webservice := newWebserviceWithEmptyLibrary(t)
+	ts := httptest.NewServer(http.HandlerFunc(webservice.addFilesToBookHandler))
+	defer ts.Close()
+
+	bookDetails := &ebooks.BookDetails{Title: "Title", Authors: []string{}, Tags: []string{"tag1"}}
+	book, err := webservice.library.Add(bookDetails, nil, make(map[string]io.Reader))
+	if err != nil {
+		t.Fatalf("Error adding book to library: %v", err)
+	}
+
+	bookFile := aPdfFileCalled("mybook.pdf", t)
+	request := newAddFilesToBookRequest(ts.URL, book.ID, bookFile, t)
+	resp, _ := doRequestWithoutFollowingRedirects(request)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("Expected status code %d but got %s", http.StatusFound, resp.Status)
+	}
+	expectedBookDetails := &ebooks.BookDetails{
+		Authors: []string{"Alan Donovan", "Brian Kernighan"},
+		Tags:    []string{"tag1"},
+		Title:   "Title",
+		Year:    2015,
+	}
+	book, _ = webservice.library.GetBookByID(book.ID)
+	if !book.BookDetails.Equals(expectedBookDetails) {
+		t.Fatalf("Expected book details %v but was %v", expectedBookDetails, book.BookDetails)
+	}
+}
+
+func TestAddFilesToBookStreamsFilesLargerThanTheMemoryLimit(t *testing.T) {
+	webservice := newWebserviceWithEmptyLibrary(t)
+	ts := httptest.NewServer(http.HandlerFunc(webservice.addFilesToBookHandler))
+	defer ts.Close()
+	book := addABook(webservice, t)
+
+	// well over the memory given to ParseMultipartForm
+	data := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+	bookFile := filepath.Join(testutils.CreateTempDir(t), "course.mp4")
+	ioutil.WriteFile(bookFile, data, 0700)
+	request := newAddFilesToBookRequest(ts.URL, book.ID, bookFile, t)
+	resp, _ := doRequestWithoutFollowingRedirects(request)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("Expected status code %d but got %s", http.StatusFound, resp.Status)
+	}
+	content, err := webservice.library.OpenBookFile(book.ID, "course.mp4")
+	if err != nil {
+		t.Fatalf("Error opening uploaded file: %v", err)
+	}
+	defer content.Close()
+	stored, _ := ioutil.ReadAll(content)
+	if !bytes.Equal(stored, data) {
+		t.Fatalf("Expected the %d bytes uploaded to be stored but found %d", len(data), len(stored))
+	}
+}
+
+func TestAddFilesToBookRejectsAMissingBookID(t *testing.T) {
+	webservice := newWebserviceWithEmptyLibrary(t)
+	ts := httptest.NewServer(http.HandlerFunc(webservice.addFilesToBookHandler))
+	defer ts.Close()
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	addBookFileToMultiPartWriter(writer, aJsonFileCalled("mybook.json", t), t)
+	writer.Close()
+	request, _ := http.NewRequest("POST", ts.URL, body)
+	request.Header.Add("Content-Type", writer.FormDataContentType())
+	resp, err := doRequestWithoutFollowingRedirects(request)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected status code %d but got %s", http.StatusBadRequest, resp.Status)
+	}
+}
+
+func TestAddBookRejectsAMissingTitle(t *testing.T) {
+	webservice := newWebserviceWithEmptyLibrary(t)
+	ts := httptest.NewServer(http.HandlerFunc(webservice.addBookHandler))
+	defer ts.Close()
+
+	bookFile := aJsonFileCalled("mybook.json", t)
+	request := newAddBookRequest(ts.URL, map[string]string{
+		"title":   " ",
+		"authors": "mr writer",
+		"year":    "2016",
+		"tags":    "tag1",
+	}, bookFile, t)
+
+	resp, _ := doRequestWithoutFollowingRedirects(request)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected status code %d but got %s", http.StatusBadRequest, resp.Status)
+	}
+	if len(webservice.library.GetAll()) != 0 {
+		t.Fatal("Expected no book to be added")
+	}
+}
+
+func TestAddBookFillsInBlankFieldsFromTheEpubMetadata(t *testing.T) {
+	webservice := newWebserviceWithEmptyLibrary(t)
+	ts := httptest.NewServer(http.HandlerFunc(webservice.addBookHandler))
+	defer ts.Close()
+
+	bookFile := anEpubFileCalled("mybook.epub", t)
+	request := newAddBookRequest(ts.URL, map[string]string{
+		"title":   "",
+		"authors": "",
+		"year":    "",
+		"tags":    "tag1",
+	}, bookFile, t)
+
+	resp, _ := doRequestWithoutFollowingRedirects(request)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("Expected status code %d but got %s", http.StatusFound, resp.Status)
+	}
+	expectedBookDetails := &ebooks.BookDetails{
+		Authors: []string{"Alan Donovan", "Brian Kernighan"},
+		Tags:    []string{"tag1"},
+		Title:   "The Go Programming Language",
+		Year:    2015,
+	}
+	book := webservice.library.GetAll()[0]
+	if !book.BookDetails.Equals(expectedBookDetails) {
+		t.Fatalf("Expected book details %v but was %v", expectedBookDetails, book.BookDetails)
+	}
+	if book.Image == "" {
+		t.Fatal("Expected the cover to be taken from the epub")
+	}
+}
+
+func TestEditBookFormIsPrefilledWithTheCurrentDetails(t *testing.T) {
+	webservice := newWebserviceWithEmptyLibrary(t)
+	ts := httptest.NewServer(http.HandlerFunc(webservice.editBookFormHandler))
+	defer ts.Close()
+
+	book := addABook(webservice, t)
+	resp, err := http.Get(ts.URL + "?id=" + strconv.Itoa(book.ID))
+	if err != nil {
+		t.Fatalf("Error requesting edit form: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	for _, expected := range []string{`value="Title"`, `value="mr writer, mrs writer"`, `value="2016"`, `value="tag1, tag2"`} {
+		if !strings.Contains(string(body), expected) {
+			t.Fatalf("Expected edit form to contain %s but was:\n%s", expected, body)
+		}
+	}
+}
+
+func TestUpdateBookParsesBookDetailsFromForm(t *testing.T) {
+	webservice := newWebserviceWithEmptyLibrary(t)
+	ts := httptest.NewServer(http.HandlerFunc(webservice.updateBookHandler))
+	defer ts.Close()
+
+	book := addABook(webservice, t)
+	resp, _ := doRequestWithoutFollowingRedirects(newUpdateBookRequest(ts.URL, url.Values{
+		"bookID":  {strconv.Itoa(book.ID)},
+		"title":   {"New Title"},
+		"authors": {"mrs writer"},
+		"year":    {"2015"},
+		"tags":    {"tag3"},
+	}, t))
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("Expected status code %d but got %s", http.StatusFound, resp.Status)
+	}
+
+	expectedBookDetails := &ebooks.BookDetails{
+		Authors: []string{"mrs writer"},
+		Tags: []string{"tag3"},
+		Title: "New Title",
+		Year: 2015,
+	}
+	assertLibraryContainsOnly(webservice, expectedBookDetails, []string{"mybook.json"}, t)
+}
+
+func TestUpdateBookRejectsAnInvalidYear(t *testing.T) {
+	webservice := newWebserviceWithEmptyLibrary(t)
+	ts := httptest.NewServer(http.HandlerFunc(webservice.updateBookHandler))
+	defer ts.Close()
+
+	book := addABook(webservice, t)
+	resp, _ := doRequestWithoutFollowingRedirects(newUpdateBookRequest(ts.URL, url.Values{
+		"bookID": {strconv.Itoa(book.ID)},
+		"title":  {"New Title"},
+		"year":   {"last year"},
+	}, t))
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected status code %d but got %s", http.StatusBadRequest, resp.Status)
+	}
+	book, _ = webservice.library.GetBookByID(book.ID)
+	if book.Title != "Title" {
+		t.Fatalf("Expected book to be unchanged but title was %s", book.Title)
+	}
+}
+
+func TestUpdatingABookWhichDoesNotExistReturnsNotFound(t *testing.T) {
+	webservice := newWebserviceWithEmptyLibrary(t)
+	ts := httptest.NewServer(http.HandlerFunc(webservice.updateBookHandler))
+	defer ts.Close()
+
+	resp, _ := doRequestWithoutFollowingRedirects(newUpdateBookRequest(ts.URL, url.Values{
+		"bookID": {"123"},
+		"title":  {"New Title"},
+	}, t))
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected status code %d but got %s", http.StatusNotFound, resp.Status)
+	}
+}
+
+func TestDeleteBookMovesTheBookToTheTrash(t *testing.T) {
+	webservice := newWebserviceWithEmptyLibrary(t)
+	ts := httptest.NewServer(http.HandlerFunc(webservice.deleteBookHandler))
+	defer ts.Close()
+
+	book := addABook(webservice, t)
+	resp := postIDWithoutFollowingRedirects(ts.URL, book.ID, t)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("Expected status code %d but got %s", http.StatusFound, resp.Status)
+	}
+	if len(webservice.library.GetAll()) != 0 || len(webservice.library.GetTrash()) != 1 {
+		t.Fatal("Expected the book to be moved to the trash")
+	}
+}
+
+func TestDeleteBookOnlyAcceptsPosts(t *testing.T) {
+	webservice := newWebserviceWithEmptyLibrary(t)
+	ts := httptest.NewServer(http.HandlerFunc(webservice.deleteBookHandler))
+	defer ts.Close()
+
+	book := addABook(webservice, t)
+	resp := getWithoutFollowingRedirects(ts.URL+"?id="+strconv.Itoa(book.ID), t)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("Expected status code %d but got %s", http.StatusMethodNotAllowed, resp.Status)
+	}
+	if len(webservice.library.GetAll()) != 1 {
+		t.Fatal("Expected the book to be left in the library")
+	}
+}
+
+func TestRestoreBookMovesTheBookBackToTheLibrary(t *testing.T) {
+	webservice := newWebserviceWithEmptyLibrary(t)
+	ts := httptest.NewServer(http.HandlerFunc(webservice.restoreBookHandler))
+	defer ts.Close()
+
+	book := addABook(webservice, t)
+	webservice.library.DeleteBook(book.ID)
+	resp := getWithoutFollowingRedirects(ts.URL+"?id="+strconv.Itoa(book.ID), t)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("Expected status code %d but got %s", http.StatusFound, resp.Status)
+	}
+	if len(webservice.library.GetAll()) != 1 || len(webservice.library.GetTrash()) != 0 {
+		t.Fatal("Expected the book to be restored from the trash")
+	}
+}
+
+func TestPurgeBookReturnsNotFoundForABookNotInTheTrash(t *testing.T) {
+	webservice := newWebserviceWithEmptyLibrary(t)
+	ts := httptest.NewServer(http.HandlerFunc(webservice.purgeBookHandler))
+	defer ts.Close()
+
+	book := addABook(webservice, t)
+	resp := postIDWithoutFollowingRedirects(ts.URL, book.ID, t)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected status code %d but got %s", http.StatusNotFound, resp.Status)
+	}
+	if len(webservice.library.GetAll()) != 1 {
+		t.Fatal("Expected the book to be left in the library")
+	}
+}
+
+func TestPurgeBookRemovesTheBookFromTheTrash(t *testing.T) {
+	webservice := newWebserviceWithEmptyLibrary(t)
+	ts := httptest.NewServer(http.HandlerFunc(webservice.purgeBookHandler))
+	defer ts.Close()
+
+	book := addABook(webservice, t)
+	webservice.library.DeleteBook(book.ID)
+	resp := postIDWithoutFollowingRedirects(ts.URL, book.ID, t)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("Expected status code %d but got %s", http.StatusFound, resp.Status)
+	}
+	if len(webservice.library.GetTrash()) != 0 {
+		t.Fatal("Expected the book to be removed from the trash")
+	}
+}
+
+func TestPurgeBookOnlyAcceptsPosts(t *testing.T) {
+	webservice := newWebserviceWithEmptyLibrary(t)
+	ts := httptest.NewServer(http.HandlerFunc(webservice.purgeBookHandler))
+	defer ts.Close()
+
+	book := addABook(webservice, t)
+	webservice.library.DeleteBook(book.ID)
+	resp := getWithoutFollowingRedirects(ts.URL+"?id="+strconv.Itoa(book.ID), t)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("Expected status code %d but got %s", http.StatusMethodNotAllowed, resp.Status)
+	}
+	if len(webservice.library.GetTrash()) != 1 {
+		t.Fatal("Expected the book to be left in the trash")
+	}
+}
+
+func TestTrashPageListsDeletedBooks(t *testing.T) {
+	webservice := newWebserviceWithEmptyLibrary(t)
+	ts := httptest.NewServer(http.HandlerFunc(webservice.trashHandler))
+	defer ts.Close()
+
+	book := addABook(webservice, t)
+	webservice.library.DeleteBook(book.ID)
+	resp := getWithoutFollowingRedirects(ts.URL, t)
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if !strings.Contains(string(body), "/restore_book?id="+strconv.Itoa(book.ID)) {
+		t.Fatalf("Expected trash page to list the deleted book but was:\n%s", body)
+	}
+}
+
+func TestListingOnlyShowsBooksMatchingTheSearch(t *testing.T) {
+	webservice := newWebserviceWithEmptyLibrary(t)
+	ts := httptest.NewServer(http.HandlerFunc(webservice.listAllHandler))
+	defer ts.Close()
+
+	goBook, _ := webservice.library.Add(&ebooks.BookDetails{Title: "Go in Action", Authors: []string{"mr writer"}}, nil, nil)
+	pythonBook, _ := webservice.library.Add(&ebooks.BookDetails{Title: "Python in Action", Authors: []string{"mr writer"}}, nil, nil)
+	resp := getWithoutFollowingRedirects(ts.URL+"/?q=go+action", t)
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if !strings.Contains(string(body), "view_book.html?id="+strconv.Itoa(goBook.ID)) {
+		t.Fatalf("Expected listing to contain the matching book but was:\n%s", body)
+	}
+	if strings.Contains(string(body), "view_book.html?id="+strconv.Itoa(pythonBook.ID)) {
+		t.Fatalf("Expected listing not to contain books which do not match but was:\n%s", body)
+	}
+}
+
+func TestViewBookShowsWhenTheBookAndItsFilesWereAdded(t *testing.T) {
+	webservice := newWebserviceWithEmptyLibrary(t)
+	ts := httptest.NewServer(http.HandlerFunc(webservice.viewBookHandler))
+	defer ts.Close()
+
+	book, _ := webservice.library.Add(&ebooks.BookDetails{Title: "Go in Action"}, nil, fileReaders(map[string][]byte{"book.pdf": []byte("%PDF")}))
+	resp := getWithoutFollowingRedirects(ts.URL+"/?id="+strconv.Itoa(book.ID), t)
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	added := book.Created.Local().Format("2 Jan 2006 15:04")
+	if !strings.Contains(string(body), "added "+added) || strings.Count(string(body), added) != 3 {
+		t.Fatalf("Expected the book and its file to be shown as added at %s but was:\n%s", added, body)
+	}
+}
+
+func TestViewBookShowsTheSizeTypeAndRoleOfEachFile(t *testing.T) {
+	webservice := newWebserviceWithEmptyLibrary(t)
+	ts := httptest.NewServer(http.HandlerFunc(webservice.viewBookHandler))
+	defer ts.Close()
+
+	pdf := append([]byte("%PDF-1.4\n"), make([]byte, 1536)...)
+	book, _ := webservice.library.Add(&ebooks.BookDetails{Title: "Go in Action"}, nil, fileReaders(map[string][]byte{"book.pdf": pdf}))
+	resp := getWithoutFollowingRedirects(ts.URL+"/?id="+strconv.Itoa(book.ID), t)
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	for _, expected := range []string{"1.5 KB, application/pdf", `<option value="ebook" selected="selected">`} {
+		if !strings.Contains(string(body), expected) {
+			t.Fatalf("Expected the page to contain %s but was:\n%s", expected, body)
+		}
+	}
+}
+
+func TestSetFileRoleChangesTheRoleOfTheFile(t *testing.T) {
+	webservice := newWebserviceWithEmptyLibrary(t)
+	ts := httptest.NewServer(http.HandlerFunc(webservice.setFileRoleHandler))
+	defer ts.Close()
+
+	book, _ := webservice.library.Add(&ebooks.BookDetails{Title: "Go in Action"}, nil, fileReaders(map[string][]byte{"fixes.pdf": []byte("%PDF")}))
+	resp, _ := doRequestWithoutFollowingRedirects(newUpdateBookRequest(ts.URL, url.Values{
+		"bookid":   {strconv.Itoa(book.ID)},
+		"filename": {"fixes.pdf"},
+		"role":     {"errata"},
+	}, t))
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("Expected status code %d but got %s", http.StatusFound, resp.Status)
+	}
+	book, _ = webservice.library.GetBookByID(book.ID)
+	if book.Files["fixes.pdf"].Role != ebooks.RoleErrata {
+		t.Fatalf("Expected file to be errata but was %s", book.Files["fixes.pdf"].Role)
+	}
+}
+
+func TestSetFileRoleRejectsAnUnknownRole(t *testing.T) {
+	webservice := newWebserviceWithEmptyLibrary(t)
+	ts := httptest.NewServer(http.HandlerFunc(webservice.setFileRoleHandler))
+	defer ts.Close()
+
+	book, _ := webservice.library.Add(&ebooks.BookDetails{Title: "Go in Action"}, nil, fileReaders(map[string][]byte{"book.pdf": []byte("%PDF")}))
+	resp, _ := doRequestWithoutFollowingRedirects(newUpdateBookRequest(ts.URL, url.Values{
+		"bookid":   {strconv.Itoa(book.ID)},
+		"filename": {"book.pdf"},
+		"role":     {"poster"},
+	}, t))
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected status code %d but got %s", http.StatusBadRequest, resp.Status)
+	}
+}
+
+func TestFileSizesAreFormattedInTheLargestWholeUnit(t *testing.T) {
+	expectedSizes := map[int64]string{
+		0:                "0 B",
+		1023:             "1023 B",
+		1536:             "1.5 KB",
+		5 << 20:          "5.0 MB",
+		3 << 30:          "3.0 GB",
+		(2048 << 30) + 1: "2048.0 GB",
+	}
+	for size, expected := range expectedSizes {
+		if formatted := formatFileSize(size); formatted != expected {
+			t.Fatalf("Expected %d bytes to be formatted as %s but was %s", size, expected, formatted)
+		}
+	}
+}
+
+func TestViewBookWarnsOfFilesIdenticalToOnesInOtherBooks(t *testing.T) {
+	webservice := newWebserviceWithEmptyLibrary(t)
+	ts := httptest.NewServer(http.HandlerFunc(webservice.viewBookHandler))
+	defer ts.Close()
+
+	original, _ := webservice.library.Add(&ebooks.BookDetails{Title: "Go in Action"}, nil, fileReaders(map[string][]byte{"book.pdf": []byte("%PDF")}))
+	duplicate, _ := webservice.library.Add(&ebooks.BookDetails{Title: "Go Again"}, nil, fileReaders(map[string][]byte{"copy.pdf": []byte("%PDF")}))
+	resp := getWithoutFollowingRedirects(ts.URL+"/?id="+strconv.Itoa(duplicate.ID), t)
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	expected := `<a href="view_book.html?id=` + strconv.Itoa(original.ID) + `">book.pdf in Go in Action</a>`
+	if !strings.Contains(string(body), "Warning: identical to") || !strings.Contains(string(body), expected) {
+		t.Fatalf("Expected a warning that copy.pdf is identical to book.pdf but was:\n%s", body)
+	}
+}
+
+func TestDuplicatesPageListsGroupsOfIdenticalFiles(t *testing.T) {
+	webservice := newWebserviceWithEmptyLibrary(t)
+	ts := httptest.NewServer(http.HandlerFunc(webservice.duplicatesHandler))
+	defer ts.Close()
+
+	webservice.library.Add(&ebooks.BookDetails{Title: "Go in Action"}, nil, fileReaders(map[string][]byte{"book.pdf": []byte("%PDF"), "code.zip": []byte("code")}))
+	webservice.library.Add(&ebooks.BookDetails{Title: "Go Again"}, nil, fileReaders(map[string][]byte{"copy.pdf": []byte("%PDF")}))
+	resp := getWithoutFollowingRedirects(ts.URL, t)
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	for _, expected := range []string{"2 copies of 4 B", "/download_book/1/book.pdf", "/download_book/2/copy.pdf"} {
+		if !strings.Contains(string(body), expected) {
+			t.Fatalf("Expected the page to contain %s but was:\n%s", expected, body)
+		}
+	}
+	if strings.Contains(string(body), "code.zip") {
+		t.Fatalf("Expected files without duplicates to be left out but was:\n%s", body)
+	}
+}
+
+func TestCheckLibraryPageListsOrphanFoldersAndOffersToRepairThem(t *testing.T) {
+	webservice, libraryDir := newWebserviceWithFileLibrary(t)
+	ts := httptest.NewServer(http.HandlerFunc(webservice.checkLibraryHandler))
+	defer ts.Close()
+
+	os.Mkdir(filepath.Join(libraryDir, "42"), 0700)
+	resp := postCheckLibrary(ts.URL, t)
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	for _, expected := range []string{"orphan folder: 42", `action="/repair_library"`} {
+		if !strings.Contains(string(body), expected) {
+			t.Fatalf("Expected the page to contain %s but was:\n%s", expected, body)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(libraryDir, "42")); err != nil {
+		t.Fatalf("Expected checking the library to leave the orphan folder in place: %v", err)
+	}
+}
+
+func TestCheckLibraryPageSaysWhenNoProblemsAreFound(t *testing.T) {
+	webservice, _ := newWebserviceWithFileLibrary(t)
+	ts := httptest.NewServer(http.HandlerFunc(webservice.checkLibraryHandler))
+	defer ts.Close()
+
+	webservice.library.Add(&ebooks.BookDetails{Title: "Go in Action"}, nil, fileReaders(map[string][]byte{"book.pdf": []byte("%PDF")}))
+	resp := postCheckLibrary(ts.URL, t)
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if !strings.Contains(string(body), "The index and the files on disk agree") || strings.Contains(string(body), "repair_library") {
+		t.Fatalf("Expected no problems and no offer to repair but was:\n%s", body)
+	}
+}
+
+func TestCheckLibraryPageOnlyChecksTheLibraryWhenPostedTo(t *testing.T) {
+	webservice, libraryDir := newWebserviceWithFileLibrary(t)
+	ts := httptest.NewServer(http.HandlerFunc(webservice.checkLibraryHandler))
+	defer ts.Close()
+
+	os.Mkdir(filepath.Join(libraryDir, "42"), 0700)
+	resp := getWithoutFollowingRedirects(ts.URL, t)
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || strings.Contains(string(body), "orphan folder") || !strings.Contains(string(body), `method="post"`) {
+		t.Fatalf("Expected only the form to start a check but got %d:\n%s", resp.StatusCode, body)
+	}
+}
+
+func TestRepairLibraryMovesOrphanFoldersToLostAndFound(t *testing.T) {
+	webservice, libraryDir := newWebserviceWithFileLibrary(t)
+	ts := httptest.NewServer(http.HandlerFunc(webservice.repairLibraryHandler))
+	defer ts.Close()
+
+	os.Mkdir(filepath.Join(libraryDir, "42"), 0700)
+	resp, err := http.Post(ts.URL, "application/x-www-form-urlencoded", nil)
 	if err != nil {
-		t.Fatalf("Error creating new library %v")
+		t.Fatalf("Error posting repair %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "Repaired: Move the folder") {
+		t.Fatalf("Expected the orphan folder to be repaired but got %d:\n%s", resp.StatusCode, body)
+	}
+	if _, err := os.Stat(filepath.Join(libraryDir, ebooks.LostAndFoundDirName, "42")); err != nil {
+		t.Fatalf("Expected the orphan folder to be moved to lost+found: %v", err)
+	}
+}
+
+func TestRepairLibraryOnlyAcceptsPosts(t *testing.T) {
+	webservice, libraryDir := newWebserviceWithFileLibrary(t)
+	ts := httptest.NewServer(http.HandlerFunc(webservice.repairLibraryHandler))
+	defer ts.Close()
+
+	os.Mkdir(filepath.Join(libraryDir, "42"), 0700)
+	resp := getWithoutFollowingRedirects(ts.URL, t)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("Expected status %d but got %d", http.StatusMethodNotAllowed, resp.StatusCode)
+	}
+	if _, err := os.Stat(filepath.Join(libraryDir, "42")); err != nil {
+		t.Fatalf("Expected the orphan folder to be left in place: %v", err)
+	}
+}
+
+func TestCheckLibraryIsNotImplementedForLibrariesWhichCannotBeChecked(t *testing.T) {
+	webservice := newWebserviceWithEmptyLibrary(t)
+	ts := httptest.NewServer(http.HandlerFunc(webservice.checkLibraryHandler))
+	defer ts.Close()
+
+	resp := postCheckLibrary(ts.URL, t)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotImplemented {
+		t.Fatalf("Expected status %d but got %d", http.StatusNotImplemented, resp.StatusCode)
 	}
-	webservice, err := NewEbookWebService(library, "../../templates/")
+}
+
+// postCheckLibrary posts the empty form which starts a check of the
+// library to the url
+func postCheckLibrary(url string, t *testing.T) *http.Response {
+	resp, err := http.Post(url, "application/x-www-form-urlencoded", nil)
+	if err != nil {
+		t.Fatalf("Error posting check %v", err)
+	}
+	return resp
+}
+
+func TestListingCanBeSortedByRecentlyAddedOrUpdated(t *testing.T) {
+	webservice := newWebserviceWithEmptyLibrary(t)
+	ts := httptest.NewServer(http.HandlerFunc(webservice.listAllHandler))
+	defer ts.Close()
+
+	older, _ := webservice.library.Add(&ebooks.BookDetails{Title: "A Book"}, nil, nil)
+	time.Sleep(time.Millisecond)
+	newer, _ := webservice.library.Add(&ebooks.BookDetails{Title: "B Book"}, nil, nil)
+	time.Sleep(time.Millisecond)
+	webservice.library.UpdateBook(older.ID, &ebooks.BookDetails{Title: "A Book", Year: 2016})
+
+	expectedOrder := map[string][]*ebooks.Ebook{
+		"":        {older, newer},
+		"added":   {newer, older},
+		"updated": {older, newer},
+	}
+	for sortBy, expected := range expectedOrder {
+		resp := getWithoutFollowingRedirects(ts.URL+"/?sort="+sortBy, t)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		first := strings.Index(string(body), "view_book.html?id="+strconv.Itoa(expected[0].ID))
+		second := strings.Index(string(body), "view_book.html?id="+strconv.Itoa(expected[1].ID))
+		if first < 0 || second < first {
+			t.Fatalf("Expected book %d before book %d sorting by '%s' but was:\n%s", expected[0].ID, expected[1].ID, sortBy, body)
+		}
+	}
+}
+
+func TestListingReportsQuerySyntaxErrors(t *testing.T) {
+	webservice := newWebserviceWithEmptyLibrary(t)
+	ts := httptest.NewServer(http.HandlerFunc(webservice.listAllHandler))
+	defer ts.Close()
+
+	resp := getWithoutFollowingRedirects(ts.URL+"/?q="+url.QueryEscape("tag:golang year>=soon"), t)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected status code %d but got %s", http.StatusBadRequest, resp.Status)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if !strings.Contains(string(body), "position 18") {
+		t.Fatalf("Expected listing to report the position of the error but was:\n%s", body)
+	}
+}
+
+func TestSearchContentsShowsHighlightedSnippetsLinkingToTheBook(t *testing.T) {
+	webservice := newWebserviceWithEmptyLibrary(t)
+	ts := httptest.NewServer(http.HandlerFunc(webservice.searchContentsHandler))
+	defer ts.Close()
+
+	bookFiles := map[string][]byte{"notes.txt": []byte("Start a server with http.ListenAndServe and a handler")}
+	book, _ := webservice.library.Add(&ebooks.BookDetails{Title: "Go Web Programming"}, nil, fileReaders(bookFiles))
+	resp := getWithoutFollowingRedirects(ts.URL+"/?q=listenandserve", t)
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if !strings.Contains(string(body), "view_book.html?id="+strconv.Itoa(book.ID)) {
+		t.Fatalf("Expected results to link to the matching book but was:\n%s", body)
+	}
+	if !strings.Contains(string(body), "<mark>ListenAndServe</mark>") {
+		t.Fatalf("Expected results to highlight the match but was:\n%s", body)
+	}
+}
+
+func TestAddBookSavesAnUploadedCover(t *testing.T) {
+	webservice := newWebserviceWithEmptyLibrary(t)
+	ts := httptest.NewServer(http.HandlerFunc(webservice.addBookHandler))
+	defer ts.Close()
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	writer.WriteField("title", "Title")
+	part, _ := writer.CreateFormFile("image", "cover.png")
+	part.Write(aPngImage(t))
+	writer.Close()
+	req, _ := http.NewRequest("POST", ts.URL, body)
+	req.Header.Add("Content-Type", writer.FormDataContentType())
+
+	resp, _ := doRequestWithoutFollowingRedirects(req)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("Expected status code %d but got %s", http.StatusFound, resp.Status)
+	}
+	book := webservice.library.GetAll()[0]
+	if filepath.Ext(book.Image) != ".png" {
+		t.Fatalf("Expected a png cover but image was '%s'", book.Image)
+	}
+}
+
+func TestSetImageFetchesTheCoverFromAUrl(t *testing.T) {
+	webservice := newWebserviceWithEmptyLibrary(t)
+	ts := httptest.NewServer(http.HandlerFunc(webservice.setImageHandler))
+	defer ts.Close()
+	imageServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(aPngImage(t))
+	}))
+	defer imageServer.Close()
+
+	book := addABook(webservice, t)
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	writer.WriteField("bookID", strconv.Itoa(book.ID))
+	writer.WriteField("image_url", imageServer.URL+"/cover.png")
+	writer.Close()
+	req, _ := http.NewRequest("POST", ts.URL, body)
+	req.Header.Add("Content-Type", writer.FormDataContentType())
+
+	resp, _ := doRequestWithoutFollowingRedirects(req)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("Expected status code %d but got %s", http.StatusFound, resp.Status)
+	}
+	book, _ = webservice.library.GetBookByID(book.ID)
+	if filepath.Ext(book.Image) != ".png" {
+		t.Fatalf("Expected a png cover but image was '%s'", book.Image)
+	}
+}
+
+func TestSetImageRejectsFilesWhichAreNotImages(t *testing.T) {
+	webservice := newWebserviceWithEmptyLibrary(t)
+	ts := httptest.NewServer(http.HandlerFunc(webservice.setImageHandler))
+	defer ts.Close()
+
+	book := addABook(webservice, t)
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	writer.WriteField("bookID", strconv.Itoa(book.ID))
+	part, _ := writer.CreateFormFile("image", "cover.png")
+	part.Write([]byte("not an image"))
+	writer.Close()
+	req, _ := http.NewRequest("POST", ts.URL, body)
+	req.Header.Add("Content-Type", writer.FormDataContentType())
+
+	resp, _ := doRequestWithoutFollowingRedirects(req)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected status code %d but got %s", http.StatusBadRequest, resp.Status)
+	}
+}
+
+func TestSetImageRejectsFilesLargerThanTheMaximumImageSize(t *testing.T) {
+	webservice := newWebserviceWithEmptyLibrary(t)
+	ts := httptest.NewServer(http.HandlerFunc(webservice.setImageHandler))
+	defer ts.Close()
+
+	book := addABook(webservice, t)
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	writer.WriteField("bookID", strconv.Itoa(book.ID))
+	part, _ := writer.CreateFormFile("image", "cover.png")
+	part.Write(aPngImage(t))
+	part.Write(make([]byte, maxImageSize))
+	writer.Close()
+	req, _ := http.NewRequest("POST", ts.URL, body)
+	req.Header.Add("Content-Type", writer.FormDataContentType())
+
+	resp, _ := doRequestWithoutFollowingRedirects(req)
+	defer resp.Body.Close()
+
+	message, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(message), "larger than") {
+		t.Fatalf("Expected status code %d for a large image but got %s: %s", http.StatusBadRequest, resp.Status, message)
+	}
+	book, _ = webservice.library.GetBookByID(book.ID)
+	if book.Image != "" {
+		t.Fatalf("Expected no cover but image was '%s'", book.Image)
+	}
+}
+
+func TestRemoveImageDeletesTheCover(t *testing.T) {
+	webservice := newWebserviceWithEmptyLibrary(t)
+	ts := httptest.NewServer(http.HandlerFunc(webservice.removeImageHandler))
+	defer ts.Close()
+
+	book := addABook(webservice, t)
+	webservice.library.SetBookImage(book.ID, aPngImage(t))
+	resp := getWithoutFollowingRedirects(ts.URL+"?id="+strconv.Itoa(book.ID), t)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("Expected status code %d but got %s", http.StatusFound, resp.Status)
+	}
+	book, _ = webservice.library.GetBookByID(book.ID)
+	if book.Image != "" {
+		t.Fatalf("Expected no cover but image was '%s'", book.Image)
+	}
+}
+
+func TestThumbnailServesAJpegOfTheCover(t *testing.T) {
+	webservice := newWebserviceWithEmptyLibrary(t)
+	ts := httptest.NewServer(http.HandlerFunc(webservice.thumbnailHandler))
+	defer ts.Close()
+
+	book := addABook(webservice, t)
+	webservice.library.SetBookImage(book.ID, aPngImage(t))
+	resp := getWithoutFollowingRedirects(ts.URL+"?size=medium&id="+strconv.Itoa(book.ID), t)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status code %d but got %s", http.StatusOK, resp.Status)
+	}
+	if resp.Header.Get("Content-Type") != "image/jpeg" {
+		t.Fatalf("Expected a jpeg but got %s", resp.Header.Get("Content-Type"))
+	}
+}
+
+func TestThumbnailReturnsNotFoundForABookWithoutACover(t *testing.T) {
+	webservice := newWebserviceWithEmptyLibrary(t)
+	ts := httptest.NewServer(http.HandlerFunc(webservice.thumbnailHandler))
+	defer ts.Close()
+
+	book := addABook(webservice, t)
+	resp := getWithoutFollowingRedirects(ts.URL+"?id="+strconv.Itoa(book.ID), t)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected status code %d but got %s", http.StatusNotFound, resp.Status)
+	}
+}
+
+func TestDownloadBookFileServesTheFileContents(t *testing.T) {
+	webservice := newWebserviceWithEmptyLibrary(t)
+	ts := httptest.NewServer(http.StripPrefix("/download_book/", http.HandlerFunc(webservice.downloadBookFileHandler)))
+	defer ts.Close()
+
+	book := addABook(webservice, t)
+	resp := getWithoutFollowingRedirects(ts.URL+"/download_book/"+strconv.Itoa(book.ID)+"/mybook.json", t)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status code %d but got %s", http.StatusOK, resp.Status)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != "{}" {
+		t.Fatalf("Expected file contents '{}' but got '%s'", body)
+	}
+}
+
+func TestDownloadBookFileReturnsNotFoundForAMissingFile(t *testing.T) {
+	webservice := newWebserviceWithEmptyLibrary(t)
+	ts := httptest.NewServer(http.StripPrefix("/download_book/", http.HandlerFunc(webservice.downloadBookFileHandler)))
+	defer ts.Close()
+
+	book := addABook(webservice, t)
+	for _, path := range []string{
+		strconv.Itoa(book.ID) + "/missing.json",
+		"123/mybook.json",
+		"index.json",
+	} {
+		resp := getWithoutFollowingRedirects(ts.URL+"/download_book/"+path, t)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("Expected status code %d for %s but got %s", http.StatusNotFound, path, resp.Status)
+		}
+	}
+}
+
+func TestCoverServesTheFullSizeImage(t *testing.T) {
+	webservice := newWebserviceWithEmptyLibrary(t)
+	ts := httptest.NewServer(http.HandlerFunc(webservice.coverHandler))
+	defer ts.Close()
+
+	book := addABook(webservice, t)
+	webservice.library.SetBookImage(book.ID, aPngImage(t))
+	resp := getWithoutFollowingRedirects(ts.URL+"?id="+strconv.Itoa(book.ID), t)
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if !bytes.Equal(body, aPngImage(t)) {
+		t.Fatal("Expected the cover image to be served")
+	}
+}
+
+func TestConcurrentAddBookRequestsAreAllSaved(t *testing.T) {
+	webservice := newWebserviceWithEmptyLibrary(t)
+	ts := httptest.NewServer(http.HandlerFunc(webservice.addBookHandler))
+	defer ts.Close()
+
+	numRequests := 20
+	bookFile := aJsonFileCalled("mybook.json", t)
+	var wg sync.WaitGroup
+	for i := 0; i < numRequests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			request := newAddBookRequest(ts.URL, map[string]string{
+				"title":   "Title" + strconv.Itoa(i),
+				"authors": "mr writer",
+				"year":    "2016",
+				"tags":    "tag1",
+			}, bookFile, t)
+			resp, err := doRequestWithoutFollowingRedirects(request)
+			if resp == nil {
+				t.Errorf("Error submitting book: %v", err)
+				return
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusFound {
+				t.Errorf("Expected status code %d but got %s", http.StatusFound, resp.Status)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	allBooks := webservice.library.GetAll()
+	if len(allBooks) != numRequests {
+		t.Fatalf("Expected %d books in library but found %d", numRequests, len(allBooks))
+	}
+}
+
+// addABook adds a book with a single file called mybook.json directly to
+// the webservice's library
+func addABook(webservice *EbookWebService, t *testing.T) *ebooks.Ebook {
+	bookDetails := &ebooks.BookDetails{
+		Authors: []string{"mr writer","mrs writer"},
+		Tags: []string{"tag1","tag2"},
+		Title: "Title",
+		Year: 2016,
+	}
+	bookFiles := map[string][]byte{"mybook.json": []byte("{}")}
+	book, err := webservice.library.Add(bookDetails, nil, fileReaders(bookFiles))
+	if err != nil {
+		t.Fatalf("Error adding book to library: %v", err)
+	}
+	return book
+}
+
+func getWithoutFollowingRedirects(uri string, t *testing.T) *http.Response {
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		t.Fatalf("Error creating request %v", err)
+	}
+	resp, err := doRequestWithoutFollowingRedirects(req)
+	if resp == nil {
+		t.Fatalf("Error sending request %v", err)
+	}
+	return resp
+}
+
+// postIDWithoutFollowingRedirects posts a form with the book id to the
+// url, as the delete buttons do
+func postIDWithoutFollowingRedirects(uri string, bookID int, t *testing.T) *http.Response {
+	form := url.Values{"id": {strconv.Itoa(bookID)}}
+	req, err := http.NewRequest("POST", uri, strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatalf("Error creating request %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := doRequestWithoutFollowingRedirects(req)
+	if resp == nil {
+		t.Fatalf("Error sending request %v", err)
+	}
+	return resp
+}
+
+func newUpdateBookRequest(uri string, form url.Values, t *testing.T) *http.Request {
+	req, err := http.NewRequest("POST", uri, strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Errorf("Error creating update request %v", err)
+	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	return req
+}
+
+func newWebserviceWithEmptyLibrary(t *testing.T) *EbookWebService {
+	webservice, err := NewEbookWebService(ebooks.NewMemoryLibrary(), aFullTextIndex(t), "../../templates/")
 	if err != nil {
 		t.Fatalf("Error creating new webservice %v", err)
 	}
 	return webservice
 }
 
+// newWebserviceWithFileLibrary returns a webservice over an empty file
+// library in a temp folder, along with the folder
+func newWebserviceWithFileLibrary(t *testing.T) (*EbookWebService, string) {
+	libraryDir := testutils.CreateTempDir(t)
+	library, err := ebooks.NewFileLibrary(libraryDir)
+	if err != nil {
+		t.Fatalf("Error creating file library %v", err)
+	}
+	webservice, err := NewEbookWebService(library, aFullTextIndex(t), "../../templates/")
+	if err != nil {
+		t.Fatalf("Error creating new webservice %v", err)
+	}
+	return webservice, libraryDir
+}
+
+// aFullTextIndex returns an empty full-text index held in memory
+func aFullTextIndex(t *testing.T) *ebooks.FullTextIndex {
+	fullText, err := ebooks.OpenFullTextIndex("")
+	if err != nil {
+		t.Fatalf("Error creating full-text index %v", err)
+	}
+	return fullText
+}
+
 func newAddFilesToBookRequest(uri string, bookID int, filePath string, t *testing.T) *http.Request {
 	body, contentType := createAddFilesToBookMultiPartFormBody(bookID, filePath, t)
 	req, err := http.NewRequest("POST", uri, body)
@@ -223,6 +1222,55 @@ func addBookFileToMultiPartWriter(writer *multipart.Writer, filePath string, t *
 	_, err = io.Copy(part, file)
 }
 
+func aPngImage(t *testing.T) []byte {
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, image.NewRGBA(image.Rect(0, 0, 20, 30))); err != nil {
+		t.Fatalf("Error encoding image %v", err)
+	}
+	return buf.Bytes()
+}
+
+// Creates a new epub with the given name in a random temporary directory
+// and returns the path to it
+func anEpubFileCalled(fileName string, t *testing.T) string {
+	tmpDir := testutils.CreateTempDir(t)
+	tmpFileName := path.Join(tmpDir, fileName)
+
+	buf := &bytes.Buffer{}
+	writer := zip.NewWriter(buf)
+	files := map[string]string{
+		"META-INF/container.xml": `<container><rootfiles><rootfile full-path="content.opf"/></rootfiles></container>`,
+		"content.opf": `<package xmlns="http://www.idpf.org/2007/opf"><metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+			<dc:title>The Go Programming Language</dc:title>
+			<dc:creator>Alan Donovan</dc:creator><dc:creator>Brian Kernighan</dc:creator>
+			<dc:date>2015-10-26</dc:date><dc:subject>golang</dc:subject>
+			</metadata><manifest><item id="cover" href="cover.png" properties="cover-image"/></manifest></package>`,
+		"cover.png": string(aPngImage(t)),
+	}
+	for name, content := range files {
+		file, _ := writer.Create(name)
+		file.Write([]byte(content))
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Error creating epub %v", err)
+	}
+	ioutil.WriteFile(tmpFileName, buf.Bytes(), 0700)
+	return tmpFileName
+}
+
+// Creates a new pdf with the given name in a random temporary directory
+// and returns the path to it
+func aPdfFileCalled(fileName string, t *testing.T) string {
+	tmpDir := testutils.CreateTempDir(t)
+	tmpFileName := path.Join(tmpDir, fileName)
+
+	pdf := "%PDF-1.4\n" +
+		"1 0 obj\n<< /Title (The Go Programming Language) /Author (Alan Donovan, Brian Kernighan) /CreationDate (D:20151026) >>\nendobj\n" +
+		"trailer\n<< /Info 1 0 R >>\n%%EOF\n"
+	ioutil.WriteFile(tmpFileName, []byte(pdf), 0700)
+	return tmpFileName
+}
+
 // Creates a new json file with the given name in a random temporary
 // directory and returns the path to it
 func aJsonFileCalled(fileName string, t *testing.T) string {
@@ -236,3 +1284,13 @@ func aJsonFileCalled(fileName string, t *testing.T) string {
 	ioutil.WriteFile(tmpFileName, data, 0700)
 	return tmpFileName
 }
+
+// fileReaders returns readers of the contents of each file for adding them
+// to a library
+func fileReaders(files map[string][]byte) map[string]io.Reader {
+	readers := make(map[string]io.Reader, len(files))
+	for fileName, data := range files {
+		readers[fileName] = bytes.NewReader(data)
+	}
+	return readers
+}